@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"rproxy/internal/tunnel"
+	"strings"
+	"syscall"
+)
+
+// runAgent publishes a local service through a tunnel to rproxy, from a
+// machine rproxy cannot dial. It returns the exit code.
+func runAgent(args []string) int {
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	server := flags.String("server", "", "rproxy address, host or host:port (default the -fqdn, port 443)")
+	fqdn := flags.String("fqdn", "", "Name to publish, with a token in TUNNEL_TOKENS on rproxy")
+	target := flags.String("target", "", "Local service to forward to, host:port")
+	idle := flags.Int("idle", 4, "Idle tunnel connections kept open, bounding bursts of new connections")
+	caFile := flags.String("ca", "", "CA bundle to verify rproxy with instead of the system roots, e.g. the internal CA")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: rproxy agent -fqdn name -target host:port [-server host:port]\n\nPublishes a local service through rproxy. The token is read from TUNNEL_TOKEN, or the file named by TUNNEL_TOKEN_FILE.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	token, err := agentToken()
+	if err != nil {
+		slog.Error("Agent: Cannot read the tunnel token", "error", err)
+		return 1
+	}
+	if *fqdn == "" || token == "" {
+		flags.Usage()
+		return 2
+	}
+	if _, _, err := net.SplitHostPort(*target); err != nil {
+		slog.Error("Agent: -target must be host:port", "target", *target)
+		return 2
+	}
+	agent := &tunnel.Agent{
+		Server: *server,
+		FQDN:   strings.ToLower(*fqdn),
+		Token:  token,
+		Target: *target,
+		Idle:   *idle,
+	}
+	if agent.Server == "" {
+		agent.Server = agent.FQDN
+	}
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			slog.Error("Agent: Cannot read -ca", "error", err)
+			return 1
+		}
+		agent.RootCAs = x509.NewCertPool()
+		if !agent.RootCAs.AppendCertsFromPEM(pem) {
+			slog.Error("Agent: No certificate in -ca", "file", *caFile)
+			return 1
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	agent.Run(ctx)
+	slog.Info("Agent: Stopped")
+	return 0
+}
+
+// agentToken reads TUNNEL_TOKEN, or the file named by TUNNEL_TOKEN_FILE, so
+// the token does not show in the process list.
+func agentToken() (string, error) {
+	if file := os.Getenv("TUNNEL_TOKEN_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		return strings.TrimSpace(string(data)), err
+	}
+	return os.Getenv("TUNNEL_TOKEN"), nil
+}
@@ -8,11 +8,22 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"rproxy/internal/admin"
+	"rproxy/internal/cache"
 	"rproxy/internal/certs"
 	"rproxy/internal/config"
+	"rproxy/internal/ddns"
+	"rproxy/internal/discovery"
+	"rproxy/internal/kubernetes"
+	"rproxy/internal/notify"
 	"rproxy/internal/podman"
 	"rproxy/internal/proxy"
+	"rproxy/internal/routefile"
 	"rproxy/internal/sshclient"
+	"rproxy/internal/spiffe"
+	"rproxy/internal/swarm"
+	"rproxy/internal/tailnet"
+	"rproxy/internal/tunnel"
 	"syscall"
 	"time"
 
@@ -20,10 +31,19 @@ import (
 )
 
 func main() {
-	// Configure slog
-	logHandler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+	// `rproxy selftest` prints its report on stdout, so it logs to stderr
+	selftest := len(os.Args) > 1 && os.Args[1] == "selftest"
+	logOutput := os.Stdout
+	if selftest {
+		logOutput = os.Stderr
+	}
+
+	// Configure slog. The level can be changed at runtime through the admin API.
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(slog.LevelInfo)
+	logHandler := slog.NewTextHandler(logOutput, &slog.HandlerOptions{
 		AddSource: true,
-		Level:     slog.LevelInfo,
+		Level:     logLevel,
 		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
 			if a.Key == slog.TimeKey {
 				a.Value = slog.StringValue(a.Value.Time().Format(time.RFC3339))
@@ -44,6 +64,13 @@ func main() {
 	log.SetOutput(slog.NewLogLogger(logHandler, slog.LevelInfo).Writer())
 	log.SetFlags(0) // Disable standard log flags (like date/time/file)
 
+	if selftest {
+		os.Exit(runSelftest(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		os.Exit(runAgent(os.Args[2:]))
+	}
+
 	slog.Info("Starting rproxy...")
 
 	// 1. Load Configuration
@@ -52,33 +79,97 @@ func main() {
 		slog.Error("Failed to load configuration", "error", err)
 		os.Exit(1)
 	}
+	slog.Info("Effective configuration", "config", cfg)
 
 	// 2. Initialize SSH Client
-	sshClient, err := sshclient.New(cfg.SSHUser, cfg.SSHHost, cfg.SSHPort)
+	sshClient, err := sshclient.New(cfg.SSHUser, cfg.SSHHost, cfg.SSHPort, cfg.SSHKeyFile, cfg.SSHKeyData)
 	if err != nil {
 		slog.Error("Failed to create SSH client", "error", err)
 		os.Exit(1)
 	}
 
-	// 3. Initialize Podman Client
-	podmanClient := podman.New(sshClient)
+	// --- Setup graceful shutdown --- 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// 3. Initialize Discovery Providers
+	providers := newProviders(cfg, sshClient)
+
+	// Tunnel agents publish their FQDN like a provider
+	var tunnels *tunnel.Hub
+	if len(cfg.TunnelTokens) > 0 {
+		tunnels = tunnel.NewHub(ctx, cfg.TunnelTokens)
+		providers = append(providers, tunnels)
+	}
 
 	// 4. Initialize Certificate Manager
-	certManager, err := certs.NewManager(cfg)
+	certManager, err := certs.NewManager(cfg, sshClient)
 	if err != nil {
 		slog.Error("Failed to create certificate manager", "error", err)
 		os.Exit(1)
 	}
 
 	// 5. Initialize Router
-	router := proxy.NewRouter(cfg, podmanClient, certManager)
+	router := proxy.NewRouter(cfg, providers, certManager)
+	if err := router.RestoreSnapshot(); err != nil {
+		// Not fatal: discovery will rebuild the table
+		slog.Warn("Failed to restore route snapshot", "error", err)
+	}
 
-	// 6. Initialize Proxy Server
-	proxyServer := proxy.NewServer(router, certManager)
+	// 6. Join the tailnet (optional)
+	var tsNode *tailnet.Node
+	if cfg.TailscaleEnabled {
+		tsNode, err = tailnet.New(ctx, cfg.TailscaleHostname, cfg.TailscaleStateDir, cfg.TailscaleAuthKey)
+		if err != nil {
+			slog.Error("Failed to start tailnet node", "error", err)
+			os.Exit(1)
+		}
+		defer tsNode.Close()
+	}
 
-	// --- Setup graceful shutdown --- 
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer stop()
+	// 7. Initialize Proxy Server
+	var dial proxy.DialFunc
+	if cfg.BackendViaSSH {
+		slog.Info("Dialing backends through the SSH connection")
+		dial = sshClient.DialContext
+	}
+	if cfg.TailscaleBackends {
+		slog.Info("Dialing backends through the tailnet")
+		dial = tsNode.DialContext
+	}
+	tap := proxy.NewTap()
+	responseCache := cache.New(cfg.CacheMaxBytes)
+	var tarpit *proxy.Tarpit
+	if cfg.Tarpit {
+		paths := cfg.TarpitPaths
+		if paths == nil {
+			paths = proxy.DefaultTarpitPaths
+		}
+		tarpit = proxy.NewTarpit(cfg.TarpitDelay, paths, int(cfg.TarpitMaxConcurrent))
+		slog.Info("Tarpit enabled for unrouted hosts and exploit probes", "delay", cfg.TarpitDelay)
+	}
+	var svids *spiffe.Source
+	if cfg.SPIFFESocket != "" {
+		svids, err = spiffe.New(ctx, cfg.SPIFFESocket)
+		if err != nil {
+			slog.Error("Failed to fetch SPIFFE identity", "error", err)
+			os.Exit(1)
+		}
+	}
+	publicIPs := ddns.New(cfg, sshClient)
+	proxyServer, err := proxy.NewServer(cfg, router, certManager, dial, tap, responseCache, tarpit, svids, tunnels, publicIPs)
+	if err != nil {
+		slog.Error("Failed to create proxy server", "error", err)
+		os.Exit(1)
+	}
+	if tsNode != nil {
+		tsListener, err := tsNode.Listen(":443")
+		if err != nil {
+			slog.Error("Failed to listen on tailnet", "error", err)
+			os.Exit(1)
+		}
+		proxyServer.AddListener(tsListener)
+	}
 
 	// Use errgroup to manage goroutines and propagate errors
 	var eg errgroup.Group
@@ -107,6 +198,34 @@ func main() {
 		return nil
 	})
 
+	// Start dynamic DNS updates (optional)
+	if publicIPs != nil {
+		eg.Go(func() error {
+			publicIPs.Run(ctx, router.PublicHosts)
+			return nil
+		})
+	}
+
+	// Start notifications (optional)
+	if notifier := notify.New(cfg.NotifyURL, cfg.NotifyFormat); notifier != nil {
+		eg.Go(func() error {
+			notifier.Run(ctx)
+			return nil
+		})
+	}
+
+	// Start Admin API
+	if cfg.AdminAddr != "" {
+		adminServer := admin.NewServer(cfg, router, tap, responseCache, tarpit, logLevel)
+		eg.Go(func() error {
+			if err := adminServer.Start(ctx); err != nil {
+				slog.Error("Admin server failed", "error", err)
+				return err
+			}
+			return nil
+		})
+	}
+
 	// --- Wait for shutdown or error --- 
 	slog.Info("rproxy running. Press Ctrl+C to shut down.")
 	if err := eg.Wait(); err != nil {
@@ -115,4 +234,26 @@ func main() {
 	}
 
 	slog.Info("rproxy shut down gracefully.")
-} 
\ No newline at end of file
+}
+
+// newProviders creates the discovery providers listed in DISCOVERY_PROVIDERS.
+func newProviders(cfg *config.Config, sshClient *sshclient.Client) []discovery.Provider {
+	var providers []discovery.Provider
+	for _, name := range cfg.Providers {
+		switch name {
+		case "podman":
+			providers = append(providers, podman.New(sshClient, podman.Options{
+				DNSDomain:      cfg.PodmanDNSDomain,
+				Concurrency:    int(cfg.DiscoveryConcurrency),
+				InspectTimeout: cfg.DiscoveryInspectTimeout,
+			}))
+		case "swarm":
+			providers = append(providers, swarm.New(sshClient, cfg.SwarmNetwork))
+		case "kubernetes":
+			providers = append(providers, kubernetes.New(sshClient, cfg.KubectlCommand, cfg.GatewayName))
+		case "file":
+			providers = append(providers, routefile.New(cfg.RoutesFile))
+		}
+	}
+	return providers
+}
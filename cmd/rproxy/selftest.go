@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"rproxy/internal/certs"
+	"rproxy/internal/config"
+	"rproxy/internal/podman"
+	"rproxy/internal/proxy"
+	"rproxy/internal/sshclient"
+	"strings"
+	"time"
+)
+
+// selftestTimeout bounds the SSH and discovery checks. The challenge and ACME
+// checks are bounded by the timeouts of the provider and of lego, which wait
+// for DNS propagation like real orders (ACME_PROPAGATION_TIMEOUT).
+const selftestTimeout = time.Minute
+
+// errSkipped marks a check that does not apply to the configuration.
+var errSkipped = errors.New("skipped")
+
+// selftestCheck is one line of the report.
+type selftestCheck struct {
+	name string
+	run  func(ctx context.Context) (string, error) // Detail on success
+}
+
+// runSelftest exercises each dependency of the configuration in turn: SSH,
+// discovery, the challenge provider, an ACME staging order and the listeners. It
+// prints a report and returns the exit code, 1 if anything failed.
+func runSelftest(args []string) int {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	domain := flags.String("domain", "", "Throwaway name for the challenge and ACME checks (default rproxy-selftest.<GANDI_ZONE>)")
+	acme := flags.Bool("acme", true, "Order a certificate from the ACME staging CA, which takes minutes")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: rproxy selftest [-domain name] [-acme=false]\n\nChecks every dependency of the configuration in the environment and prints a report.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		printResult("config", "", err)
+		return 1
+	}
+	printResult("config", fmt.Sprintf("providers %s, DNS provider %s", strings.Join(cfg.Providers, ","), cfg.DNSProvider), nil)
+	if *domain == "" && cfg.DNSProvider == "gandi" {
+		*domain = "rproxy-selftest." + cfg.GandiZone
+	}
+
+	sshClient, err := sshclient.New(cfg.SSHUser, cfg.SSHHost, cfg.SSHPort, cfg.SSHKeyFile, cfg.SSHKeyData)
+	if err != nil {
+		printResult("ssh", "", err)
+		return 1
+	}
+	checks := []selftestCheck{{"ssh", func(ctx context.Context) (string, error) {
+		if !usesSSH(cfg) {
+			return "not used by the configured providers", errSkipped
+		}
+		out, err := sshClient.RunCommandContext(ctx, "uname -sr")
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s@%s:%s, %s", cfg.SSHUser, cfg.SSHHost, cfg.SSHPort, strings.TrimSpace(string(out))), nil
+	}}}
+	for _, p := range newProviders(cfg, sshClient) {
+		checks = append(checks, selftestCheck{"discovery/" + p.Name(), func(ctx context.Context) (string, error) {
+			if pc, ok := p.(*podman.Client); ok {
+				return checkPodman(ctx, pc)
+			}
+			targets, err := p.Discover(ctx)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%d targets", len(targets)), nil
+		}})
+	}
+	checks = append(checks,
+		selftestCheck{"challenge", func(context.Context) (string, error) {
+			switch {
+			case *domain == "":
+				return "no -domain given", errSkipped
+			case cfg.ACMEChallenge == "http-01" && cfg.ACMEWebroot == "":
+				return "answered by rproxy on HTTP_ADDR, the acme check tests it", errSkipped
+			}
+			if err := certs.CheckChallengeProvider(cfg, sshClient, *domain); err != nil {
+				return "", err
+			}
+			if cfg.ACMEChallenge == "http-01" {
+				return "created and deleted a challenge file in " + cfg.ACMEWebroot, nil
+			}
+			return "created and deleted _acme-challenge." + *domain, nil
+		}},
+		selftestCheck{"acme", func(context.Context) (string, error) {
+			switch {
+			case !*acme:
+				return "-acme=false", errSkipped
+			case *domain == "":
+				return "no -domain given", errSkipped
+			}
+			if err := certs.CheckACMEOrder(cfg, sshClient, *domain); err != nil {
+				return "", err
+			}
+			return "staging certificate issued for " + *domain, nil
+		}},
+		selftestCheck{"listen", func(context.Context) (string, error) {
+			bound, err := proxy.CheckListen(cfg)
+			if err != nil {
+				return "", fmt.Errorf("%w (is rproxy already running?)", err)
+			}
+			if len(bound) == 0 {
+				return "no listeners besides the tailnet", errSkipped
+			}
+			return "bound " + strings.Join(bound, ", "), nil
+		}},
+	)
+
+	failed := 0
+	for _, check := range checks {
+		ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+		detail, err := check.run(ctx)
+		cancel()
+		printResult(check.name, detail, err)
+		if err != nil && !errors.Is(err, errSkipped) {
+			failed++
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("\n%d of %d checks failed\n", failed, len(checks)+1)
+		return 1
+	}
+	fmt.Println("\nAll checks passed")
+	return 0
+}
+
+// checkPodman lists the labelled containers and inspects them, as discovery does.
+func checkPodman(ctx context.Context, pc *podman.Client) (string, error) {
+	containers, err := pc.ListContainers(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(containers) == 0 {
+		return "no exposed containers", nil
+	}
+	ids := make([]string, len(containers))
+	for i, c := range containers {
+		ids[i] = c.ID
+	}
+	inspected, err := pc.InspectContainers(ctx, ids)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d exposed containers, %d inspected", len(containers), len(inspected)), nil
+}
+
+// usesSSH reports whether anything in the configuration goes through SSH.
+func usesSSH(cfg *config.Config) bool {
+	if cfg.BackendViaSSH || (cfg.ACMEChallenge == "http-01" && cfg.ACMEWebroot != "") || cfg.DNSProvider == "exec" {
+		return true
+	}
+	for _, p := range cfg.Providers {
+		if p != "file" {
+			return true
+		}
+	}
+	return false
+}
+
+func printResult(name, detail string, err error) {
+	status := "PASS"
+	switch {
+	case errors.Is(err, errSkipped):
+		status = "SKIP"
+	case err != nil:
+		status, detail = "FAIL", err.Error()
+	}
+	fmt.Printf("%-4s  %-20s  %s\n", status, name, detail)
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: rproxyctl [flags] <command> [args]
+
+Commands:
+  routes list            List active routes
+  routes refresh         Run route discovery now
+  certs list             List certificates and failing renewals
+  cert renew <fqdn>      Force a certificate renewal
+  certs export --out <file>
+                         Write an encrypted backup of certificates, keys and
+                         the ACME account ("-" for stdout, passphrase from
+                         RPROXY_BACKUP_PASSPHRASE)
+  certs import <file>    Restore a backup written by certs export ("-" for stdin)
+  ca root                Print the internal CA root certificate (PEM) for clients to trust
+  drain <fqdn> [eta]     Answer 503 for an FQDN, optionally until eta
+                         (a duration like 30m, or an RFC 3339 time)
+  undrain <fqdn>         Resume serving an FQDN
+  loglevel [level]       Show or set the log level (debug, info, warn, error)
+  config                 Show the effective configuration, secrets redacted
+  tap <fqdn>             Stream live requests for an FQDN (Ctrl+C to stop)
+  events                 Stream route and certificate events (Ctrl+C to stop)
+  tarpit list            List client addresses caught by the tarpit
+  cache stats            Show cache size
+  cache purge <target>   Purge cached responses: an FQDN, a URL, or a URL
+                         prefix ending in * (https://app.example.com/static/*)
+
+Flags:
+`
+
+// client talks to the rproxy admin API.
+type client struct {
+	baseURL string
+	token   string       // Bearer token, empty for none
+	http    *http.Client // For calls, with a timeout
+	streams *http.Client // For tap and events, without one
+}
+
+func main() {
+	addr := flag.String("addr", getEnv("RPROXY_ADMIN_URL", "http://127.0.0.1:9000"), "Admin API base URL (env RPROXY_ADMIN_URL)")
+	token := flag.String("token", getEnv("RPROXY_ADMIN_TOKEN", ""), "Admin API bearer token (env RPROXY_ADMIN_TOKEN)")
+	output := flag.String("o", "table", "Output format: table or json")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *output != "table" && *output != "json" {
+		fail(fmt.Errorf("invalid output format %q (expected table or json)", *output))
+	}
+
+	transport, err := newTransport(getEnv("RPROXY_ADMIN_CA", ""), getEnv("RPROXY_ADMIN_CERT", ""), getEnv("RPROXY_ADMIN_KEY", ""))
+	if err != nil {
+		fail(err)
+	}
+	c := &client{
+		baseURL: *addr,
+		token:   *token,
+		http:    &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		streams: &http.Client{Transport: transport},
+	}
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch {
+	case len(args) == 2 && args[0] == "routes" && args[1] == "list":
+		err = c.routesList(*output)
+	case len(args) == 2 && args[0] == "routes" && args[1] == "refresh":
+		err = c.do(http.MethodPost, "/api/routes/refresh", nil, *output)
+	case len(args) == 2 && args[0] == "certs" && args[1] == "list":
+		err = c.certsList(*output)
+	case len(args) >= 2 && args[0] == "certs" && args[1] == "export":
+		exportFlags := flag.NewFlagSet("certs export", flag.ExitOnError)
+		out := exportFlags.String("out", "", "Backup file to write")
+		exportFlags.Parse(args[2:])
+		if *out == "" || exportFlags.NArg() > 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		err = c.certsExport(*out)
+	case len(args) == 3 && args[0] == "certs" && args[1] == "import":
+		err = c.certsImport(args[2], *output)
+	case len(args) == 2 && args[0] == "ca" && args[1] == "root":
+		var root []byte
+		if root, err = c.send(http.MethodGet, "/api/ca", nil, nil); err == nil {
+			_, err = os.Stdout.Write(root)
+		}
+	case len(args) == 3 && args[0] == "cert" && args[1] == "renew":
+		err = c.do(http.MethodPost, "/api/certs/"+url.PathEscape(args[2])+"/renew", nil, *output)
+	case len(args) == 2 && args[0] == "drain":
+		err = c.do(http.MethodPost, "/api/routes/"+url.PathEscape(args[1])+"/drain", nil, *output)
+	case len(args) == 3 && args[0] == "drain":
+		err = c.do(http.MethodPost, "/api/routes/"+url.PathEscape(args[1])+"/drain?eta="+url.QueryEscape(args[2]), nil, *output)
+	case len(args) == 2 && args[0] == "undrain":
+		err = c.do(http.MethodDelete, "/api/routes/"+url.PathEscape(args[1])+"/drain", nil, *output)
+	case len(args) == 1 && args[0] == "config":
+		err = c.do(http.MethodGet, "/api/config", nil, *output)
+	case len(args) == 1 && args[0] == "loglevel":
+		err = c.do(http.MethodGet, "/api/loglevel", nil, *output)
+	case len(args) == 2 && args[0] == "loglevel":
+		err = c.do(http.MethodPut, "/api/loglevel", map[string]string{"level": args[1]}, *output)
+	case len(args) == 2 && args[0] == "tap":
+		err = c.tap(args[1], *output)
+	case len(args) == 1 && args[0] == "events":
+		err = c.events(*output)
+	case len(args) == 2 && args[0] == "tarpit" && args[1] == "list":
+		err = c.tarpitList(*output)
+	case len(args) == 2 && args[0] == "cache" && args[1] == "stats":
+		err = c.do(http.MethodGet, "/api/cache", nil, *output)
+	case len(args) == 3 && args[0] == "cache" && args[1] == "purge":
+		var path string
+		path, err = purgePath(args[2])
+		if err == nil {
+			err = c.do(http.MethodDelete, path, nil, *output)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+// routesList prints the route table.
+func (c *client) routesList(output string) error {
+	body, err := c.request(http.MethodGet, "/api/routes", nil)
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		_, err = os.Stdout.Write(body)
+		return err
+	}
+
+	var routes []struct {
+		FQDN       string `json:"fqdn"`
+		HostRegex  string `json:"host_regex"`
+		PathPrefix string `json:"path_prefix"`
+		Target     string `json:"target"`
+		TLSMode    string `json:"tls_mode"`
+		Draining   bool   `json:"draining"`
+	}
+	if err := json.Unmarshal(body, &routes); err != nil {
+		return fmt.Errorf("failed to parse routes: %w", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tPATH\tTARGET\tTLS\tDRAINING")
+	for _, r := range routes {
+		host := r.FQDN
+		if r.HostRegex != "" {
+			host = "~" + r.HostRegex
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", host, r.PathPrefix, r.Target, r.TLSMode, strconv.FormatBool(r.Draining))
+	}
+	return tw.Flush()
+}
+
+// certsList prints certificate states.
+func (c *client) certsList(output string) error {
+	body, err := c.request(http.MethodGet, "/api/certs", nil)
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		_, err = os.Stdout.Write(body)
+		return err
+	}
+
+	var certs []struct {
+		FQDN        string    `json:"fqdn"`
+		State       string    `json:"state"`
+		NotAfter    time.Time `json:"not_after"`
+		Failures    int       `json:"failures"`
+		LastError   string    `json:"last_error"`
+		NextAttempt time.Time `json:"next_attempt"`
+		Reason      string    `json:"reason"`
+	}
+	if err := json.Unmarshal(body, &certs); err != nil {
+		return fmt.Errorf("failed to parse certificates: %w", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FQDN\tSTATE\tEXPIRES\tFAILURES\tNEXT ATTEMPT\tLAST ERROR")
+	for _, ct := range certs {
+		if ct.Reason != "" {
+			ct.LastError = ct.Reason + ": " + ct.LastError
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", ct.FQDN, ct.State, formatTime(ct.NotAfter), ct.Failures, formatTime(ct.NextAttempt), ct.LastError)
+	}
+	return tw.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+// tarpitList prints the addresses caught by the tarpit.
+func (c *client) tarpitList(output string) error {
+	body, err := c.request(http.MethodGet, "/api/tarpit", nil)
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		_, err = os.Stdout.Write(body)
+		return err
+	}
+
+	var offenders []struct {
+		IP       string    `json:"ip"`
+		Count    int       `json:"count"`
+		LastSeen time.Time `json:"last_seen"`
+		LastHost string    `json:"last_host"`
+		LastPath string    `json:"last_path"`
+	}
+	if err := json.Unmarshal(body, &offenders); err != nil {
+		return fmt.Errorf("failed to parse tarpit offenders: %w", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "IP\tCOUNT\tLAST SEEN\tLAST HOST\tLAST PATH")
+	for _, o := range offenders {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", o.IP, o.Count, formatTime(o.LastSeen), o.LastHost, o.LastPath)
+	}
+	return tw.Flush()
+}
+
+// backupPassphrase returns the passphrase protecting certificate backups.
+func backupPassphrase() (string, error) {
+	passphrase := getEnv("RPROXY_BACKUP_PASSPHRASE", "")
+	if passphrase == "" {
+		return "", fmt.Errorf("RPROXY_BACKUP_PASSPHRASE must be set")
+	}
+	return passphrase, nil
+}
+
+// certsExport saves an encrypted certificate backup to file.
+func (c *client) certsExport(file string) error {
+	passphrase, err := backupPassphrase()
+	if err != nil {
+		return err
+	}
+	header := http.Header{"X-Backup-Passphrase": {passphrase}}
+	body, err := c.send(http.MethodGet, "/api/certs/export", nil, header)
+	if err != nil {
+		return err
+	}
+	if file == "-" {
+		_, err = os.Stdout.Write(body)
+		return err
+	}
+	if err := os.WriteFile(file, body, 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s (%d bytes)\n", file, len(body))
+	return nil
+}
+
+// certsImport uploads a certificate backup for restore.
+func (c *client) certsImport(file, output string) error {
+	passphrase, err := backupPassphrase()
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+	header := http.Header{"X-Backup-Passphrase": {passphrase}, "Content-Type": {"application/octet-stream"}}
+	body, err := c.send(http.MethodPost, "/api/certs/import", bytes.NewReader(data), header)
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		_, err = os.Stdout.Write(body)
+		return err
+	}
+	var result struct {
+		Files []string `json:"files"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	for _, name := range result.Files {
+		fmt.Println("restored", name)
+	}
+	return nil
+}
+
+// purgePath turns a purge target into its admin API path.
+func purgePath(target string) (string, error) {
+	if !strings.Contains(target, "://") {
+		return "/api/cache/" + url.PathEscape(target), nil
+	}
+	prefix := strings.HasSuffix(target, "*")
+	u, err := url.Parse(strings.TrimSuffix(target, "*"))
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid purge target %q", target)
+	}
+
+	query := url.Values{}
+	switch {
+	case prefix:
+		query.Set("prefix", u.RequestURI())
+	case u.RequestURI() != "/" || u.Path == "/":
+		query.Set("path", u.RequestURI())
+	}
+	path := "/api/cache/" + url.PathEscape(u.Hostname())
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	return path, nil
+}
+
+// tap streams request events until interrupted.
+func (c *client) tap(fqdn, output string) error {
+	return c.stream("/api/tap?fqdn="+url.QueryEscape(fqdn), func(data string) {
+		if output == "json" {
+			fmt.Println(data)
+			return
+		}
+		var ev struct {
+			Time     time.Time     `json:"time"`
+			Method   string        `json:"method"`
+			Path     string        `json:"path"`
+			Status   int           `json:"status"`
+			Duration time.Duration `json:"duration_ns"`
+			Upstream string        `json:"upstream"`
+			Remote   string        `json:"remote"`
+		}
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			return
+		}
+		fmt.Printf("%s %d %-6s %s %s -> %s (%s)\n", ev.Time.Format(time.TimeOnly), ev.Status, ev.Method, ev.Path, ev.Remote, ev.Upstream, ev.Duration.Round(time.Millisecond))
+	})
+}
+
+// events streams route and certificate events until interrupted.
+func (c *client) events(output string) error {
+	return c.stream("/api/events", func(data string) {
+		if output == "json" {
+			fmt.Println(data)
+			return
+		}
+		var ev struct {
+			Time    time.Time `json:"time"`
+			Type    string    `json:"type"`
+			Subject string    `json:"subject"`
+			Message string    `json:"message"`
+		}
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			return
+		}
+		fmt.Printf("%s %-16s %s %s\n", ev.Time.Format(time.TimeOnly), ev.Type, ev.Subject, ev.Message)
+	})
+}
+
+// stream reads a server-sent event stream, calling line with each event's data.
+func (c *client) stream(path string, line func(data string)) error {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	c.authorize(req)
+	// No client timeout: the stream stays open until the user stops it
+	resp, err := c.streams.Do(req)
+	if err != nil {
+		return fmt.Errorf("admin API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("admin API error: %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			line(data)
+		}
+	}
+	return scanner.Err()
+}
+
+// do sends a request and prints the response object.
+func (c *client) do(method, path string, payload any, output string) error {
+	body, err := c.request(method, path, payload)
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		_, err = os.Stdout.Write(body)
+		return err
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, k := range slices.Sorted(maps.Keys(fields)) {
+		fmt.Fprintf(tw, "%s\t%v\n", k, fields[k])
+	}
+	return tw.Flush()
+}
+
+// request performs an admin API call and returns the body of a successful response.
+func (c *client) request(method, path string, payload any) ([]byte, error) {
+	if payload == nil {
+		return c.send(method, path, nil, nil)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return c.send(method, path, bytes.NewReader(data), http.Header{"Content-Type": {"application/json"}})
+}
+
+// send performs an admin API call with a raw body and returns the body of a successful response.
+func (c *client) send(method, path string, reqBody io.Reader, header http.Header) ([]byte, error) {
+	req, err := http.NewRequest(method, c.baseURL+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	maps.Copy(req.Header, header)
+	c.authorize(req)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("admin API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admin API response: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != "" {
+			return nil, fmt.Errorf("admin API error (%s): %s", resp.Status, apiErr.Error)
+		}
+		return nil, fmt.Errorf("admin API error: %s", resp.Status)
+	}
+	return body, nil
+}
+
+// authorize adds the bearer token, if any, to req.
+func (c *client) authorize(req *http.Request) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+}
+
+// newTransport returns the HTTP transport for an https admin API: caFile
+// verifies its certificate instead of the system roots, certFile and keyFile
+// are the client certificate for mTLS. All are optional.
+func newTransport(caFile, certFile, keyFile string) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsCfg := &tls.Config{}
+	if caFile != "" {
+		pemData, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read RPROXY_ADMIN_CA: %w", err)
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates in RPROXY_ADMIN_CA %s", caFile)
+		}
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("RPROXY_ADMIN_CERT and RPROXY_ADMIN_KEY must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsCfg
+	return transport, nil
+}
+
+func getEnv(key, fallback string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return fallback
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "rproxyctl:", err)
+	os.Exit(1)
+}
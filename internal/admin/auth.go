@@ -0,0 +1,227 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"rproxy/internal/config"
+	"rproxy/internal/metrics"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// authFailureLimit failed attempts from one address within
+	// authFailureWindow get further requests refused with 429.
+	authFailureLimit  = 5
+	authFailureWindow = time.Minute
+)
+
+var authFailures = metrics.NewCounter("rproxy_admin_auth_failures_total",
+	"Admin API requests refused for their credentials, by reason (missing, invalid_token, forbidden, rate_limited).", "reason")
+
+// readDenied are the GET routes read-only credentials are denied: they
+// export private keys, stream live traffic or profile the process.
+var readDenied = map[string]bool{
+	"GET /api/certs/export": true,
+	"GET /api/tap":          true,
+	"GET /api/runtime":      true,
+}
+
+// scope is what a request's credentials allow.
+type scope int
+
+const (
+	scopeAdmin  scope = iota // Everything
+	scopeRead                // GET routes, except readDenied and /debug/
+	scopeTenant              // tenantPatterns, for the tenant's own FQDNs
+)
+
+// authRequired reports whether requests must carry credentials: once any
+// token (admin, read or tenant) or a client CA is configured, the API is
+// closed to anonymous callers. Otherwise a tenant could drop its token to
+// get full access.
+func (s *Server) authRequired() bool {
+	return s.hasTokens() || s.cfg.AdminClientCA != ""
+}
+
+// authenticate resolves the credentials of each request (a bearer token, or
+// a client certificate verified against ADMIN_CLIENT_CA) to a scope and
+// refuses what the scope does not allow. /readyz stays open for health
+// checks. Addresses with repeated failures are locked out for a while.
+func (s *Server) authenticate(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "GET /readyz" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		ip := remoteIP(r)
+		if wait := s.failures.blocked(ip); wait > 0 {
+			authFailures.Inc("rate_limited")
+			w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			writeError(w, http.StatusTooManyRequests, "too many failed authentication attempts")
+			return
+		}
+
+		sc, tenant, reason := s.credentials(r)
+		if reason != "" {
+			authFailures.Inc(reason)
+			s.failures.add(ip)
+			slog.Warn("Admin: Authentication failed", "remote", r.RemoteAddr, "path", r.URL.Path, "reason", reason)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rproxy"`)
+			writeError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+
+		switch sc {
+		case scopeRead:
+			if (r.Method != http.MethodGet && r.Method != http.MethodHead) || readDenied[pattern] || strings.HasPrefix(r.URL.Path, "/debug/") {
+				authFailures.Inc("forbidden")
+				writeError(w, http.StatusForbidden, "not available to read-only credentials")
+				return
+			}
+		case scopeTenant:
+			if !tenantPatterns[pattern] {
+				authFailures.Inc("forbidden")
+				writeError(w, http.StatusForbidden, "not available to tenants")
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant))
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// credentials returns the scope of the request, or the reason it has none.
+// A bearer token takes precedence over a client certificate.
+func (s *Server) credentials(r *http.Request) (scope, *config.Tenant, string) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && s.hasTokens() {
+		switch {
+		case tokenEqual(s.cfg.AdminToken, token):
+			return scopeAdmin, nil, ""
+		case tokenEqual(s.cfg.AdminReadToken, token):
+			return scopeRead, nil, ""
+		}
+		for i := range s.cfg.Tenants {
+			if t := &s.cfg.Tenants[i]; tokenEqual(t.AdminToken, token) {
+				return scopeTenant, t, ""
+			}
+		}
+		return 0, nil, "invalid_token"
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if slices.Contains(s.cfg.AdminClients, r.TLS.VerifiedChains[0][0].Subject.CommonName) {
+			return scopeAdmin, nil, ""
+		}
+		return scopeRead, nil, ""
+	}
+	if s.authRequired() {
+		return 0, nil, "missing"
+	}
+	return scopeAdmin, nil, ""
+}
+
+// hasTokens reports whether any bearer token is configured. Without one,
+// Authorization headers are ignored like before tokens existed.
+func (s *Server) hasTokens() bool {
+	if s.cfg.AdminToken != "" || s.cfg.AdminReadToken != "" {
+		return true
+	}
+	return slices.ContainsFunc(s.cfg.Tenants, func(t config.Tenant) bool { return t.AdminToken != "" })
+}
+
+// tokenEqual compares a configured token with a presented one in constant
+// time. An unset token matches nothing.
+func tokenEqual(configured, presented string) bool {
+	return configured != "" && subtle.ConstantTimeCompare([]byte(configured), []byte(presented)) == 1
+}
+
+// tlsConfig returns the listener's TLS settings: client certificates are
+// requested, and verified against ADMIN_CLIENT_CA, when one is set.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.cfg.AdminClientCA == "" {
+		return tlsCfg, nil
+	}
+	pemData, err := os.ReadFile(s.cfg.AdminClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("read ADMIN_CLIENT_CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no certificates in ADMIN_CLIENT_CA %s", s.cfg.AdminClientCA)
+	}
+	tlsCfg.ClientCAs = pool
+	tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsCfg, nil
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// failureLimiter counts authentication failures per client address over a
+// fixed window.
+type failureLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*failureWindow
+}
+
+type failureWindow struct {
+	count int
+	reset time.Time
+}
+
+// blocked returns how long ip stays locked out, 0 if it is not.
+func (l *failureLimiter) blocked(ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fw, ok := l.clients[ip]
+	if !ok {
+		return 0
+	}
+	wait := time.Until(fw.reset)
+	if wait <= 0 {
+		delete(l.clients, ip)
+		return 0
+	}
+	if fw.count < authFailureLimit {
+		return 0
+	}
+	return wait
+}
+
+// add records a failure of ip, dropping expired windows as it goes.
+func (l *failureLimiter) add(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.clients == nil {
+		l.clients = make(map[string]*failureWindow)
+	}
+	for client, fw := range l.clients {
+		if now.After(fw.reset) {
+			delete(l.clients, client)
+		}
+	}
+	fw, ok := l.clients[ip]
+	if !ok {
+		fw = &failureWindow{reset: now.Add(authFailureWindow)}
+		l.clients[ip] = fw
+	}
+	fw.count++
+}
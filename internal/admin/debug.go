@@ -0,0 +1,58 @@
+package admin
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// mountDebug registers pprof, expvar and runtime statistics endpoints.
+func mountDebug(mux *http.ServeMux) {
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	mux.HandleFunc("GET /api/runtime", handleRuntime)
+}
+
+// runtimeStats is a summary of the Go runtime state, for spotting leaks.
+type runtimeStats struct {
+	Goroutines    int       `json:"goroutines"`
+	HeapAlloc     uint64    `json:"heap_alloc_bytes"`
+	HeapInuse     uint64    `json:"heap_inuse_bytes"`
+	HeapObjects   uint64    `json:"heap_objects"`
+	Sys           uint64    `json:"sys_bytes"`
+	NumGC         uint32    `json:"num_gc"`
+	LastGC        time.Time `json:"last_gc"`
+	PauseTotal    string    `json:"gc_pause_total"`
+	LastPause     string    `json:"gc_last_pause"`
+	GCCPUFraction float64   `json:"gc_cpu_fraction"`
+}
+
+func handleRuntime(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+
+	stats := runtimeStats{
+		Goroutines:    runtime.NumGoroutine(),
+		HeapAlloc:     mem.HeapAlloc,
+		HeapInuse:     mem.HeapInuse,
+		HeapObjects:   mem.HeapObjects,
+		Sys:           mem.Sys,
+		NumGC:         mem.NumGC,
+		LastGC:        gc.LastGC,
+		PauseTotal:    gc.PauseTotal.String(),
+		GCCPUFraction: mem.GCCPUFraction,
+	}
+	if len(gc.Pause) > 0 {
+		stats.LastPause = gc.Pause[0].String()
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,422 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"rproxy/internal/cache"
+	"rproxy/internal/certs"
+	"rproxy/internal/config"
+	"rproxy/internal/events"
+	"rproxy/internal/metrics"
+	"rproxy/internal/proxy"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server exposes the admin API used by rproxyctl.
+type Server struct {
+	router     *proxy.Router
+	tap        *proxy.Tap
+	cache      *cache.Cache
+	tarpit     *proxy.Tarpit // Nil when disabled
+	logLevel   *slog.LevelVar
+	cfg        *config.Config // Admin credentials and tenants, see auth.go
+	failures   failureLimiter
+	httpServer *http.Server
+}
+
+// NewServer creates the admin API server listening on cfg.AdminAddr.
+// Debug endpoints (pprof, expvar, runtime stats) are only mounted when cfg.AdminDebug is true.
+func NewServer(cfg *config.Config, router *proxy.Router, tap *proxy.Tap, store *cache.Cache, tarpit *proxy.Tarpit, logLevel *slog.LevelVar) *Server {
+	s := &Server{
+		router:   router,
+		tap:      tap,
+		cache:    store,
+		tarpit:   tarpit,
+		logLevel: logLevel,
+		cfg:      cfg,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /readyz", s.handleReady)
+	mux.Handle("GET /metrics", metrics.Handler())
+	mux.HandleFunc("GET /api/routes", s.handleListRoutes)
+	mux.HandleFunc("POST /api/routes/refresh", s.handleRefresh)
+	mux.HandleFunc("POST /api/routes/{fqdn}/drain", s.handleDrain(true))
+	mux.HandleFunc("DELETE /api/routes/{fqdn}/drain", s.handleDrain(false))
+	mux.HandleFunc("GET /api/certs", s.handleListCerts)
+	mux.HandleFunc("POST /api/certs/{fqdn}/renew", s.handleRenew)
+	mux.HandleFunc("GET /api/certs/export", s.handleExportCerts)
+	mux.HandleFunc("POST /api/certs/import", s.handleImportCerts)
+	mux.HandleFunc("GET /api/ca", s.handleInternalCA)
+	mux.HandleFunc("GET /api/cache", s.handleCacheStats)
+	mux.HandleFunc("DELETE /api/cache/{fqdn}", s.handlePurge)
+	mux.HandleFunc("GET /api/tap", s.handleTap)
+	mux.HandleFunc("GET /api/events", s.handleEvents)
+	mux.HandleFunc("GET /api/tarpit", s.handleTarpit)
+	mux.HandleFunc("GET /api/config", s.handleConfig)
+	mux.HandleFunc("GET /api/loglevel", s.handleGetLogLevel)
+	mux.HandleFunc("PUT /api/loglevel", s.handleSetLogLevel)
+	if cfg.AdminDebug {
+		mountDebug(mux)
+	}
+
+	s.httpServer = &http.Server{
+		Addr:              cfg.AdminAddr,
+		Handler:           s.authenticate(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+// Start runs the admin API until ctx is cancelled.
+func (s *Server) Start(ctx context.Context) error {
+	slog.Info("Starting admin API server", "address", s.httpServer.Addr, "tls", s.cfg.AdminTLSCert != "", "auth", s.authRequired())
+	if !s.authRequired() {
+		slog.Warn("Admin API is unauthenticated, set ADMIN_TOKEN or ADMIN_CLIENT_CA unless ADMIN_ADDR is only reachable by trusted clients")
+	}
+	if s.cfg.AdminTLSCert != "" {
+		tlsCfg, err := s.tlsConfig()
+		if err != nil {
+			return err
+		}
+		s.httpServer.TLSConfig = tlsCfg
+	}
+
+	// Tie request contexts to ctx so long-lived streams (tap) end on shutdown
+	s.httpServer.BaseContext = func(net.Listener) context.Context { return ctx }
+
+	errChan := make(chan error, 1)
+	go func() {
+		var err error
+		if s.cfg.AdminTLSCert != "" {
+			err = s.httpServer.ListenAndServeTLS(s.cfg.AdminTLSCert, s.cfg.AdminTLSKey)
+		} else {
+			err = s.httpServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			errChan <- fmt.Errorf("admin server error: %w", err)
+		} else {
+			errChan <- nil
+		}
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.httpServer.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("Admin server graceful shutdown failed", "error", err)
+			return err
+		}
+		slog.Info("Admin server gracefully stopped.")
+		return nil
+	}
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !s.router.Ready() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]bool{"ready": false})
+		return
+	}
+	degraded := s.router.DiscoveryDegraded()
+	if age, exceeded := s.router.StaleLimitExceeded(); exceeded {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"ready": false, "stale_for": age.Round(time.Second).String(), "discovery_degraded": degraded})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"ready": true, "discovery_degraded": degraded})
+}
+
+func (s *Server) handleListRoutes(w http.ResponseWriter, r *http.Request) {
+	routes := s.router.ListRoutes()
+	if tenant := tenantFrom(r); tenant != nil {
+		routes = slices.DeleteFunc(routes, func(rs proxy.RouteStatus) bool { return rs.Tenant != tenant.Name })
+	}
+	if routes == nil {
+		routes = []proxy.RouteStatus{}
+	}
+	writeJSON(w, http.StatusOK, routes)
+}
+
+// handleDrain drains or restores an FQDN. Draining takes an optional ?eta=,
+// either a duration from now (30m) or an RFC 3339 time, shown on maintenance
+// pages and sent as Retry-After.
+func (s *Server) handleDrain(draining bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fqdn := r.PathValue("fqdn")
+		if !permits(w, r, fqdn) {
+			return
+		}
+		var eta time.Time
+		if v := r.URL.Query().Get("eta"); v != "" && draining {
+			if d, err := time.ParseDuration(v); err == nil {
+				eta = time.Now().Add(d).Truncate(time.Second)
+			} else if eta, err = time.Parse(time.RFC3339, v); err != nil {
+				writeError(w, http.StatusBadRequest, "eta must be a duration or an RFC 3339 time")
+				return
+			}
+		}
+		s.router.SetDraining(fqdn, draining, eta)
+		resp := map[string]any{"fqdn": fqdn, "draining": draining}
+		if !eta.IsZero() {
+			resp["eta"] = eta
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// handleRefresh triggers a discovery pass, e.g. from a deploy hook, and
+// resets the polling interval when DISCOVERY_MAX_INTERVAL backs it off.
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	s.router.RequestRefresh()
+	writeJSON(w, http.StatusAccepted, map[string]any{"status": "refresh queued"})
+}
+
+func (s *Server) handleListCerts(w http.ResponseWriter, r *http.Request) {
+	list := s.router.CertStatus()
+	if tenant := tenantFrom(r); tenant != nil {
+		list = slices.DeleteFunc(list, func(c certs.CertStatus) bool { return !tenant.Owns(c.FQDN) })
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) handleRenew(w http.ResponseWriter, r *http.Request) {
+	fqdn := r.PathValue("fqdn")
+	if !permits(w, r, fqdn) {
+		return
+	}
+	if err := s.router.RequestCertRenewal(fqdn); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{"fqdn": fqdn, "status": "renewal queued"})
+}
+
+// BackupPassphraseHeader carries the passphrase for certificate backups, so it
+// never ends up in URLs or access logs.
+const BackupPassphraseHeader = "X-Backup-Passphrase"
+
+// handleExportCerts builds the whole archive before answering, so a failure
+// is reported as an error instead of a truncated backup with status 200.
+func (s *Server) handleExportCerts(w http.ResponseWriter, r *http.Request) {
+	passphrase := r.Header.Get(BackupPassphraseHeader)
+	if passphrase == "" {
+		writeError(w, http.StatusBadRequest, BackupPassphraseHeader+" header is required")
+		return
+	}
+	var archive bytes.Buffer
+	count, err := s.router.ExportCerts(&archive, passphrase)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="rproxy-certs.tar.gz.enc"`)
+	w.Header().Set("Content-Length", strconv.Itoa(archive.Len()))
+	if _, err := archive.WriteTo(w); err != nil {
+		slog.Warn("Admin: Certificate export not delivered", "remote", r.RemoteAddr, "error", err)
+		return
+	}
+	slog.Info("Admin: Exported certificates", "files", count, "remote", r.RemoteAddr)
+}
+
+// handleInternalCA returns the internal CA root certificate for clients to trust.
+func (s *Server) handleInternalCA(w http.ResponseWriter, r *http.Request) {
+	root, ok := s.router.InternalCARoot()
+	if !ok {
+		writeError(w, http.StatusNotFound, "INTERNAL_CA is not enabled")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(root)
+}
+
+func (s *Server) handleImportCerts(w http.ResponseWriter, r *http.Request) {
+	restored, err := s.router.ImportCerts(r.Body, r.Header.Get(BackupPassphraseHeader))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	slog.Info("Admin: Imported certificates", "files", len(restored), "remote", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, map[string]any{"restored": len(restored), "files": restored})
+}
+
+func (s *Server) handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	entries, size := s.cache.Stats()
+	writeJSON(w, http.StatusOK, map[string]any{"entries": entries, "bytes": size})
+}
+
+// handlePurge removes cached responses for an FQDN: one URL with ?path=/a?b=c,
+// everything under ?prefix=/static/, or all of them without parameters.
+func (s *Server) handlePurge(w http.ResponseWriter, r *http.Request) {
+	fqdn := r.PathValue("fqdn")
+	if !permits(w, r, fqdn) {
+		return
+	}
+	path, prefix := r.URL.Query().Get("path"), r.URL.Query().Get("prefix")
+
+	var purged int
+	switch {
+	case path != "" && prefix != "":
+		writeError(w, http.StatusBadRequest, "path and prefix are mutually exclusive")
+		return
+	case path != "":
+		if !strings.HasPrefix(path, "/") {
+			writeError(w, http.StatusBadRequest, "path must start with /")
+			return
+		}
+		if s.cache.Delete(cache.Key(fqdn, path)) {
+			purged = 1
+		}
+	case prefix != "":
+		if !strings.HasPrefix(prefix, "/") {
+			writeError(w, http.StatusBadRequest, "prefix must start with /")
+			return
+		}
+		purged = s.cache.DeletePrefix(cache.Key(fqdn, prefix))
+	default:
+		purged = s.cache.DeletePrefix(cache.Key(fqdn, "/"))
+	}
+	slog.Info("Admin: Purged cache", "fqdn", fqdn, "path", path, "prefix", prefix, "purged", purged)
+	writeJSON(w, http.StatusOK, map[string]any{"fqdn": fqdn, "purged": purged})
+}
+
+// handleTarpit lists the client addresses caught by the tarpit.
+func (s *Server) handleTarpit(w http.ResponseWriter, r *http.Request) {
+	offenders := s.tarpit.Offenders()
+	if offenders == nil {
+		offenders = []proxy.TarpitOffender{}
+	}
+	writeJSON(w, http.StatusOK, offenders)
+}
+
+// handleTap streams completed requests for one FQDN as Server-Sent Events.
+func (s *Server) handleTap(w http.ResponseWriter, r *http.Request) {
+	filter := proxy.TapFilter{
+		FQDN:       r.URL.Query().Get("fqdn"),
+		PathPrefix: r.URL.Query().Get("path_prefix"),
+	}
+	if filter.FQDN == "" {
+		writeError(w, http.StatusBadRequest, "fqdn query parameter is required")
+		return
+	}
+	if !permits(w, r, filter.FQDN) {
+		return
+	}
+	if v := r.URL.Query().Get("min_status"); v != "" {
+		minStatus, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid min_status")
+			return
+		}
+		filter.MinStatus = minStatus
+	}
+
+	events, unsubscribe := s.tap.Subscribe(filter)
+	defer unsubscribe()
+	slog.Info("Admin: Tap stream opened", "fqdn", filter.FQDN, "remote", r.RemoteAddr)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	for {
+		select {
+		case ev := <-events:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			rc.Flush()
+		case <-r.Context().Done():
+			slog.Info("Admin: Tap stream closed", "fqdn", filter.FQDN, "remote", r.RemoteAddr)
+			return
+		}
+	}
+}
+
+// handleEvents streams internal events (route and certificate changes) as
+// server-sent events, optionally only those whose type starts with ?type=.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	typePrefix := r.URL.Query().Get("type")
+	evs, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	for {
+		select {
+		case ev := <-evs:
+			if !strings.HasPrefix(ev.Type, typePrefix) {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			rc.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// handleConfig returns the effective configuration with secrets redacted.
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.cfg.Effective())
+}
+
+func (s *Server) handleGetLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"level": strings.ToLower(s.logLevel.Level().String())})
+}
+
+func (s *Server) handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Level string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(body.Level)); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid level %q (expected debug, info, warn or error)", body.Level))
+		return
+	}
+	s.logLevel.Set(level)
+	slog.Info("Admin: Log level changed", "level", level)
+	writeJSON(w, http.StatusOK, map[string]string{"level": strings.ToLower(level.String())})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Admin: Failed to write response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,37 @@
+package admin
+
+import (
+	"net/http"
+	"rproxy/internal/config"
+)
+
+// tenantKey carries the tenant of a request made with a tenant token.
+type tenantKey struct{}
+
+// tenantPatterns are the admin API routes open to tenant tokens (see
+// authenticate). Their
+// handlers only act on, or list, the tenant's own FQDNs.
+var tenantPatterns = map[string]bool{
+	"GET /api/routes":                 true,
+	"POST /api/routes/{fqdn}/drain":   true,
+	"DELETE /api/routes/{fqdn}/drain": true,
+	"GET /api/certs":                  true,
+	"POST /api/certs/{fqdn}/renew":    true,
+	"DELETE /api/cache/{fqdn}":        true,
+	"GET /api/tap":                    true,
+}
+
+// tenantFrom returns the tenant of a tenant-scoped request, nil otherwise.
+func tenantFrom(r *http.Request) *config.Tenant {
+	tenant, _ := r.Context().Value(tenantKey{}).(*config.Tenant)
+	return tenant
+}
+
+// permits reports whether the request may act on fqdn, answering 403 if not.
+func permits(w http.ResponseWriter, r *http.Request, fqdn string) bool {
+	if tenant := tenantFrom(r); tenant != nil && !tenant.Owns(fqdn) {
+		writeError(w, http.StatusForbidden, "fqdn is outside the tenant's zones")
+		return false
+	}
+	return true
+}
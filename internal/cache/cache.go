@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"container/list"
+	"net/http"
+	"rproxy/internal/metrics"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	entriesGauge = metrics.NewGauge("rproxy_cache_entries", "Responses held in the cache.")
+	bytesGauge   = metrics.NewGauge("rproxy_cache_bytes", "Size of the responses held in the cache.")
+)
+
+// Key returns the cache key of a request: FQDN followed by path and query.
+func Key(fqdn, requestURI string) string {
+	return fqdn + requestURI
+}
+
+// Entry is a stored response.
+type Entry struct {
+	Key      string // See Key, e.g. "app.example.com/static/app.js?v=2"
+	Status   int
+	Header   http.Header
+	Body     []byte
+	StoredAt time.Time
+	Expires  time.Time
+}
+
+// Fresh reports whether the entry can be served without contacting the backend.
+func (e *Entry) Fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+func (e *Entry) size() int64 {
+	n := int64(len(e.Key) + len(e.Body))
+	for k, vs := range e.Header {
+		n += int64(len(k))
+		for _, v := range vs {
+			n += int64(len(v))
+		}
+	}
+	return n
+}
+
+// Cache is an in-memory response store bounded by total size, evicting the
+// least recently used entries first.
+type Cache struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // Values are *Entry
+	lru     *list.List               // Front is most recently used
+	bytes   int64
+}
+
+// New creates a cache holding at most maxBytes of responses.
+func New(maxBytes int64) *Cache {
+	return &Cache{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Get returns the entry stored under key, fresh or not.
+func (c *Cache) Get(key string) (*Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*Entry), true
+}
+
+// Put stores an entry, replacing any previous one with the same key. Entries
+// larger than the whole cache are ignored.
+func (c *Cache) Put(e *Entry) {
+	size := e.size()
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.Key]; ok {
+		c.remove(el)
+	}
+	c.entries[e.Key] = c.lru.PushFront(e)
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	c.updateGauges()
+}
+
+// Delete removes the entry stored under key.
+func (c *Cache) Delete(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if ok {
+		c.remove(el)
+		c.updateGauges()
+	}
+	return ok
+}
+
+// DeletePrefix removes every entry whose key starts with prefix and returns
+// how many were removed.
+func (c *Cache) DeletePrefix(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for key, el := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(el)
+			removed++
+		}
+	}
+	c.updateGauges()
+	return removed
+}
+
+// Refresh extends the freshness of an entry after the backend confirmed it is
+// unchanged, merging the headers of the 304 response.
+func (c *Cache) Refresh(key string, header http.Header, expires time.Time) (*Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	// Entries are shared with in-flight readers, so replace rather than mutate
+	old := el.Value.(*Entry)
+	e := *old
+	e.Header = old.Header.Clone()
+	for k, v := range header {
+		e.Header[k] = v
+	}
+	e.StoredAt = time.Now()
+	e.Expires = expires
+	c.bytes += e.size() - old.size()
+	el.Value = &e
+	c.lru.MoveToFront(el)
+	return &e, true
+}
+
+func (c *Cache) updateGauges() {
+	entriesGauge.Set(float64(len(c.entries)))
+	bytesGauge.Set(float64(c.bytes))
+}
+
+// Stats returns the number of entries and their total size.
+func (c *Cache) Stats() (entries int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), c.bytes
+}
+
+func (c *Cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*Entry)
+	delete(c.entries, e.Key)
+	c.bytes -= e.size()
+}
@@ -0,0 +1,186 @@
+package certs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Backups are a gzipped tar of the files under CERTS_DIR, sealed with
+// AES-256-GCM under a key derived from a passphrase:
+// backupMagic | salt | nonce | ciphertext.
+const (
+	backupMagic    = "RPROXY-CERTS-BACKUP-1\n"
+	backupSaltSize = 16
+	backupMaxSize  = 64 << 20
+)
+
+// backupCipher derives the archive cipher from a passphrase.
+func backupCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	if passphrase == "" {
+		return nil, errors.New("backup passphrase must not be empty")
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// backupFile reports whether a file under CERTS_DIR belongs in a
+// backup: certificates, keys, the ACME account and acme-dns registrations,
+// but not subdirectories (Tailscale state) or files moved aside as corrupt.
+func backupFile(entry os.DirEntry) bool {
+	return entry.Type().IsRegular() && !strings.Contains(entry.Name(), ".corrupt-") && !strings.HasPrefix(entry.Name(), ".")
+}
+
+// Export writes an encrypted archive of the certificate store to w and
+// returns the number of files in it. Private keys are archived as stored, so
+// encrypted keys need the same CERT_ENCRYPTION_KEY after a restore.
+func (m *Manager) Export(w io.Writer, passphrase string) (int, error) {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list %s: %w", m.dir, err)
+	}
+
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	count := 0
+	for _, entry := range entries {
+		if !backupFile(entry) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(m.dir, entry.Name()))
+		if err != nil {
+			return 0, fmt.Errorf("failed to read %s: %w", entry.Name(), err)
+		}
+		hdr := &tar.Header{Name: entry.Name(), Mode: 0600, Size: int64(len(data)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return 0, err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	if err := tw.Close(); err != nil {
+		return 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return 0, err
+	}
+
+	salt := make([]byte, backupSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return 0, err
+	}
+	aead, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return 0, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, err
+	}
+
+	out := append([]byte(backupMagic), salt...)
+	out = append(out, nonce...)
+	out = aead.Seal(out, nonce, archive.Bytes(), nil)
+	if _, err := w.Write(out); err != nil {
+		return 0, err
+	}
+	slog.Info("Certs: Exported certificate store", "files", count)
+	return count, nil
+}
+
+// Import restores an archive written by Export into the certificate store,
+// replacing files with the same name, and reloads the restored certificates.
+// It returns the restored file names. A restored ACME account key is only
+// used after a restart.
+func (m *Manager) Import(r io.Reader, passphrase string) ([]string, error) {
+	data, err := io.ReadAll(io.LimitReader(r, backupMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > backupMaxSize {
+		return nil, fmt.Errorf("backup larger than %d bytes", backupMaxSize)
+	}
+	rest, ok := bytes.CutPrefix(data, []byte(backupMagic))
+	if !ok || len(rest) < backupSaltSize {
+		return nil, errors.New("not an rproxy certificate backup")
+	}
+	aead, err := backupCipher(passphrase, rest[:backupSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	rest = rest[backupSaltSize:]
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("truncated backup")
+	}
+	archive, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("failed to decrypt backup, wrong passphrase?")
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	var restored []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return restored, fmt.Errorf("invalid backup archive: %w", err)
+		}
+		name := hdr.Name
+		if hdr.Typeflag != tar.TypeReg || name != filepath.Base(name) || name == "." || name == ".." || strings.HasPrefix(name, ".") {
+			slog.Warn("Certs: Skipping unexpected entry in backup", "name", name)
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return restored, fmt.Errorf("invalid backup archive: %w", err)
+		}
+		// Written beside the target and renamed, so a failed restore never leaves half a file
+		if err := writeFileAtomic(filepath.Join(m.dir, name), content); err != nil {
+			return restored, fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+		restored = append(restored, name)
+	}
+
+	for _, name := range restored {
+		base, ok := strings.CutSuffix(name, ".crt")
+		if !ok {
+			continue
+		}
+		fqdn := base
+		if rest, ok := strings.CutPrefix(base, "_wildcard."); ok {
+			fqdn = "*." + rest
+		}
+		m.Preload(fqdn)
+	}
+	slog.Info("Certs: Imported certificate store", "files", len(restored))
+	return restored, nil
+}
@@ -0,0 +1,173 @@
+package certs
+
+import (
+	"container/list"
+	"crypto/tls"
+	"maps"
+	"rproxy/internal/metrics"
+	"sync"
+	"time"
+)
+
+// maxNegativeEntries bounds the names remembered as missing, so scanners
+// cycling through random SNIs cannot grow it without limit.
+const maxNegativeEntries = 10000
+
+var (
+	certCacheEntries   = metrics.NewGauge("rproxy_cert_cache_entries", "Certificates held in memory.")
+	certCacheEvictions = metrics.NewCounter("rproxy_cert_cache_evictions_total", "Certificates evicted from memory to stay within CERT_CACHE_SIZE.")
+	certCacheLookups   = metrics.NewCounter("rproxy_cert_cache_lookups_total",
+		"Certificate lookups by result (hit, load, miss, negative_hit).", "result")
+)
+
+// certMeta is what is kept of every certificate seen on disk, loaded or not:
+// enough for renewal decisions and status.
+type certMeta struct {
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+// certCache holds the certificates being served, bounded by CERT_CACHE_SIZE
+// and evicting the least recently served first. Evicted certificates are
+// loaded again from disk on demand. Names without a certificate file are
+// remembered for CERT_CACHE_NEGATIVE_TTL, so repeated handshakes for them
+// do not touch the disk.
+type certCache struct {
+	max         int // 0 for no limit
+	negativeTTL time.Duration
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element // Values are *certEntry
+	lru      *list.List               // Front is most recently served
+	meta     map[string]certMeta      // Every name loaded since startup, never evicted
+	negative map[string]time.Time     // Missing names, until when
+}
+
+type certEntry struct {
+	fqdn string
+	cert *tls.Certificate
+}
+
+func newCertCache(max int, negativeTTL time.Duration) *certCache {
+	return &certCache{
+		max:         max,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		meta:        make(map[string]certMeta),
+		negative:    make(map[string]time.Time),
+	}
+}
+
+// get returns the cached certificate of fqdn, marking it recently served.
+func (c *certCache) get(fqdn string) (*tls.Certificate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[fqdn]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*certEntry).cert, true
+}
+
+// add caches the certificate of fqdn, evicting beyond the limit.
+func (c *certCache) add(fqdn string, cert *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.record(fqdn, cert)
+	if el, ok := c.entries[fqdn]; ok {
+		el.Value.(*certEntry).cert = cert
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[fqdn] = c.lru.PushFront(&certEntry{fqdn, cert})
+	for c.max > 0 && c.lru.Len() > c.max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*certEntry).fqdn)
+		certCacheEvictions.Inc()
+	}
+	certCacheEntries.Set(float64(c.lru.Len()))
+}
+
+// update records a certificate just read from disk, replacing the cached
+// copy if there is one. Certificates not being served stay on disk.
+func (c *certCache) update(fqdn string, cert *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.record(fqdn, cert)
+	if el, ok := c.entries[fqdn]; ok {
+		el.Value.(*certEntry).cert = cert
+	}
+}
+
+// record keeps the validity of cert and forgets that fqdn was missing. Must
+// be called with mu held.
+func (c *certCache) record(fqdn string, cert *tls.Certificate) {
+	delete(c.negative, fqdn)
+	if cert.Leaf != nil {
+		c.meta[fqdn] = certMeta{notBefore: cert.Leaf.NotBefore, notAfter: cert.Leaf.NotAfter}
+	}
+}
+
+// remove forgets everything about fqdn, e.g. when its files were moved aside.
+func (c *certCache) remove(fqdn string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[fqdn]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, fqdn)
+		certCacheEntries.Set(float64(c.lru.Len()))
+	}
+	delete(c.meta, fqdn)
+}
+
+// missing remembers that fqdn has no certificate file.
+func (c *certCache) missing(fqdn string) {
+	if c.negativeTTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.negative) >= maxNegativeEntries {
+		for name, until := range c.negative {
+			if now.After(until) {
+				delete(c.negative, name)
+			}
+		}
+		if len(c.negative) >= maxNegativeEntries {
+			clear(c.negative) // All fresh: a flood of random names, start over
+		}
+	}
+	c.negative[fqdn] = now.Add(c.negativeTTL)
+}
+
+// knownMissing reports whether fqdn was recently found to have no
+// certificate file.
+func (c *certCache) knownMissing(fqdn string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	until, ok := c.negative[fqdn]
+	if ok && time.Now().After(until) {
+		delete(c.negative, fqdn)
+		return false
+	}
+	return ok
+}
+
+// validity returns the recorded validity of fqdn's certificate.
+func (c *certCache) validity(fqdn string) (certMeta, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	meta, ok := c.meta[fqdn]
+	return meta, ok
+}
+
+// names returns the validity of every certificate seen, by name.
+func (c *certCache) names() map[string]certMeta {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return maps.Clone(c.meta)
+}
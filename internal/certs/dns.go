@@ -0,0 +1,89 @@
+package certs
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"rproxy/internal/config"
+	"rproxy/internal/sshclient"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/providers/dns/acmedns"
+	"github.com/go-acme/lego/v4/providers/dns/gandiv5"
+)
+
+// newDNSProvider creates the DNS-01 challenge provider selected by DNS_PROVIDER.
+func newDNSProvider(cfg *config.Config, ssh *sshclient.Client) (challenge.Provider, error) {
+	switch cfg.DNSProvider {
+	case "exec":
+		slog.Info("Setting up DNS helper on the podman host", "helper", cfg.ACMEDNSHelper)
+		return &execProvider{ssh: ssh, helper: cfg.ACMEDNSHelper}, nil
+	case "acmedns":
+		// acme-dns only needs the _acme-challenge names delegated (CNAME) to it,
+		// so rproxy never holds credentials that can write the whole zone
+		slog.Info("Setting up acme-dns DNS provider", "apiBase", cfg.ACMEDNSAPIBase, "storage", cfg.ACMEDNSStoragePath)
+		acmeDNSCfg := acmedns.NewDefaultConfig()
+		acmeDNSCfg.APIBase = cfg.ACMEDNSAPIBase
+		acmeDNSCfg.StoragePath = cfg.ACMEDNSStoragePath
+		acmeDNSCfg.AllowList = cfg.ACMEDNSAllowList
+		provider, err := acmedns.NewDNSProviderConfig(acmeDNSCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create acme-dns provider: %w", err)
+		}
+		return provider, nil
+	default:
+		// Use Gandi LiveDNS provider with Personal Access Token (Bearer auth)
+		slog.Info("Setting up Gandi DNS provider using Personal Access Token")
+		gandiCfg := gandiv5.NewDefaultConfig()
+		gandiCfg.HTTPClient = &http.Client{Timeout: 30 * time.Second}
+		gandiCfg.PersonalAccessToken = cfg.GandiPAT
+		provider, err := gandiv5.NewDNSProviderConfig(gandiCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Gandi DNS provider: %w", err)
+		}
+		return provider, nil
+	}
+}
+
+// timeoutProvider overrides a DNS provider's propagation timeout and polling
+// interval (ACME_PROPAGATION_TIMEOUT, ACME_POLLING_INTERVAL). Zero keeps the
+// provider's own value.
+type timeoutProvider struct {
+	challenge.Provider
+	timeout, interval time.Duration
+}
+
+// withTimeouts wraps provider when either value is set.
+func withTimeouts(provider challenge.Provider, timeout, interval time.Duration) challenge.Provider {
+	if timeout == 0 && interval == 0 {
+		return provider
+	}
+	return timeoutProvider{Provider: provider, timeout: timeout, interval: interval}
+}
+
+// Timeout implements challenge.ProviderTimeout.
+func (p timeoutProvider) Timeout() (timeout, interval time.Duration) {
+	timeout, interval = dns01.DefaultPropagationTimeout, dns01.DefaultPollingInterval
+	if inner, ok := p.Provider.(challenge.ProviderTimeout); ok {
+		timeout, interval = inner.Timeout()
+	}
+	if p.timeout > 0 {
+		timeout = p.timeout
+	}
+	if p.interval > 0 {
+		interval = p.interval
+	}
+	return timeout, interval
+}
+
+// logSetupRequired explains the one-time CNAME acme-dns needs for a new domain.
+func logSetupRequired(err error) {
+	var cnameErr acmedns.ErrCNAMERequired
+	if errors.As(err, &cnameErr) {
+		slog.Error("ACME: acme-dns account registered, create this CNAME record then wait for the next renewal check",
+			"domain", cnameErr.Domain, "name", cnameErr.FQDN, "target", cnameErr.Target)
+	}
+}
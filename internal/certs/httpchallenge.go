@@ -0,0 +1,95 @@
+package certs
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpTokens solves HTTP-01 challenges from memory: the key authorizations
+// being validated are answered by the proxy's own plain HTTP listener
+// (HTTP_ADDR, port 80), for ACME_CHALLENGE=http-01 without ACME_WEBROOT.
+type httpTokens struct {
+	mu     sync.RWMutex
+	tokens map[string]httpToken // By token
+}
+
+type httpToken struct {
+	domain  string
+	keyAuth string
+}
+
+func newHTTPTokens() *httpTokens {
+	return &httpTokens{tokens: make(map[string]httpToken)}
+}
+
+// Present implements challenge.Provider.
+func (t *httpTokens) Present(domain, token, keyAuth string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens[token] = httpToken{domain: strings.ToLower(domain), keyAuth: keyAuth}
+	slog.Debug("ACME: Serving HTTP-01 challenge", "domain", domain)
+	return nil
+}
+
+// CleanUp implements challenge.Provider.
+func (t *httpTokens) CleanUp(domain, token, keyAuth string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.tokens, token)
+	return nil
+}
+
+// lookup returns the key authorization of token if it was issued for host.
+func (t *httpTokens) lookup(host, token string) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tok, ok := t.tokens[token]
+	if !ok || tok.domain != strings.ToLower(host) {
+		return "", false
+	}
+	return tok.keyAuth, true
+}
+
+// serve answers the challenges on addr until the returned function is called,
+// for `rproxy selftest`, which runs without the proxy's listener.
+func (t *httpTokens) serve(addr string) (func(), error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on HTTP_ADDR to answer the challenge, stop rproxy first: %w", err)
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			host, _, err := net.SplitHostPort(req.Host)
+			if err != nil {
+				host = req.Host
+			}
+			token := strings.TrimPrefix(req.URL.Path, "/.well-known/acme-challenge/")
+			keyAuth, ok := t.lookup(host, token)
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, keyAuth)
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go srv.Serve(ln)
+	return func() { srv.Close() }, nil
+}
+
+// HTTPChallenge returns the key authorization to answer a request for
+// /.well-known/acme-challenge/<token> on host with, false when no such
+// challenge is pending or challenges are not served by the proxy.
+func (m *Manager) HTTPChallenge(host, token string) (string, bool) {
+	if m == nil || m.httpTokens == nil {
+		return "", false
+	}
+	return m.httpTokens.lookup(host, token)
+}
@@ -0,0 +1,196 @@
+package certs
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Internal CA files in CERTS_DIR. The certificate is not named .crt, so it is
+// not mistaken for a route certificate when a backup is imported.
+const (
+	internalCACertFile = "internal-ca.pem"
+	internalCAKeyFile  = "internal-ca.key"
+
+	internalCALifetime = 10 * 365 * 24 * time.Hour
+)
+
+// internalCA issues certificates for names under internal-only zones, such as
+// .internal or .lan, which no public CA will certify. Clients trust them
+// once its root certificate is installed.
+type internalCA struct {
+	zones    []string
+	lifetime time.Duration // Of issued certificates
+	cert     *x509.Certificate
+	certPEM  []byte
+	key      crypto.Signer
+}
+
+// loadOrCreateInternalCA loads the CA from dir, creating it on first use.
+// Its key is stored like the other private keys, so CERT_ENCRYPTION_KEY
+// applies to it.
+func loadOrCreateInternalCA(dir string, keys *keySealer, zones []string, lifetime time.Duration) (*internalCA, error) {
+	certPath := filepath.Join(dir, internalCACertFile)
+	keyPath := filepath.Join(dir, internalCAKeyFile)
+	ca := &internalCA{zones: zones, lifetime: lifetime}
+
+	certPEM, err := os.ReadFile(certPath)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := ca.create(keys, certPath, keyPath); err != nil {
+			return nil, fmt.Errorf("failed to create internal CA: %w", err)
+		}
+		slog.Info("InternalCA: Created root certificate, install it on clients to trust internal names", "path", certPath, "expiry", ca.cert.NotAfter)
+		return ca, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read internal CA certificate: %w", err)
+	}
+	keyPEM, err := keys.readKeyFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read internal CA key: %w", err)
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, fmt.Errorf("internal CA files %s and %s are not PEM", certPath, keyPath)
+	}
+	if ca.cert, err = x509.ParseCertificate(certBlock.Bytes); err != nil {
+		return nil, fmt.Errorf("failed to parse internal CA certificate: %w", err)
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse internal CA key: %w", err)
+	}
+	if !key.PublicKey.Equal(ca.cert.PublicKey) {
+		return nil, fmt.Errorf("internal CA key does not match %s", certPath)
+	}
+	ca.key, ca.certPEM = key, certPEM
+	for _, zone := range zones {
+		if !slices.Contains(ca.cert.PermittedDNSDomains, zone) {
+			slog.Warn("InternalCA: Zone added after the root certificate was created, clients will reject its certificates; move the CA files aside to create a new root", "zone", zone, "path", certPath)
+		}
+	}
+	if time.Until(ca.cert.NotAfter) < 365*24*time.Hour {
+		slog.Warn("InternalCA: Root certificate expires within a year, replace it and redistribute it to clients", "path", certPath, "expiry", ca.cert.NotAfter)
+	}
+	return ca, nil
+}
+
+// create generates a self-signed root, limited to the CA's zones through
+// name constraints, so a stolen key cannot certify public names.
+func (ca *internalCA) create(keys *keySealer, certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:                serial,
+		Subject:                     pkix.Name{CommonName: "rproxy internal CA", Organization: []string{"rproxy"}},
+		NotBefore:                   time.Now().Add(-time.Hour),
+		NotAfter:                    time.Now().Add(internalCALifetime),
+		KeyUsage:                    x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid:       true,
+		IsCA:                        true,
+		MaxPathLenZero:              true,
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         ca.zones,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := keys.writeKeyFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})); err != nil {
+		return err
+	}
+	ca.key = key
+	ca.certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return os.WriteFile(certPath, ca.certPEM, 0644)
+}
+
+// covers reports whether fqdn is under one of the CA's zones.
+func (ca *internalCA) covers(fqdn string) bool {
+	name := strings.TrimPrefix(fqdn, "*.")
+	for _, zone := range ca.zones {
+		if name == zone || strings.HasSuffix(name, "."+zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// issue returns a certificate for fqdn, bundled with the root like ACME
+// chains, and its private key, both PEM.
+func (ca *internalCA) issue(fqdn string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	notAfter := time.Now().Add(ca.lifetime)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: fqdn},
+		DNSNames:     []string{fqdn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	var chain bytes.Buffer
+	pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain.Write(ca.certPEM)
+	return chain.Bytes(), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// InternalCARoot returns the PEM root certificate of the internal CA, for
+// clients to trust, and false when INTERNAL_CA is off.
+func (m *Manager) InternalCARoot() ([]byte, bool) {
+	if m.internalCA == nil {
+		return nil, false
+	}
+	return m.internalCA.certPEM, true
+}
@@ -0,0 +1,87 @@
+package certs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// sealedKeyType is the PEM block type of an encrypted private key file. The
+// block holds the nonce followed by the AES-GCM sealed original PEM.
+const sealedKeyType = "RPROXY ENCRYPTED PRIVATE KEY"
+
+// keySealer encrypts private key files at rest. A zero keySealer stores them
+// in plain.
+type keySealer struct {
+	aead cipher.AEAD
+}
+
+func newKeySealer(key []byte) (*keySealer, error) {
+	if key == nil {
+		return &keySealer{}, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cert encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cert encryption key: %w", err)
+	}
+	return &keySealer{aead: aead}, nil
+}
+
+// readKeyFile returns the plain PEM of a private key file. With encryption
+// enabled, a plain file left from before is encrypted in place.
+func (s *keySealer) readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != sealedKeyType {
+		if s.aead != nil {
+			if err := s.writeKeyFile(path, data); err != nil {
+				slog.Warn("Certs: Failed to encrypt existing private key", "path", path, "error", err)
+			} else {
+				slog.Info("Certs: Encrypted existing private key", "path", path)
+			}
+		}
+		return data, nil
+	}
+
+	if s.aead == nil {
+		return nil, fmt.Errorf("%s is encrypted but no CERT_ENCRYPTION_KEY is set", path)
+	}
+	size := s.aead.NonceSize()
+	if len(block.Bytes) < size {
+		return nil, fmt.Errorf("%s: encrypted key too short", path)
+	}
+	plain, err := s.aead.Open(nil, block.Bytes[:size], block.Bytes[size:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s, wrong CERT_ENCRYPTION_KEY?: %w", path, err)
+	}
+	return plain, nil
+}
+
+// writeKeyFile writes a private key PEM, sealed when encryption is enabled,
+// replacing the file atomically.
+func (s *keySealer) writeKeyFile(path string, pemData []byte) error {
+	if s.aead == nil {
+		return writeFileAtomic(path, pemData)
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	block := &pem.Block{
+		Type:    sealedKeyType,
+		Headers: map[string]string{"Cipher": "AES-256-GCM"},
+		Bytes:   s.aead.Seal(nonce, nonce, pemData, nil),
+	}
+	return writeFileAtomic(path, pem.EncodeToMemory(block))
+}
@@ -0,0 +1,135 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Instances sharing a cert store (an HA pair on one volume) take a lease file
+// per name before ordering, so only one of them issues. Leases are plain files
+// created with O_EXCL, which works on network filesystems where flock may not,
+// and are refreshed while held so a crashed holder's lease goes stale.
+const (
+	locksDir         = ".locks"
+	lockStaleAfter   = 5 * time.Minute
+	lockRefreshEvery = time.Minute
+	lockRetryDelay   = 2 * time.Minute // Check again once the other instance is likely done
+)
+
+// errIssuanceLocked means another instance is ordering a certificate for the name.
+var errIssuanceLocked = errors.New("another instance is issuing this certificate")
+
+// lockPath returns the lease file for fqdn.
+func (m *Manager) lockPath(fqdn string) string {
+	certFile, _ := m.certPaths(fqdn)
+	return filepath.Join(m.dir, locksDir, strings.TrimSuffix(filepath.Base(certFile), ".crt")+".lock")
+}
+
+// lockOwner identifies this instance in lease files.
+func lockOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d", host, os.Getpid())
+}
+
+// acquireIssuanceLock takes the lease for fqdn and keeps it fresh until the
+// returned release function is called.
+func (m *Manager) acquireIssuanceLock(fqdn string) (release func(), err error) {
+	path := m.lockPath(fqdn)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		if err := takeOverStaleLock(fqdn, path); err != nil {
+			return nil, err
+		}
+		// Another instance may win the race to recreate it
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, os.ErrExist) {
+			return nil, errIssuanceLocked
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create lock %s: %w", path, err)
+	}
+	fmt.Fprintln(f, lockOwner())
+	f.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(lockRefreshEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !ownsLock(path) {
+					slog.Warn("Certs: Issuance lock was taken over by another instance", "fqdn", fqdn)
+					return
+				}
+				now := time.Now()
+				if err := os.Chtimes(path, now, now); err != nil {
+					slog.Warn("Certs: Failed to refresh issuance lock", "fqdn", fqdn, "error", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		if !ownsLock(path) {
+			return // Taken over as stale; the lease is no longer ours to remove
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			slog.Warn("Certs: Failed to release issuance lock", "fqdn", fqdn, "error", err)
+		}
+	}, nil
+}
+
+// ownsLock reports whether the lease at path was written by this instance.
+func ownsLock(path string) bool {
+	owner, err := os.ReadFile(path)
+	return err == nil && strings.TrimSpace(string(owner)) == lockOwner()
+}
+
+// takeOverStaleLock moves the lease at path out of the way if it is stale,
+// and returns errIssuanceLocked if it is not. The lease is renamed rather
+// than removed, so of several instances taking over at once only one moves
+// it; the moved file is checked again, in case a fresh lease was created
+// between the stat and the rename, and then put back.
+func takeOverStaleLock(fqdn, path string) error {
+	owner, _ := os.ReadFile(path)
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) < lockStaleAfter {
+		slog.Info("Certs: Issuance locked by another instance", "fqdn", fqdn, "owner", strings.TrimSpace(string(owner)))
+		return errIssuanceLocked
+	}
+
+	moved := fmt.Sprintf("%s.stale-%s-%d", path, strings.ReplaceAll(lockOwner(), "/", "-"), time.Now().UnixNano())
+	if err := os.Rename(path, moved); err != nil {
+		if os.IsNotExist(err) {
+			return nil // Someone else moved it; race them to create the new one
+		}
+		return fmt.Errorf("failed to take over stale lock: %w", err)
+	}
+	defer os.Remove(moved)
+	movedOwner, _ := os.ReadFile(moved)
+	movedInfo, err := os.Stat(moved)
+	if err != nil || !bytes.Equal(movedOwner, owner) || !movedInfo.ModTime().Equal(info.ModTime()) {
+		// Not the lease found stale: put it back unless a newer one exists
+		if err := os.Link(moved, path); err != nil && !os.IsExist(err) {
+			slog.Warn("Certs: Failed to restore issuance lock of another instance", "fqdn", fqdn, "error", err)
+		}
+		return errIssuanceLocked
+	}
+	slog.Warn("Certs: Taking over stale issuance lock", "fqdn", fqdn, "owner", strings.TrimSpace(string(owner)), "age", time.Since(info.ModTime()).Round(time.Second))
+	return nil
+}
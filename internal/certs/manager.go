@@ -8,20 +8,23 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"log/slog"
-	"net/http"
 	"os"
 	"path/filepath"
 	"rproxy/internal/config"
+	"rproxy/internal/sshclient"
+	"rproxy/internal/discovery"
+	"rproxy/internal/events"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
-	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/challenge"
 	"github.com/go-acme/lego/v4/lego"
-	"github.com/go-acme/lego/v4/providers/dns/gandiv5"
 	"github.com/go-acme/lego/v4/registration"
 )
 
@@ -45,21 +48,68 @@ func (u *ACMEUser) GetPrivateKey() crypto.PrivateKey {
 
 // --- CertManager --- 
 
-const certificatesPath = "/certs"         // Hardcoded path for certs volume
 const acmeAccountKeyFile = "acme_account.key" // Filename for the ACME account key
 
 type Manager struct {
-	certs       map[string]*tls.Certificate // In-memory cache: fqdn -> cert
-	mu          sync.RWMutex
+	dir         string // CERTS_DIR
+	cache       *certCache // Certificates being served, loaded on demand (see certcache.go)
 	legoUser    *ACMEUser
 	legoClient  *lego.Client
+	accounts    map[string]*lego.Client // Tenants with their own ACME account, by name
+	tenantFor   func(host string) *config.Tenant
+	allowed     func(host string) bool // DOMAIN_ALLOWLIST and DOMAIN_DENYLIST
+	profileFor  func(fqdn string) string // ACME profile to order with, "" for the CA's default
+	internalCA  *internalCA            // Issues INTERNAL_CA_ZONES names instead of ACME, nil when off
+	httpTokens  *httpTokens            // HTTP-01 challenges answered by the proxy, nil unless ACME_CHALLENGE=http-01 without ACME_WEBROOT
+	wanted      func(fqdn string) bool // Names the current routes need certificates for, see SetWanted
+	keys        *keySealer // Private key files, optionally encrypted (see keycrypt.go)
 	renewBefore time.Duration
+
+	obtainTimeout time.Duration // ACME_OBTAIN_TIMEOUT, 0 for none
+
+	// Retry scheduling and failure tracking (see retry.go)
+	retry   RetryPolicy
+	stateMu sync.Mutex
+	states  map[string]*certState
+}
+
+// certPaths returns the certificate and key file paths for an FQDN.
+// Wildcard names are stored as _wildcard.example.com to keep '*' out of file names.
+func (m *Manager) certPaths(fqdn string) (certFile, keyFile string) {
+	base := fqdn
+	if rest, ok := strings.CutPrefix(fqdn, "*."); ok {
+		base = "_wildcard." + rest
+	}
+	return filepath.Join(m.dir, base+".crt"), filepath.Join(m.dir, base+".key")
+}
+
+// writeFileAtomic writes data beside path and renames it into place, so
+// readers (and heal) never see a truncated or half-written file. The
+// temporary name starts with a dot, which backups skip.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
 }
 
 // loadOrCreateACMEKey tries to load the key, generates and saves if not found.
-func loadOrCreateACMEKey() (crypto.PrivateKey, error) {
-	keyPath := filepath.Join(certificatesPath, acmeAccountKeyFile)
-	pemData, err := os.ReadFile(keyPath)
+func loadOrCreateACMEKey(keys *keySealer, keyPath string) (crypto.PrivateKey, error) {
+	pemData, err := keys.readKeyFile(keyPath)
 	if err == nil {
 		// Key file exists, try to parse it
 		block, _ := pem.Decode(pemData)
@@ -89,7 +139,7 @@ func loadOrCreateACMEKey() (crypto.PrivateKey, error) {
 			Type:  "EC PRIVATE KEY",
 			Bytes: keyBytes,
 		}
-		if writeErr := os.WriteFile(keyPath, pem.EncodeToMemory(pemBlock), 0600); writeErr != nil {
+		if writeErr := keys.writeKeyFile(keyPath, pem.EncodeToMemory(pemBlock)); writeErr != nil {
 			slog.Error("Failed to save newly generated ACME account private key", "path", keyPath, "error", writeErr)
 			// Return the generated key anyway, but log the error
 			return privateKey, nil 
@@ -102,62 +152,40 @@ func loadOrCreateACMEKey() (crypto.PrivateKey, error) {
 	}
 }
 
-// NewManager initializes the certificate manager.
-func NewManager(cfg *config.Config) (*Manager, error) {
-	// Ensure certificates directory exists first
-	if err := os.MkdirAll(certificatesPath, 0700); err != nil {
-		slog.Warn("Could not create certs directory", "path", certificatesPath, "error", err)
-		// Allow continuation, maybe permissions are fixed later or volume is read-only
-	}
-
+// newACMEClient sets up the ACME account of email, whose key is stored at
+// keyPath, solving challenges with solver.
+func newACMEClient(cfg *config.Config, keys *keySealer, email, keyPath string, solver challenge.Provider) (*lego.Client, *ACMEUser, error) {
 	// Load or create the ACME private key
-	privateKey, err := loadOrCreateACMEKey()
+	privateKey, err := loadOrCreateACMEKey(keys, keyPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load or create ACME private key: %w", err)
+		return nil, nil, fmt.Errorf("failed to load or create ACME private key: %w", err)
 	}
 
 	// Create ACME user WITH PERSISTENT KEY
 	// privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader) // REMOVED: Don't generate every time
 	acmeUser := &ACMEUser{
-		Email: cfg.ACMEEmail,
+		Email: email,
 		key:   privateKey, // Use the loaded or newly generated key
 	}
 
 	// Create Lego Config
 	legoCfg := lego.NewConfig(acmeUser)
-	if cfg.ACMEStaging {
-		legoCfg.CADirURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
-		slog.Info("Using Let's Encrypt staging environment.")
-	} else {
-		legoCfg.CADirURL = "https://acme-v02.api.letsencrypt.org/directory"
-		slog.Info("Using Let's Encrypt production environment.")
-	}
+	legoCfg.CADirURL = caDirURL(cfg)
 	legoCfg.Certificate.KeyType = certcrypto.EC256
 
 	// Create Lego Client
 	client, err := lego.NewClient(legoCfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create ACME client: %w", err)
+		return nil, nil, fmt.Errorf("failed to create ACME client: %w", err)
 	}
 
-	// Use Gandi LiveDNS provider with Personal Access Token (Bearer auth)
-	slog.Info("Setting up Gandi DNS provider using Personal Access Token")
-	gandiCfg := gandiv5.NewDefaultConfig()
-	gandiCfg.HTTPClient = &http.Client{Timeout: 30 * time.Second}
-	gandiCfg.PersonalAccessToken = cfg.GandiPAT
-	gandiProvider, err := gandiv5.NewDNSProviderConfig(gandiCfg)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create Gandi DNS provider: %w", err)
-	}
-	resolverOpt := dns01.AddRecursiveNameservers([]string{"1.1.1.1:53", "8.8.8.8:53"})
-	err = client.Challenge.SetDNS01Provider(gandiProvider, resolverOpt)
-	if err != nil {
-		return nil, fmt.Errorf("failed to set Gandi DNS01 provider with resolvers: %w", err)
+	if err := setChallengeProvider(client, cfg, solver); err != nil {
+		return nil, nil, err
 	}
 
 	// Register or Resolve ACME User
 	// Try resolving first, as the key should now be persistent
-	slog.Info("Resolving ACME account...")
+	slog.Info("Resolving ACME account...", "email", email)
 	acmeUser.Registration, err = client.Registration.ResolveAccountByKey()
 	if err != nil {
 		slog.Warn("Failed to resolve ACME account by key, attempting registration...", "error", err)
@@ -165,90 +193,286 @@ func NewManager(cfg *config.Config) (*Manager, error) {
 		acmeUser.Registration, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
 		if err != nil {
 			// If both resolve and register fail, it's a real error
-			return nil, fmt.Errorf("failed to resolve or register ACME account: %w", err)
+			return nil, nil, fmt.Errorf("failed to resolve or register ACME account: %w", err)
 		}
 		slog.Info("ACME account registered successfully.")
 	} else {
 		slog.Info("Resolved existing ACME account successfully.")
 	}
 
+	return client, acmeUser, nil
+}
+
+// NewManager initializes the certificate manager. Challenges solved on the
+// podman host (DNS_PROVIDER=exec, ACME_CHALLENGE=http-01 with ACME_WEBROOT)
+// go through ssh.
+func NewManager(cfg *config.Config, ssh *sshclient.Client) (*Manager, error) {
+	// Ensure certificates directory exists first
+	if err := os.MkdirAll(cfg.CertsDir, 0700); err != nil {
+		slog.Warn("Could not create certs directory", "path", cfg.CertsDir, "error", err)
+		// Allow continuation, maybe permissions are fixed later or volume is read-only
+	}
+
+	keys, err := newKeySealer(cfg.CertEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	solver, err := newChallengeProvider(cfg, ssh)
+	if err != nil {
+		return nil, err
+	}
+	tokens, _ := solver.(*httpTokens)
+
+	if cfg.ACMEStaging {
+		slog.Info("Using Let's Encrypt staging environment.")
+	} else {
+		slog.Info("Using Let's Encrypt production environment.")
+	}
+	client, acmeUser, err := newACMEClient(cfg, keys, cfg.ACMEEmail, filepath.Join(cfg.CertsDir, acmeAccountKeyFile), solver)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tenants with their own email get their own account
+	accounts := make(map[string]*lego.Client)
+	for _, tenant := range cfg.Tenants {
+		if tenant.ACMEEmail == "" {
+			continue
+		}
+		keyPath := filepath.Join(cfg.CertsDir, "acme_account."+tenant.Name+".key")
+		accounts[tenant.Name], _, err = newACMEClient(cfg, keys, tenant.ACMEEmail, keyPath, solver)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", tenant.Name, err)
+		}
+	}
+
+	profileFor, err := newProfileSelector(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var ca *internalCA
+	if cfg.InternalCA {
+		if ca, err = loadOrCreateInternalCA(cfg.CertsDir, keys, cfg.InternalCAZones, cfg.InternalCertLifetime); err != nil {
+			return nil, err
+		}
+	}
+
 	manager := &Manager{
-		certs:       make(map[string]*tls.Certificate),
+		dir:         cfg.CertsDir,
+		cache:       newCertCache(cfg.CertCacheSize, cfg.CertCacheNegativeTTL),
 		legoUser:    acmeUser,
 		legoClient:  client,
+		accounts:    accounts,
+		tenantFor:   cfg.TenantFor,
+		allowed:     cfg.DomainAllowed,
+		profileFor:  profileFor,
+		internalCA:  ca,
+		httpTokens:  tokens,
+		keys:        keys,
 		renewBefore: cfg.RenewBefore,
+
+		obtainTimeout: cfg.ACMEObtainTimeout,
+		retry: RetryPolicy{
+			BaseDelay:   cfg.CertRetryBaseDelay,
+			MaxDelay:    cfg.CertRetryMaxDelay,
+			MaxAttempts: cfg.CertRetryMaxAttempts,
+
+			QuarantineAfter: cfg.CertQuarantineAfter,
+			QuarantineFor:   cfg.CertQuarantineFor,
+		},
+		states: make(map[string]*certState),
 	}
 
 	slog.Info("Certificate manager initialized.")
 	return manager, nil
 }
 
-// loadCertFromFile loads cert from file, returns expiry time and caches it.
+// loadCertFromFile loads cert from file and returns its expiry. The cached
+// copy is replaced if there is one; otherwise the certificate enters the
+// cache when first served.
 func (m *Manager) loadCertFromFile(fqdn string) (time.Time, error) {
-	certFile := filepath.Join(certificatesPath, fqdn+".crt")
-	keyFile := filepath.Join(certificatesPath, fqdn+".key")
-
-	certData, err := os.ReadFile(certFile)
+	tlsCert, err := m.readCertFile(fqdn)
 	if err != nil {
 		return time.Time{}, err
 	}
-	keyData, err := os.ReadFile(keyFile)
+	m.cache.update(fqdn, tlsCert)
+	return tlsCert.Leaf.NotAfter, nil
+}
+
+// readCertFile reads and validates the certificate and key files of fqdn.
+// Files that exist but do not form a valid pair return an error wrapping errCorrupt.
+func (m *Manager) readCertFile(fqdn string) (*tls.Certificate, error) {
+	if !validName(fqdn) {
+		return nil, fmt.Errorf("invalid certificate name %q", fqdn)
+	}
+	certFile, keyFile := m.certPaths(fqdn)
+
+	certData, err := os.ReadFile(certFile)
 	if err != nil {
-		return time.Time{}, err
+		return nil, err
+	}
+	keyData, err := m.keys.readKeyFile(keyFile)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s exists without %s", errCorrupt, certFile, keyFile)
+	} else if err != nil {
+		return nil, err
 	}
 
-	tlsCert, err := tls.X509KeyPair(certData, keyData)
+	tlsCert, err := parseKeyPair(certData, keyData)
 	if err != nil {
-		return time.Time{}, fmt.Errorf("failed to load key pair from file for %s: %w", fqdn, err)
+		return nil, fmt.Errorf("failed to load key pair from file for %s: %w", fqdn, err)
 	}
+	return &tlsCert, nil
+}
 
-	if len(tlsCert.Certificate) == 0 {
-		return time.Time{}, fmt.Errorf("no certificate found in %s", certFile)
+// obtainOrRenewCert obtains or renews cert using Lego and records the outcome
+// for retry scheduling. Unless forced, it does nothing when the certificate on
+// disk, possibly just written by another instance, needs no renewal.
+func (m *Manager) obtainOrRenewCert(fqdn string, force bool) error {
+	// Routes are already filtered, this guards every other way to an order
+	if !m.allowed(fqdn) {
+		return fmt.Errorf("%s is not allowed by DOMAIN_ALLOWLIST/DOMAIN_DENYLIST", fqdn)
 	}
-	x509Cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
-	if err != nil {
-		return time.Time{}, fmt.Errorf("failed to parse certificate from %s: %w", certFile, err)
+	certFile, _ := m.certPaths(fqdn)
+	before, _ := os.Stat(certFile)
+
+	release, err := m.acquireIssuanceLock(fqdn)
+	if errors.Is(err, errIssuanceLocked) {
+		m.Defer(fqdn, lockRetryDelay) // Not a failure, pick up its result later
+		return err
+	} else if err != nil {
+		m.recordResult(fqdn, err)
+		return err
 	}
 
-	m.mu.Lock()
-	m.certs[fqdn] = &tlsCert
-	m.mu.Unlock()
+	if after, statErr := os.Stat(certFile); statErr == nil {
+		changed := before == nil || !after.ModTime().Equal(before.ModTime())
+		if expiry, loadErr := m.loadCertFromFile(fqdn); loadErr == nil && (changed || !force) && time.Until(expiry) >= m.renewWindow(fqdn) {
+			release()
+			slog.Info("Certs: Certificate was renewed by another instance, not ordering", "fqdn", fqdn, "expiry", expiry)
+			m.recordResult(fqdn, nil)
+			return nil
+		}
+	}
 
-	return x509Cert.NotAfter, nil
+	err = m.obtain(fqdn, release) // Releases the lease once the order is over
+	m.recordResult(fqdn, err)
+	return err
 }
 
-// obtainOrRenewCert obtains or renews cert using Lego.
-func (m *Manager) obtainOrRenewCert(fqdn string) error {
-	slog.Info("ACME: Attempting to obtain/renew certificate", "fqdn", fqdn)
-
-	if m.legoClient == nil {
-		return fmt.Errorf("Lego client not initialized in CertManager")
+// obtainWithDeadline runs an ACME obtain, giving up after ACME_OBTAIN_TIMEOUT.
+// lego cannot cancel an order, so an abandoned obtain finishes in the
+// background (bounded by its own timeouts) and a certificate it still gets
+// is saved. It then returns errObtainAbandoned and calls release itself once
+// the order is over, so the issuance lease is held until then.
+func (m *Manager) obtainWithDeadline(fqdn string, request certificate.ObtainRequest, release func()) (*certificate.Resource, error) {
+	client := m.clientFor(request.Domains[0])
+	if m.obtainTimeout <= 0 {
+		return client.Certificate.Obtain(request)
+	}
+	type result struct {
+		res *certificate.Resource
+		err error
 	}
+	results := make(chan result, 1)
+	go func() {
+		res, err := client.Certificate.Obtain(request)
+		results <- result{res, err}
+	}()
+	timer := time.NewTimer(m.obtainTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.res, r.err
+	case <-timer.C:
+		go func() {
+			defer release()
+			r := <-results
+			if r.err != nil {
+				slog.Warn("ACME: Abandoned obtain failed", "fqdn", fqdn, "error", r.err)
+				return
+			}
+			slog.Info("ACME: Abandoned obtain finished late, saving its certificate", "fqdn", fqdn)
+			err := m.saveCert(fqdn, r.res.Certificate, r.res.PrivateKey)
+			m.recordResult(fqdn, err)
+		}()
+		return nil, fmt.Errorf("%w (%s)", errObtainAbandoned, m.obtainTimeout)
+	}
+}
+
+// errObtainAbandoned is returned when an obtain outlasts ACME_OBTAIN_TIMEOUT.
+var errObtainAbandoned = errors.New("obtain did not finish within ACME_OBTAIN_TIMEOUT")
 
-	slog.Info("ACME: Requesting certificate", "domains", []string{fqdn})
-	request := certificate.ObtainRequest{
-		Domains: []string{fqdn},
-		Bundle:  true,
+// clientFor returns the ACME client of the tenant owning fqdn, or the global one.
+func (m *Manager) clientFor(fqdn string) *lego.Client {
+	if tenant := m.tenantFor(fqdn); tenant != nil {
+		if client, ok := m.accounts[tenant.Name]; ok {
+			return client
+		}
 	}
-	certRes, err := m.legoClient.Certificate.Obtain(request)
-	if err != nil {
-		slog.Error("ACME: Failed to obtain certificate", "fqdn", fqdn, "error", err)
-		return fmt.Errorf("failed to obtain certificate for %s: %w", fqdn, err)
+	return m.legoClient
+}
+
+// obtain issues a certificate for fqdn and saves it, calling release once no
+// order is running for it any more.
+func (m *Manager) obtain(fqdn string, release func()) error {
+	defer func() { release() }()
+	var certPEM, keyPEM []byte
+	if m.internalCA != nil && m.internalCA.covers(fqdn) {
+		slog.Info("InternalCA: Issuing certificate", "fqdn", fqdn)
+		var err error
+		if certPEM, keyPEM, err = m.internalCA.issue(fqdn); err != nil {
+			return fmt.Errorf("failed to issue internal certificate for %s: %w", fqdn, err)
+		}
+	} else {
+		slog.Info("ACME: Attempting to obtain/renew certificate", "fqdn", fqdn)
+
+		if m.legoClient == nil {
+			return fmt.Errorf("Lego client not initialized in CertManager")
+		}
+
+		request := certificate.ObtainRequest{
+			Domains: []string{fqdn},
+			Bundle:  true,
+			Profile: m.profileFor(fqdn),
+		}
+		slog.Info("ACME: Requesting certificate", "domains", request.Domains, "profile", request.Profile)
+		certRes, err := m.obtainWithDeadline(fqdn, request, release)
+		if errors.Is(err, errObtainAbandoned) {
+			release = func() {} // Released by the abandoned obtain
+		}
+		if err != nil {
+			slog.Error("ACME: Failed to obtain certificate", "fqdn", fqdn, "error", err)
+			logSetupRequired(err)
+			return fmt.Errorf("failed to obtain certificate for %s: %w", fqdn, err)
+		}
+		certPEM, keyPEM = certRes.Certificate, certRes.PrivateKey
 	}
+	return m.saveCert(fqdn, certPEM, keyPEM)
+}
 
-	certFile := filepath.Join(certificatesPath, fqdn+".crt")
-	keyFile := filepath.Join(certificatesPath, fqdn+".key")
+// saveCert writes a newly issued certificate and key and loads them.
+func (m *Manager) saveCert(fqdn string, certPEM, keyPEM []byte) error {
+	certFile, keyFile := m.certPaths(fqdn)
+	event := events.CertObtained
+	if _, err := os.Stat(certFile); err == nil {
+		event = events.CertRenewed
+	}
 
-	err = os.WriteFile(certFile, certRes.Certificate, 0600)
+	// The key goes first: a certificate is never in place without its key
+	err := m.keys.writeKeyFile(keyFile, keyPEM)
 	if err != nil {
-		return fmt.Errorf("failed to save certificate to %s: %w", certFile, err)
+		return fmt.Errorf("failed to save private key to %s: %w", keyFile, err)
 	}
-	err = os.WriteFile(keyFile, certRes.PrivateKey, 0600)
+	err = writeFileAtomic(certFile, certPEM)
 	if err != nil {
-		return fmt.Errorf("failed to save private key to %s: %w", keyFile, err)
+		return fmt.Errorf("failed to save certificate to %s: %w", certFile, err)
 	}
 
 	slog.Info("Successfully obtained and saved certificate", "fqdn", fqdn)
+	events.Publish(event, fqdn, "")
 
 	_, err = m.loadCertFromFile(fqdn) // Load and cache
 	if err != nil {
@@ -260,8 +484,12 @@ func (m *Manager) obtainOrRenewCert(fqdn string) error {
 
 // CheckAndManageCert checks cert file, triggers obtain/renew if needed.
 func (m *Manager) CheckAndManageCert(fqdn string) {
+	if m.Quarantined(fqdn) {
+		slog.Debug("CertMaintenance: Skipping quarantined name", "fqdn", fqdn)
+		return
+	}
 	needsObtain := false
-	certFile := filepath.Join(certificatesPath, fqdn+".crt")
+	certFile, _ := m.certPaths(fqdn)
 
 	if _, err := os.Stat(certFile); os.IsNotExist(err) {
 		slog.Info("CertMaintenance: Certificate file not found, triggering initial obtainment", "fqdn", fqdn)
@@ -271,25 +499,51 @@ func (m *Manager) CheckAndManageCert(fqdn string) {
 		return
 	} else {
 		expiry, err := m.loadCertFromFile(fqdn)
-		if err != nil {
+		if errors.Is(err, errCorrupt) {
+			slog.Error("CertMaintenance: Certificate on disk is corrupt, re-issuing", "fqdn", fqdn, "error", err)
+			m.quarantineFiles(fqdn)
+			needsObtain = true
+		} else if err != nil {
 			slog.Error("CertMaintenance: Error loading existing certificate file", "fqdn", fqdn, "error", err)
 		} else {
-			if time.Until(expiry) < m.renewBefore {
-				slog.Info("CertMaintenance: Certificate nearing expiry, triggering renewal", "fqdn", fqdn, "expiry", expiry, "renew_before", m.renewBefore)
+			if window := m.renewWindow(fqdn); time.Until(expiry) < window {
+				slog.Info("CertMaintenance: Certificate nearing expiry, triggering renewal", "fqdn", fqdn, "expiry", expiry, "renew_before", window)
 				needsObtain = true
 			}
 		}
 	}
 
 	if needsObtain {
-		err := m.obtainOrRenewCert(fqdn)
+		err := m.obtainOrRenewCert(fqdn, false)
 		if err != nil {
 			slog.Error("CertMaintenance: Error during certificate obtain/renew", "fqdn", fqdn, "error", err)
 		}
+	} else {
+		m.recordResult(fqdn, nil) // Nothing to do, clears a deferred check
+	}
+}
+
+// SetWanted tells the manager which names the current routes need
+// certificates for. Corrupt files are only healed for those, or names with
+// certificate state.
+func (m *Manager) SetWanted(wanted func(fqdn string) bool) {
+	m.wanted = wanted
+}
+
+// Preload loads an existing certificate from disk into the cache, if there is one.
+func (m *Manager) Preload(fqdn string) {
+	if _, err := m.loadCertFromFile(fqdn); err != nil && !os.IsNotExist(err) && !m.heal(fqdn, err) {
+		slog.Warn("Failed to preload certificate", "fqdn", fqdn, "error", err)
 	}
 }
 
+// ForceRenew obtains a new certificate for fqdn regardless of the current one's expiry.
+func (m *Manager) ForceRenew(fqdn string) error {
+	return m.obtainOrRenewCert(fqdn, true)
+}
+
 // GetCertificateForSNI retrieves a certificate from cache or loads from file.
+// An exact certificate is preferred; otherwise a wildcard certificate for the parent domain is used.
 func (m *Manager) GetCertificateForSNI(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	if hello.ServerName == "" {
 		slog.Warn("TLS ClientHello missing ServerName (SNI)")
@@ -297,30 +551,60 @@ func (m *Manager) GetCertificateForSNI(hello *tls.ClientHelloInfo) (*tls.Certifi
 	}
 
 	fqdn := hello.ServerName
-	m.mu.RLock()
-	cert, exists := m.certs[fqdn]
-	m.mu.RUnlock()
-
-	if !exists {
-		slog.Info("TLS: Certificate not in cache, attempting load from file", "sni", fqdn)
-		_, err := m.loadCertFromFile(fqdn)
-		if err == nil {
-			m.mu.RLock()
-			cert, exists = m.certs[fqdn]
-			m.mu.RUnlock()
-			if !exists {
-				slog.Error("TLS: Certificate inconsistent after loading", "sni", fqdn)
-				return nil, fmt.Errorf("certificate for %s inconsistent after loading", fqdn)
-			}
-		} else {
-			if os.IsNotExist(err) {
-				slog.Info("TLS: Certificate not found in cache or on disk", "sni", fqdn)
-			} else {
-				slog.Error("TLS: Failed to load certificate from file", "sni", fqdn, "error", err)
-			}
-			return nil, fmt.Errorf("certificate for %s not available", fqdn)
+	if cert, err := m.lookupCert(fqdn); err == nil {
+		return cert, nil
+	}
+	if wildcard, ok := discovery.WildcardFor(fqdn); ok {
+		if cert, err := m.lookupCert(wildcard); err == nil {
+			return cert, nil
+		}
+	}
+	return nil, fmt.Errorf("certificate for %s not available", fqdn)
+}
+
+// FirstCertificate returns the known certificate with the lowest name, a
+// stable choice for clients that send no SNI.
+func (m *Manager) FirstCertificate() (*tls.Certificate, bool) {
+	var first string
+	for fqdn := range m.cache.names() {
+		if first == "" || fqdn < first {
+			first = fqdn
 		}
 	}
+	if first == "" {
+		return nil, false
+	}
+	cert, err := m.lookupCert(first)
+	return cert, err == nil
+}
+
+// lookupCert returns the cached certificate for a name, loading it from file on a cache miss.
+func (m *Manager) lookupCert(fqdn string) (*tls.Certificate, error) {
+	if !validName(fqdn) {
+		return nil, fmt.Errorf("certificate for %q not available", fqdn)
+	}
+	if cert, ok := m.cache.get(fqdn); ok {
+		certCacheLookups.Inc("hit")
+		return cert, nil
+	}
+	if m.cache.knownMissing(fqdn) {
+		certCacheLookups.Inc("negative_hit")
+		return nil, fmt.Errorf("certificate for %s not available", fqdn)
+	}
 
+	slog.Debug("TLS: Certificate not in cache, attempting load from file", "sni", fqdn)
+	cert, err := m.readCertFile(fqdn)
+	if err != nil {
+		certCacheLookups.Inc("miss")
+		if os.IsNotExist(err) {
+			slog.Info("TLS: Certificate not found in cache or on disk", "sni", fqdn)
+			m.cache.missing(fqdn)
+		} else if !m.heal(fqdn, err) {
+			slog.Error("TLS: Failed to load certificate from file", "sni", fqdn, "error", err)
+		}
+		return nil, fmt.Errorf("certificate for %s not available", fqdn)
+	}
+	certCacheLookups.Inc("load")
+	m.cache.add(fqdn, cert)
 	return cert, nil
-} 
\ No newline at end of file
+}
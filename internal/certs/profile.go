@@ -0,0 +1,86 @@
+package certs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"rproxy/internal/config"
+	"slices"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+)
+
+// caDirURL returns the ACME directory of Let's Encrypt, staging or production.
+func caDirURL(cfg *config.Config) string {
+	if cfg.ACMEStaging {
+		return stagingDirURL
+	}
+	return "https://acme-v02.api.letsencrypt.org/directory"
+}
+
+// newProfileSelector returns the profile to order each name with, from
+// ACME_PROFILE and ACME_PROFILES. Profiles the CA does not advertise in its
+// directory are dropped with a warning, so those names are ordered with the
+// CA's default rather than failing.
+func newProfileSelector(cfg *config.Config) (func(fqdn string) string, error) {
+	configured := []string{cfg.ACMEProfile}
+	for _, profile := range cfg.ACMEProfiles {
+		configured = append(configured, profile)
+	}
+	configured = slices.DeleteFunc(configured, func(p string) bool { return p == "" })
+	if len(configured) == 0 {
+		return func(string) string { return "" }, nil
+	}
+
+	advertised, err := fetchProfiles(caDirURL(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ACME profiles: %w", err)
+	}
+	slices.Sort(configured)
+	for _, profile := range slices.Compact(configured) {
+		if _, ok := advertised[profile]; !ok {
+			slog.Warn("ACME: Profile not offered by the CA, ordering with its default profile instead", "profile", profile, "offered", slices.Sorted(maps.Keys(advertised)))
+		}
+	}
+	return func(fqdn string) string {
+		profile := cfg.ACMEProfileFor(fqdn)
+		if _, ok := advertised[profile]; !ok {
+			return ""
+		}
+		return profile
+	}, nil
+}
+
+// fetchProfiles returns the profiles advertised in the meta of the ACME
+// directory at dirURL, by name.
+func fetchProfiles(dirURL string) (map[string]string, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(dirURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ACME directory %s answered %s", dirURL, resp.Status)
+	}
+	var dir acme.Directory
+	if err := json.NewDecoder(resp.Body).Decode(&dir); err != nil {
+		return nil, fmt.Errorf("invalid ACME directory %s: %w", dirURL, err)
+	}
+	return dir.Meta.Profiles, nil
+}
+
+// renewWindow returns how long before expiry the loaded certificate of fqdn
+// is renewed: RENEW_BEFORE, or a third of its lifetime when that is shorter,
+// as for the shortlived profile, whose certificates would otherwise be
+// renewed on every check.
+func (m *Manager) renewWindow(fqdn string) time.Duration {
+	meta, ok := m.cache.validity(fqdn)
+	if !ok {
+		return m.renewBefore
+	}
+	return min(m.renewBefore, meta.notAfter.Sub(meta.notBefore)/3)
+}
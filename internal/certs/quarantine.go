@@ -0,0 +1,43 @@
+package certs
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/go-acme/lego/v4/acme"
+)
+
+// hopelessProblems are ACME error types that retrying soon cannot fix: the
+// domain's DNS or CA policy has to change first.
+var hopelessProblems = map[string]string{
+	"urn:ietf:params:acme:error:caa":                "CAA records forbid issuance by this CA",
+	"urn:ietf:params:acme:error:rejectedIdentifier": "CA refuses to issue for this name",
+	"urn:ietf:params:acme:error:dns":                "DNS problem (e.g. NXDOMAIN) for this name",
+}
+
+// hopelessReason returns why an obtain error cannot succeed on retry, or ""
+// when it may be transient.
+func hopelessReason(err error) string {
+	var problem *acme.ProblemDetails
+	if errors.As(err, &problem) {
+		if reason, ok := hopelessProblems[problem.Type]; ok {
+			return reason
+		}
+		for _, sub := range problem.SubProblems {
+			if reason, ok := hopelessProblems[sub.Type]; ok {
+				return reason
+			}
+		}
+	}
+	// Not every lego code path wraps the problem document
+	msg := err.Error()
+	for problemType, reason := range hopelessProblems {
+		if strings.Contains(msg, problemType) {
+			return reason
+		}
+	}
+	if strings.Contains(msg, "could not find zone") {
+		return "no DNS zone found for this name at the DNS provider"
+	}
+	return ""
+}
@@ -0,0 +1,241 @@
+package certs
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"rproxy/internal/events"
+	"rproxy/internal/metrics"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	certFailing = metrics.NewGauge("rproxy_cert_failing",
+		"1 while obtaining the certificate keeps failing, 0 once it succeeds.", "fqdn")
+	certFailures = metrics.NewCounter("rproxy_cert_obtain_failures_total",
+		"Failed certificate obtain or renewal attempts.", "fqdn")
+	certQuarantined = metrics.NewGauge("rproxy_cert_quarantined",
+		"1 while a name is quarantined after hopeless ACME failures.", "fqdn")
+)
+
+// Certificate states reported by Status.
+const (
+	StateOK      = "ok"
+	StatePending = "pending" // Waiting for a first attempt or a retry
+	StateFailing = "failing" // Last attempt failed, a retry is scheduled
+	StateFailed  = "failed"  // Retries exhausted until the route changes or a renewal is forced
+
+	StateQuarantined = "quarantined" // Hopeless failures, no attempts until the quarantine ends
+)
+
+// RetryPolicy controls how failed obtains are retried.
+type RetryPolicy struct {
+	BaseDelay   time.Duration // Delay after the first failure, doubled after each further one
+	MaxDelay    time.Duration
+	MaxAttempts int // Consecutive failures before giving up
+
+	// Names failing QuarantineAfter times in a row for a hopeless reason (bad
+	// DNS, CAA denial) are left alone for QuarantineFor
+	QuarantineAfter int
+	QuarantineFor   time.Duration
+}
+
+// certState tracks pending work and failures for one name.
+type certState struct {
+	failures    int
+	hopeless    int // Consecutive failures with a hopeless reason
+	lastError   string
+	lastAttempt time.Time
+	nextAttempt time.Time // Zero when nothing is scheduled
+
+	quarantinedUntil time.Time
+	reason           string // Why the name is quarantined
+}
+
+func (st *certState) quarantined(now time.Time) bool {
+	return now.Before(st.quarantinedUntil)
+}
+
+// CertStatus describes a managed certificate for the admin API.
+type CertStatus struct {
+	FQDN        string    `json:"fqdn"`
+	State       string    `json:"state"`
+	NotAfter    time.Time `json:"not_after,omitzero"`
+	Failures    int       `json:"failures,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastAttempt time.Time `json:"last_attempt,omitzero"`
+	NextAttempt time.Time `json:"next_attempt,omitzero"`
+
+	QuarantinedUntil time.Time `json:"quarantined_until,omitzero"`
+	Reason           string    `json:"reason,omitempty"`
+}
+
+// backoff returns the delay before retry number failures, with ±20% jitter so
+// retries for many names don't line up.
+func (p RetryPolicy) backoff(failures int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.MaxDelay)
+	jitter := time.Duration(rand.Int64N(int64(delay)/5*2+1)) - delay/5
+	return delay + jitter
+}
+
+// recordResult updates the failure state of fqdn after an obtain attempt.
+func (m *Manager) recordResult(fqdn string, err error) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+
+	if err == nil {
+		m.forget(fqdn)
+		return
+	}
+
+	st := m.state(fqdn)
+	st.failures++
+	st.lastError = err.Error()
+	st.lastAttempt = time.Now()
+	st.nextAttempt = time.Time{}
+	certFailing.Set(1, fqdn)
+	certFailures.Inc(fqdn)
+
+	if reason := hopelessReason(err); reason != "" {
+		st.hopeless++
+		if st.hopeless >= m.retry.QuarantineAfter {
+			st.quarantinedUntil = st.lastAttempt.Add(m.retry.QuarantineFor)
+			st.reason = reason
+			st.nextAttempt = st.quarantinedUntil
+			certQuarantined.Set(1, fqdn)
+			slog.Warn("CertManager: Quarantining name after repeated hopeless ACME failures",
+				"fqdn", fqdn, "reason", reason, "until", st.quarantinedUntil, "error", err)
+			events.Publish(events.CertQuarantined, fqdn, fmt.Sprintf("%s, no attempts until %s", reason, st.quarantinedUntil.Format(time.RFC3339)))
+			return
+		}
+	} else {
+		st.hopeless = 0
+	}
+	if st.failures < m.retry.MaxAttempts {
+		st.nextAttempt = st.lastAttempt.Add(m.retry.backoff(st.failures))
+		events.Publish(events.CertFailed, fqdn, fmt.Sprintf("attempt %d failed, retrying at %s: %s", st.failures, st.nextAttempt.Format(time.RFC3339), st.lastError))
+	} else {
+		events.Publish(events.CertFailed, fqdn, fmt.Sprintf("attempt %d failed, giving up: %s", st.failures, st.lastError))
+	}
+}
+
+// forget drops all state for fqdn. Must be called with stateMu held.
+func (m *Manager) forget(fqdn string) {
+	if _, ok := m.states[fqdn]; ok {
+		delete(m.states, fqdn)
+		certFailing.Set(0, fqdn)
+		certQuarantined.Set(0, fqdn)
+	}
+}
+
+// Quarantined reports whether no attempts should be made for fqdn right now.
+func (m *Manager) Quarantined(fqdn string) bool {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	st, ok := m.states[fqdn]
+	return ok && st.quarantined(time.Now())
+}
+
+// Unquarantine lifts a quarantine and forgets past failures, e.g. before a forced renewal.
+func (m *Manager) Unquarantine(fqdn string) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.forget(fqdn)
+}
+
+// state returns the state of fqdn, creating it. Must be called with stateMu held.
+func (m *Manager) state(fqdn string) *certState {
+	st, ok := m.states[fqdn]
+	if !ok {
+		st = &certState{}
+		m.states[fqdn] = st
+	}
+	return st
+}
+
+// Defer schedules a check of fqdn after delay, e.g. when the cert manager was
+// too busy to take it.
+func (m *Manager) Defer(fqdn string, delay time.Duration) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	st := m.state(fqdn)
+	next := time.Now().Add(delay)
+	if st.nextAttempt.IsZero() || next.Before(st.nextAttempt) {
+		st.nextAttempt = next
+	}
+}
+
+// ResetFailures forgets past failures, so a changed route gets a fresh set of
+// attempts. Quarantines survive it: a restarting container must not restart
+// challenge attempts for a broken name.
+func (m *Manager) ResetFailures(fqdn string) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	if st, ok := m.states[fqdn]; ok && !st.quarantined(time.Now()) {
+		m.forget(fqdn)
+	}
+}
+
+// DueRetries returns the names whose scheduled check is due, oldest first.
+func (m *Manager) DueRetries(now time.Time) []string {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	var due []string
+	for fqdn, st := range m.states {
+		if !st.nextAttempt.IsZero() && !st.nextAttempt.After(now) {
+			due = append(due, fqdn)
+		}
+	}
+	slices.SortFunc(due, func(a, b string) int {
+		return m.states[a].nextAttempt.Compare(m.states[b].nextAttempt)
+	})
+	return due
+}
+
+// Status reports every loaded certificate and every name with pending work or failures.
+func (m *Manager) Status() []CertStatus {
+	byName := make(map[string]*CertStatus)
+
+	for fqdn, meta := range m.cache.names() {
+		byName[fqdn] = &CertStatus{FQDN: fqdn, State: StateOK, NotAfter: meta.notAfter}
+	}
+
+	m.stateMu.Lock()
+	for fqdn, s := range m.states {
+		st, ok := byName[fqdn]
+		if !ok {
+			st = &CertStatus{FQDN: fqdn}
+			byName[fqdn] = st
+		}
+		switch {
+		case s.quarantined(time.Now()):
+			st.State = StateQuarantined
+			st.QuarantinedUntil = s.quarantinedUntil
+			st.Reason = s.reason
+		case s.failures == 0:
+			st.State = StatePending
+		case s.nextAttempt.IsZero():
+			st.State = StateFailed
+		default:
+			st.State = StateFailing
+		}
+		st.Failures = s.failures
+		st.LastError = s.lastError
+		st.LastAttempt = s.lastAttempt
+		st.NextAttempt = s.nextAttempt
+	}
+	m.stateMu.Unlock()
+
+	list := make([]CertStatus, 0, len(byName))
+	for _, st := range byName {
+		list = append(list, *st)
+	}
+	slices.SortFunc(list, func(a, b CertStatus) int { return strings.Compare(a.FQDN, b.FQDN) })
+	return list
+}
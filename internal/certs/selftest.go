@@ -0,0 +1,86 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"rproxy/internal/config"
+	"rproxy/internal/sshclient"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/registration"
+)
+
+// stagingDirURL is the Let's Encrypt staging directory, whose certificates
+// are not trusted and whose rate limits are generous.
+const stagingDirURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+// CheckChallengeProvider publishes a challenge for domain through the
+// configured DNS provider, or webroot for HTTP-01, and removes it again, for
+// `rproxy selftest`.
+func CheckChallengeProvider(cfg *config.Config, ssh *sshclient.Client, domain string) error {
+	provider, err := newChallengeProvider(cfg, ssh)
+	if err != nil {
+		return err
+	}
+	random := make([]byte, 16)
+	rand.Read(random)
+	token := hex.EncodeToString(random)
+	keyAuth := token + ".selftest"
+	if err := provider.Present(domain, token, keyAuth); err != nil {
+		logSetupRequired(err)
+		return fmt.Errorf("failed to create challenge: %w", err)
+	}
+	if err := provider.CleanUp(domain, token, keyAuth); err != nil {
+		if cfg.ACMEChallenge == "http-01" {
+			return fmt.Errorf("challenge file created but not deleted, remove it from ACME_WEBROOT by hand: %w", err)
+		}
+		return fmt.Errorf("record created but not deleted, remove _acme-challenge.%s by hand: %w", domain, err)
+	}
+	return nil
+}
+
+// CheckACMEOrder obtains a certificate for domain from the Let's Encrypt
+// staging CA, solving the challenge like real orders, and discards it.
+// A throwaway account is used, so nothing in CERTS_DIR changes.
+func CheckACMEOrder(cfg *config.Config, ssh *sshclient.Client, domain string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	user := &ACMEUser{Email: cfg.ACMEEmail, key: key}
+	legoCfg := lego.NewConfig(user)
+	legoCfg.CADirURL = stagingDirURL
+	legoCfg.Certificate.KeyType = certcrypto.EC256
+	client, err := lego.NewClient(legoCfg)
+	if err != nil {
+		return fmt.Errorf("failed to reach the ACME staging CA: %w", err)
+	}
+
+	provider, err := newChallengeProvider(cfg, ssh)
+	if err != nil {
+		return err
+	}
+	if err := setChallengeProvider(client, cfg, provider); err != nil {
+		return err
+	}
+	if tokens, ok := provider.(*httpTokens); ok {
+		stop, err := tokens.serve(cfg.HTTPAddr)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+	if user.Registration, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true}); err != nil {
+		return fmt.Errorf("failed to register a staging account: %w", err)
+	}
+	if _, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{domain}, Bundle: true}); err != nil {
+		logSetupRequired(err)
+		return fmt.Errorf("staging order failed: %w", err)
+	}
+	return nil
+}
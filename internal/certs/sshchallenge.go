@@ -0,0 +1,122 @@
+package certs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"rproxy/internal/config"
+	"rproxy/internal/sshclient"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/lego"
+)
+
+// sshHelperTimeout bounds each command run on the podman host for a
+// challenge.
+const sshHelperTimeout = 2 * time.Minute
+
+// newChallengeProvider creates the provider solving ACME_CHALLENGE.
+func newChallengeProvider(cfg *config.Config, ssh *sshclient.Client) (challenge.Provider, error) {
+	if cfg.ACMEChallenge == "http-01" && cfg.ACMEWebroot == "" {
+		slog.Info("Setting up HTTP-01 challenges served by the proxy", "address", cfg.HTTPAddr)
+		return newHTTPTokens(), nil
+	}
+	if cfg.ACMEChallenge == "http-01" {
+		slog.Info("Setting up HTTP-01 challenges through the webroot on the podman host", "webroot", cfg.ACMEWebroot)
+		return &webrootProvider{ssh: ssh, root: cfg.ACMEWebroot}, nil
+	}
+	provider, err := newDNSProvider(cfg, ssh)
+	if err != nil {
+		return nil, err
+	}
+	return withTimeouts(provider, cfg.ACMEPropagationTimeout, cfg.ACMEPollingInterval), nil
+}
+
+// setChallengeProvider has client solve ACME_CHALLENGE with provider.
+func setChallengeProvider(client *lego.Client, cfg *config.Config, provider challenge.Provider) error {
+	if cfg.ACMEChallenge == "http-01" {
+		if err := client.Challenge.SetHTTP01Provider(provider); err != nil {
+			return fmt.Errorf("failed to set HTTP01 provider: %w", err)
+		}
+		return nil
+	}
+	resolverOpt := dns01.AddRecursiveNameservers([]string{"1.1.1.1:53", "8.8.8.8:53"})
+	if err := client.Challenge.SetDNS01Provider(provider, resolverOpt); err != nil {
+		return fmt.Errorf("failed to set DNS01 provider with resolvers: %w", err)
+	}
+	return nil
+}
+
+// execProvider updates DNS-01 records by running ACME_DNS_HELPER on the
+// podman host, for DNS providers rproxy does not integrate. The helper is
+// called like lego's exec provider:
+//
+//	helper present _acme-challenge.app.example.com. <value>
+//	helper cleanup _acme-challenge.app.example.com. <value>
+//
+// It must exit 0 once the record is created or removed.
+type execProvider struct {
+	ssh    *sshclient.Client
+	helper string
+}
+
+// Present implements challenge.Provider.
+func (p *execProvider) Present(domain, token, keyAuth string) error {
+	info := dns01.GetChallengeInfo(domain, keyAuth)
+	return p.run("present", info.EffectiveFQDN, info.Value)
+}
+
+// CleanUp implements challenge.Provider.
+func (p *execProvider) CleanUp(domain, token, keyAuth string) error {
+	info := dns01.GetChallengeInfo(domain, keyAuth)
+	return p.run("cleanup", info.EffectiveFQDN, info.Value)
+}
+
+func (p *execProvider) run(action, fqdn, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sshHelperTimeout)
+	defer cancel()
+	cmd := fmt.Sprintf("%s %s %s %s", sshclient.Quote(p.helper), action, sshclient.Quote(fqdn), sshclient.Quote(value))
+	if _, err := p.ssh.RunCommandContext(ctx, cmd); err != nil {
+		return fmt.Errorf("ACME_DNS_HELPER %s failed for %s: %w", action, fqdn, err)
+	}
+	return nil
+}
+
+// webrootProvider solves HTTP-01 challenges by writing the key authorization
+// under ACME_WEBROOT on the podman host, for a web server there that serves
+// the challenged names on port 80.
+type webrootProvider struct {
+	ssh  *sshclient.Client
+	root string
+}
+
+// Present implements challenge.Provider.
+func (p *webrootProvider) Present(domain, token, keyAuth string) error {
+	file := path.Join(p.root, http01.ChallengePath(token))
+	cmd := fmt.Sprintf("mkdir -p %s && printf %%s %s > %s",
+		sshclient.Quote(path.Dir(file)), sshclient.Quote(keyAuth), sshclient.Quote(file))
+	if err := p.run(cmd); err != nil {
+		return fmt.Errorf("failed to write HTTP-01 challenge for %s to %s: %w", domain, file, err)
+	}
+	return nil
+}
+
+// CleanUp implements challenge.Provider.
+func (p *webrootProvider) CleanUp(domain, token, keyAuth string) error {
+	file := path.Join(p.root, http01.ChallengePath(token))
+	if err := p.run("rm -f " + sshclient.Quote(file)); err != nil {
+		return fmt.Errorf("failed to remove HTTP-01 challenge for %s at %s: %w", domain, file, err)
+	}
+	return nil
+}
+
+func (p *webrootProvider) run(cmd string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sshHelperTimeout)
+	defer cancel()
+	_, err := p.ssh.RunCommandContext(ctx, cmd)
+	return err
+}
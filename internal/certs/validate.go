@@ -0,0 +1,102 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// errCorrupt marks certificate files that exist but cannot be used: unparsable
+// PEM, a key not matching the certificate, or a broken chain.
+var errCorrupt = errors.New("corrupt certificate files")
+
+// parseKeyPair validates a certificate/key pair read from disk and returns it
+// with the leaf parsed.
+func parseKeyPair(certData, keyData []byte) (tls.Certificate, error) {
+	// X509KeyPair rejects keys not matching the leaf
+	tlsCert, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("%w: %w", errCorrupt, err)
+	}
+	if len(tlsCert.Certificate) == 0 {
+		return tls.Certificate{}, fmt.Errorf("%w: no certificate found", errCorrupt)
+	}
+
+	chain := make([]*x509.Certificate, len(tlsCert.Certificate))
+	for i, der := range tlsCert.Certificate {
+		if chain[i], err = x509.ParseCertificate(der); err != nil {
+			return tls.Certificate{}, fmt.Errorf("%w: chain certificate %d: %w", errCorrupt, i, err)
+		}
+	}
+	for i := 0; i+1 < len(chain); i++ {
+		if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+			return tls.Certificate{}, fmt.Errorf("%w: chain certificate %d not issued by the next one: %w", errCorrupt, i, err)
+		}
+	}
+	tlsCert.Leaf = chain[0]
+	return tlsCert, nil
+}
+
+// validName reports whether fqdn is a DNS name, optionally with a leading
+// "*." label, and so safe to build file names in CERTS_DIR from. Server
+// names come straight from ClientHellos: "../../etc/ssl/certs/x" must not
+// reach the disk.
+func validName(fqdn string) bool {
+	name := strings.TrimPrefix(fqdn, "*.")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for label := range strings.SplitSeq(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// manages reports whether fqdn is a name of the current routes or has
+// certificate state, the only names heal may touch.
+func (m *Manager) manages(fqdn string) bool {
+	m.stateMu.Lock()
+	_, ok := m.states[fqdn]
+	m.stateMu.Unlock()
+	return ok || (m.wanted != nil && m.wanted(fqdn))
+}
+
+// quarantineFiles moves corrupt certificate files aside, keeping them for
+// inspection, and drops the cached certificate so the name gets a fresh one.
+func (m *Manager) quarantineFiles(fqdn string) {
+	m.cache.remove(fqdn)
+
+	suffix := fmt.Sprintf(".corrupt-%d", time.Now().Unix())
+	certFile, keyFile := m.certPaths(fqdn)
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Rename(file, file+suffix); err != nil && !os.IsNotExist(err) {
+			slog.Error("Certs: Failed to move corrupt file aside", "fqdn", fqdn, "file", file, "error", err)
+		}
+	}
+	slog.Warn("Certs: Moved corrupt certificate files aside", "fqdn", fqdn, "suffix", suffix)
+}
+
+// heal moves corrupt files aside and schedules re-issuance on the next retry
+// pass. It reports whether err was a corruption it handled: files of names
+// the proxy does not manage are left alone.
+func (m *Manager) heal(fqdn string, err error) bool {
+	if !errors.Is(err, errCorrupt) || !m.manages(fqdn) {
+		return false
+	}
+	slog.Error("Certs: Certificate on disk is corrupt, re-issuing", "fqdn", fqdn, "error", err)
+	m.quarantineFiles(fqdn)
+	m.Defer(fqdn, 0)
+	return true
+}
@@ -0,0 +1,36 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ACMEProfileFor returns the ACME profile to order host's certificate with:
+// that of the longest ACME_PROFILES zone containing it, else ACME_PROFILE.
+// "" leaves the choice to the CA.
+func (c *Config) ACMEProfileFor(host string) string {
+	host = strings.TrimPrefix(strings.ToLower(host), "*.")
+	profile, bestLen := c.ACMEProfile, 0
+	for zone, p := range c.ACMEProfiles {
+		if (host == zone || strings.HasSuffix(host, "."+zone)) && len(zone) > bestLen {
+			profile, bestLen = p, len(zone)
+		}
+	}
+	return profile
+}
+
+// loadACMEProfiles reads ACME_PROFILES, e.g.
+// "example.com=shortlived,legacy.example.org=classic".
+func loadACMEProfiles() (map[string]string, error) {
+	profiles := make(map[string]string)
+	for _, entry := range getEnvAsList("ACME_PROFILES", nil) {
+		zone, profile, ok := strings.Cut(entry, "=")
+		zone = strings.ToLower(strings.Trim(strings.TrimSpace(zone), "."))
+		profile = strings.TrimSpace(profile)
+		if !ok || zone == "" || profile == "" || strings.Contains(zone, "*") {
+			return nil, fmt.Errorf("invalid entry %q in ACME_PROFILES, expected zone=profile", entry)
+		}
+		profiles[zone] = profile
+	}
+	return profiles, nil
+}
@@ -1,9 +1,19 @@
 package config
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"slices"
+	"rproxy/internal/discovery"
+	"rproxy/internal/notify"
+	"rproxy/internal/secrets"
 	"strconv"
 	"strings"
 	"time"
@@ -12,19 +22,169 @@ import (
 // Config holds the application configuration.
 type Config struct {
 	UpdateInterval    time.Duration
-	// CertsDir          string // Removed - Hardcoded to /certs in certs/manager.go
+	DiscoveryMaxInterval time.Duration // Back discovery polling off up to this while nothing changes, 0 to always poll at UpdateInterval
+	RouteRemovalMisses int64 // Consecutive discovery passes a route must be missing before it is removed
+	RoutesStaleLimit   time.Duration // Fail /readyz once routes went unconfirmed by discovery this long, 0 never
+	DiscoveryFailureMaxBackoff time.Duration // Ceiling of the exponential backoff after failed discovery passes
+	Providers         []string // Discovery providers: podman, swarm, kubernetes
+	KubectlCommand    string   // kubectl invocation on the SSH host (kubernetes provider)
+	GatewayName       string   // Only serve HTTPRoutes attached to this Gateway, "namespace/name" or a name in default (kubernetes provider)
+	SwarmNetwork      string   // Overlay network rproxy shares with services, whose VIPs are used (swarm provider)
+	PodmanDNSDomain   string   // Dial containers as <name>.<domain> (e.g. dns.podman) instead of their IP (podman provider)
+
+	DiscoveryConcurrency    int64         // Inspect commands run at once when containers are inspected one by one
+	DiscoveryInspectTimeout time.Duration // Bound on each inspect command
+
+	RoutesFile        string   // Static route file (file provider)
+	BackendCAFile     string   // Extra CA bundle for verifying reencrypt backends
+	SPIFFESocket      string   // Workload API endpoint (SPIRE agent) for the SVID presented to backends
+	TunnelTokens      map[string]string // Agent tokens by tunnel FQDN, see internal/tunnel
+	BackendViaSSH     bool     // Dial backends through the SSH connection to the podman host
+	PublicListener    bool     // Listen on :443 (disable to serve only on the tailnet)
+	ListenFamily      string   // dual, ipv4 or ipv6, for the public listener
+	ListenAddrs       []string // Specific IPs to bind port 443 on instead of the wildcard address
+	Listeners         []Listener // Extra listener profiles serving only routes labelled for them
+	Tenants           []Tenant   // Users sharing this rproxy, see tenant.go
+	DomainAllowList   []string   // Zones and patterns rproxy may serve, empty for any (see domains.go)
+	DomainDenyList    []string   // Zones and patterns it never serves, even if allowed
+	ListenReusePort   int64      // SO_REUSEPORT sockets (accept loops) per listen address, 0 for a plain socket
+	AdminAddr         string   // Admin API listen address, empty disables it
+	AdminDebug        bool     // Expose pprof, expvar and runtime stats on the admin API
+
+	// Admin API authentication, open to anyone reaching ADMIN_ADDR when none is set
+	AdminToken           string   // Bearer token with full access
+	AdminReadToken       string   // Bearer token limited to reading
+	AdminTLSCert         string   // Serve the admin API over HTTPS with this certificate
+	AdminTLSKey          string
+	AdminClientCA        string   // Accept client certificates signed by this CA bundle (mTLS)
+	AdminClients         []string // Common names of client certificates with full access, others only read
+	RoutesStateFile   string   // Route table snapshot restored on startup, empty disables it
+	ReadinessGate     bool     // Answer 503 until the first route table is ready
+
+	ResponseHeaders      string   // Headers set on every response: "Name=value|Other=value"
+	StripResponseHeaders []string // Headers removed from every response
+	RewriteLocation      bool     // Rewrite redirects to internal backend addresses
+	AltSvc               string   // Alt-Svc header set on every response, e.g. h3=":443"; ma=86400
+
+	FlushInterval      time.Duration // Default reverse proxy flush interval, -1 flushes after every write
+	MaxRequestDuration time.Duration // Default deadline for reading and answering a request, 0 for none
+	DeadlineHeader     string        // Request header telling backends the milliseconds left before the deadline, empty for none
+	EarlyHints         bool          // Forward 1xx responses such as 103 Early Hints from backends
+	UpgradeIdleTimeout time.Duration // Close upgraded (WebSocket) connections idle this long, 0 for never
+	BackendDNSTTL      time.Duration // How long resolved backend hostnames are cached
+
+	LabelFilesDir string // Directory "file:" label values (keys, pages) may read from, empty refuses them
+
+	StartingPage       bool          // Answer 503 with a reloading page instead of 502 while a backend refuses connections
+	StartingRetryAfter time.Duration // Retry-After of the starting page
+
+	CacheMaxBytes       int64         // Memory budget of the response cache
+	CacheMaxObjectBytes int64         // Largest response kept in the cache
+	CacheDefaultTTL     time.Duration // Freshness of cached responses without Cache-Control or Expires
+
+	CacheStaleWhileRevalidate time.Duration // Serve expired entries this long while refreshing them
+	CacheStaleIfError         time.Duration // Serve expired entries this long while the backend fails
+
+	CoalesceMaxBytes int64 // Largest response shared by coalesced requests (exposed-coalesce)
+
+	TailscaleEnabled  bool   // Serve the proxy on a tailnet via an embedded tsnet node
+	TailscaleHostname string
+	TailscaleAuthKey  string
+	TailscaleStateDir string
+	TailscaleBackends bool // Dial backends (e.g. Tailscale IPs) through the tailnet
+	CertsDir          string // Certificates, keys and the default location of other state
 	CertCheckInterval time.Duration
+	CertRetryBaseDelay   time.Duration // Delay before retrying a failed obtain, doubled per failure
+	CertRetryMaxDelay    time.Duration
+	CertRetryMaxAttempts int
+	CertQuarantineAfter  int           // Consecutive hopeless failures (bad DNS, CAA) before quarantine
+	CertQuarantineFor    time.Duration // How long a quarantined name gets no attempts
+	CertCacheSize        int           // Certificates kept in memory, least recently served evicted first; 0 for no limit
+	CertCacheNegativeTTL time.Duration // How long a name without a certificate file is not looked up again, 0 to always look
 	RenewBefore       time.Duration
 
+	InternalCA           bool          // Issue certificates for InternalCAZones from a local CA instead of ACME
+	InternalCAZones      []string      // Internal-only zones, e.g. internal and lan
+	InternalCertLifetime time.Duration // Validity of certificates from the internal CA
+
 	SSHUser string
 	SSHHost string // Set via Makefile
 	SSHPort string // Set via Makefile
 	// SSHIdentityFile string // Removed field
+	SSHKeyFile string // PODMAN_SSH_KEY, the ssh_key credential (see credentialDirs), or a default (see hostDefaults)
+	SSHKeyData []byte // PEM private key from PODMAN_SSH_KEY_DATA, used instead of SSHKeyFile
+
+	DNSProvider        string   // DNS-01 challenge provider: gandi, acmedns or exec
+	ACMEDNSAPIBase     string   // acme-dns server URL
+	ACMEDNSStoragePath string   // acme-dns account registrations, one per domain
+	ACMEDNSAllowList   []string // CIDRs allowed to update the acme-dns records
+	ACMEDNSHelper      string   // Script run on the podman host to update records (exec provider)
+
+	ACMEChallenge string // dns-01, or http-01 answered on HTTPAddr, or through files in ACMEWebroot
+	ACMEWebroot   string // Directory on the podman host served as http://<fqdn>/ (http-01), empty to answer on HTTPAddr
+	HTTPAddr      string // Plain HTTP listen address for HTTP-01 challenges and redirects to HTTPS, empty for none
+
+	ACMEPropagationTimeout time.Duration // How long to wait for the challenge record, 0 for the provider default
+	ACMEPollingInterval    time.Duration // How often to check for it, 0 for the provider default
+	ACMEObtainTimeout      time.Duration // Deadline for a whole obtain, 0 for none
+	ACMEProfile            string            // ACME profile ordered by default, e.g. shortlived; "" for the CA's default
+	ACMEProfiles           map[string]string // Profiles by zone, overriding ACMEProfile
 
 	GandiPAT string // Gandi Personal Access Token (uses "Bearer" auth prefix)
 	ACMEEmail   string
 	GandiZone   string
 	ACMEStaging bool
+
+	Tarpit              bool          // Answer unrouted hosts and exploit probes slowly
+	TarpitDelay         time.Duration
+	TarpitPaths         []string // Path prefixes of exploit probes, nil for the built-in list
+	TarpitMaxConcurrent int64
+
+	UnknownSNIPolicy string // reject, default-cert or close, for TLS handshakes without a certificate
+	NoSNICert        string // Certificate for clients without SNI: first, self-signed or an FQDN; empty to reject
+	TLSKeyLogFile    string // Append TLS session secrets in NSS key log format (debugging only)
+
+	HTTPStrict     []string // Protocol anomalies answered 400: te-cl, header-whitespace, absolute-form
+	EnforceHostSNI bool     // Answer 421 when Host differs from the TLS server name
+
+	MiddlewareOrder string // Default order of per-route middlewares, e.g. "hmac,api-key"
+
+	// Bandwidth budgets in bytes per second shared fairly by all routes, 0 for unlimited
+	BandwidthLimitIn  int64 // Request bodies
+	BandwidthLimitOut int64 // Response bodies
+
+	NotifyURL    string // Webhook for operator notifications (routes added/removed), empty disables them
+	NotifyFormat string // webhook, slack or ntfy
+
+	// 5xx spike detection, reported as error_spike events (see proxy/errorspike.go)
+	ErrorSpikeWindow    time.Duration // Responses are counted over this sliding window
+	ErrorSpikeMinErrors int           // 5xx responses in the window before a spike is reported, 0 disables detection
+	ErrorSpikeRate      float64       // Share of 5xx responses in the window that makes a spike
+
+	// Synthetic probes of every published FQDN (see proxy/prober.go)
+	ProbeInterval time.Duration // 0 disables probing
+	ProbeTimeout  time.Duration
+	ProbePath     string // Requested path, routes override it with exposed-probe-path
+	ProbeAddr     string // host:port connected to instead of each FQDN's public address, e.g. for hairpin NAT
+
+	// DNS record checks of every published FQDN (see proxy/dnscheck.go)
+	PublicIPs        []netip.Addr  // Addresses the records must point at, empty disables the checks
+	DNSCheckInterval time.Duration // 0 disables the checks
+	DNSCheckResolver string        // host:port of the DNS server asked, empty for the system resolver
+
+	// Dynamic DNS for changing public addresses (see the ddns package)
+	DDNS              bool
+	DDNSSources       []string      // "stun:host:port" servers and HTTPS echo URLs, asked in order
+	DDNSFamilies      []string      // ipv4 and/or ipv6
+	DDNSHosts         []string      // Names kept up to date, nil for every published FQDN
+	DDNSInterval      time.Duration // How often the public address is detected
+	DDNSConfirmations int64         // Detections in a row needed before a changed address is used
+	DDNSTTL           time.Duration // TTL of the updated records
+
+	AccessLog    string // on, off or errors-only; routes override it with exposed-access-log
+	ErrorDetails bool   // Show backend errors to clients instead of a generic 502 page (development)
+
+	CertEncryptionKey []byte // AES-256 key sealing private keys under /certs, nil to store them in plain
 }
 
 // LoadConfig loads configuration from environment variables.
@@ -32,23 +192,365 @@ func LoadConfig() (*Config, error) {
 	cfg := &Config{
 		// Defaults
 		UpdateInterval:    10 * time.Second,
-		// CertsDir:          "/certs", // Removed
+		Providers:         []string{"podman"},
+		KubectlCommand:    "kubectl",
+		RouteRemovalMisses: 2,
+		DiscoveryFailureMaxBackoff: 5 * time.Minute,
+		DiscoveryConcurrency:    4,
+		DiscoveryInspectTimeout: 15 * time.Second,
+		CertsDir:          "/certs",
 		CertCheckInterval: 12 * time.Hour,
+		CertRetryBaseDelay:   10 * time.Minute,
+		CertRetryMaxDelay:    12 * time.Hour,
+		CertRetryMaxAttempts: 8,
+		CertQuarantineAfter:  2,
+		CertQuarantineFor:    7 * 24 * time.Hour,
+		CertCacheSize:        1000,
+		CertCacheNegativeTTL: time.Minute,
+		TarpitDelay:          10 * time.Second,
+		ACMEObtainTimeout:    30 * time.Minute,
+		TarpitMaxConcurrent:  256,
 		RenewBefore:       30 * 24 * time.Hour,
+		InternalCAZones:      []string{"internal", "lan"},
+		InternalCertLifetime: 90 * 24 * time.Hour,
 		SSHUser:           "core", // Default SSH user
+		SSHKeyFile:        "/ssh/id_rsa",
 		ACMEStaging:       false,
+		PublicListener:    true,
+		AdminAddr:         "127.0.0.1:9000",
+		ReadinessGate:     true,
+		RewriteLocation:   true,
+		FlushInterval:     100 * time.Millisecond,
+		MaxRequestDuration: 10 * time.Minute,
+		EarlyHints:        true,
+		UpgradeIdleTimeout: time.Hour,
+		BackendDNSTTL:      30 * time.Second,
+		StartingRetryAfter: 5 * time.Second,
+		ErrorSpikeWindow:    2 * time.Minute,
+		ErrorSpikeMinErrors: 20,
+		ErrorSpikeRate:      0.5,
+		ProbeTimeout:        10 * time.Second,
+		DNSCheckInterval:    10 * time.Minute,
+		DDNSInterval:        5 * time.Minute,
+		DDNSConfirmations:   2,
+		DDNSTTL:             5 * time.Minute,
+		CacheMaxBytes:       256 << 20,
+		CacheMaxObjectBytes: 64 << 20,
+		CacheDefaultTTL:     5 * time.Minute,
+		CacheStaleIfError:   10 * time.Minute,
+		CoalesceMaxBytes:    8 << 20,
+		DNSProvider:        "gandi",
+		TailscaleHostname: "rproxy",
+	}
+
+	if !inContainer() {
+		hostDefaults(cfg)
 	}
 
 	// Load from environment variables
+	if err := loadSecretFiles(append(slices.Clone(secretEnvVars), tenantSecretVars()...)); err != nil {
+		return nil, err
+	}
+	cfg.CertsDir = filepath.Clean(getEnv("CERTS_DIR", cfg.CertsDir))
+	if !filepath.IsAbs(cfg.CertsDir) {
+		return nil, fmt.Errorf("CERTS_DIR must be an absolute path, got %q", cfg.CertsDir)
+	}
+	// State persisted on the certs volume by default
+	cfg.RoutesStateFile = filepath.Join(cfg.CertsDir, "routes-state.json")
+	cfg.ACMEDNSStoragePath = filepath.Join(cfg.CertsDir, "acme-dns.json")
+	cfg.TailscaleStateDir = filepath.Join(cfg.CertsDir, "tailscale")
+	cfg.Providers = getEnvAsList("DISCOVERY_PROVIDERS", cfg.Providers)
+	cfg.KubectlCommand = getEnv("KUBECTL_COMMAND", cfg.KubectlCommand)
+	cfg.GatewayName = getEnv("GATEWAY_NAME", "")
+	cfg.SwarmNetwork = getEnv("SWARM_NETWORK", "")
+	cfg.PodmanDNSDomain = strings.Trim(getEnv("PODMAN_DNS_DOMAIN", ""), ".")
+	cfg.DiscoveryConcurrency = getEnvAsInt64("DISCOVERY_CONCURRENCY", cfg.DiscoveryConcurrency)
+	cfg.RouteRemovalMisses = getEnvAsInt64("ROUTE_REMOVAL_MISSES", cfg.RouteRemovalMisses)
+	cfg.RoutesFile = getEnv("ROUTES_FILE", "")
+	cfg.BackendCAFile = getEnv("BACKEND_CA_FILE", "")
+	cfg.SPIFFESocket = getEnv("SPIFFE_ENDPOINT_SOCKET", "")
+	cfg.BackendViaSSH = getEnvAsBool("BACKEND_VIA_SSH", false)
+	cfg.PublicListener = getEnvAsBool("PUBLIC_LISTENER", cfg.PublicListener)
+	cfg.ListenFamily = getEnv("LISTEN_FAMILY", ListenDual)
+	cfg.ListenAddrs = getEnvAsList("LISTEN_ADDRS", nil)
+	cfg.ListenReusePort = getEnvAsInt64("LISTEN_REUSEPORT", 0)
+	listeners, err := loadListeners(getEnvAsList("LISTENERS", nil))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Listeners = listeners
+	if cfg.TunnelTokens, err = loadTunnelTokens(); err != nil {
+		return nil, err
+	}
+	if cfg.Tenants, err = loadTenants(getEnvAsList("TENANTS", nil)); err != nil {
+		return nil, err
+	}
+	if cfg.DomainAllowList, err = loadDomainList("DOMAIN_ALLOWLIST"); err != nil {
+		return nil, err
+	}
+	if cfg.DomainDenyList, err = loadDomainList("DOMAIN_DENYLIST"); err != nil {
+		return nil, err
+	}
+	cfg.AdminAddr = getEnv("ADMIN_ADDR", cfg.AdminAddr)
+	cfg.AdminDebug = getEnvAsBool("ADMIN_DEBUG", false)
+	cfg.AdminToken = getEnv("ADMIN_TOKEN", "")
+	cfg.AdminReadToken = getEnv("ADMIN_READ_TOKEN", "")
+	cfg.AdminTLSCert = getEnv("ADMIN_TLS_CERT", "")
+	cfg.AdminTLSKey = getEnv("ADMIN_TLS_KEY", "")
+	cfg.AdminClientCA = getEnv("ADMIN_CLIENT_CA", "")
+	cfg.AdminClients = getEnvAsList("ADMIN_CLIENTS", nil)
+	if _, ok := os.LookupEnv("ADMIN_READ_ONLY_CLIENTS"); ok {
+		return nil, fmt.Errorf("ADMIN_READ_ONLY_CLIENTS is no longer used: client certificates only read unless their common name is in ADMIN_CLIENTS")
+	}
+	if (cfg.AdminTLSCert == "") != (cfg.AdminTLSKey == "") {
+		return nil, fmt.Errorf("ADMIN_TLS_CERT and ADMIN_TLS_KEY must be set together")
+	}
+	if cfg.AdminClientCA != "" && cfg.AdminTLSCert == "" {
+		return nil, fmt.Errorf("ADMIN_CLIENT_CA needs ADMIN_TLS_CERT and ADMIN_TLS_KEY")
+	}
+	if cfg.AdminToken != "" && cfg.AdminToken == cfg.AdminReadToken {
+		return nil, fmt.Errorf("ADMIN_TOKEN and ADMIN_READ_TOKEN must differ")
+	}
+	cfg.RoutesStateFile = getEnv("ROUTES_STATE_FILE", cfg.RoutesStateFile)
+	cfg.ReadinessGate = getEnvAsBool("READINESS_GATE", cfg.ReadinessGate)
+	cfg.ResponseHeaders = getEnv("RESPONSE_HEADERS", "")
+	cfg.StripResponseHeaders = getEnvAsList("STRIP_RESPONSE_HEADERS", nil)
+	cfg.AltSvc = strings.TrimSpace(getEnv("ALT_SVC", ""))
+	if strings.ContainsAny(cfg.AltSvc, "\r\n") {
+		return nil, fmt.Errorf("invalid ALT_SVC: line breaks are not allowed in header values")
+	}
+	cfg.RewriteLocation = getEnvAsBool("REWRITE_LOCATION", cfg.RewriteLocation)
+	cfg.ErrorDetails = getEnvAsBool("ERROR_DETAILS", false)
+	cfg.Tarpit = getEnvAsBool("TARPIT", false)
+	cfg.TarpitPaths = getEnvAsList("TARPIT_PATHS", nil)
+	cfg.TarpitMaxConcurrent = getEnvAsInt64("TARPIT_MAX_CONCURRENT", cfg.TarpitMaxConcurrent)
+	cfg.UnknownSNIPolicy = getEnv("UNKNOWN_SNI_POLICY", "reject")
+	switch cfg.UnknownSNIPolicy {
+	case "reject", "default-cert", "close":
+	default:
+		return nil, fmt.Errorf("invalid UNKNOWN_SNI_POLICY %q (expected reject, default-cert or close)", cfg.UnknownSNIPolicy)
+	}
+	cfg.NoSNICert = getEnv("NO_SNI_CERT", "")
+	cfg.TLSKeyLogFile = getEnv("TLS_KEYLOG_FILE", "")
+	cfg.EnforceHostSNI = getEnvAsBool("ENFORCE_HOST_SNI", false)
+	cfg.HTTPStrict = getEnvAsList("HTTP_STRICT", nil)
+	if slices.Contains(cfg.HTTPStrict, "all") {
+		cfg.HTTPStrict = []string{"te-cl", "header-whitespace", "absolute-form"}
+	}
+	for _, check := range cfg.HTTPStrict {
+		if check != "te-cl" && check != "header-whitespace" && check != "absolute-form" {
+			return nil, fmt.Errorf("unknown check %q in HTTP_STRICT (expected te-cl, header-whitespace, absolute-form or all)", check)
+		}
+	}
+	cfg.MiddlewareOrder = getEnv("MIDDLEWARE_ORDER", "")
+	cfg.BandwidthLimitIn = getEnvAsInt64("BANDWIDTH_LIMIT_IN", 0)
+	cfg.BandwidthLimitOut = getEnvAsInt64("BANDWIDTH_LIMIT_OUT", 0)
+	cfg.NotifyURL = getEnv("NOTIFY_URL", "")
+	cfg.NotifyFormat = getEnv("NOTIFY_FORMAT", notify.FormatWebhook)
+	if !notify.ValidFormat(cfg.NotifyFormat) {
+		return nil, fmt.Errorf("invalid NOTIFY_FORMAT %q (expected webhook, slack or ntfy)", cfg.NotifyFormat)
+	}
+	cfg.ErrorSpikeMinErrors = int(getEnvAsInt64("ERROR_SPIKE_MIN_ERRORS", int64(cfg.ErrorSpikeMinErrors)))
+	if v, exists := os.LookupEnv("ERROR_SPIKE_RATE"); exists {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate <= 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid ERROR_SPIKE_RATE %q (expected a share above 0 and at most 1, e.g. 0.5)", v)
+		}
+		cfg.ErrorSpikeRate = rate
+	}
+	cfg.ProbePath = getEnv("PROBE_PATH", "/")
+	if !strings.HasPrefix(cfg.ProbePath, "/") {
+		return nil, fmt.Errorf("invalid PROBE_PATH %q (expected a path starting with /)", cfg.ProbePath)
+	}
+	cfg.ProbeAddr = getEnv("PROBE_ADDR", "")
+	if cfg.ProbeAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.ProbeAddr); err != nil {
+			return nil, fmt.Errorf("invalid PROBE_ADDR %q (expected host:port): %w", cfg.ProbeAddr, err)
+		}
+	}
+	for _, v := range getEnvAsList("PUBLIC_IPS", nil) {
+		ip, err := netip.ParseAddr(v)
+		if err != nil || ip.Zone() != "" {
+			return nil, fmt.Errorf("invalid address %q in PUBLIC_IPS (expected an IPv4 or IPv6 address without port)", v)
+		}
+		cfg.PublicIPs = append(cfg.PublicIPs, ip.Unmap())
+	}
+	cfg.DNSCheckResolver = getEnv("DNS_CHECK_RESOLVER", "")
+	if cfg.DNSCheckResolver != "" {
+		if _, _, err := net.SplitHostPort(cfg.DNSCheckResolver); err != nil {
+			return nil, fmt.Errorf("invalid DNS_CHECK_RESOLVER %q (expected host:port, e.g. 1.1.1.1:53): %w", cfg.DNSCheckResolver, err)
+		}
+	}
+	cfg.DDNS = getEnvAsBool("DDNS", false)
+	cfg.DDNSSources = getEnvAsList("DDNS_SOURCES", []string{"stun:stun.cloudflare.com:3478", "https://icanhazip.com", "https://api64.ipify.org"})
+	for _, source := range cfg.DDNSSources {
+		if !strings.HasPrefix(source, "stun:") && !strings.HasPrefix(source, "https://") {
+			return nil, fmt.Errorf("invalid source %q in DDNS_SOURCES (expected stun:host:port or an https:// URL)", source)
+		}
+	}
+	cfg.DDNSFamilies = getEnvAsList("DDNS_FAMILIES", []string{"ipv4", "ipv6"})
+	for _, family := range cfg.DDNSFamilies {
+		if family != "ipv4" && family != "ipv6" {
+			return nil, fmt.Errorf("invalid family %q in DDNS_FAMILIES (expected ipv4 and/or ipv6)", family)
+		}
+	}
+	cfg.DDNSHosts = getEnvAsList("DDNS_HOSTS", nil)
+	cfg.DDNSConfirmations = getEnvAsInt64("DDNS_CONFIRMATIONS", cfg.DDNSConfirmations)
+	if cfg.DDNSConfirmations < 1 {
+		return nil, fmt.Errorf("DDNS_CONFIRMATIONS must be at least 1")
+	}
+	cfg.AccessLog = getEnv("ACCESS_LOG", "off")
+	switch cfg.AccessLog {
+	case "on", "off", "errors-only":
+	default:
+		return nil, fmt.Errorf("invalid ACCESS_LOG %q (expected on, off or errors-only)", cfg.AccessLog)
+	}
+	if v, exists := os.LookupEnv("FLUSH_INTERVAL"); exists {
+		interval, err := discovery.ParseFlushInterval(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FLUSH_INTERVAL %q: %w", v, err)
+		}
+		cfg.FlushInterval = interval
+	}
+	cfg.EarlyHints = getEnvAsBool("EARLY_HINTS", cfg.EarlyHints)
+	cfg.StartingPage = getEnvAsBool("STARTING_PAGE", false)
+	if cfg.LabelFilesDir = getEnv("LABEL_FILES_DIR", ""); cfg.LabelFilesDir != "" && !filepath.IsAbs(cfg.LabelFilesDir) {
+		return nil, fmt.Errorf("LABEL_FILES_DIR must be an absolute path")
+	}
+	if v, exists := os.LookupEnv("UPGRADE_IDLE_TIMEOUT"); exists {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UPGRADE_IDLE_TIMEOUT %q: %w", v, err)
+		}
+		cfg.UpgradeIdleTimeout = d
+	}
+	cfg.CertRetryMaxAttempts = int(getEnvAsInt64("CERT_RETRY_MAX_ATTEMPTS", int64(cfg.CertRetryMaxAttempts)))
+	cfg.CertQuarantineAfter = int(getEnvAsInt64("CERT_QUARANTINE_AFTER", int64(cfg.CertQuarantineAfter)))
+	cfg.CertCacheSize = int(getEnvAsInt64("CERT_CACHE_SIZE", int64(cfg.CertCacheSize)))
+	cfg.CacheMaxBytes = getEnvAsInt64("CACHE_MAX_BYTES", cfg.CacheMaxBytes)
+	cfg.CacheMaxObjectBytes = getEnvAsInt64("CACHE_MAX_OBJECT_BYTES", cfg.CacheMaxObjectBytes)
+	cfg.CoalesceMaxBytes = getEnvAsInt64("COALESCE_MAX_BYTES", cfg.CoalesceMaxBytes)
+	if cfg.CoalesceMaxBytes <= 0 {
+		return nil, fmt.Errorf("COALESCE_MAX_BYTES must be positive")
+	}
+	for key, target := range map[string]*time.Duration{
+		"CACHE_DEFAULT_TTL":             &cfg.CacheDefaultTTL,
+		"CACHE_STALE_WHILE_REVALIDATE":  &cfg.CacheStaleWhileRevalidate,
+		"CACHE_STALE_IF_ERROR":          &cfg.CacheStaleIfError,
+		"CERT_RETRY_BASE_DELAY":         &cfg.CertRetryBaseDelay,
+		"CERT_RETRY_MAX_DELAY":          &cfg.CertRetryMaxDelay,
+		"CERT_QUARANTINE_DURATION":      &cfg.CertQuarantineFor,
+		"CERT_CACHE_NEGATIVE_TTL":       &cfg.CertCacheNegativeTTL,
+		"TARPIT_DELAY":                  &cfg.TarpitDelay,
+		"DISCOVERY_MAX_INTERVAL":        &cfg.DiscoveryMaxInterval,
+		"ACME_PROPAGATION_TIMEOUT":      &cfg.ACMEPropagationTimeout,
+		"ACME_POLLING_INTERVAL":         &cfg.ACMEPollingInterval,
+		"ACME_OBTAIN_TIMEOUT":           &cfg.ACMEObtainTimeout,
+		"BACKEND_DNS_TTL":               &cfg.BackendDNSTTL,
+		"STARTING_RETRY_AFTER":          &cfg.StartingRetryAfter,
+		"ERROR_SPIKE_WINDOW":            &cfg.ErrorSpikeWindow,
+		"PROBE_INTERVAL":                &cfg.ProbeInterval,
+		"PROBE_TIMEOUT":                 &cfg.ProbeTimeout,
+		"DNS_CHECK_INTERVAL":            &cfg.DNSCheckInterval,
+		"DDNS_INTERVAL":                 &cfg.DDNSInterval,
+		"DDNS_TTL":                      &cfg.DDNSTTL,
+		"DISCOVERY_INSPECT_TIMEOUT":     &cfg.DiscoveryInspectTimeout,
+		"ROUTES_STALE_LIMIT":            &cfg.RoutesStaleLimit,
+		"DISCOVERY_FAILURE_MAX_BACKOFF": &cfg.DiscoveryFailureMaxBackoff,
+		"INTERNAL_CA_CERT_LIFETIME":     &cfg.InternalCertLifetime,
+	} {
+		if v, exists := os.LookupEnv(key); exists {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %w", key, v, err)
+			}
+			*target = d
+		}
+	}
+	if cfg.ErrorSpikeWindow < 10*time.Second {
+		return nil, fmt.Errorf("ERROR_SPIKE_WINDOW must be at least 10s")
+	}
+	if cfg.ProbeInterval < 0 || (cfg.ProbeInterval > 0 && cfg.ProbeInterval < 10*time.Second) {
+		return nil, fmt.Errorf("PROBE_INTERVAL must be 0 (off) or at least 10s")
+	}
+	if cfg.DNSCheckInterval < 0 || (cfg.DNSCheckInterval > 0 && cfg.DNSCheckInterval < time.Minute) {
+		return nil, fmt.Errorf("DNS_CHECK_INTERVAL must be 0 (off) or at least 1m")
+	}
+	if cfg.DDNSInterval < 30*time.Second {
+		return nil, fmt.Errorf("DDNS_INTERVAL must be at least 30s")
+	}
+	if cfg.DDNSTTL < 5*time.Minute {
+		return nil, fmt.Errorf("DDNS_TTL must be at least 5m")
+	}
+	if cfg.ProbeTimeout <= 0 {
+		return nil, fmt.Errorf("PROBE_TIMEOUT must be positive")
+	}
+	if cfg.StartingRetryAfter < time.Second {
+		return nil, fmt.Errorf("STARTING_RETRY_AFTER must be at least 1s")
+	}
+	if v, exists := os.LookupEnv("MAX_REQUEST_DURATION"); exists {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAX_REQUEST_DURATION %q: %w", v, err)
+		}
+		cfg.MaxRequestDuration = d
+	}
+	cfg.DeadlineHeader = getEnv("DEADLINE_HEADER", "")
+	if strings.ContainsAny(cfg.DeadlineHeader, " \t:") {
+		return nil, fmt.Errorf("invalid DEADLINE_HEADER %q (expected a header name such as X-Request-Timeout-Ms)", cfg.DeadlineHeader)
+	}
+	cfg.InternalCA = getEnvAsBool("INTERNAL_CA", false)
+	cfg.InternalCAZones = getEnvAsList("INTERNAL_CA_ZONES", cfg.InternalCAZones)
+	if cfg.InternalCA {
+		if len(cfg.InternalCAZones) == 0 {
+			return nil, fmt.Errorf("INTERNAL_CA_ZONES must list at least one zone")
+		}
+		for i, zone := range cfg.InternalCAZones {
+			cfg.InternalCAZones[i] = strings.ToLower(strings.Trim(zone, "."))
+		}
+		if cfg.InternalCertLifetime <= cfg.RenewBefore {
+			return nil, fmt.Errorf("INTERNAL_CA_CERT_LIFETIME must be longer than the %s renewal window", cfg.RenewBefore)
+		}
+	}
+	cfg.TailscaleEnabled = getEnvAsBool("TS_ENABLED", false)
+	cfg.TailscaleHostname = getEnv("TS_HOSTNAME", cfg.TailscaleHostname)
+	cfg.TailscaleAuthKey = getEnv("TS_AUTHKEY", "")
+	cfg.TailscaleStateDir = getEnv("TS_STATE_DIR", cfg.TailscaleStateDir)
+	cfg.TailscaleBackends = getEnvAsBool("TS_DIAL_BACKENDS", false)
 	cfg.SSHUser = getEnv("PODMAN_SSH_USER", cfg.SSHUser)
 	cfg.SSHHost = getEnv("PODMAN_SSH_HOST", "") // Expect host set by Makefile
 	cfg.SSHPort = getEnv("PODMAN_SSH_PORT", "") // Expect port set by Makefile
-	// cfg.SSHIdentityFile = getEnv("PODMAN_SSH_KEY", "") // Removed line
+	if path, ok := findCredential("ssh_key"); ok {
+		cfg.SSHKeyFile = path
+	}
+	cfg.SSHKeyFile = getEnv("PODMAN_SSH_KEY", cfg.SSHKeyFile)
+	if cfg.SSHKeyData, err = decodeSSHKey(getEnv("PODMAN_SSH_KEY_DATA", "")); err != nil {
+		return nil, err
+	}
+	cfg.DNSProvider = getEnv("DNS_PROVIDER", cfg.DNSProvider)
+	cfg.ACMEDNSAPIBase = getEnv("ACMEDNS_API_BASE", "")
+	cfg.ACMEDNSStoragePath = getEnv("ACMEDNS_STORAGE_PATH", cfg.ACMEDNSStoragePath)
+	cfg.ACMEDNSAllowList = getEnvAsList("ACMEDNS_ALLOWLIST", nil)
+	cfg.ACMEDNSHelper = getEnv("ACME_DNS_HELPER", "")
+	cfg.ACMEChallenge = getEnv("ACME_CHALLENGE", "dns-01")
+	cfg.ACMEWebroot = getEnv("ACME_WEBROOT", "")
+	if cfg.ACMEChallenge == "http-01" && cfg.ACMEWebroot == "" {
+		cfg.HTTPAddr = ":80"
+	}
+	cfg.HTTPAddr = getEnv("HTTP_ADDR", cfg.HTTPAddr)
+	if cfg.HTTPAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.HTTPAddr); err != nil {
+			return nil, fmt.Errorf("invalid HTTP_ADDR %q (expected host:port): %w", cfg.HTTPAddr, err)
+		}
+	}
 	cfg.GandiPAT = getEnv("GANDI_PAT", "")
 	cfg.ACMEEmail = getEnv("ACME_EMAIL", "")
 	cfg.GandiZone = getEnv("GANDI_ZONE", "")
 	cfg.ACMEStaging = getEnvAsBool("LEGO_STAGING", cfg.ACMEStaging)
-	// cfg.CertsDir = getEnv("CERTS_DIR", cfg.CertsDir) // Removed
+	cfg.ACMEProfile = getEnv("ACME_PROFILE", "")
+	if cfg.ACMEProfiles, err = loadACMEProfiles(); err != nil {
+		return nil, err
+	}
 
 	// Validate required fields
 	if cfg.SSHHost == "" {
@@ -68,30 +570,403 @@ func LoadConfig() (*Config, error) {
      }
 	*/
 
-	if cfg.GandiPAT == "" {
-		return nil, fmt.Errorf("GANDI_PAT (Personal Access Token) must be set in .env")
+	if len(cfg.Providers) == 0 {
+		return nil, fmt.Errorf("DISCOVERY_PROVIDERS must list at least one provider")
+	}
+	for _, p := range cfg.Providers {
+		if p != "podman" && p != "swarm" && p != "kubernetes" && p != "file" {
+			return nil, fmt.Errorf("unknown discovery provider %q in DISCOVERY_PROVIDERS (expected podman, swarm, kubernetes or file)", p)
+		}
+		if p == "file" && cfg.RoutesFile == "" {
+			return nil, fmt.Errorf("ROUTES_FILE must be set when the file provider is enabled")
+		}
+	}
+
+	if !cfg.PublicListener && !cfg.TailscaleEnabled {
+		return nil, fmt.Errorf("PUBLIC_LISTENER=false requires TS_ENABLED=true, otherwise nothing would be served")
+	}
+	if err := validateListen(cfg.ListenFamily, cfg.ListenAddrs); err != nil {
+		return nil, err
+	}
+	if cfg.ListenReusePort < 0 || cfg.ListenReusePort > 64 {
+		return nil, fmt.Errorf("LISTEN_REUSEPORT must be between 0 and 64")
+	}
+	if cfg.RoutesStaleLimit < 0 {
+		return nil, fmt.Errorf("ROUTES_STALE_LIMIT must not be negative")
+	}
+	if cfg.RouteRemovalMisses < 1 {
+		return nil, fmt.Errorf("ROUTE_REMOVAL_MISSES must be at least 1")
+	}
+	if cfg.DiscoveryConcurrency < 1 || cfg.DiscoveryInspectTimeout <= 0 {
+		return nil, fmt.Errorf("DISCOVERY_CONCURRENCY and DISCOVERY_INSPECT_TIMEOUT must be positive")
+	}
+	if cfg.BackendDNSTTL <= 0 {
+		return nil, fmt.Errorf("BACKEND_DNS_TTL must be positive")
+	}
+	if cfg.BandwidthLimitIn < 0 || cfg.BandwidthLimitOut < 0 {
+		return nil, fmt.Errorf("BANDWIDTH_LIMIT_IN and BANDWIDTH_LIMIT_OUT must not be negative")
+	}
+	if cfg.TailscaleBackends && !cfg.TailscaleEnabled {
+		return nil, fmt.Errorf("TS_DIAL_BACKENDS requires TS_ENABLED=true")
+	}
+	if cfg.TailscaleBackends && cfg.BackendViaSSH {
+		return nil, fmt.Errorf("TS_DIAL_BACKENDS and BACKEND_VIA_SSH are mutually exclusive")
+	}
+
+	if cfg.CertRetryBaseDelay <= 0 || cfg.CertRetryMaxDelay < cfg.CertRetryBaseDelay {
+		return nil, fmt.Errorf("CERT_RETRY_BASE_DELAY must be positive and not exceed CERT_RETRY_MAX_DELAY")
+	}
+	if cfg.CertCacheSize < 0 || cfg.CertCacheNegativeTTL < 0 {
+		return nil, fmt.Errorf("CERT_CACHE_SIZE and CERT_CACHE_NEGATIVE_TTL must not be negative")
+	}
+
+	switch {
+	case cfg.ACMEChallenge == "http-01":
+		if cfg.ACMEWebroot != "" && !strings.HasPrefix(cfg.ACMEWebroot, "/") {
+			return nil, fmt.Errorf("ACME_WEBROOT must be an absolute path on the podman host")
+		}
+		if cfg.ACMEWebroot == "" && cfg.HTTPAddr == "" {
+			return nil, fmt.Errorf("ACME_CHALLENGE=http-01 needs HTTP_ADDR (port 80 by default) to answer challenges, or ACME_WEBROOT")
+		}
+	case cfg.ACMEChallenge != "dns-01":
+		return nil, fmt.Errorf("unknown ACME_CHALLENGE %q (expected dns-01 or http-01)", cfg.ACMEChallenge)
+	}
+	switch {
+	case cfg.ACMEChallenge == "http-01":
+		// DNS_PROVIDER is not used
+	case cfg.DNSProvider == "gandi":
+		if cfg.GandiPAT == "" {
+			return nil, fmt.Errorf("GANDI_PAT (Personal Access Token) must be set in .env")
+		}
+		if cfg.GandiZone == "" {
+			return nil, fmt.Errorf("GANDI_ZONE environment variable must be set (in .env)")
+		}
+	case cfg.DNSProvider == "acmedns":
+		if cfg.ACMEDNSAPIBase == "" {
+			return nil, fmt.Errorf("ACMEDNS_API_BASE must be set when DNS_PROVIDER=acmedns")
+		}
+	case cfg.DNSProvider == "exec":
+		if cfg.ACMEDNSHelper == "" {
+			return nil, fmt.Errorf("ACME_DNS_HELPER must be set when DNS_PROVIDER=exec")
+		}
+	default:
+		return nil, fmt.Errorf("unknown DNS_PROVIDER %q (expected gandi, acmedns or exec)", cfg.DNSProvider)
+	}
+	switch {
+	case !cfg.DDNS:
+	case cfg.DNSProvider == "gandi":
+		if cfg.GandiPAT == "" || cfg.GandiZone == "" {
+			return nil, fmt.Errorf("GANDI_PAT and GANDI_ZONE must be set for DDNS with DNS_PROVIDER=gandi")
+		}
+	case cfg.DNSProvider == "exec":
+		if cfg.ACMEDNSHelper == "" {
+			return nil, fmt.Errorf("ACME_DNS_HELPER must be set for DDNS with DNS_PROVIDER=exec")
+		}
+	default:
+		return nil, fmt.Errorf("DDNS needs DNS_PROVIDER=gandi or exec, %s cannot update address records", cfg.DNSProvider)
+	}
+	if cfg.ACMEPropagationTimeout < 0 || cfg.ACMEPollingInterval < 0 || cfg.ACMEObtainTimeout < 0 {
+		return nil, fmt.Errorf("ACME_PROPAGATION_TIMEOUT, ACME_POLLING_INTERVAL and ACME_OBTAIN_TIMEOUT must not be negative")
+	}
+	if cfg.ACMEObtainTimeout > 0 && cfg.ACMEPropagationTimeout >= cfg.ACMEObtainTimeout {
+		return nil, fmt.Errorf("ACME_PROPAGATION_TIMEOUT must be shorter than ACME_OBTAIN_TIMEOUT")
 	}
 	if cfg.ACMEEmail == "" {
 		return nil, fmt.Errorf("ACME_EMAIL environment variable must be set (in .env)")
 	}
-	if cfg.GandiZone == "" {
-		return nil, fmt.Errorf("GANDI_ZONE environment variable must be set (in .env)")
+
+	key, err := loadEncryptionKey()
+	if err != nil {
+		return nil, err
 	}
+	cfg.CertEncryptionKey = key
 
-	/* // Removed certs dir check
 	// Ensure certs directory exists
 	if err := os.MkdirAll(cfg.CertsDir, 0700); err != nil {
+		if info, statErr := os.Stat(cfg.CertsDir); statErr != nil || !info.IsDir() {
+			return nil, fmt.Errorf("failed to create CERTS_DIR %s: %w", cfg.CertsDir, err)
+		}
 		// Log warning but allow continuation, maybe permissions are fixed later
 		slog.Warn("Could not create certs directory", "path", cfg.CertsDir, "error", err)
 	}
-	*/
 
 	slog.Info("Configuration loaded.")
 	return cfg, nil
 }
 
-func getEnv(key, fallback string) string {
+// Address families for the public listener, set with LISTEN_FAMILY.
+const (
+	ListenDual = "dual" // One dual-stack socket, or IPv4 only on hosts without IPv6
+	ListenIPv4 = "ipv4"
+	ListenIPv6 = "ipv6" // IPv6 only, IPv4 clients are not accepted
+)
+
+// validateListen checks LISTEN_FAMILY and that LISTEN_ADDRS are IPs of that family.
+func validateListen(family string, addrs []string) error {
+	if family != ListenDual && family != ListenIPv4 && family != ListenIPv6 {
+		return fmt.Errorf("unknown LISTEN_FAMILY %q (expected dual, ipv4 or ipv6)", family)
+	}
+	for _, a := range addrs {
+		ip, err := netip.ParseAddr(a)
+		if err != nil || ip.Zone() != "" {
+			return fmt.Errorf("invalid address %q in LISTEN_ADDRS (expected an IPv4 or IPv6 address without port)", a)
+		}
+		if family == ListenIPv4 && !ip.Is4() || family == ListenIPv6 && ip.Is4() {
+			return fmt.Errorf("address %q in LISTEN_ADDRS does not match LISTEN_FAMILY=%s", a, family)
+		}
+	}
+	return nil
+}
+
+// Listener is an extra HTTPS listener profile from LISTENERS. It serves only
+// routes whose exposed-listener label names it, with its own TLS policy.
+type Listener struct {
+	Name         string
+	Addr         string
+	ClientCAFile string // Require client certificates signed by this CA bundle (mTLS)
+	MinTLS       uint16 // tls.VersionTLS12 or tls.VersionTLS13
+}
+
+// loadListeners parses LISTENERS entries ("internal=:8443") and reads each
+// profile's LISTENER_<NAME>_CLIENT_CA and LISTENER_<NAME>_MIN_TLS.
+func loadListeners(specs []string) ([]Listener, error) {
+	var listeners []Listener
+	seen := map[string]bool{}
+	for _, spec := range specs {
+		name, addr, ok := strings.Cut(spec, "=")
+		if !ok || addr == "" || !validListenerName(name) {
+			return nil, fmt.Errorf("invalid LISTENERS entry %q (expected name=address, e.g. internal=:8443)", spec)
+		}
+		if name == "public" || seen[name] {
+			return nil, fmt.Errorf("duplicate or reserved listener name %q in LISTENERS", name)
+		}
+		seen[name] = true
+		prefix := "LISTENER_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		l := Listener{Name: name, Addr: addr, ClientCAFile: getEnv(prefix+"CLIENT_CA", ""), MinTLS: tls.VersionTLS12}
+		switch v := getEnv(prefix+"MIN_TLS", "1.2"); v {
+		case "1.2":
+		case "1.3":
+			l.MinTLS = tls.VersionTLS13
+		default:
+			return nil, fmt.Errorf("invalid %sMIN_TLS %q (expected 1.2 or 1.3)", prefix, v)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// validListenerName accepts lowercase letters, digits and dashes.
+func validListenerName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// secretEnvVars can also be read from the file named by the same variable with
+// a _FILE suffix (GANDI_PAT_FILE=/run/secrets/gandi_pat), the docker and
+// podman secrets convention. Without either, a credential named after the
+// variable in lower case (gandi_pat) is used when present, unless the
+// SECRETS_BACKEND has the variable.
+var secretEnvVars = []string{
+	"GANDI_PAT",
+	"ACME_EMAIL",
+	"ACMEDNS_API_BASE",
+	"TS_AUTHKEY",
+	"NOTIFY_URL",
+	"CERT_ENCRYPTION_KEY",
+	"VAULT_TOKEN",
+	"PODMAN_SSH_KEY_DATA",
+	"ADMIN_TOKEN",
+	"ADMIN_READ_TOKEN",
+	"TUNNEL_TOKENS",
+}
+
+// secretsBackendTimeout bounds fetching the secrets at startup.
+const secretsBackendTimeout = 30 * time.Second
+
+// secretFiles holds the values read from secret files, see lookupEnv.
+var secretFiles = map[string]string{}
+
+// credentialDirs lists where credentials are looked up, in order: the
+// directory of systemd LoadCredential= (CREDENTIALS_DIRECTORY), then the
+// mount point of podman secrets.
+func credentialDirs() []string {
+	var dirs []string
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	return append(dirs, "/run/secrets")
+}
+
+// findCredential returns the path of the credential name, if one is present.
+func findCredential(name string) (string, bool) {
+	for _, dir := range credentialDirs() {
+		if path := filepath.Join(dir, name); fileExists(path) {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// loadSecretFiles reads the secret files named by the _FILE variables, or
+// the credentials of secret variables that are not set, then the secrets
+// backend.
+func loadSecretFiles(keys []string) error {
+	credentials := make(map[string]bool)
+	for _, key := range keys {
+		path, ok := os.LookupEnv(key + "_FILE")
+		_, set := os.LookupEnv(key)
+		switch {
+		case ok && path != "" && set:
+			return fmt.Errorf("%s and %s_FILE are mutually exclusive", key, key)
+		case ok && path != "":
+		case set:
+			continue
+		default:
+			if path, ok = findCredential(strings.ToLower(key)); !ok {
+				continue
+			}
+			credentials[key] = true
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s_FILE: %w", key, err)
+		}
+		secretFiles[key] = strings.TrimSpace(string(data))
+	}
+	return loadSecretsBackend(keys, credentials)
+}
+
+// loadSecretsBackend fetches the secrets of SECRETS_BACKEND (Vault or a SOPS
+// file). They fill the secret variables that are not set, taking precedence
+// over credentials.
+func loadSecretsBackend(keys []string, credentials map[string]bool) error {
+	name := getEnv("SECRETS_BACKEND", "")
+	if name == "" {
+		return nil
+	}
+	backend, err := secrets.New(name, secrets.Options{
+		VaultAddr:  getEnv("VAULT_ADDR", ""),
+		VaultToken: getEnv("VAULT_TOKEN", ""),
+		VaultPath:  getEnv("SECRETS_VAULT_PATH", ""),
+		SOPSFile:   getEnv("SECRETS_SOPS_FILE", ""),
+		SOPSBinary: getEnv("SOPS_COMMAND", ""),
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretsBackendTimeout)
+	defer cancel()
+	values, err := backend.Fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch secrets from the %s backend: %w", backend.Name(), err)
+	}
+	var loaded []string
+	for _, key := range keys {
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+		if _, set := lookupEnv(key); set && !credentials[key] {
+			continue
+		}
+		secretFiles[key] = value
+		loaded = append(loaded, key)
+	}
+	slog.Info("Loaded secrets from backend", "backend", backend.Name(), "keys", loaded)
+	return nil
+}
+
+// lookupEnv returns the environment variable key, or the content of its secret file.
+func lookupEnv(key string) (string, bool) {
 	if value, exists := os.LookupEnv(key); exists {
+		return value, true
+	}
+	value, exists := secretFiles[key]
+	return value, exists
+}
+
+// loadEncryptionKey reads the base64 key for private keys at rest from
+// CERT_ENCRYPTION_KEY (or its secret file, CERT_ENCRYPTION_KEY_FILE).
+func loadEncryptionKey() ([]byte, error) {
+	encoded := getEnv("CERT_ENCRYPTION_KEY", "")
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("cert encryption key must be 32 base64-encoded bytes (e.g. from openssl rand -base64 32)")
+	}
+	return key, nil
+}
+
+// inContainer reports whether rproxy runs in a podman or docker container,
+// which mounts the certs volume at /certs and the SSH key at /ssh/id_rsa.
+func inContainer() bool {
+	for _, marker := range []string{"/run/.containerenv", "/.dockerenv"} {
+		if _, err := os.Stat(marker); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// hostDefaults replaces the container paths with per-user ones, so rproxy runs
+// straight from a checkout (go run ./cmd/rproxy): state goes to
+// $XDG_STATE_HOME/rproxy (~/.local/state/rproxy) and the SSH key is the
+// user's own.
+func hostDefaults(cfg *Config) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		slog.Warn("Cannot find the home directory, keeping container paths", "error", err)
+		return
+	}
+	stateDir := os.Getenv("XDG_STATE_HOME")
+	if !filepath.IsAbs(stateDir) {
+		stateDir = filepath.Join(home, ".local", "state")
+	}
+	cfg.CertsDir = filepath.Join(stateDir, "rproxy")
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		if path := filepath.Join(home, ".ssh", name); fileExists(path) {
+			cfg.SSHKeyFile = path
+			break
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// decodeSSHKey reads PODMAN_SSH_KEY_DATA: a PEM private key, with newlines
+// possibly escaped as \n, or the same base64-encoded.
+func decodeSSHKey(v string) ([]byte, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(v, "-----BEGIN ") {
+		if !strings.Contains(v, "\n") {
+			v = strings.ReplaceAll(v, `\n`, "\n")
+		}
+		return []byte(v + "\n"), nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(v), ""))
+	if err != nil || !strings.HasPrefix(string(key), "-----BEGIN ") {
+		return nil, fmt.Errorf("PODMAN_SSH_KEY_DATA must be a PEM private key, or one encoded in base64")
+	}
+	return key, nil
+}
+
+func getEnv(key, fallback string) string {
+	if value, exists := lookupEnv(key); exists {
 		return value
 	}
 	return fallback
@@ -106,4 +981,30 @@ func getEnvAsBool(key string, fallback bool) bool {
 		slog.Warn("Invalid boolean value for environment variable", "key", key, "value", valueStr, "error", err, "default", fallback)
 	}
 	return fallback
-} 
\ No newline at end of file
+} 
+
+func getEnvAsInt64(key string, fallback int64) int64 {
+	if valueStr, exists := os.LookupEnv(key); exists {
+		value, err := strconv.ParseInt(valueStr, 10, 64)
+		if err == nil {
+			return value
+		}
+		slog.Warn("Invalid integer value for environment variable", "key", key, "value", valueStr, "error", err, "default", fallback)
+	}
+	return fallback
+}
+
+func getEnvAsList(key string, fallback []string) []string {
+	valueStr, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	var values []string
+	for _, v := range strings.Split(valueStr, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// DomainAllowed reports whether rproxy may route host and obtain certificates
+// for it under DOMAIN_ALLOWLIST and DOMAIN_DENYLIST. The deny list wins; an
+// empty allow list allows every host not denied. Entries are zones, covering
+// the name and all names under it, or patterns whose labels may use * (one
+// label each), e.g. "*.preview.example.com".
+func (c *Config) DomainAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, entry := range c.DomainDenyList {
+		if domainMatches(entry, host) {
+			return false
+		}
+	}
+	if len(c.DomainAllowList) == 0 {
+		return true
+	}
+	for _, entry := range c.DomainAllowList {
+		if domainMatches(entry, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainMatches reports whether host, possibly a wildcard route name like
+// "*.example.com", falls under a list entry.
+func domainMatches(entry, host string) bool {
+	if !strings.Contains(entry, "*") {
+		zoneHost := strings.TrimPrefix(host, "*.")
+		return zoneHost == entry || strings.HasSuffix(zoneHost, "."+entry)
+	}
+	patternLabels := strings.Split(entry, ".")
+	hostLabels := strings.Split(host, ".")
+	if len(patternLabels) != len(hostLabels) {
+		return false
+	}
+	for i, label := range patternLabels {
+		if ok, _ := path.Match(label, hostLabels[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// loadDomainList reads a DOMAIN_ALLOWLIST or DOMAIN_DENYLIST.
+func loadDomainList(key string) ([]string, error) {
+	var list []string
+	for _, entry := range getEnvAsList(key, nil) {
+		entry = strings.ToLower(strings.TrimSuffix(entry, "."))
+		if _, err := path.Match(entry, ""); err != nil || strings.Contains(entry, "..") || strings.HasPrefix(entry, ".") {
+			return nil, fmt.Errorf("invalid entry %q in %s", entry, key)
+		}
+		list = append(list, entry)
+	}
+	return list, nil
+}
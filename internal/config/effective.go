@@ -0,0 +1,87 @@
+package config
+
+import (
+	"log/slog"
+	"reflect"
+	"time"
+)
+
+// redacted replaces the value of a secret that is set.
+const redacted = "[redacted]"
+
+// secretFields are the fields of Config, and of the structs it holds, whose
+// values never leave the process. NOTIFY_URL is one because webhook URLs
+// usually embed their token.
+var secretFields = map[string]bool{
+	"AdminToken":        true,
+	"AdminReadToken":    true,
+	"TailscaleAuthKey":  true,
+	"SSHKeyData":        true,
+	"GandiPAT":          true,
+	"NotifyURL":         true,
+	"CertEncryptionKey": true,
+	"TunnelTokens":      true,
+}
+
+// Effective returns the resolved configuration (defaults, environment,
+// secret files and backends) by field name, with secrets redacted. Unset
+// secrets stay empty, so it still shows whether they are configured.
+func (c *Config) Effective() map[string]any {
+	values := make(map[string]any)
+	for _, attr := range effectiveAttrs(reflect.ValueOf(*c)) {
+		values[attr.Key] = attr.Value.Any()
+	}
+	return values
+}
+
+// LogValue logs the configuration like Effective, in field order.
+func (c *Config) LogValue() slog.Value {
+	return slog.GroupValue(effectiveAttrs(reflect.ValueOf(*c))...)
+}
+
+// effectiveAttrs returns the exported fields of struct v.
+func effectiveAttrs(v reflect.Value) []slog.Attr {
+	var attrs []slog.Attr
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		value := v.Field(i)
+		if secretFields[field.Name] {
+			attrs = append(attrs, slog.String(field.Name, redact(value)))
+			continue
+		}
+		attrs = append(attrs, slog.Any(field.Name, effectiveValue(value)))
+	}
+	return attrs
+}
+
+func redact(v reflect.Value) string {
+	if v.Len() == 0 {
+		return ""
+	}
+	return redacted
+}
+
+// effectiveValue converts v for printing: durations as text, structs (listener
+// and tenant profiles) as maps with their own secrets redacted.
+func effectiveValue(v reflect.Value) any {
+	switch {
+	case v.Type() == reflect.TypeFor[time.Duration]():
+		return time.Duration(v.Int()).String()
+	case v.Kind() == reflect.Struct:
+		values := make(map[string]any)
+		for _, attr := range effectiveAttrs(v) {
+			values[attr.Key] = attr.Value.Any()
+		}
+		return values
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		list := make([]any, v.Len())
+		for i := range v.Len() {
+			list[i] = effectiveValue(v.Index(i))
+		}
+		return list
+	}
+	return v.Interface()
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Tenant is a user of a shared rproxy from TENANTS. Containers join a tenant
+// with the exposed-tenant label; their routes must stay inside the tenant's
+// zones and quotas.
+type Tenant struct {
+	Name       string
+	Zones      []string // Domains the tenant's routes may use, subdomains included
+	ACMEEmail  string   // Own ACME account, empty to share the global one
+	MaxRoutes  int64    // 0 for unlimited
+	MaxCerts   int64    // Names with issued certificates, 0 for unlimited
+	AdminToken string   // Bearer token for the tenant's part of the admin API
+}
+
+// Owns reports whether host (an FQDN or a wildcard) is inside the tenant's zones.
+func (t *Tenant) Owns(host string) bool {
+	host = strings.TrimPrefix(host, "*.")
+	for _, zone := range t.Zones {
+		if host == zone || strings.HasSuffix(host, "."+zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tenant returns the tenant called name, nil if there is none.
+func (c *Config) Tenant(name string) *Tenant {
+	for i := range c.Tenants {
+		if c.Tenants[i].Name == name {
+			return &c.Tenants[i]
+		}
+	}
+	return nil
+}
+
+// TenantFor returns the tenant whose zones contain host, nil if none does.
+// Nested zones go to the tenant with the longest match.
+func (c *Config) TenantFor(host string) *Tenant {
+	host = strings.TrimPrefix(host, "*.")
+	var best *Tenant
+	bestLen := 0
+	for i := range c.Tenants {
+		for _, zone := range c.Tenants[i].Zones {
+			if (host == zone || strings.HasSuffix(host, "."+zone)) && len(zone) > bestLen {
+				best, bestLen = &c.Tenants[i], len(zone)
+			}
+		}
+	}
+	return best
+}
+
+// tenantPrefix is the prefix of a tenant's settings, TENANT_<NAME>_.
+func tenantPrefix(name string) string {
+	return "TENANT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+}
+
+// tenantSecretVars lists the secret variables of the tenants named in TENANTS,
+// so their tokens can come from files like the other secrets.
+func tenantSecretVars() []string {
+	var keys []string
+	for _, name := range getEnvAsList("TENANTS", nil) {
+		keys = append(keys, tenantPrefix(name)+"ADMIN_TOKEN")
+	}
+	return keys
+}
+
+// loadTenants parses TENANTS (alice,bob) and each tenant's TENANT_<NAME>_ZONES,
+// _ACME_EMAIL, _MAX_ROUTES, _MAX_CERTS and _ADMIN_TOKEN.
+func loadTenants(names []string) ([]Tenant, error) {
+	var tenants []Tenant
+	zoneOwner := map[string]string{}
+	tokens := map[string]bool{}
+	for _, name := range names {
+		if !validListenerName(name) {
+			return nil, fmt.Errorf("invalid tenant name %q in TENANTS (lowercase letters, digits and dashes)", name)
+		}
+		prefix := tenantPrefix(name)
+		t := Tenant{
+			Name:       name,
+			ACMEEmail:  getEnv(prefix+"ACME_EMAIL", ""),
+			MaxRoutes:  getEnvAsInt64(prefix+"MAX_ROUTES", 0),
+			MaxCerts:   getEnvAsInt64(prefix+"MAX_CERTS", 0),
+			AdminToken: getEnv(prefix+"ADMIN_TOKEN", ""),
+		}
+		for _, zone := range getEnvAsList(prefix+"ZONES", nil) {
+			zone = strings.ToLower(strings.Trim(zone, "."))
+			if owner, taken := zoneOwner[zone]; taken {
+				return nil, fmt.Errorf("zone %s is assigned to tenants %s and %s", zone, owner, name)
+			}
+			zoneOwner[zone] = name
+			t.Zones = append(t.Zones, zone)
+		}
+		if len(t.Zones) == 0 {
+			return nil, fmt.Errorf("%sZONES must list the tenant's domains", prefix)
+		}
+		if t.MaxRoutes < 0 || t.MaxCerts < 0 {
+			return nil, fmt.Errorf("%sMAX_ROUTES and %sMAX_CERTS must not be negative", prefix, prefix)
+		}
+		if t.AdminToken != "" {
+			if tokens[t.AdminToken] {
+				return nil, fmt.Errorf("tenants must not share an admin token (%sADMIN_TOKEN)", prefix)
+			}
+			tokens[t.AdminToken] = true
+		}
+		for _, other := range tenants {
+			if other.Name == name {
+				return nil, fmt.Errorf("duplicate tenant %q in TENANTS", name)
+			}
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, nil
+}
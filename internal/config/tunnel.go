@@ -0,0 +1,26 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// loadTunnelTokens reads TUNNEL_TOKENS, the FQDNs published by tunnel agents
+// and the token each agent authenticates with, e.g.
+// "app.example.com=s3cret,nas.example.com=0ther".
+func loadTunnelTokens() (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, entry := range getEnvAsList("TUNNEL_TOKENS", nil) {
+		fqdn, token, ok := strings.Cut(entry, "=")
+		fqdn = strings.ToLower(strings.Trim(strings.TrimSpace(fqdn), "."))
+		token = strings.TrimSpace(token)
+		if !ok || fqdn == "" || token == "" || strings.Contains(fqdn, "*") {
+			return nil, fmt.Errorf("invalid entry in TUNNEL_TOKENS for %q, expected fqdn=token", fqdn)
+		}
+		if len(token) < 16 {
+			return nil, fmt.Errorf("TUNNEL_TOKENS token for %s is too short, use at least 16 characters", fqdn)
+		}
+		tokens[fqdn] = token
+	}
+	return tokens, nil
+}
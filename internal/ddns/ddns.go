@@ -0,0 +1,237 @@
+// Package ddns keeps DNS records pointing at a host whose public address
+// changes, such as a home connection: it detects the current public IPv4 and
+// IPv6 addresses with STUN or HTTPS echo services and updates the A and AAAA
+// records of the published names through the DNS provider.
+package ddns
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"rproxy/internal/config"
+	"rproxy/internal/events"
+	"rproxy/internal/metrics"
+	"rproxy/internal/sshclient"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	publicAddress = metrics.NewGauge("rproxy_public_ip_info",
+		"The detected public address by family, always 1.", "family", "address")
+	detectFailures = metrics.NewCounter("rproxy_public_ip_detect_failures_total",
+		"Public address detections that got no usable answer, by family and source.", "family", "source")
+	recordUpdates = metrics.NewCounter("rproxy_ddns_updates_total",
+		"DNS record updates by result (ok, failed).", "result")
+)
+
+// Updater detects the public addresses every DDNS_INTERVAL and keeps the
+// records of the published names pointing at them. A changed address is
+// only trusted once DDNS_CONFIRMATIONS detections in a row agree, so a
+// flapping source or a short failover does not rewrite every record.
+type Updater struct {
+	sources       []string
+	interval      time.Duration
+	confirmations int
+	hosts         []string // DDNS_HOSTS, nil for the published names
+	records       recordUpdater
+
+	mu       sync.Mutex
+	families []*family
+}
+
+// family is the state of one address family.
+type family struct {
+	name       string // ipv4 or ipv6
+	recordType string // A or AAAA
+
+	addr      netip.Addr // Confirmed public address, invalid until detected
+	candidate netip.Addr // A different address seen in the latest detections
+	seen      int        // Detections in a row that returned candidate
+
+	updated map[string]netip.Addr // Address each name's record was set to
+	failed  map[string]netip.Addr // Address a name's update last failed for, reported once
+}
+
+// New returns nil when DDNS is off.
+func New(cfg *config.Config, ssh *sshclient.Client) *Updater {
+	if !cfg.DDNS {
+		return nil
+	}
+	u := &Updater{
+		sources:       cfg.DDNSSources,
+		interval:      cfg.DDNSInterval,
+		confirmations: int(cfg.DDNSConfirmations),
+		hosts:         cfg.DDNSHosts,
+	}
+	switch cfg.DNSProvider {
+	case "exec":
+		u.records = &execUpdater{ssh: ssh, helper: cfg.ACMEDNSHelper}
+	default:
+		u.records = &gandiUpdater{
+			token:  cfg.GandiPAT,
+			zone:   cfg.GandiZone,
+			ttl:    int(cfg.DDNSTTL.Seconds()),
+			client: &http.Client{Timeout: 30 * time.Second},
+		}
+	}
+	for _, name := range cfg.DDNSFamilies {
+		f := &family{name: name, recordType: "A", updated: make(map[string]netip.Addr), failed: make(map[string]netip.Addr)}
+		if name == "ipv6" {
+			f.recordType = "AAAA"
+		}
+		u.families = append(u.families, f)
+	}
+	return u
+}
+
+// Addrs returns the confirmed public addresses, none before the first
+// detection or with a nil Updater.
+func (u *Updater) Addrs() []netip.Addr {
+	if u == nil {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var addrs []netip.Addr
+	for _, f := range u.families {
+		if f.addr.IsValid() {
+			addrs = append(addrs, f.addr)
+		}
+	}
+	return addrs
+}
+
+// Run detects and updates every interval, and sets the records of names as
+// soon as they are published, until ctx is done. published lists the names
+// served on the public listener.
+func (u *Updater) Run(ctx context.Context, published func() []string) {
+	if u == nil {
+		return
+	}
+	hosts := published
+	if u.hosts != nil {
+		hosts = func() []string { return u.hosts }
+	}
+	added, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+
+	slog.Info("DDNS: Keeping DNS records at the public address", "interval", u.interval, "sources", u.sources)
+	u.detectAll(ctx)
+	u.sync(ctx, hosts())
+	for {
+		select {
+		case <-ticker.C:
+			u.detectAll(ctx)
+			u.sync(ctx, hosts())
+		case ev := <-added:
+			if ev.Type == events.RouteAdded && u.hosts == nil {
+				u.sync(ctx, hosts())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// detectAll asks the sources in order for each family's address until one
+// answers, and confirms changes.
+func (u *Updater) detectAll(ctx context.Context) {
+	for _, f := range u.families {
+		var ip netip.Addr
+		for _, source := range u.sources {
+			var err error
+			if ip, err = detect(ctx, source, f.name); err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			detectFailures.Inc(f.name, source)
+			slog.Debug("DDNS: Source gave no public address", "family", f.name, "source", source, "error", err)
+		}
+		if !ip.IsValid() {
+			if f.addr.IsValid() {
+				slog.Warn("DDNS: No source answered, keeping the last public address", "family", f.name, "address", f.addr)
+			}
+			continue
+		}
+		u.observe(f, ip)
+	}
+}
+
+// observe records a detection of ip and adopts it once confirmed.
+func (u *Updater) observe(f *family, ip netip.Addr) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if ip == f.addr {
+		f.candidate, f.seen = netip.Addr{}, 0
+		return
+	}
+	if ip == f.candidate {
+		f.seen++
+	} else {
+		f.candidate, f.seen = ip, 1
+	}
+	if f.addr.IsValid() && f.seen < u.confirmations {
+		slog.Info("DDNS: Public address may have changed, waiting for confirmation", "family", f.name, "address", ip, "seen", f.seen)
+		return
+	}
+
+	old := f.addr
+	f.addr, f.candidate, f.seen = ip, netip.Addr{}, 0
+	publicAddress.Set(1, f.name, ip.String())
+	if !old.IsValid() {
+		slog.Info("DDNS: Public address detected", "family", f.name, "address", ip)
+		return
+	}
+	publicAddress.Delete(f.name, old.String())
+	slog.Warn("DDNS: Public address changed", "family", f.name, "old", old, "new", ip)
+	events.PublishDetails(events.PublicIPChanged, f.name, fmt.Sprintf("public address changed from %s to %s", old, ip),
+		map[string]any{"family": f.name, "old": old.String(), "new": ip.String()})
+}
+
+// sync updates the records of hosts that do not point at the confirmed
+// addresses yet. Failed updates are retried on the next call.
+func (u *Updater) sync(ctx context.Context, hosts []string) {
+	for _, f := range u.families {
+		u.mu.Lock()
+		addr := f.addr
+		u.mu.Unlock()
+		if !addr.IsValid() {
+			continue
+		}
+		for _, fqdn := range hosts {
+			if f.updated[fqdn] == addr || !u.records.manages(fqdn) {
+				continue
+			}
+			if err := u.records.update(ctx, fqdn, f.recordType, addr); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				recordUpdates.Inc("failed")
+				slog.Error("DDNS: Failed to update DNS record", "fqdn", fqdn, "type", f.recordType, "address", addr, "error", err)
+				if f.failed[fqdn] != addr {
+					f.failed[fqdn] = addr
+					events.PublishDetails(events.DDNSFailed, fqdn, fmt.Sprintf("failed to point the %s record at %s: %v", f.recordType, addr, err),
+						map[string]any{"fqdn": fqdn, "type": f.recordType, "address": addr.String(), "error": err.Error()})
+				}
+				continue
+			}
+			recordUpdates.Inc("ok")
+			slog.Info("DDNS: Updated DNS record", "fqdn", fqdn, "type", f.recordType, "address", addr)
+			f.updated[fqdn] = addr
+			delete(f.failed, fqdn)
+		}
+		for fqdn := range f.updated {
+			if !slices.Contains(hosts, fqdn) {
+				delete(f.updated, fqdn) // Set again if the name comes back
+			}
+		}
+	}
+}
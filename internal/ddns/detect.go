@@ -0,0 +1,172 @@
+package ddns
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// detectTimeout bounds one question to one source.
+const detectTimeout = 10 * time.Second
+
+// detect asks source for the public address this host connects from over
+// family ("ipv4" or "ipv6"). source is "stun:host:port" or an HTTPS URL
+// answering with the address as plain text.
+func detect(ctx context.Context, source, family string) (netip.Addr, error) {
+	ctx, cancel := context.WithTimeout(ctx, detectTimeout)
+	defer cancel()
+	suffix := "4"
+	if family == "ipv6" {
+		suffix = "6"
+	}
+
+	var ip netip.Addr
+	var err error
+	if server, ok := strings.CutPrefix(source, "stun:"); ok {
+		ip, err = stunBinding(ctx, "udp"+suffix, server)
+	} else {
+		ip, err = echo(ctx, "tcp"+suffix, source)
+	}
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	ip = ip.Unmap()
+	if ip.Is4() != (family == "ipv4") || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return netip.Addr{}, fmt.Errorf("%s is not a public %s address", ip, family)
+	}
+	return ip, nil
+}
+
+// echo fetches url over network (tcp4 or tcp6) and parses the body as an IP.
+func echo(ctx context.Context, network, url string) (netip.Addr, error) {
+	var dialer net.Dialer
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		DisableKeepAlives: true,
+	}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	req.Header.Set("User-Agent", "rproxy-ddns/1")
+	resp, err := client.Do(req)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return netip.Addr{}, fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	ip, err := netip.ParseAddr(string(bytes.TrimSpace(body)))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("%s did not answer with an address: %w", url, err)
+	}
+	return ip, nil
+}
+
+// STUN (RFC 8489) message constants.
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingSuccess  = 0x0101
+	stunMagicCookie     = 0x2112A442
+	stunMappedAddr      = 0x0001
+	stunXORMappedAddr   = 0x0020
+	stunHeaderLen       = 20
+	stunFamilyIPv4      = 0x01
+	stunFamilyIPv6      = 0x02
+	stunMaxMessageBytes = 1500
+)
+
+// stunBinding sends a STUN binding request to server over network (udp4 or
+// udp6) and returns the address the server saw the request come from.
+func stunBinding(ctx context.Context, network, server string) (netip.Addr, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := make([]byte, stunHeaderLen)
+	binary.BigEndian.PutUint16(req[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	rand.Read(req[8:stunHeaderLen]) // Transaction ID
+	if _, err := conn.Write(req); err != nil {
+		return netip.Addr{}, err
+	}
+
+	buf := make([]byte, stunMaxMessageBytes)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		msg := buf[:n]
+		if n < stunHeaderLen || !bytes.Equal(msg[8:stunHeaderLen], req[8:stunHeaderLen]) {
+			continue // Not the answer to this request
+		}
+		if binary.BigEndian.Uint16(msg[0:]) != stunBindingSuccess {
+			return netip.Addr{}, fmt.Errorf("STUN server %s refused the binding request", server)
+		}
+		return parseSTUNAddr(msg)
+	}
+}
+
+// parseSTUNAddr returns the (XOR-)MAPPED-ADDRESS of a binding response.
+func parseSTUNAddr(msg []byte) (netip.Addr, error) {
+	length := int(binary.BigEndian.Uint16(msg[2:]))
+	attrs := msg[stunHeaderLen:min(stunHeaderLen+length, len(msg))]
+	var mapped netip.Addr
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:])
+		size := int(binary.BigEndian.Uint16(attrs[2:]))
+		if len(attrs) < 4+size {
+			break
+		}
+		value := attrs[4 : 4+size]
+		attrs = attrs[min(4+(size+3)&^3, len(attrs)):] // Values are padded to 4 bytes
+
+		if (typ != stunXORMappedAddr && typ != stunMappedAddr) || len(value) < 8 {
+			continue
+		}
+		var addr []byte
+		switch {
+		case value[1] == stunFamilyIPv4 && len(value) >= 8:
+			addr = bytes.Clone(value[4:8])
+		case value[1] == stunFamilyIPv6 && len(value) >= 20:
+			addr = bytes.Clone(value[4:20])
+		default:
+			continue
+		}
+		if typ == stunXORMappedAddr {
+			key := msg[4:stunHeaderLen] // Magic cookie, then the transaction ID
+			for i := range addr {
+				addr[i] ^= key[i]
+			}
+			ip, _ := netip.AddrFromSlice(addr)
+			return ip, nil
+		}
+		mapped, _ = netip.AddrFromSlice(addr) // Used if there is no XOR-MAPPED-ADDRESS
+	}
+	if !mapped.IsValid() {
+		return netip.Addr{}, fmt.Errorf("STUN response carries no mapped address")
+	}
+	return mapped, nil
+}
@@ -0,0 +1,92 @@
+package ddns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"rproxy/internal/sshclient"
+	"strings"
+	"time"
+)
+
+// recordUpdater points the A or AAAA record of a name at an address.
+type recordUpdater interface {
+	// manages reports whether fqdn is in a zone the updater can change.
+	manages(fqdn string) bool
+	update(ctx context.Context, fqdn, recordType string, ip netip.Addr) error
+}
+
+// gandiAPI is the LiveDNS API base URL.
+const gandiAPI = "https://api.gandi.net/v5/livedns"
+
+// gandiUpdater replaces records in GANDI_ZONE through the LiveDNS API, with
+// the token DNS-01 challenges use.
+type gandiUpdater struct {
+	token  string
+	zone   string
+	ttl    int // Seconds, LiveDNS accepts 300 and more
+	client *http.Client
+}
+
+func (g *gandiUpdater) manages(fqdn string) bool {
+	return fqdn == g.zone || strings.HasSuffix(fqdn, "."+g.zone)
+}
+
+func (g *gandiUpdater) update(ctx context.Context, fqdn, recordType string, ip netip.Addr) error {
+	name := "@"
+	if fqdn != g.zone {
+		name = strings.TrimSuffix(fqdn, "."+g.zone)
+	}
+	body, err := json.Marshal(map[string]any{"rrset_values": []string{ip.String()}, "rrset_ttl": g.ttl})
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("%s/domains/%s/records/%s/%s", gandiAPI, url.PathEscape(g.zone), url.PathEscape(name), recordType)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+g.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("LiveDNS answered %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// helperTimeout bounds one run of ACME_DNS_HELPER.
+const helperTimeout = 2 * time.Minute
+
+// execUpdater runs ACME_DNS_HELPER on the podman host, like DNS-01 challenges
+// with DNS_PROVIDER=exec, with the action "update":
+//
+//	helper update app.example.com. A 203.0.113.10
+//
+// It must exit 0 once the record holds only that address.
+type execUpdater struct {
+	ssh    *sshclient.Client
+	helper string
+}
+
+func (e *execUpdater) manages(string) bool { return true }
+
+func (e *execUpdater) update(ctx context.Context, fqdn, recordType string, ip netip.Addr) error {
+	ctx, cancel := context.WithTimeout(ctx, helperTimeout)
+	defer cancel()
+	cmd := fmt.Sprintf("%s update %s %s %s", sshclient.Quote(e.helper), sshclient.Quote(fqdn+"."), recordType, ip)
+	if _, err := e.ssh.RunCommandContext(ctx, cmd); err != nil {
+		return fmt.Errorf("ACME_DNS_HELPER update failed: %w", err)
+	}
+	return nil
+}
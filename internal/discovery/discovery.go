@@ -0,0 +1,186 @@
+package discovery
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Labels used by every provider to publish a backend.
+const (
+	LabelExposedPort = "exposed-port"
+	LabelExposedFQDN = "exposed-fqdn"
+	LabelExposedTLS  = "exposed-tls"  // terminate (default), passthrough or reencrypt; "off" means passthrough
+	LabelACME        = "exposed-acme" // "false" serves a manually placed certificate instead of issuing one
+
+	// Extra names served by the same backend
+	LabelFQDNAliases   = "exposed-fqdn-aliases"   // Comma-separated FQDNs served like exposed-fqdn
+	LabelCanonicalHost = "exposed-canonical-host" // "www" or "apex": also serve the other name and redirect it there
+
+	LabelTargetHost = "exposed-target-host" // Dial this hostname instead of the container IP, e.g. the container name on a podman network
+
+	// Backend TLS settings for reencrypt routes
+	LabelBackendCA         = "exposed-backend-ca"          // Base64-encoded PEM CA bundle
+	LabelBackendServerName = "exposed-backend-server-name" // Name to verify, defaults to the FQDN
+	LabelBackendInsecure   = "exposed-backend-insecure"    // "true" skips verification
+	LabelBackendClientCert = "exposed-backend-client-cert" // Client certificate file for backend mTLS
+	LabelBackendClientKey  = "exposed-backend-client-key"  // Client key file, defaults to the cert file
+	LabelBackendSPIFFEID   = "exposed-backend-spiffe-id"   // SPIFFE ID (or trust domain) the backend must present
+
+	// Backend connection pool
+	LabelUpstreamMaxIdleConns = "exposed-upstream-max-idle-conns" // Idle keep-alive connections kept per backend, default 2; "0" for none
+	LabelUpstreamMaxConns     = "exposed-upstream-max-conns"      // Connections per backend, active or idle; requests beyond it wait
+	LabelUpstreamIdleTimeout  = "exposed-upstream-idle-timeout"   // Idle time before a backend connection is closed, default "90s"
+
+	// Response modification
+	LabelResponseHeaders = "exposed-response-headers" // "Name=value|Other=value"
+	LabelStripHeaders    = "exposed-strip-headers"    // "Server,X-Powered-By"
+	LabelRewriteBody     = "exposed-rewrite-body"     // "true" replaces the container's IP:port in HTML, JSON, CSS and JS bodies with the FQDN
+
+	// Streaming
+	LabelFlushInterval = "exposed-flush-interval" // "-1" or a duration; marks the route as streaming
+	LabelMaxDuration   = "exposed-max-duration"   // Request deadline, e.g. "2h"; "0" for none
+
+	// Upgraded connections (WebSocket)
+	LabelUpgradeIdleTimeout = "exposed-upgrade-idle-timeout" // e.g. "10m"; "0" for none
+
+	// Protocol advertisement
+	LabelAltSvc = "exposed-alt-svc" // Alt-Svc header value, overrides ALT_SVC; "off" sends none
+	LabelALPN   = "exposed-alpn"    // TLS application protocols in order of preference, e.g. "http/1.1,h2"
+
+	// Client connections
+	LabelIdleTimeout = "exposed-idle-timeout" // Keep-alive idle timeout, e.g. "15s"; only shortens the server's 2 minutes
+	LabelMaxLifetime = "exposed-max-lifetime" // Total lifetime of a client connection, keep-alive or upgraded, e.g. "1h"
+
+	// Caching
+	LabelCache    = "exposed-cache"    // "true" serves cacheable GET responses from memory
+	LabelCoalesce = "exposed-coalesce" // "true" lets concurrent identical GETs share one backend request
+
+	// Static file routes
+	LabelStaticMaxAge = "exposed-static-max-age" // Cache lifetime of non-HTML files, default "1h"
+
+	// Logging
+	LabelAccessLog = "exposed-access-log" // on, off or errors-only; overrides ACCESS_LOG
+
+	// Drained routes
+	LabelMaintenancePage = "exposed-maintenance-page" // html/template text or "file:" in LABEL_FILES_DIR
+
+	// Backends refusing connections
+	LabelStartingPage = "exposed-starting-page" // "on", "off", or html/template text or "file:" in LABEL_FILES_DIR of the page
+
+	// Listener profiles
+	LabelListener = "exposed-listener" // Serve only on this LISTENERS profile instead of the public listener
+
+	// Multi-tenancy
+	LabelTenant = "exposed-tenant" // TENANTS entry owning the route; required for hosts in a tenant's zones
+
+	// Middleware chain
+	LabelMiddlewares = "exposed-middlewares" // Order of the route's middlewares, e.g. "hmac,api-key"
+
+	// Access control
+	LabelAPIKeys = "exposed-api-keys" // "key1,key2" or "file:" in LABEL_FILES_DIR with one key per line
+
+	// Signed requests (webhooks)
+	LabelHMACSecret = "exposed-hmac-secret"  // Shared secret(s), same format as exposed-api-keys
+	LabelHMACHeader = "exposed-hmac-header"  // Signature header, default X-Signature
+	LabelHMACMaxAge = "exposed-hmac-max-age" // Allowed timestamp skew, default "5m"; "0" signs the body only
+
+	// Request filtering
+	LabelMethods          = "exposed-methods"           // Allowed methods, e.g. "GET,HEAD"; others get 405
+	LabelContentTypes     = "exposed-content-types"     // Allowed body media types, e.g. "application/json,image/*"; others get 415
+	LabelContentEncodings = "exposed-content-encodings" // Allowed body Content-Encodings besides identity, e.g. "gzip"
+
+	// External authorization
+	LabelExtAuthz        = "exposed-ext-authz"         // URL of a service asked about every request, 200 allows
+	LabelExtAuthzHeaders = "exposed-ext-authz-headers" // Headers of an allowing verdict copied to the request, e.g. "X-User,X-Groups"
+
+	// Script hooks
+	LabelScriptRequest  = "exposed-script-request"  // WASI module run before the backend: header changes, rejection, routing
+	LabelScriptResponse = "exposed-script-response" // WASI module run on the backend's response headers
+
+	// Synthetic probes
+	LabelProbePath = "exposed-probe-path" // Path requested by PROBE_INTERVAL probes, e.g. "/healthz"; "off" skips the host
+)
+
+const (
+	// Client certificates of LISTENER_<NAME>_CLIENT_CA listeners
+	LabelClientCertAllow = "exposed-client-cert-allow" // Certificates let through, e.g. "cn=device-1,ou=sensors,san=svc.internal"; others get 403
+)
+
+// Target is a backend published by a provider.
+type Target struct {
+	ID     string // Provider-specific ID (container or service ID)
+	Name   string // Human readable name, used in logs
+	FQDN   string
+	IP     string // IP address or hostname
+	Port   int
+	Labels map[string]string
+	// PathPrefix restricts the target to requests under this path. Empty means every path.
+	PathPrefix string
+	// HostRegex matches request hosts by regular expression instead of FQDN.
+	HostRegex string
+	// CertFQDN is the certificate name to manage for a regex target (usually a wildcard).
+	CertFQDN string
+	// StaticRoot serves files from this local directory instead of proxying to IP:Port.
+	StaticRoot string
+}
+
+// Provider discovers backend targets from a container runtime or orchestrator.
+type Provider interface {
+	// Name identifies the provider in logs.
+	Name() string
+	// Discover returns the currently published targets. An error means the
+	// provider could not be queried and the caller should keep its previous state.
+	Discover(ctx context.Context) ([]Target, error)
+}
+
+// ParsePort validates the value of an exposed-port label.
+func ParsePort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if port < 1 || port > 65535 {
+		return 0, strconv.ErrRange
+	}
+	return port, nil
+}
+
+// ValidHostname reports whether value is a DNS name (e.g. "db", "app.internal")
+// that can stand in for a backend IP address.
+func ValidHostname(value string) bool {
+	if value == "" || len(value) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(value, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ParseFlushInterval parses a flush interval: "-1" (or "immediate") flushes
+// after every write, anything else is a Go duration such as "100ms".
+func ParseFlushInterval(value string) (time.Duration, error) {
+	if value == "-1" || value == "immediate" {
+		return -1, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// WildcardFor returns the wildcard name covering a host: app.example.com -> *.example.com.
+// Like certificate wildcards, it only covers a single label.
+func WildcardFor(host string) (string, bool) {
+	_, parent, found := strings.Cut(host, ".")
+	if !found || !strings.Contains(parent, ".") {
+		return "", false
+	}
+	return "*." + parent, true
+}
@@ -0,0 +1,84 @@
+package events
+
+import (
+	"rproxy/internal/metrics"
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	RouteAdded      = "route_added"      // A host got its first route
+	RouteRemoved    = "route_removed"    // A host lost its last route
+	CertObtained    = "cert_obtained"    // First certificate for a name
+	CertRenewed     = "cert_renewed"     // A certificate was replaced
+	CertFailed      = "cert_failed"      // An obtain attempt failed
+	CertQuarantined = "cert_quarantined" // A name gets no attempts for a while (see certs/quarantine.go)
+
+	ErrorSpike         = "error_spike"          // A route keeps answering 5xx, with diagnostics in Details
+	ErrorSpikeResolved = "error_spike_resolved" // Its error rate is back below the threshold
+
+	DNSDrift         = "dns_drift"          // A host's public records do not point at PUBLIC_IPS, with the records in Details
+	DNSDriftResolved = "dns_drift_resolved" // They do again
+
+	PublicIPChanged = "public_ip_changed" // DDNS confirmed a new public address, Subject is the family
+	DDNSFailed      = "ddns_failed"       // A record could not be pointed at the public address
+)
+
+var (
+	eventsTotal = metrics.NewCounter("rproxy_events_total",
+		"Internal events published, by type.", "type")
+	eventsDropped = metrics.NewCounter("rproxy_events_dropped_total",
+		"Events not delivered to a subscriber that fell behind.")
+)
+
+// Event is something an operator may want to know about.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Subject string    `json:"subject"` // FQDN or host pattern
+	Message string    `json:"message,omitempty"`
+
+	Details map[string]any `json:"details,omitempty"` // Structured data for some types
+}
+
+// bus fans events out to subscribers: the notifier, the admin event stream.
+// Publishing never blocks; events are dropped for subscribers that fall behind.
+var bus = struct {
+	sync.RWMutex
+	subs map[chan Event]struct{}
+}{subs: make(map[chan Event]struct{})}
+
+// Publish sends an event to every subscriber.
+func Publish(typ, subject, message string) {
+	PublishDetails(typ, subject, message, nil)
+}
+
+// PublishDetails sends an event with structured details to every subscriber.
+// Subscribers share details and must not modify them.
+func PublishDetails(typ, subject, message string, details map[string]any) {
+	ev := Event{Time: time.Now(), Type: typ, Subject: subject, Message: message, Details: details}
+	eventsTotal.Inc(typ)
+	bus.RLock()
+	defer bus.RUnlock()
+	for ch := range bus.subs {
+		select {
+		case ch <- ev:
+		default:
+			eventsDropped.Inc()
+		}
+	}
+}
+
+// Subscribe registers a subscriber. The returned function unsubscribes it.
+func Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 64)
+	bus.Lock()
+	bus.subs[ch] = struct{}{}
+	bus.Unlock()
+	return ch, func() {
+		bus.Lock()
+		delete(bus.subs, ch)
+		bus.Unlock()
+	}
+}
@@ -0,0 +1,352 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"rproxy/internal/discovery"
+	"rproxy/internal/sshclient"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// --- Structs for Kubernetes Objects ---
+
+// HTTPRouteList matches the relevant fields of Gateway API HTTPRoute objects.
+type HTTPRouteList struct {
+	Items []HTTPRoute `json:"items"`
+}
+
+type HTTPRoute struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		ParentRefs []ParentRef     `json:"parentRefs"`
+		Hostnames  []string        `json:"hostnames"`
+		Rules      []HTTPRouteRule `json:"rules"`
+	} `json:"spec"`
+}
+
+type ObjectMeta struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+type ParentRef struct {
+	Kind      string `json:"kind"` // Gateway when empty
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"` // The route's namespace when empty
+}
+
+type HTTPRouteRule struct {
+	Matches []struct {
+		Path *struct {
+			Type  string `json:"type"` // PathPrefix (default), Exact, RegularExpression
+			Value string `json:"value"`
+		} `json:"path"`
+	} `json:"matches"`
+	BackendRefs []BackendRef `json:"backendRefs"`
+}
+
+type BackendRef struct {
+	Kind      string `json:"kind"` // Service when empty
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Port      int    `json:"port"`
+}
+
+// ServiceList matches the relevant fields of core/v1 Service objects.
+type ServiceList struct {
+	Items []struct {
+		Metadata ObjectMeta `json:"metadata"`
+		Spec     struct {
+			ClusterIP string `json:"clusterIP"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// ReferenceGrantList matches the relevant fields of Gateway API
+// ReferenceGrant objects, which allow references from other namespaces.
+type ReferenceGrantList struct {
+	Items []struct {
+		Metadata ObjectMeta `json:"metadata"`
+		Spec     struct {
+			From []GrantFrom `json:"from"`
+			To   []GrantTo   `json:"to"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+type GrantFrom struct {
+	Group     string `json:"group"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+}
+
+type GrantTo struct {
+	Group string `json:"group"`
+	Kind  string `json:"kind"`
+	Name  string `json:"name"` // Every object of the kind when empty
+}
+
+// gatewayGroup is the API group of HTTPRoutes in ReferenceGrants.
+const gatewayGroup = "gateway.networking.k8s.io"
+
+// --- Kubernetes Client ---
+
+// Client reads Gateway API HTTPRoutes with kubectl over SSH.
+type Client struct {
+	ssh              *sshclient.Client
+	kubectl          string // kubectl invocation, e.g. "kubectl" or "k3s kubectl"
+	gateway          string // Only accept routes attached to this Gateway (empty accepts all)
+	gatewayNamespace string // Namespace of gateway
+
+	mu     sync.Mutex
+	warned map[string]bool // Problems already reported for the current routes, by route and kind
+}
+
+// New creates a new Kubernetes client. gateway is "namespace/name", or a name
+// in the default namespace.
+func New(sshClient *sshclient.Client, kubectl, gateway string) *Client {
+	c := &Client{ssh: sshClient, kubectl: kubectl, gateway: gateway}
+	if gateway != "" {
+		c.gatewayNamespace = "default"
+		if ns, name, ok := strings.Cut(gateway, "/"); ok {
+			c.gatewayNamespace, c.gateway = ns, name
+		}
+	}
+	return c
+}
+
+// Name identifies this provider in logs.
+func (c *Client) Name() string {
+	return "kubernetes"
+}
+
+// ListHTTPRoutes returns all HTTPRoutes across namespaces.
+func (c *Client) ListHTTPRoutes() ([]HTTPRoute, error) {
+	cmd := fmt.Sprintf("%s get httproutes.gateway.networking.k8s.io --all-namespaces --output json", c.kubectl)
+	output, err := c.ssh.RunCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list httproutes via ssh: %w", err)
+	}
+	var list HTTPRouteList
+	if err := json.Unmarshal(output, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse httproute list json: %w", err)
+	}
+	return list.Items, nil
+}
+
+// ServiceIPs returns the cluster IP of every service keyed by "namespace/name".
+func (c *Client) ServiceIPs() (map[string]string, error) {
+	cmd := fmt.Sprintf("%s get services --all-namespaces --output json", c.kubectl)
+	output, err := c.ssh.RunCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services via ssh: %w", err)
+	}
+	var list ServiceList
+	if err := json.Unmarshal(output, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse service list json: %w", err)
+	}
+	ips := make(map[string]string, len(list.Items))
+	for _, svc := range list.Items {
+		if svc.Spec.ClusterIP != "" && svc.Spec.ClusterIP != "None" {
+			ips[svc.Metadata.Namespace+"/"+svc.Metadata.Name] = svc.Spec.ClusterIP
+		}
+	}
+	return ips, nil
+}
+
+// ReferenceGrants returns the ReferenceGrants across namespaces. Clusters
+// without the CRD have none.
+func (c *Client) ReferenceGrants() (*ReferenceGrantList, error) {
+	cmd := fmt.Sprintf("%s get referencegrants.gateway.networking.k8s.io --all-namespaces --output json", c.kubectl)
+	output, err := c.ssh.RunCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list referencegrants via ssh: %w", err)
+	}
+	var list ReferenceGrantList
+	if err := json.Unmarshal(output, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse referencegrant list json: %w", err)
+	}
+	return &list, nil
+}
+
+// granted reports whether a ReferenceGrant in the service's namespace lets
+// HTTPRoutes of routeNamespace reference it.
+func (l *ReferenceGrantList) granted(routeNamespace, namespace, service string) bool {
+	if l == nil {
+		return false
+	}
+	for _, g := range l.Items {
+		if g.Metadata.Namespace != namespace {
+			continue
+		}
+		from := slices.ContainsFunc(g.Spec.From, func(f GrantFrom) bool {
+			return f.Group == gatewayGroup && f.Kind == "HTTPRoute" && f.Namespace == routeNamespace
+		})
+		to := slices.ContainsFunc(g.Spec.To, func(t GrantTo) bool {
+			return t.Group == "" && t.Kind == "Service" && (t.Name == "" || t.Name == service)
+		})
+		if from && to {
+			return true
+		}
+	}
+	return false
+}
+
+// Discover turns every hostname/path-prefix pair of the HTTPRoutes into a target
+// pointing at the cluster IP of the rule's first Service backendRef.
+func (c *Client) Discover(ctx context.Context) ([]discovery.Target, error) {
+	routes, err := c.ListHTTPRoutes()
+	if err != nil {
+		return nil, err
+	}
+	if len(routes) == 0 {
+		return nil, nil
+	}
+	serviceIPs, err := c.ServiceIPs()
+	if err != nil {
+		return nil, err
+	}
+
+	// Problems are logged once, when they appear, not on every poll
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reported := make(map[string]bool)
+	warnOnce := func(key, msg string, args ...any) {
+		reported[key] = true
+		if !c.warned[key] {
+			slog.Warn(msg, args...)
+		}
+	}
+	defer func() { c.warned = reported }()
+
+	var grants *ReferenceGrantList
+	if crossNamespace(routes) {
+		if grants, err = c.ReferenceGrants(); err != nil {
+			// Without grants, cross-namespace backends are refused below
+			warnOnce("referencegrants", "Kubernetes: Failed to read ReferenceGrants", "error", err)
+		}
+	}
+
+	var targets []discovery.Target
+	for _, hr := range routes {
+		name := hr.Metadata.Namespace + "/" + hr.Metadata.Name
+		if !c.attached(hr) {
+			slog.Debug("Kubernetes: HTTPRoute not attached to configured gateway, skipping", "httproute", name, "gateway", c.gateway)
+			continue
+		}
+		if len(hr.Spec.Hostnames) == 0 {
+			warnOnce(name+"/hostnames", "Kubernetes: HTTPRoute has no hostnames, skipping", "httproute", name)
+			continue
+		}
+
+		for i, rule := range hr.Spec.Rules {
+			ruleKey := fmt.Sprintf("%s/rule/%d", name, i)
+			backend, ok := firstServiceBackend(rule.BackendRefs)
+			if !ok {
+				warnOnce(ruleKey+"/backend", "Kubernetes: HTTPRoute rule has no Service backendRef with a port, skipping", "httproute", name)
+				continue
+			}
+			if len(rule.BackendRefs) > 1 {
+				warnOnce(name+"/weighted", "Kubernetes: Weighted backendRefs are not supported, using the first one", "httproute", name, "backend", backend.Name)
+			}
+			namespace := backend.Namespace
+			if namespace == "" {
+				namespace = hr.Metadata.Namespace
+			}
+			if namespace != hr.Metadata.Namespace && !grants.granted(hr.Metadata.Namespace, namespace, backend.Name) {
+				warnOnce(name+"/grant/"+namespace+"/"+backend.Name, "Kubernetes: No ReferenceGrant allows this cross-namespace backendRef, skipping", "httproute", name, "service", namespace+"/"+backend.Name)
+				continue
+			}
+			ip, ok := serviceIPs[namespace+"/"+backend.Name]
+			if !ok {
+				warnOnce(name+"/service/"+namespace+"/"+backend.Name, "Kubernetes: Service for backendRef not found or has no cluster IP", "httproute", name, "service", namespace+"/"+backend.Name)
+				continue
+			}
+
+			for _, prefix := range pathPrefixes(rule, func(m int, args ...any) {
+				warnOnce(fmt.Sprintf("%s/match/%d", ruleKey, m), "Kubernetes: Unsupported path match type, skipping match", append([]any{"httproute", name}, args...)...)
+			}) {
+				for _, hostname := range hr.Spec.Hostnames {
+					targets = append(targets, discovery.Target{
+						ID:         name,
+						Name:       name,
+						FQDN:       hostname,
+						IP:         ip,
+						Port:       backend.Port,
+						PathPrefix: prefix,
+					})
+				}
+			}
+		}
+	}
+	return targets, nil
+}
+
+// attached reports whether the route references the configured gateway, by
+// namespace and name.
+func (c *Client) attached(hr HTTPRoute) bool {
+	if c.gateway == "" {
+		return true
+	}
+	for _, ref := range hr.Spec.ParentRefs {
+		namespace := ref.Namespace
+		if namespace == "" {
+			namespace = hr.Metadata.Namespace
+		}
+		if (ref.Kind == "" || ref.Kind == "Gateway") && ref.Name == c.gateway && namespace == c.gatewayNamespace {
+			return true
+		}
+	}
+	return false
+}
+
+// crossNamespace reports whether any route references a backend in another
+// namespace, which needs ReferenceGrants to be read.
+func crossNamespace(routes []HTTPRoute) bool {
+	for _, hr := range routes {
+		for _, rule := range hr.Spec.Rules {
+			if slices.ContainsFunc(rule.BackendRefs, func(ref BackendRef) bool {
+				return ref.Namespace != "" && ref.Namespace != hr.Metadata.Namespace
+			}) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// firstServiceBackend returns the first backendRef pointing at a Service port.
+func firstServiceBackend(refs []BackendRef) (BackendRef, bool) {
+	for _, ref := range refs {
+		if (ref.Kind == "" || ref.Kind == "Service") && ref.Name != "" && ref.Port > 0 {
+			return ref, true
+		}
+	}
+	return BackendRef{}, false
+}
+
+// pathPrefixes returns the path prefixes matched by a rule. A rule without
+// matches matches every path. Exact and RegularExpression matches are not
+// supported and passed to unsupported with their index.
+func pathPrefixes(rule HTTPRouteRule, unsupported func(match int, args ...any)) []string {
+	if len(rule.Matches) == 0 {
+		return []string{"/"}
+	}
+	var prefixes []string
+	for i, m := range rule.Matches {
+		if m.Path == nil {
+			prefixes = append(prefixes, "/")
+			continue
+		}
+		if m.Path.Type != "" && m.Path.Type != "PathPrefix" {
+			unsupported(i, "type", m.Path.Type, "value", m.Path.Value)
+			continue
+		}
+		prefixes = append(prefixes, m.Path.Value)
+	}
+	return prefixes
+}
@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Vec is a counter or gauge family with a fixed set of label names.
+type Vec struct {
+	name   string
+	help   string
+	kind   string // "counter" or "gauge"
+	labels []string
+
+	mu     sync.RWMutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	bits        atomic.Uint64 // float64 value
+}
+
+func (s *series) add(v float64) {
+	for {
+		old := s.bits.Load()
+		if s.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []*Vec
+)
+
+// NewCounter registers a counter family.
+func NewCounter(name, help string, labels ...string) *Vec {
+	return register(&Vec{name: name, help: help, kind: "counter", labels: labels})
+}
+
+// NewGauge registers a gauge family.
+func NewGauge(name, help string, labels ...string) *Vec {
+	return register(&Vec{name: name, help: help, kind: "gauge", labels: labels})
+}
+
+func register(v *Vec) *Vec {
+	v.series = make(map[string]*series)
+	registryMu.Lock()
+	registry = append(registry, v)
+	registryMu.Unlock()
+	return v
+}
+
+func (v *Vec) get(labelValues []string) *series {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.mu.RLock()
+	s, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok = v.series[key]; !ok {
+		s = &series{labelValues: slices.Clone(labelValues)}
+		v.series[key] = s
+	}
+	return s
+}
+
+// Add adds delta to the series for labelValues. Counters must only go up.
+func (v *Vec) Add(delta float64, labelValues ...string) {
+	v.get(labelValues).add(delta)
+}
+
+// Inc adds one.
+func (v *Vec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+// Dec subtracts one from a gauge.
+func (v *Vec) Dec(labelValues ...string) {
+	v.Add(-1, labelValues...)
+}
+
+// Set sets a gauge.
+func (v *Vec) Set(value float64, labelValues ...string) {
+	v.get(labelValues).bits.Store(math.Float64bits(value))
+}
+
+// Delete removes the series for labelValues, e.g. of a route that is gone.
+func (v *Vec) Delete(labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	delete(v.series, key)
+	v.mu.Unlock()
+}
+
+func (v *Vec) write(w io.Writer) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	v.mu.RUnlock()
+	slices.Sort(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	for _, k := range keys {
+		v.mu.RLock()
+		s := v.series[k]
+		v.mu.RUnlock()
+		if s == nil {
+			continue // Deleted meanwhile
+		}
+
+		var labels []string
+		for i, name := range v.labels {
+			labels = append(labels, name+"="+strconv.Quote(s.labelValues[i]))
+		}
+		value := strconv.FormatFloat(math.Float64frombits(s.bits.Load()), 'g', -1, 64)
+		if len(labels) == 0 {
+			fmt.Fprintf(w, "%s %s\n", v.name, value)
+		} else {
+			fmt.Fprintf(w, "%s{%s} %s\n", v.name, strings.Join(labels, ","), value)
+		}
+	}
+}
+
+// Handler serves every registered metric in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		registryMu.Lock()
+		vecs := slices.Clone(registry)
+		registryMu.Unlock()
+		for _, v := range vecs {
+			v.write(w)
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"rproxy/internal/events"
+	"strings"
+	"time"
+)
+
+// Message formats, set with NOTIFY_FORMAT.
+const (
+	FormatWebhook = "webhook" // JSON object with event, text and details
+	FormatSlack   = "slack"   // Slack incoming webhook ({"text": ...})
+	FormatNtfy    = "ntfy"    // ntfy topic URL, plain text body with a title
+)
+
+// ValidFormat reports whether format is a supported NOTIFY_FORMAT.
+func ValidFormat(format string) bool {
+	return format == FormatWebhook || format == FormatSlack || format == FormatNtfy
+}
+
+// Notifier posts operator notifications to a webhook. A nil Notifier does nothing.
+type Notifier struct {
+	url    string
+	format string
+	client *http.Client
+}
+
+// New returns a Notifier posting to url, or nil when url is empty.
+func New(url, format string) *Notifier {
+	if url == "" {
+		return nil
+	}
+	return &Notifier{url: url, format: format, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// routeBatchDelay collects the route events of a deploy (or a crash taking
+// several services down) into one message.
+const routeBatchDelay = 5 * time.Second
+
+// Run forwards events until ctx is done: route changes, batched,
+// certificate failures and quarantines, and 5xx spikes.
+func (n *Notifier) Run(ctx context.Context) {
+	if n == nil {
+		return
+	}
+	evs, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+
+	var added, removed []string
+	var flush <-chan time.Time
+	for {
+		select {
+		case ev := <-evs:
+			switch ev.Type {
+			case events.RouteAdded, events.RouteRemoved:
+				if ev.Type == events.RouteAdded {
+					added = append(added, ev.Subject)
+				} else {
+					removed = append(removed, ev.Subject)
+				}
+				if flush == nil {
+					flush = time.After(routeBatchDelay)
+				}
+			case events.CertFailed, events.CertQuarantined:
+				n.send(ev.Type, ev.Subject+": "+ev.Message, map[string]any{"fqdn": ev.Subject})
+			case events.ErrorSpike, events.ErrorSpikeResolved, events.DNSDrift, events.DNSDriftResolved,
+				events.PublicIPChanged, events.DDNSFailed:
+				n.send(ev.Type, ev.Subject+": "+ev.Message, ev.Details)
+			}
+		case <-flush:
+			n.routesChanged(added, removed)
+			added, removed, flush = nil, nil, nil
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// routesChanged reports FQDNs that gained or lost their route, e.g. a new
+// service was published or one died.
+func (n *Notifier) routesChanged(added, removed []string) {
+	var parts []string
+	if len(added) > 0 {
+		parts = append(parts, "added "+strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		parts = append(parts, "removed "+strings.Join(removed, ", "))
+	}
+	n.send("routes_changed", "Routes "+strings.Join(parts, "; "), map[string]any{"added": added, "removed": removed})
+}
+
+// send posts a notification in the background. Failures are only logged.
+func (n *Notifier) send(event, text string, details map[string]any) {
+	go func() {
+		if err := n.post(event, text, details); err != nil {
+			slog.Warn("Notify: Failed to send notification", "event", event, "error", err)
+		}
+	}()
+}
+
+func (n *Notifier) post(event, text string, details map[string]any) error {
+	var body []byte
+	contentType := "application/json"
+	switch n.format {
+	case FormatSlack:
+		body, _ = json.Marshal(map[string]string{"text": "rproxy: " + text})
+	case FormatNtfy:
+		body, contentType = []byte(text), "text/plain; charset=utf-8"
+	default:
+		body, _ = json.Marshal(map[string]any{"event": event, "text": text, "details": details, "time": time.Now()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if n.format == FormatNtfy {
+		req.Header.Set("Title", "rproxy: "+event)
+		req.Header.Set("Tags", event)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
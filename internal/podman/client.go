@@ -1,13 +1,15 @@
 package podman
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"rproxy/internal/discovery"
 	"rproxy/internal/sshclient" // Assuming module path is rproxy
 	"strings"
+	"sync"
+	"time"
 )
 
 // --- Structs for Podman Data --- 
@@ -29,63 +31,84 @@ type ContainerInfo struct {
 	Name        string
 	ExposedPort string
 	FQDN        string
+	Labels      map[string]string
 }
 
 // --- Podman Client --- 
 
+// Options tunes the podman provider.
+type Options struct {
+	// DNSDomain such as "dns.podman" makes targets the containers' names on the
+	// podman network's DNS instead of their IPs, so a restarted container is
+	// reached at its new IP right away. Empty uses IPs.
+	DNSDomain string
+	// Concurrency bounds the inspect commands run at once when containers are
+	// inspected one by one.
+	Concurrency int
+	// InspectTimeout bounds each inspect command, batched or not.
+	InspectTimeout time.Duration
+}
+
 // Client interacts with Podman via SSH.
 type Client struct {
-	ssh *sshclient.Client
+	ssh  *sshclient.Client
+	opts Options
 }
 
 // New creates a new Podman client.
-func New(sshClient *sshclient.Client) *Client {
-	return &Client{ssh: sshClient}
+func New(sshClient *sshclient.Client, opts Options) *Client {
+	return &Client{ssh: sshClient, opts: opts}
+}
+
+// ListOutput matches the relevant fields of one entry of
+// podman container list --format json.
+type ListOutput struct {
+	Id     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
 }
 
 // ListContainers lists running containers with required labels.
-func (c *Client) ListContainers() ([]ContainerInfo, error) {
-	// Use tab separator for potentially complex FQDNs/Names
-	cmd := `podman container list --filter label=exposed-port --filter label=exposed-fqdn --filter status=running --no-trunc --format '{{.ID}}\t{{.Names}}\t{{index .Labels "exposed-port"}}\t{{index .Labels "exposed-fqdn"}}'`
+func (c *Client) ListContainers(ctx context.Context) ([]ContainerInfo, error) {
+	cmd := `podman container list --filter label=exposed-port --filter label=exposed-fqdn --filter status=running --no-trunc --format json`
 
-	output, err := c.ssh.RunCommand(cmd)
+	output, err := c.ssh.RunCommandContext(ctx, cmd)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list containers via ssh: %w", err)
 	}
 
+	var listed []ListOutput
+	if err := json.Unmarshal(output, &listed); err != nil {
+		return nil, fmt.Errorf("failed to parse podman list json: %w", err)
+	}
+
 	var containers []ContainerInfo
-	scanner := bufio.NewScanner(bytes.NewReader(output))
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, "\t", 4) // Split by tab
-		if len(parts) == 4 {
-			name := strings.TrimPrefix(parts[1], "/")
-			fqdn := strings.TrimSpace(parts[3])
-			if name != "" && parts[0] != "" && parts[2] != "" && fqdn != "" {
-				containers = append(containers, ContainerInfo{
-					ID:          parts[0],
-					Name:        name,
-					ExposedPort: parts[2],
-					FQDN:        fqdn,
-				})
-			} else {
-				slog.Warn("Missing required info in list output line", "line", line)
-			}
-		} else {
-			slog.Warn("Could not parse list output line (expected 4 tab-separated parts)", "line", line)
+	for _, l := range listed {
+		var name string
+		if len(l.Names) > 0 {
+			name = strings.TrimPrefix(l.Names[0], "/")
 		}
+		port := strings.TrimSpace(l.Labels[discovery.LabelExposedPort])
+		fqdn := strings.TrimSpace(l.Labels[discovery.LabelExposedFQDN])
+		if l.Id == "" || name == "" || port == "" || fqdn == "" {
+			slog.Warn("Podman: Missing required info in list output", "id", l.Id, "name", name)
+			continue
+		}
+		containers = append(containers, ContainerInfo{
+			ID:          l.Id,
+			Name:        name,
+			ExposedPort: port,
+			FQDN:        fqdn,
+			Labels:      l.Labels,
+		})
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error scanning podman list output: %w", err)
-	}
-
 	return containers, nil
 }
 
 // InspectContainer gets details for a specific container ID.
-func (c *Client) InspectContainer(containerID string) (*InspectOutput, error) {
+func (c *Client) InspectContainer(ctx context.Context, containerID string) (*InspectOutput, error) {
 	cmd := fmt.Sprintf("podman container inspect %s --format json", containerID)
-	output, err := c.ssh.RunCommand(cmd)
+	output, err := c.ssh.RunCommandContext(ctx, cmd)
 	if err != nil {
 		return nil, fmt.Errorf("failed to inspect container %s via ssh: %w", containerID, err)
 	}
@@ -102,4 +125,138 @@ func (c *Client) InspectContainer(containerID string) (*InspectOutput, error) {
 	}
 
 	return &inspectDataSlice[0], nil
-} 
\ No newline at end of file
+} 
+// Name identifies this provider in logs.
+func (c *Client) Name() string {
+	return "podman"
+}
+
+// InspectContainers inspects several containers in one SSH round trip and
+// returns the results by container ID. Podman fails the whole command when one
+// of them is gone (e.g. it stopped since it was listed).
+func (c *Client) InspectContainers(ctx context.Context, containerIDs []string) (map[string]*InspectOutput, error) {
+	cmd := fmt.Sprintf("podman container inspect %s --format json", strings.Join(containerIDs, " "))
+	output, err := c.ssh.RunCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect %d containers via ssh: %w", len(containerIDs), err)
+	}
+
+	var inspectDataSlice []InspectOutput
+	if err := json.Unmarshal(output, &inspectDataSlice); err != nil {
+		return nil, fmt.Errorf("failed to parse inspect json: %w", err)
+	}
+	results := make(map[string]*InspectOutput, len(inspectDataSlice))
+	for i := range inspectDataSlice {
+		results[inspectDataSlice[i].Id] = &inspectDataSlice[i]
+	}
+	return results, nil
+}
+
+// Discover lists labelled containers and inspects them to resolve their IPs.
+// All containers are inspected in one command; if that fails, each one is
+// inspected on its own so a single vanished container cannot hide the rest.
+// Containers that cannot be inspected or carry invalid labels are skipped.
+func (c *Client) Discover(ctx context.Context) ([]discovery.Target, error) {
+	containers, err := c.ListContainers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(containers) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, len(containers))
+	for i, ci := range containers {
+		ids[i] = ci.ID
+	}
+	batchCtx, cancel := context.WithTimeout(ctx, c.opts.InspectTimeout)
+	inspected, err := c.InspectContainers(batchCtx, ids)
+	cancel()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		slog.Warn("Podman: Batch inspect failed, inspecting containers one by one", "count", len(ids), "error", err)
+		inspected = c.inspectEach(ctx, containers)
+	}
+
+	var targets []discovery.Target
+	for _, ci := range containers {
+		inspectData, ok := inspected[ci.ID]
+		if !ok {
+			continue // Already logged, or gone since listing
+		}
+
+		var ipAddress string
+		for _, netDetails := range inspectData.NetworkSettings.Networks {
+			if netDetails.IPAddress != "" {
+				ipAddress = netDetails.IPAddress
+				break
+			}
+		}
+		if ipAddress == "" {
+			slog.Warn("Podman: Could not find IP address for container", "name", ci.Name, "id", ci.ID)
+			continue
+		}
+
+		if c.opts.DNSDomain != "" {
+			if name := ci.Name + "." + c.opts.DNSDomain; discovery.ValidHostname(name) {
+				ipAddress = name
+			} else {
+				slog.Warn("Podman: Container name is not a valid DNS name, using its IP", "name", ci.Name, "id", ci.ID)
+			}
+		}
+
+		port, err := discovery.ParsePort(ci.ExposedPort)
+		if err != nil {
+			slog.Error("Podman: Invalid exposed-port label", "label", ci.ExposedPort, "name", ci.Name, "id", ci.ID, "error", err)
+			continue
+		}
+
+		targets = append(targets, discovery.Target{
+			ID:     ci.ID,
+			Name:   ci.Name,
+			FQDN:   ci.FQDN,
+			IP:     ipAddress,
+			Port:   port,
+			Labels: ci.Labels,
+		})
+	}
+	return targets, nil
+}
+
+// inspectEach inspects containers one command each, at most
+// Options.Concurrency at a time and each bounded by Options.InspectTimeout.
+func (c *Client) inspectEach(ctx context.Context, containers []ContainerInfo) map[string]*InspectOutput {
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex // Protects inspected from the inspect goroutines
+		inspected = make(map[string]*InspectOutput)
+		slots     = make(chan struct{}, max(c.opts.Concurrency, 1))
+	)
+	for _, container := range containers {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return inspected
+		}
+		wg.Add(1)
+		go func(ci ContainerInfo) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			inspectCtx, cancel := context.WithTimeout(ctx, c.opts.InspectTimeout)
+			defer cancel()
+			inspectData, err := c.InspectContainer(inspectCtx, ci.ID)
+			if err != nil {
+				slog.Error("Podman: Error inspecting container", "name", ci.Name, "id", ci.ID, "error", err)
+				return
+			}
+			mu.Lock()
+			inspected[ci.ID] = inspectData
+			mu.Unlock()
+		}(container)
+	}
+	wg.Wait()
+	return inspected
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Access log modes, set globally with ACCESS_LOG and per route with exposed-access-log.
+const (
+	AccessLogOn     = "on"
+	AccessLogOff    = "off"
+	AccessLogErrors = "errors-only" // Only responses with status 400 and above
+)
+
+// validAccessLog reports whether mode is a known access log mode.
+func validAccessLog(mode string) bool {
+	switch mode {
+	case AccessLogOn, AccessLogOff, AccessLogErrors:
+		return true
+	}
+	return false
+}
+
+// logAccess writes one access log line if mode asks for it.
+func logAccess(mode string, ev TapEvent, bytes int64) {
+	if mode == AccessLogOff || (mode == AccessLogErrors && ev.Status < 400) {
+		return
+	}
+	slog.Info("access",
+		"fqdn", ev.FQDN,
+		"method", ev.Method,
+		"path", ev.Path,
+		"status", ev.Status,
+		"bytes", bytes,
+		"duration", ev.Duration.Round(time.Microsecond),
+		"upstream", ev.Upstream,
+		"remote", ev.Remote,
+		"request_id", ev.RequestID,
+	)
+}
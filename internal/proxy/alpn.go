@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"rproxy/internal/discovery"
+	"rproxy/internal/metrics"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var alpnMisdirected = metrics.NewCounter("rproxy_alpn_misdirected_total",
+	"HTTP/2 requests answered 421 because they reached a host pinned to HTTP/1.1 over a connection opened for another name.", "fqdn")
+
+// alpnProtocols are the values exposed-alpn accepts. HTTP/3 runs over QUIC,
+// not this listener, and is announced with Alt-Svc instead.
+var alpnProtocols = []string{"h2", "http/1.1"}
+
+// AltSvcOff in exposed-alt-svc keeps ALT_SVC off a route's responses.
+const AltSvcOff = "off"
+
+// parseALPN normalizes the exposed-alpn label of t, "" when unset or invalid.
+func parseALPN(t discovery.Target) string {
+	v := t.Labels[discovery.LabelALPN]
+	if v == "" {
+		return ""
+	}
+	var protos []string
+	for _, p := range strings.Split(v, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if !slices.Contains(alpnProtocols, p) {
+			slog.Warn("Router: Invalid exposed-alpn label, expected h2 and/or http/1.1, offering both", "label", v, "container", t.Name)
+			return ""
+		}
+		if !slices.Contains(protos, p) {
+			protos = append(protos, p)
+		}
+	}
+	return strings.Join(protos, ",")
+}
+
+// altSvcHeader returns the Alt-Svc header for responses on route: its
+// exposed-alt-svc label, else ALT_SVC; "" sends none.
+func altSvcHeader(route Route, global string) string {
+	v := global
+	if route.AltSvc != "" {
+		v = route.AltSvc
+	}
+	if v == AltSvcOff {
+		return ""
+	}
+	return v
+}
+
+// routeALPN serves the TLS config of each handshake: tlsConfig as is, or a
+// copy offering the exposed-alpn protocols of the requested name. ALPN is
+// settled before any request is read, so the route serving "/" decides for
+// the whole host.
+type routeALPN struct {
+	router *Router
+	base   *tls.Config
+
+	mu      sync.Mutex
+	configs map[string]*tls.Config // By Route.ALPN
+}
+
+// withRouteALPN returns a copy of tlsConfig that applies exposed-alpn.
+func withRouteALPN(tlsConfig *tls.Config, router *Router) *tls.Config {
+	a := &routeALPN{router: router, base: tlsConfig, configs: make(map[string]*tls.Config)}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.GetConfigForClient = a.getConfigForClient
+	return tlsConfig
+}
+
+func (a *routeALPN) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	route, ok := a.router.GetRoute(strings.ToLower(hello.ServerName), "/")
+	if !ok || route.ALPN == "" {
+		return nil, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	config, ok := a.configs[route.ALPN]
+	if !ok {
+		config = a.base.Clone()
+		config.NextProtos = strings.Split(route.ALPN, ",")
+		a.configs[route.ALPN] = config
+	}
+	return config, nil
+}
+
+// pinALPN answers 421 Misdirected Request to HTTP/2 requests for a host whose
+// exposed-alpn excludes h2. They arrive when a browser reuses an HTTP/2
+// connection opened for another name of the same certificate (connection
+// coalescing), where the pinned host's handshake never took place. The
+// browser then retries on a connection of its own, which negotiates the
+// pinned protocol. Clients sending no SNI could not do better and are let
+// through.
+func pinALPN(next http.Handler, router *Router) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 || req.TLS == nil || req.TLS.ServerName == "" {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if host == strings.ToLower(req.TLS.ServerName) {
+			next.ServeHTTP(rw, req) // Negotiated for this host
+			return
+		}
+		route, ok := router.GetRoute(host, "/")
+		if !ok || route.ALPN == "" || slices.Contains(strings.Split(route.ALPN, ","), "h2") {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		slog.Debug("Handler: Responding 421 Misdirected Request (host is pinned to HTTP/1.1)", "host", host, "sni", req.TLS.ServerName, "remote", req.RemoteAddr)
+		alpnMisdirected.Inc(host)
+		rw.WriteHeader(http.StatusMisdirectedRequest)
+		fmt.Fprintln(rw, "421 Misdirected Request: This host does not serve HTTP/2, open a new connection.")
+	})
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// apiKeyCache memoizes parsed key lists by label value, like labelRuleCache.
+// A "file:" entry is replaced when the file changes, so old keys are not kept.
+var apiKeyCache sync.Map // spec -> apiKeys
+
+// apiKeys is a key list parsed from text, the resolved label value.
+type apiKeys struct {
+	text string
+	keys [][]byte
+}
+
+// parseAPIKeys splits a comma or newline separated key list.
+func parseAPIKeys(list string) [][]byte {
+	var keys [][]byte
+	for _, key := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+		if key = strings.TrimSpace(key); key != "" && !strings.HasPrefix(key, "#") {
+			keys = append(keys, []byte(key))
+		}
+	}
+	return keys
+}
+
+// labelSecrets returns the keys (or HMAC secrets) accepted for a route: a list
+// or a "file:" in LABEL_FILES_DIR with one key per line. Unreadable key files yield no keys,
+// so the route rejects every request rather than opening up.
+func labelSecrets(spec string) [][]byte {
+	list, err := resolveLabel(spec)
+	if err != nil {
+		return nil
+	}
+	if cached, ok := apiKeyCache.Load(spec); ok && cached.(apiKeys).text == list {
+		return cached.(apiKeys).keys
+	}
+	keys := parseAPIKeys(list)
+	apiKeyCache.Store(spec, apiKeys{text: list, keys: keys})
+	return keys
+}
+
+// checkAPIKey reports whether req carries one of the route's keys in
+// X-API-Key or as a bearer token. The credential is removed before the
+// request is forwarded.
+func checkAPIKey(req *http.Request, spec string) bool {
+	presented := req.Header.Get("X-API-Key")
+	fromAuthorization := false
+	if presented == "" {
+		scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			presented, fromAuthorization = strings.TrimSpace(token), true
+		}
+	}
+	if presented == "" {
+		return false
+	}
+
+	valid := false
+	for _, key := range labelSecrets(spec) {
+		// Compare against every key so timing does not reveal which one matched
+		if subtle.ConstantTimeCompare([]byte(presented), key) == 1 {
+			valid = true
+		}
+	}
+	if valid {
+		req.Header.Del("X-API-Key")
+		if fromAuthorization {
+			req.Header.Del("Authorization")
+		}
+	}
+	return valid
+}
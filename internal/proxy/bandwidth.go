@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"rproxy/internal/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bandwidthChunk bounds a single grant, so routes take turns at a fine grain.
+const bandwidthChunk = 32 << 10
+
+var (
+	bandwidthThrottled = metrics.NewCounter("rproxy_bandwidth_throttled_total",
+		"Transfers delayed by the bandwidth budget, by direction (in, out).", "direction")
+	bandwidthThrottledSeconds = metrics.NewCounter("rproxy_bandwidth_throttled_seconds_total",
+		"Time transfers waited for the bandwidth budget, by direction (in, out).", "direction")
+)
+
+// bandwidthWaiter is a transfer waiting for its share of the budget.
+type bandwidthWaiter struct {
+	n         int
+	ready     chan struct{}
+	cancelled atomic.Bool
+}
+
+// bandwidthBudget is a token bucket shared by all routes in one direction
+// (BANDWIDTH_LIMIT_IN or BANDWIDTH_LIMIT_OUT). While the bucket has tokens,
+// transfers pass immediately. Once it runs dry, waiting transfers are queued
+// per route and granted round-robin, so a busy route cannot starve the others.
+type bandwidthBudget struct {
+	direction string
+	rate      float64 // Bytes per second
+	burst     float64
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	queues  map[string][]*bandwidthWaiter
+	order   []string // Routes with waiters, in turn order
+	running bool     // The dispatcher is granting queued transfers
+}
+
+// newBandwidthBudget returns nil when rate is 0 (unlimited).
+func newBandwidthBudget(direction string, rate int64) *bandwidthBudget {
+	if rate <= 0 {
+		return nil
+	}
+	burst := max(float64(rate)/10, bandwidthChunk) // 100ms worth
+	return &bandwidthBudget{
+		direction: direction,
+		rate:      float64(rate),
+		burst:     burst,
+		tokens:    burst,
+		last:      time.Now(),
+		queues:    make(map[string][]*bandwidthWaiter),
+	}
+}
+
+// refill adds the tokens earned since the last call. Must hold mu.
+func (b *bandwidthBudget) refill() {
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.burst)
+	b.last = now
+}
+
+// wait blocks until route may transfer n bytes (at most bandwidthChunk).
+func (b *bandwidthBudget) wait(ctx context.Context, route string, n int) error {
+	b.mu.Lock()
+	b.refill()
+	if len(b.order) == 0 && b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		b.mu.Unlock()
+		return nil
+	}
+	w := &bandwidthWaiter{n: n, ready: make(chan struct{})}
+	if _, queued := b.queues[route]; !queued {
+		b.order = append(b.order, route)
+	}
+	b.queues[route] = append(b.queues[route], w)
+	if !b.running {
+		b.running = true
+		go b.dispatch()
+	}
+	b.mu.Unlock()
+
+	start := time.Now()
+	bandwidthThrottled.Inc(b.direction)
+	defer func() { bandwidthThrottledSeconds.Add(time.Since(start).Seconds(), b.direction) }()
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		w.cancelled.Store(true)
+		return ctx.Err()
+	}
+}
+
+// dispatch grants queued transfers one route at a time, sleeping while the
+// bucket is in deficit. It exits once the queues are empty.
+func (b *bandwidthBudget) dispatch() {
+	for {
+		b.mu.Lock()
+		if len(b.order) == 0 {
+			b.running = false
+			b.mu.Unlock()
+			return
+		}
+		route := b.order[0]
+		queue := b.queues[route]
+		w := queue[0]
+		b.order = b.order[1:]
+		if len(queue) == 1 {
+			delete(b.queues, route)
+		} else {
+			b.queues[route] = queue[1:]
+			b.order = append(b.order, route) // Next turn after the other routes
+		}
+		if w.cancelled.Load() {
+			b.mu.Unlock()
+			continue
+		}
+		b.refill()
+		b.tokens -= float64(w.n)
+		deficit := -b.tokens
+		b.mu.Unlock()
+
+		if deficit > 0 {
+			time.Sleep(time.Duration(deficit / b.rate * float64(time.Second)))
+		}
+		close(w.ready)
+	}
+}
+
+// throttledWriter paces a response body through the egress budget. Upgraded
+// connections bypass it once hijacked.
+type throttledWriter struct {
+	http.ResponseWriter
+	budget *bandwidthBudget
+	ctx    context.Context
+	route  string
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), bandwidthChunk)]
+		if err := w.budget.wait(w.ctx, w.route, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// throttledBody paces a request body through the ingress budget.
+type throttledBody struct {
+	io.ReadCloser
+	budget *bandwidthBudget
+	ctx    context.Context
+	route  string
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p[:min(len(p), bandwidthChunk)])
+	if n > 0 {
+		if waitErr := b.budget.wait(b.ctx, b.route, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"rproxy/internal/metrics"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var bodyRewrites = metrics.NewCounter("rproxy_body_rewrites_total",
+	"Backend addresses replaced with the public FQDN in response bodies.", "fqdn")
+
+// rewriteMediaTypes are the response types exposed-rewrite-body applies to.
+var rewriteMediaTypes = []string{
+	"text/html", "application/xhtml+xml", "application/json", "text/css",
+	"text/javascript", "application/javascript", "application/xml", "text/xml",
+}
+
+// rewriteChunk is how much of the backend's body is read at a time. Besides
+// it, a rewriter holds back only the bytes a split address may need.
+const rewriteChunk = 32 << 10
+
+// rewriteBody replaces the backend's internal address (container IP:port) in
+// text bodies with the route's FQDN, for apps that build absolute URLs from
+// the address they were reached at. Compressed bodies are left alone, since
+// the proxy never re-encodes responses.
+func rewriteBody(resp *http.Response, info routeInfo) error {
+	if !info.Route.RewriteBody || resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !slices.Contains(rewriteMediaTypes, mediaType) {
+		return nil
+	}
+
+	backend := net.JoinHostPort(info.Route.TargetIP, strconv.Itoa(info.Route.TargetPort))
+	resp.Body = newAddrRewriter(resp.Body, backend, info.FQDN)
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag) // Same meaning, different bytes
+	}
+	return nil
+}
+
+// addrRewriter reads a body with an address replaced by a public name:
+// "http://addr" and "https://addr" (also with JSON-escaped slashes) become
+// "https://fqdn", and any other "addr" becomes "fqdn".
+type addrRewriter struct {
+	src  io.ReadCloser
+	addr []byte
+	fqdn string
+	hold int // Bytes kept back after the last match: a scheme and an address
+
+	chunk []byte // Read buffer
+	in    []byte // Read but not yet scanned to the end
+	last  byte   // Input byte before in, 0 at the start
+	out   []byte // Ready to be returned
+	eof   bool
+}
+
+// rewriteSchemes prefix the address in absolute URLs, longest first.
+var rewriteSchemes = []string{`https:\/\/`, `http:\/\/`, "https://", "http://"}
+
+func newAddrRewriter(src io.ReadCloser, addr, fqdn string) *addrRewriter {
+	return &addrRewriter{
+		src:  src,
+		addr: []byte(addr),
+		fqdn: fqdn,
+		hold: len(addr) + len(rewriteSchemes[0]),
+	}
+}
+
+func (r *addrRewriter) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		if r.chunk == nil {
+			r.chunk = make([]byte, rewriteChunk)
+		}
+		n, err := r.src.Read(r.chunk)
+		r.in = append(r.in, r.chunk[:n]...)
+		if err == io.EOF {
+			r.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+		r.scan()
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// scan moves what is settled from in to out.
+func (r *addrRewriter) scan() {
+	from := 0
+	for {
+		i := bytes.Index(r.in[from:], r.addr)
+		if i < 0 {
+			break
+		}
+		i += from
+		end := i + len(r.addr)
+		if end == len(r.in) && !r.eof {
+			break // Whether it ends here depends on the next byte
+		}
+		before := r.last
+		if i > 0 {
+			before = r.in[i-1]
+		}
+		if isAddrByte(before) || (end < len(r.in) && isAddrByte(r.in[end])) {
+			from = i + 1 // Part of a longer address, e.g. 10.0.0.2:8080 for 10.0.0.2:80
+			continue
+		}
+		start, replacement := i, r.fqdn
+		for _, scheme := range rewriteSchemes {
+			if bytes.HasSuffix(r.in[:i], []byte(scheme)) {
+				start = i - len(scheme)
+				replacement = "https://" + r.fqdn
+				if strings.Contains(scheme, `\/`) {
+					replacement = `https:\/\/` + r.fqdn
+				}
+				break
+			}
+		}
+		r.out = append(r.out, r.in[:start]...)
+		r.out = append(r.out, replacement...)
+		r.last = r.in[end-1]
+		r.in = r.in[end:]
+		from = 0
+		bodyRewrites.Inc(r.fqdn)
+	}
+	keep := min(r.hold, len(r.in))
+	if r.eof {
+		keep = 0
+	}
+	if settled := r.in[:len(r.in)-keep]; len(settled) > 0 {
+		r.out = append(r.out, settled...)
+		r.last = settled[len(settled)-1]
+	}
+	r.in = append([]byte(nil), r.in[len(r.in)-keep:]...)
+}
+
+// isAddrByte reports whether b can continue a host name, IP address or port.
+func isAddrByte(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b == '.' || b == '-'
+}
+
+func (r *addrRewriter) Close() error {
+	return r.src.Close()
+}
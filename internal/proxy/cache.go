@@ -0,0 +1,395 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"rproxy/internal/cache"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fillTimeout bounds the background fetch that caches a whole object after a range miss.
+const fillTimeout = 5 * time.Minute
+
+var errObjectTooLarge = errors.New("object too large to cache")
+
+// responseCache serves cacheable GET responses for routes with exposed-cache
+// from memory. Range requests are answered from cached objects; a range miss is
+// passed through and the whole object is fetched in the background, so later
+// ranges of the same file don't reach the backend.
+type responseCache struct {
+	store      *cache.Cache
+	maxObject  int64
+	defaultTTL time.Duration // Used when the backend gives no freshness information
+
+	// Defaults for the stale-while-revalidate and stale-if-error directives
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+
+	filling    sync.Map // Keys with a background fill in flight
+	refreshing sync.Map // Keys with a background revalidation in flight
+}
+
+func (c *responseCache) serveHTTP(rw http.ResponseWriter, req *http.Request, fqdn string, next http.Handler) {
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || req.Header.Get("Authorization") != "" {
+		cacheRequests.Inc(fqdn, "bypass")
+		next.ServeHTTP(rw, req)
+		return
+	}
+
+	key := cache.Key(fqdn, req.URL.RequestURI())
+	if e, ok := c.store.Get(key); ok && acceptsEncoding(req, e.Header.Get("Content-Encoding")) {
+		now := time.Now()
+		if e.Fresh(now) && !wantsRevalidation(req) {
+			cacheRequests.Inc(fqdn, "hit")
+			serveEntry(rw, req, e, "HIT")
+			return
+		}
+		swr, _ := c.staleWindows(e.Header)
+		if now.Before(e.Expires.Add(swr)) && !wantsRevalidation(req) {
+			cacheRequests.Inc(fqdn, "stale")
+			serveEntry(rw, req, e, "STALE")
+			c.refreshInBackground(req, fqdn, key, e, next)
+			return
+		}
+		if c.revalidate(rw, req, fqdn, key, e, next) {
+			return
+		}
+	}
+	cacheRequests.Inc(fqdn, "miss")
+	rw.Header().Set("X-Cache", "MISS")
+
+	isRange := req.Header.Get("Range") != ""
+	var fillReq *http.Request
+	if req.Method == http.MethodGet && isRange {
+		fillReq = req.Clone(context.Background())
+		fillReq.Body = http.NoBody
+	}
+
+	w := &cacheWriter{ResponseWriter: rw, capture: req.Method == http.MethodGet && !isRange, limit: c.maxObject}
+	next.ServeHTTP(w, req)
+
+	switch {
+	case w.capture:
+		c.save(key, w)
+	case fillReq != nil && w.status == http.StatusPartialContent:
+		if total := rangeTotal(w.header); total > 0 && total <= c.maxObject && c.storable(w.header) {
+			go c.fill(key, fillReq, next)
+		}
+	}
+}
+
+// refreshInBackground revalidates an entry served stale, at most once at a time per key.
+func (c *responseCache) refreshInBackground(req *http.Request, fqdn, key string, e *cache.Entry, next http.Handler) {
+	if _, busy := c.refreshing.LoadOrStore(key, struct{}{}); busy {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fillTimeout)
+	bgReq := req.Clone(ctx)
+	go func() {
+		defer cancel()
+		defer c.refreshing.Delete(key)
+		c.revalidate(&discardWriter{header: make(http.Header)}, bgReq, fqdn, key, e, next)
+	}()
+}
+
+// staleWindows returns how long past expiry an entry may be served while it is
+// refreshed, and while the backend fails.
+func (c *responseCache) staleWindows(h http.Header) (whileRevalidate, ifError time.Duration) {
+	whileRevalidate, ifError = c.staleWhileRevalidate, c.staleIfError
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	if _, ok := cc["must-revalidate"]; ok {
+		return 0, 0
+	}
+	if _, ok := cc["proxy-revalidate"]; ok {
+		return 0, 0
+	}
+	if v, err := strconv.Atoi(cc["stale-while-revalidate"]); err == nil && v >= 0 {
+		whileRevalidate = time.Duration(v) * time.Second
+	}
+	if v, err := strconv.Atoi(cc["stale-if-error"]); err == nil && v >= 0 {
+		ifError = time.Duration(v) * time.Second
+	}
+	return whileRevalidate, ifError
+}
+
+// revalidate asks the backend whether a stale entry (or one the client wants
+// revalidated) is still current, using its ETag and Last-Modified. When the
+// backend fails, the entry is served within its stale-if-error window. It
+// returns false when the request must be passed through as a plain miss instead.
+func (c *responseCache) revalidate(rw http.ResponseWriter, req *http.Request, fqdn, key string, e *cache.Entry, next http.Handler) bool {
+	condReq := req.Clone(req.Context())
+	condReq.Method = http.MethodGet
+	condReq.Body = http.NoBody
+	for _, h := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+		condReq.Header.Del(h)
+	}
+	if etag := e.Header.Get("ETag"); etag != "" {
+		condReq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" {
+		condReq.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	w := &cacheWriter{ResponseWriter: &discardWriter{header: make(http.Header)}, capture: true, abort: true, limit: c.maxObject}
+	next.ServeHTTP(w, condReq)
+
+	switch {
+	case w.status == http.StatusNotModified:
+		update := w.header.Clone()
+		for _, h := range []string{"Content-Length", "X-Cache"} {
+			update.Del(h)
+		}
+		merged := e.Header.Clone()
+		for k, v := range update {
+			merged[k] = v
+		}
+		refreshed, ok := c.store.Refresh(key, update, time.Now().Add(c.ttl(merged)))
+		if !ok {
+			return false // Purged meanwhile
+		}
+		cacheRequests.Inc(fqdn, "revalidated")
+		serveEntry(rw, req, refreshed, "REVALIDATED")
+		return true
+	case w.status == http.StatusOK && !w.overflow:
+		// Changed: the new version answers this request too
+		c.save(key, w)
+		cacheRequests.Inc(fqdn, "miss")
+		serveEntry(rw, req, &cache.Entry{Header: w.header, Body: w.body.Bytes(), StoredAt: time.Now()}, "MISS")
+		return true
+	case w.status >= http.StatusInternalServerError:
+		// Backend down or restarting (errors from the transport arrive as 502)
+		if _, sie := c.staleWindows(e.Header); time.Now().Before(e.Expires.Add(sie)) {
+			slog.Warn("Cache: Backend failed, serving stale response", "key", key, "status", w.status)
+			cacheRequests.Inc(fqdn, "stale")
+			serveEntry(rw, req, e, "STALE")
+			return true
+		}
+	}
+	return false
+}
+
+// fill fetches a whole object without the client's Range header and caches it.
+func (c *responseCache) fill(key string, req *http.Request, next http.Handler) {
+	if _, busy := c.filling.LoadOrStore(key, struct{}{}); busy {
+		return
+	}
+	defer c.filling.Delete(key)
+
+	ctx, cancel := context.WithTimeout(context.Background(), fillTimeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+	for _, h := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		req.Header.Del(h)
+	}
+
+	w := &cacheWriter{ResponseWriter: &discardWriter{header: make(http.Header)}, capture: true, abort: true, limit: c.maxObject}
+	next.ServeHTTP(w, req)
+	if c.save(key, w) {
+		slog.Debug("Cache: Filled object after range miss", "key", key, "bytes", w.body.Len())
+	}
+}
+
+// save stores a captured response if it is complete and cacheable.
+func (c *responseCache) save(key string, w *cacheWriter) bool {
+	if w.status != http.StatusOK || w.overflow || !c.storable(w.header) {
+		return false
+	}
+	if cl := w.header.Get("Content-Length"); cl != "" && cl != strconv.Itoa(w.body.Len()) {
+		return false // Truncated, e.g. the client went away mid-transfer
+	}
+
+	header := w.header.Clone()
+	header.Del("X-Cache")
+	now := time.Now()
+	c.store.Put(&cache.Entry{
+		Key:      key,
+		Status:   w.status,
+		Header:   header,
+		Body:     bytes.Clone(w.body.Bytes()),
+		StoredAt: now,
+		Expires:  now.Add(c.ttl(w.header)),
+	})
+	return true
+}
+
+// storable reports whether a response may be kept. Responses that are never
+// fresh are only kept when they can be revalidated.
+func (c *responseCache) storable(h http.Header) bool {
+	if h.Get("Set-Cookie") != "" {
+		return false
+	}
+	if vary := strings.TrimSpace(h.Get("Vary")); vary != "" && !strings.EqualFold(vary, "Accept-Encoding") {
+		return false
+	}
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	for _, d := range []string{"no-store", "private"} {
+		if _, ok := cc[d]; ok {
+			return false
+		}
+	}
+	return c.ttl(h) > 0 || hasValidators(h)
+}
+
+// ttl returns how long a response stays fresh. no-cache responses are stored
+// stale, so every use is revalidated with the backend.
+func (c *responseCache) ttl(h http.Header) time.Duration {
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[d]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs < 0 {
+				return 0
+			}
+			return time.Duration(secs) * time.Second
+		}
+	}
+	if v := h.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		return max(time.Until(expires), 0)
+	}
+	return c.defaultTTL
+}
+
+// hasValidators reports whether a response can be revalidated with a conditional request.
+func hasValidators(h http.Header) bool {
+	return h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+}
+
+// wantsRevalidation reports whether the client asked for an end-to-end
+// revalidation (Cache-Control: no-cache or max-age=0, Pragma: no-cache).
+func wantsRevalidation(req *http.Request) bool {
+	cc := parseCacheControl(req.Header.Get("Cache-Control"))
+	if _, ok := cc["no-cache"]; ok {
+		return true
+	}
+	if v, ok := cc["max-age"]; ok && v == "0" {
+		return true
+	}
+	return strings.EqualFold(req.Header.Get("Pragma"), "no-cache")
+}
+
+// serveEntry answers a request from a cached response, reported in X-Cache as
+// result. http.ServeContent takes care of Range, If-Range and conditional requests.
+func serveEntry(rw http.ResponseWriter, req *http.Request, e *cache.Entry, result string) {
+	h := rw.Header()
+	for k, v := range e.Header {
+		if k != "Content-Length" {
+			h[k] = v
+		}
+	}
+	h.Set("Age", strconv.Itoa(int(time.Since(e.StoredAt).Seconds())))
+	h.Set("X-Cache", result)
+	modtime, _ := http.ParseTime(e.Header.Get("Last-Modified"))
+	http.ServeContent(rw, req, "", modtime, bytes.NewReader(e.Body))
+}
+
+// parseCacheControl splits a Cache-Control header into lowercase directives.
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name != "" {
+			directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return directives
+}
+
+// acceptsEncoding reports whether the client accepts a content coding.
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	if encoding == "" || encoding == "identity" {
+		return true
+	}
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(name, encoding) || name == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeTotal returns the complete length from a Content-Range header, -1 if unknown.
+func rangeTotal(h http.Header) int64 {
+	_, total, ok := strings.Cut(h.Get("Content-Range"), "/")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// cacheWriter passes a response through while keeping a copy of it.
+type cacheWriter struct {
+	http.ResponseWriter
+	capture bool  // Keep the body
+	abort   bool  // Fail writes past limit instead of passing them through (background fills)
+	limit   int64 // Largest body kept
+
+	status   int
+	header   http.Header // Snapshot taken when the status is written
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *cacheWriter) WriteHeader(code int) {
+	if code >= 100 && code <= 199 && code != http.StatusSwitchingProtocols {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.status == 0 {
+		w.status = code
+		w.header = w.ResponseWriter.Header().Clone()
+		if cl, err := strconv.ParseInt(w.header.Get("Content-Length"), 10, 64); err == nil && cl > w.limit {
+			w.overflow = true
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.capture && !w.overflow {
+		if int64(w.body.Len()+len(p)) > w.limit {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(p)
+		}
+	}
+	if w.abort && w.overflow {
+		return 0, errObjectTooLarge
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack on the underlying writer.
+func (w *cacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// discardWriter is the client side of a background fill.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardWriter) WriteHeader(int)             {}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"rproxy/internal/discovery"
+	"strings"
+)
+
+// Values of the exposed-canonical-host label.
+const (
+	CanonicalWWW  = "www"  // Redirect example.com to www.example.com
+	CanonicalApex = "apex" // Redirect www.example.com to example.com
+)
+
+// wwwCounterpart returns the other name of a www/apex pair:
+// www.example.com for example.com and the reverse.
+func wwwCounterpart(fqdn string) string {
+	if apex, ok := strings.CutPrefix(fqdn, "www."); ok {
+		return apex
+	}
+	return "www." + fqdn
+}
+
+// canonicalRedirect returns the name requests for t.FQDN are redirected to
+// under its exposed-canonical-host label, or "" when t.FQDN is the canonical
+// name.
+func canonicalRedirect(t discovery.Target) string {
+	mode := t.Labels[discovery.LabelCanonicalHost]
+	if mode == "" || strings.HasPrefix(t.FQDN, "*.") {
+		return ""
+	}
+	isWWW := strings.HasPrefix(t.FQDN, "www.")
+	switch mode {
+	case CanonicalWWW:
+		if !isWWW {
+			return wwwCounterpart(t.FQDN)
+		}
+	case CanonicalApex:
+		if isWWW {
+			return wwwCounterpart(t.FQDN)
+		}
+	default:
+		slog.Warn("Router: Invalid exposed-canonical-host label, expected www or apex", "label", mode, "container", t.Name)
+	}
+	return ""
+}
+
+// serveCanonicalRedirect sends the client to the same URL on the canonical
+// name, keeping the port it connected to. GET and HEAD get 301 for the
+// widest client and crawler support, other methods 308 so they are repeated
+// with their body.
+func serveCanonicalRedirect(rw http.ResponseWriter, req *http.Request, host string) {
+	if _, port, err := net.SplitHostPort(req.Host); err == nil {
+		host = net.JoinHostPort(host, port)
+	}
+	status := http.StatusPermanentRedirect
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		status = http.StatusMovedPermanently
+	}
+	http.Redirect(rw, req, "https://"+host+req.URL.RequestURI(), status)
+}
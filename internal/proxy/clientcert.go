@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Headers carrying the verified client certificate of a LISTENER_<NAME>_CLIENT_CA
+// listener to backends. Copies sent by clients are always removed, so a
+// backend can trust them whenever they are present.
+const (
+	headerClientCertSubject     = "X-Client-Cert-Subject"     // RFC 2253 distinguished name
+	headerClientCertSAN         = "X-Client-Cert-SAN"         // DNS names, emails, URIs and IPs, comma-separated
+	headerClientCertFingerprint = "X-Client-Cert-Fingerprint" // SHA-256 of the DER certificate, hex
+)
+
+// clientCertRule is one entry of exposed-client-cert-allow.
+type clientCertRule struct {
+	attr  string // cn, ou, san or sha256
+	value string
+}
+
+// clientCertRuleCache memoizes parsed exposed-client-cert-allow labels, like
+// labelRuleCache.
+var clientCertRuleCache sync.Map // string -> []clientCertRule
+
+// parseClientCertRules parses "cn=device-1,ou=sensors,san=svc.internal".
+// Fingerprints may be written with colons and in any case.
+func parseClientCertRules(spec string) ([]clientCertRule, error) {
+	if v, ok := clientCertRuleCache.Load(spec); ok {
+		return v.([]clientCertRule), nil
+	}
+	var rules []clientCertRule
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		attr, value, ok := strings.Cut(entry, "=")
+		attr, value = strings.ToLower(strings.TrimSpace(attr)), strings.TrimSpace(value)
+		if !ok || value == "" || !slices.Contains([]string{"cn", "ou", "san", "sha256"}, attr) {
+			return nil, fmt.Errorf("invalid rule %q (expected cn=, ou=, san= or sha256=)", entry)
+		}
+		if attr == "sha256" {
+			value = strings.ToLower(strings.ReplaceAll(value, ":", ""))
+		}
+		rules = append(rules, clientCertRule{attr, value})
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no rules")
+	}
+	clientCertRuleCache.Store(spec, rules)
+	return rules, nil
+}
+
+// matches reports whether the certificate has the rule's attribute value.
+func (r clientCertRule) matches(cert *x509.Certificate) bool {
+	switch r.attr {
+	case "cn":
+		return cert.Subject.CommonName == r.value
+	case "ou":
+		return slices.Contains(cert.Subject.OrganizationalUnit, r.value)
+	case "san":
+		return slices.ContainsFunc(certSANs(cert), func(san string) bool { return strings.EqualFold(san, r.value) })
+	case "sha256":
+		return certFingerprint(cert) == r.value
+	}
+	return false
+}
+
+// verifiedClientCert returns the client certificate the listener verified
+// against its LISTENER_<NAME>_CLIENT_CA, nil without one.
+func verifiedClientCert(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
+
+func certSANs(cert *x509.Certificate) []string {
+	sans := slices.Concat(cert.DNSNames, cert.EmailAddresses)
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return sans
+}
+
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// setClientCertHeaders replaces the client certificate headers of req with
+// the identity the listener verified, or removes them without one.
+func setClientCertHeaders(req *http.Request) {
+	req.Header.Del(headerClientCertSubject)
+	req.Header.Del(headerClientCertSAN)
+	req.Header.Del(headerClientCertFingerprint)
+	cert := verifiedClientCert(req)
+	if cert == nil {
+		return
+	}
+	req.Header.Set(headerClientCertSubject, cert.Subject.String())
+	if sans := certSANs(cert); len(sans) > 0 {
+		req.Header.Set(headerClientCertSAN, strings.Join(sans, ","))
+	}
+	req.Header.Set(headerClientCertFingerprint, certFingerprint(cert))
+}
+
+// requireClientCert answers 403 unless the verified client certificate
+// matches one of the route's exposed-client-cert-allow rules. Requests
+// without a verified certificate, e.g. on the public listener, and routes
+// with invalid rules are always refused.
+func requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		info, _ := routeInfoFrom(req.Context())
+		cert := verifiedClientCert(req)
+		rules, err := parseClientCertRules(info.Route.ClientCertAllow)
+		if cert == nil || err != nil || !slices.ContainsFunc(rules, func(r clientCertRule) bool { return r.matches(cert) }) {
+			subject := ""
+			if cert != nil {
+				subject = cert.Subject.String()
+			}
+			slog.Debug("Handler: Responding 403 Forbidden (client certificate not allowed)", "fqdn", info.FQDN, "remote", req.RemoteAddr, "subject", subject)
+			rw.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(rw, "403 Forbidden: This client certificate is not allowed.")
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"rproxy/internal/metrics"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var coalescedRequests = metrics.NewCounter("rproxy_coalesced_requests_total",
+	"GET requests on coalescing routes by result (leader, shared, unshared).", "fqdn", "result")
+
+// coalesceKeyHeaders are the request headers a response commonly depends on
+// besides the URL. Requests only share a response when these match.
+var coalesceKeyHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "If-None-Match", "If-Modified-Since"}
+
+// coalescer lets concurrent identical GETs on routes with exposed-coalesce
+// share one backend request. The first request is proxied as usual while its
+// response is recorded; identical requests arriving meanwhile wait for it and
+// get a copy, so a slow or cold backend sees one request instead of a burst.
+// Responses that are too large, set cookies, are private or were cut short
+// are not shared: the waiting requests are then proxied on their own.
+type coalescer struct {
+	maxBody int64 // COALESCE_MAX_BYTES
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a backend request shared by identical requests.
+type flight struct {
+	done   chan struct{} // Closed once the response is recorded
+	shared bool          // The response below may be copied to the waiting requests
+	status int
+	header http.Header
+	body   []byte
+}
+
+func newCoalescer(maxBody int64) *coalescer {
+	return &coalescer{maxBody: maxBody, flights: make(map[string]*flight)}
+}
+
+// wrap returns next with coalescing for the route of fqdn.
+func (c *coalescer) wrap(fqdn string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		c.serveHTTP(rw, req, fqdn, next)
+	})
+}
+
+func (c *coalescer) serveHTTP(rw http.ResponseWriter, req *http.Request, fqdn string, next http.Handler) {
+	if !coalescible(req) {
+		next.ServeHTTP(rw, req)
+		return
+	}
+	key := coalesceKey(fqdn, req)
+
+	c.mu.Lock()
+	f, inFlight := c.flights[key]
+	if !inFlight {
+		f = &flight{done: make(chan struct{})}
+		c.flights[key] = f
+	}
+	c.mu.Unlock()
+
+	if inFlight {
+		select {
+		case <-f.done:
+		case <-req.Context().Done():
+			return // The client went away while waiting
+		}
+		if !f.shared {
+			coalescedRequests.Inc(fqdn, "unshared")
+			next.ServeHTTP(rw, req)
+			return
+		}
+		coalescedRequests.Inc(fqdn, "shared")
+		h := rw.Header()
+		for k, v := range f.header {
+			if k != "Connection" {
+				h[k] = v
+			}
+		}
+		rw.WriteHeader(f.status)
+		rw.Write(f.body)
+		return
+	}
+
+	coalescedRequests.Inc(fqdn, "leader")
+	w := &cacheWriter{ResponseWriter: rw, capture: true, limit: c.maxBody}
+	defer func() {
+		c.mu.Lock()
+		delete(c.flights, key)
+		c.mu.Unlock()
+		close(f.done)
+	}()
+	next.ServeHTTP(w, req)
+	if req.Context().Err() == nil && w.status != 0 && !w.overflow && shareable(w) {
+		f.status, f.header, f.body = w.status, w.header, bytes.Clone(w.body.Bytes())
+		f.shared = true
+	}
+}
+
+// coalescible reports whether req may share a response with others: a plain
+// GET with no credentials, range, body, upgrade or event stream.
+func coalescible(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.ContentLength != 0 || isUpgrade(req) || isEventStream(req) {
+		return false
+	}
+	for _, h := range []string{"Authorization", "Cookie", "Range", "If-Range"} {
+		if req.Header.Get(h) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// coalesceKey identifies the requests that share a response.
+func coalesceKey(fqdn string, req *http.Request) string {
+	var b strings.Builder
+	b.WriteString(fqdn)
+	b.WriteByte(0)
+	b.WriteString(req.URL.RequestURI())
+	for _, h := range coalesceKeyHeaders {
+		b.WriteByte(0)
+		b.WriteString(strings.Join(req.Header.Values(h), ","))
+	}
+	return b.String()
+}
+
+// shareable reports whether a recorded response is complete and meant for
+// anyone who asked.
+func shareable(w *cacheWriter) bool {
+	if w.header.Get("Set-Cookie") != "" {
+		return false
+	}
+	cc := parseCacheControl(w.header.Get("Cache-Control"))
+	for _, d := range []string{"no-store", "private"} {
+		if _, ok := cc[d]; ok {
+			return false
+		}
+	}
+	if cl := w.header.Get("Content-Length"); cl != "" && cl != strconv.Itoa(w.body.Len()) {
+		return false
+	}
+	return true
+}
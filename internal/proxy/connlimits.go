@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// connLimitKey carries the client connection's connLimit in request contexts.
+type connLimitKey struct{}
+
+// connLimit holds the per-route limits of one client connection, taken from
+// the route of its latest request.
+type connLimit struct {
+	conn   net.Conn
+	opened time.Time
+
+	mu       sync.Mutex
+	idle     time.Duration // exposed-idle-timeout, 0 for the server's
+	lifetime time.Duration // exposed-max-lifetime, 0 for unlimited
+	timer    *time.Timer
+}
+
+// connLimits closes idle keep-alive connections on behalf of their routes.
+// The server's IdleTimeout still applies, so route idle timeouts can only be
+// shorter. HTTP/2 connections never go idle between requests this way; they
+// are only subject to the lifetime.
+type connLimits struct {
+	conns sync.Map // net.Conn -> *connLimit
+}
+
+func (l *connLimits) connContext(ctx context.Context, c net.Conn) context.Context {
+	cl := &connLimit{conn: c, opened: time.Now()}
+	l.conns.Store(c, cl)
+	return context.WithValue(ctx, connLimitKey{}, cl)
+}
+
+func (l *connLimits) connState(c net.Conn, state http.ConnState) {
+	v, ok := l.conns.Load(c)
+	if !ok {
+		return
+	}
+	cl := v.(*connLimit)
+	switch state {
+	case http.StateIdle:
+		cl.startIdle()
+	case http.StateActive:
+		cl.stopIdle()
+	case http.StateClosed, http.StateHijacked:
+		cl.stopIdle()
+		l.conns.Delete(c)
+	}
+}
+
+// startIdle closes the connection when its route's idle timeout or lifetime
+// runs out before the next request.
+func (cl *connLimit) startIdle() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	wait := cl.idle
+	if cl.lifetime > 0 {
+		if remaining := cl.lifetime - time.Since(cl.opened); wait == 0 || remaining < wait {
+			wait = max(remaining, 0)
+		}
+	}
+	if wait == 0 && cl.lifetime == 0 {
+		return
+	}
+	cl.timer = time.AfterFunc(wait, func() {
+		slog.Debug("Handler: Closing idle client connection (route idle timeout or lifetime)", "remote", cl.conn.RemoteAddr())
+		cl.conn.Close()
+	})
+}
+
+func (cl *connLimit) stopIdle() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.timer != nil {
+		cl.timer.Stop()
+		cl.timer = nil
+	}
+}
+
+// applyConnLimits hands the route's connection limits to the client
+// connection. Once the connection outlived the route's lifetime, the response
+// asks the client to close it (HTTP/2 connections are shut down gracefully).
+func applyConnLimits(rw http.ResponseWriter, req *http.Request, route Route) {
+	cl, ok := req.Context().Value(connLimitKey{}).(*connLimit)
+	if !ok {
+		return
+	}
+	cl.mu.Lock()
+	cl.idle, cl.lifetime = route.IdleTimeout, route.MaxLifetime
+	expired := cl.lifetime > 0 && time.Since(cl.opened) >= cl.lifetime
+	cl.mu.Unlock()
+	if expired {
+		rw.Header().Set("Connection", "close")
+	}
+}
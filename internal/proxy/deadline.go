@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"rproxy/internal/metrics"
+	"strconv"
+	"time"
+)
+
+// Reasons a request's backend work was cancelled.
+const (
+	cancelClient   = "client"   // The client disconnected or reset the stream
+	cancelDeadline = "deadline" // The route's maximum duration passed
+)
+
+// statusClientClosed is logged for requests whose client went away before the
+// backend answered, as in nginx. The client never sees it.
+const statusClientClosed = 499
+
+// deadlineGrace is how long the client connection outlives a request's
+// deadline, to write the 504.
+const deadlineGrace = time.Second
+
+// errRequestDeadline is the cause of contexts cancelled by the route's maximum
+// duration.
+var errRequestDeadline = errors.New("request exceeded the route's maximum duration")
+
+var cancelledRequests = metrics.NewCounter("rproxy_cancelled_requests_total",
+	"Requests whose backend work was cancelled, by reason: client (the client went away) or deadline (the maximum duration passed).", "fqdn", "reason")
+
+// withRequestDeadline bounds the context of req, and with it the backend
+// request, by d. The connection deadlines of setRequestDeadline only stop
+// reads and writes to the client; cancelling the context also aborts the
+// backend request, so a backend that is still working is not waited for. Zero
+// sets no deadline.
+func withRequestDeadline(req *http.Request, d time.Duration) (*http.Request, context.CancelFunc) {
+	if d <= 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeoutCause(req.Context(), d, errRequestDeadline)
+	return req.WithContext(ctx), cancel
+}
+
+// setDeadlineHeader tells the backend in header (DEADLINE_HEADER) how many
+// milliseconds are left before the request is cancelled, so it can give up
+// on work nobody will wait for. A value sent by the client is never passed on.
+func setDeadlineHeader(req *http.Request, header string) {
+	if header == "" {
+		return
+	}
+	deadline, ok := req.Context().Deadline()
+	if !ok {
+		req.Header.Del(header)
+		return
+	}
+	req.Header.Set(header, strconv.FormatInt(max(time.Until(deadline).Milliseconds(), 1), 10))
+}
+
+// cancelReason returns why ctx was cancelled, "" while it is not.
+func cancelReason(ctx context.Context) string {
+	switch {
+	case ctx.Err() == nil:
+		return ""
+	case errors.Is(context.Cause(ctx), errRequestDeadline):
+		return cancelDeadline
+	default:
+		return cancelClient
+	}
+}
+
+// recordCancelled counts a request of fqdn whose context was cancelled before
+// the handler returned.
+func recordCancelled(fqdn string, ctx context.Context) {
+	if reason := cancelReason(ctx); reason != "" {
+		cancelledRequests.Inc(fqdn, reason)
+	}
+}
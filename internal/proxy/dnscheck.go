@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"rproxy/internal/config"
+	"rproxy/internal/ddns"
+	"rproxy/internal/events"
+	"rproxy/internal/metrics"
+	"slices"
+	"strings"
+	"time"
+)
+
+// dnsLookupTimeout bounds the lookup of one host.
+const dnsLookupTimeout = 5 * time.Second
+
+var (
+	dnsRecordsMatch = metrics.NewGauge("rproxy_dns_records_match",
+		"Whether the public A/AAAA records of the FQDN all point at PUBLIC_IPS (1) or not (0).", "fqdn")
+	dnsCheckErrors = metrics.NewCounter("rproxy_dns_check_errors_total",
+		"DNS record checks that got no answer (timeouts, SERVFAIL), by FQDN.", "fqdn")
+)
+
+// dnsCheck verifies that the A and AAAA records of every published FQDN point
+// at the proxy. A host whose records are missing or lead elsewhere cannot get
+// an HTTP-01 certificate and gets no traffic, usually because a record was
+// forgotten or still points at an old server. Hosts are checked every
+// DNS_CHECK_INTERVAL and, with PUBLIC_IPS, as soon as they are published.
+type dnsCheck struct {
+	router   *Router
+	interval time.Duration
+	expected func() []netip.Addr // PUBLIC_IPS, or the addresses DDNS detected
+	resolver *net.Resolver
+	checkNew bool // Check hosts when published; not with DDNS, which is creating their records then
+
+	drifting map[string]bool // Last result by FQDN, only touched by run
+}
+
+// newDNSCheck returns nil with neither PUBLIC_IPS nor DDNS, or with
+// DNS_CHECK_INTERVAL=0.
+func newDNSCheck(cfg *config.Config, router *Router, publicIPs *ddns.Updater) *dnsCheck {
+	if (len(cfg.PublicIPs) == 0 && publicIPs == nil) || cfg.DNSCheckInterval <= 0 {
+		return nil
+	}
+	expected := publicIPs.Addrs
+	if len(cfg.PublicIPs) > 0 {
+		expected = func() []netip.Addr { return cfg.PublicIPs }
+	}
+	resolver := net.DefaultResolver
+	if server := cfg.DNSCheckResolver; server != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return &dnsCheck{
+		router:   router,
+		interval: cfg.DNSCheckInterval,
+		expected: expected,
+		resolver: resolver,
+		checkNew: len(cfg.PublicIPs) > 0,
+		drifting: make(map[string]bool),
+	}
+}
+
+// run checks every interval, and new hosts when they are published, until
+// ctx is done.
+func (c *dnsCheck) run(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	added, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	// The first check waits for the initial route table
+	for !c.router.Ready() {
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+	c.checkAll(ctx)
+	for {
+		select {
+		case <-ticker.C:
+			c.checkAll(ctx)
+		case ev := <-added:
+			if c.checkNew && ev.Type == events.RouteAdded && slices.Contains(c.router.PublicHosts(), ev.Subject) {
+				c.check(ctx, ev.Subject)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkAll checks each host and forgets those no longer published.
+func (c *dnsCheck) checkAll(ctx context.Context) {
+	if len(c.expected()) == 0 {
+		return // DDNS has not detected an address yet
+	}
+	hosts := c.router.PublicHosts()
+	for _, fqdn := range hosts {
+		c.check(ctx, fqdn)
+	}
+	for fqdn := range c.drifting {
+		if !slices.Contains(hosts, fqdn) {
+			delete(c.drifting, fqdn)
+			dnsRecordsMatch.Delete(fqdn)
+		}
+	}
+}
+
+// check looks fqdn up and reports when the result changes.
+func (c *dnsCheck) check(ctx context.Context, fqdn string) {
+	expected := c.expected()
+	if len(expected) == 0 {
+		return
+	}
+	lookupCtx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+	records, err := c.resolver.LookupNetIP(lookupCtx, "ip", fqdn)
+	cancel()
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		if ctx.Err() == nil {
+			dnsCheckErrors.Inc(fqdn)
+			slog.Warn("Router: DNS check got no answer, keeping the last result", "fqdn", fqdn, "error", err)
+		}
+		return
+	}
+	for i, ip := range records {
+		records[i] = ip.Unmap()
+	}
+
+	var unexpected []netip.Addr
+	for _, ip := range records {
+		if !slices.Contains(expected, ip) {
+			unexpected = append(unexpected, ip)
+		}
+	}
+	drifting := len(records) == 0 || len(unexpected) > 0
+	if drifting {
+		dnsRecordsMatch.Set(0, fqdn)
+	} else {
+		dnsRecordsMatch.Set(1, fqdn)
+	}
+	was, known := c.drifting[fqdn]
+	c.drifting[fqdn] = drifting
+	if drifting == was && known || !drifting && !known {
+		return
+	}
+
+	details := map[string]any{"fqdn": fqdn, "records": addrStrings(records), "expected": addrStrings(expected)}
+	if !drifting {
+		slog.Info("Router: DNS records point at this proxy again", "fqdn", fqdn, "records", records)
+		events.PublishDetails(events.DNSDriftResolved, fqdn, "DNS records point at this proxy again", details)
+		return
+	}
+	message := "no A or AAAA records"
+	if len(records) > 0 {
+		message = fmt.Sprintf("DNS points at %s, not at this proxy (%s)", strings.Join(addrStrings(unexpected), ", "), strings.Join(addrStrings(expected), ", "))
+		details["unexpected"] = addrStrings(unexpected)
+	}
+	slog.Warn("Router: DNS records do not point at this proxy", "fqdn", fqdn, "records", records, "expected", expected)
+	events.PublishDetails(events.DNSDrift, fqdn, message, details)
+}
+
+func addrStrings(ips []netip.Addr) []string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return s
+}
+
+// PublicHosts returns the exact FQDNs served on the public listener, sorted.
+// Wildcard and regex hosts have no single name to look up.
+func (r *Router) PublicHosts() []string {
+	table := r.table.Load()
+	var hosts []string
+	for fqdn, routes := range table.routes {
+		if strings.HasPrefix(fqdn, "*.") {
+			continue
+		}
+		if slices.ContainsFunc(routes, func(route Route) bool { return route.Listener == "" }) {
+			hosts = append(hosts, fqdn)
+		}
+	}
+	slices.Sort(hosts)
+	return hosts
+}
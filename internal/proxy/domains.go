@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"log/slog"
+	"rproxy/internal/discovery"
+	"rproxy/internal/metrics"
+)
+
+var domainRejected = metrics.NewCounter("rproxy_domain_policy_rejected_total",
+	"Routes refused because DOMAIN_ALLOWLIST or DOMAIN_DENYLIST excludes their host or certificate name.")
+
+// admitDomain reports whether the config-level domain policy lets the target
+// be routed: its FQDN for host routes, or the certificate name of a regex
+// route. Hosts matched by a regex are checked per request in GetRoute.
+func (r *Router) admitDomain(t discovery.Target) bool {
+	name := t.FQDN
+	if t.HostRegex != "" {
+		name = t.CertFQDN
+	}
+	if name == "" || r.config.DomainAllowed(name) {
+		return true
+	}
+	slog.Warn("Router: Host not allowed by DOMAIN_ALLOWLIST/DOMAIN_DENYLIST, ignoring route", "fqdn", name, "container", t.Name)
+	domainRejected.Inc()
+	return false
+}
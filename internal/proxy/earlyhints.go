@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// informationalWriter handles the 1xx responses httputil.ReverseProxy relays
+// from backends (103 Early Hints in particular). They are forwarded to the
+// client unless disabled, and never count as the final status.
+type informationalWriter struct {
+	http.ResponseWriter
+	forward bool
+	info    *requestInfo
+}
+
+func (w *informationalWriter) WriteHeader(code int) {
+	if code < 100 || code > 199 || code == http.StatusSwitchingProtocols {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if !w.forward {
+		return // ReverseProxy clears the 1xx headers itself after writing them
+	}
+	fqdn := w.info.fqdn
+	if fqdn == "" {
+		fqdn = unroutedLabel
+	}
+	informationalTotal.Inc(fqdn, strconv.Itoa(code))
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack on the underlying writer.
+func (w *informationalWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"rproxy/internal/config"
+	"rproxy/internal/discovery"
+	"rproxy/internal/events"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// spikeTick is the resolution of the sliding window and how often it is
+	// evaluated.
+	spikeTick = 10 * time.Second
+	// spikeSamples is how many recent 5xx responses are kept per FQDN.
+	spikeSamples = 10
+	// spikeProbeTimeout bounds the backend connection attempt of a report.
+	spikeProbeTimeout = 3 * time.Second
+)
+
+// secretLabels are redacted from the discovery data of spike reports.
+var secretLabels = []string{discovery.LabelAPIKeys, discovery.LabelHMACSecret}
+
+// errorSpikes watches the share of 5xx responses per FQDN over a sliding
+// window. When it stays above ERROR_SPIKE_RATE with at least
+// ERROR_SPIKE_MIN_ERRORS errors, an error_spike event carries a diagnostics
+// bundle to the notifier: recent failed requests, whether the backend accepts
+// connections, and the route and discovery data behind it. error_spike_resolved
+// follows once the rate is back to normal.
+type errorSpikes struct {
+	minErrors int
+	rate      float64
+	buckets   int // Window length in ticks
+	window    time.Duration
+	router    *Router
+	dial      DialFunc
+
+	mu    sync.Mutex
+	hosts map[string]*hostErrors
+}
+
+// hostErrors is the window of one FQDN.
+type hostErrors struct {
+	buckets []errorBucket // Ring, buckets[current] is filling
+	current int
+	samples []errorSample // Oldest first
+	spiking bool
+}
+
+type errorBucket struct {
+	requests, errors int
+}
+
+// errorSample is a 5xx response in a spike report.
+type errorSample struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Upstream  string    `json:"upstream,omitempty"`
+	RequestID string    `json:"request_id"`
+	Error     string    `json:"error,omitempty"` // Why the backend could not answer, for proxy errors
+}
+
+// newErrorSpikes returns nil when ERROR_SPIKE_MIN_ERRORS is 0.
+func newErrorSpikes(cfg *config.Config, router *Router, dial DialFunc) *errorSpikes {
+	if cfg.ErrorSpikeMinErrors <= 0 {
+		return nil
+	}
+	return &errorSpikes{
+		minErrors: cfg.ErrorSpikeMinErrors,
+		rate:      cfg.ErrorSpikeRate,
+		buckets:   max(int(cfg.ErrorSpikeWindow/spikeTick), 1),
+		window:    cfg.ErrorSpikeWindow,
+		router:    router,
+		dial:      dial,
+		hosts:     make(map[string]*hostErrors),
+	}
+}
+
+// record counts a response of a routed request. sample is only used for 5xx.
+func (s *errorSpikes) record(fqdn string, sample errorSample) {
+	if s == nil || fqdn == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.hosts[fqdn]
+	if !ok {
+		h = &hostErrors{buckets: make([]errorBucket, s.buckets)}
+		s.hosts[fqdn] = h
+	}
+	h.buckets[h.current].requests++
+	if sample.Status >= 500 {
+		h.buckets[h.current].errors++
+		if len(h.samples) == spikeSamples {
+			h.samples = h.samples[1:]
+		}
+		h.samples = append(h.samples, sample)
+	}
+}
+
+// run evaluates the windows every tick until ctx is done.
+func (s *errorSpikes) run(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	ticker := time.NewTicker(spikeTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.evaluate(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *errorSpikes) evaluate(ctx context.Context) {
+	type change struct {
+		fqdn             string
+		spiking          bool
+		requests, errors int
+		samples          []errorSample
+	}
+	var changes []change
+
+	s.mu.Lock()
+	for fqdn, h := range s.hosts {
+		var requests, errors int
+		for _, b := range h.buckets {
+			requests += b.requests
+			errors += b.errors
+		}
+		spiking := errors >= s.minErrors && float64(errors) >= s.rate*float64(requests)
+		if spiking != h.spiking {
+			h.spiking = spiking
+			changes = append(changes, change{fqdn, spiking, requests, errors, append([]errorSample(nil), h.samples...)})
+		}
+		if requests == 0 && !h.spiking {
+			delete(s.hosts, fqdn) // Quiet for a whole window
+			continue
+		}
+		h.current = (h.current + 1) % len(h.buckets)
+		h.buckets[h.current] = errorBucket{}
+	}
+	s.mu.Unlock()
+
+	for _, c := range changes {
+		summary := fmt.Sprintf("%d of %d responses in the last %s were 5xx", c.errors, c.requests, s.window)
+		if !c.spiking {
+			slog.Info("Handler: 5xx spike over", "fqdn", c.fqdn, "errors", c.errors, "requests", c.requests)
+			events.PublishDetails(events.ErrorSpikeResolved, c.fqdn, summary, map[string]any{
+				"fqdn": c.fqdn, "requests": c.requests, "errors": c.errors, "window": s.window.String(),
+			})
+			continue
+		}
+		slog.Warn("Handler: 5xx spike", "fqdn", c.fqdn, "errors", c.errors, "requests", c.requests)
+		details := s.diagnose(ctx, c.fqdn)
+		details["fqdn"] = c.fqdn
+		details["requests"] = c.requests
+		details["errors"] = c.errors
+		details["window"] = s.window.String()
+		details["samples"] = c.samples
+		events.PublishDetails(events.ErrorSpike, c.fqdn, summary, details)
+	}
+}
+
+// backendCheck is the result of connecting to a route's backend.
+type backendCheck struct {
+	Target    string `json:"target"`
+	Reachable bool   `json:"reachable"`
+	ConnectMS int64  `json:"connect_ms,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// diagnose collects what is known about fqdn: its routes, whether each
+// backend accepts connections, and what the latest discovery pass found.
+func (s *errorSpikes) diagnose(ctx context.Context, fqdn string) map[string]any {
+	routes, targets, confirmedAt := s.router.hostDiagnostics(fqdn)
+	var checks []backendCheck
+	for _, rt := range routes {
+		if strings.HasPrefix(rt.Target, "static:") {
+			continue
+		}
+		check := backendCheck{Target: rt.Target}
+		probeCtx, cancel := context.WithTimeout(ctx, spikeProbeTimeout)
+		start := time.Now()
+		conn, err := s.dial(probeCtx, "tcp", rt.Target)
+		cancel()
+		if err != nil {
+			check.Error = err.Error()
+		} else {
+			conn.Close()
+			check.Reachable = true
+			check.ConnectMS = time.Since(start).Milliseconds()
+		}
+		checks = append(checks, check)
+	}
+	return map[string]any{
+		"routes":                 routes,
+		"backends":               checks,
+		"discovery":              targets,
+		"discovery_confirmed_at": confirmedAt,
+	}
+}
+
+// hostDiagnostics returns the routes of fqdn (or those matching it by
+// regex), the targets the latest discovery pass found for them with only
+// exposed-* labels and secrets redacted, and when discovery last succeeded.
+func (r *Router) hostDiagnostics(fqdn string) ([]RouteStatus, []discovery.Target, time.Time) {
+	table := r.table.Load()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var routes []RouteStatus
+	hosts := []string{fqdn}
+	for _, route := range table.routes[fqdn] {
+		routes = append(routes, r.routeStatus(fqdn, route))
+	}
+	if wildcard, ok := discovery.WildcardFor(fqdn); ok && len(routes) == 0 {
+		for _, route := range table.routes[wildcard] {
+			routes = append(routes, r.routeStatus(wildcard, route))
+		}
+		hosts = append(hosts, wildcard)
+	}
+	for _, route := range table.regexRoutes {
+		if table.patterns[route.HostRegex].MatchString(fqdn) {
+			routes = append(routes, r.routeStatus("", route))
+			hosts = append(hosts, route.HostRegex)
+		}
+	}
+
+	var targets []discovery.Target
+	for _, host := range hosts {
+		for _, t := range r.discovered[host] {
+			labels := make(map[string]string)
+			for k, v := range t.Labels {
+				switch {
+				case !strings.HasPrefix(k, "exposed-"):
+				case slices.Contains(secretLabels, k):
+					labels[k] = "[redacted]"
+				default:
+					labels[k] = v
+				}
+			}
+			t.Labels = labels
+			targets = append(targets, t)
+		}
+	}
+	return routes, targets, r.confirmedAt
+}
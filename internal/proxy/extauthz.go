@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	extAuthzTimeout = 5 * time.Second
+	extAuthzMaxBody = 64 << 10 // Denial bodies passed to the client
+)
+
+var extAuthzClient = &http.Client{
+	Timeout: extAuthzTimeout,
+	// The verdict is the service's own answer, redirects included
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// extAuthzSkipHeaders are never copied from a denial to the client.
+var extAuthzSkipHeaders = map[string]bool{
+	"Connection": true, "Content-Length": true, "Keep-Alive": true,
+	"Transfer-Encoding": true, "Trailer": true, "Upgrade": true,
+}
+
+// checkExternalAuthz asks the route's authorization service (exposed-ext-authz)
+// whether a request may pass. The service gets the request's method and headers
+// without the body, with X-Forwarded-Method, -Proto, -Host, -Uri and -For
+// describing the original request. A 200 lets the request through with the
+// response headers named by exposed-ext-authz-headers (e.g. X-User) copied
+// onto it; any other status, headers and body are returned to the client.
+// An unreachable service gets the request a 503.
+func checkExternalAuthz(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		info, _ := routeInfoFrom(req.Context())
+		ctx, cancel := context.WithTimeout(req.Context(), extAuthzTimeout)
+		defer cancel()
+		check, err := http.NewRequestWithContext(ctx, req.Method, info.Route.ExtAuthz, nil)
+		if err != nil {
+			slog.Error("Handler: Invalid exposed-ext-authz URL, responding 503", "fqdn", info.FQDN, "url", info.Route.ExtAuthz, "error", err)
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(rw, "503 Service Unavailable: The authorization service is unavailable.")
+			return
+		}
+		check.Header = req.Header.Clone()
+		check.Header.Del("Content-Length")
+		check.Header.Set("X-Forwarded-Method", req.Method)
+		check.Header.Set("X-Forwarded-Proto", "https")
+		check.Header.Set("X-Forwarded-Host", info.FQDN)
+		check.Header.Set("X-Forwarded-Uri", req.URL.RequestURI())
+		check.Header.Set("X-Forwarded-For", clientIP(req.RemoteAddr))
+
+		resp, err := extAuthzClient.Do(check)
+		if err != nil {
+			slog.Error("Handler: Authorization service failed, responding 503", "fqdn", info.FQDN, "url", info.Route.ExtAuthz, "error", err)
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(rw, "503 Service Unavailable: The authorization service is unavailable.")
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			slog.Debug("Handler: Request denied by authorization service", "fqdn", info.FQDN, "status", resp.StatusCode, "remote", req.RemoteAddr)
+			for name, values := range resp.Header {
+				if !extAuthzSkipHeaders[name] {
+					rw.Header()[name] = values
+				}
+			}
+			rw.WriteHeader(resp.StatusCode)
+			io.Copy(rw, io.LimitReader(resp.Body, extAuthzMaxBody))
+			return
+		}
+		for _, name := range parseHeaderList(info.Route.ExtAuthzHeaders) {
+			if values := resp.Header.Values(name); len(values) > 0 {
+				req.Header[name] = values
+			} else {
+				req.Header.Del(name) // Clients cannot pose as the service
+			}
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// validExtAuthzURL reports whether the exposed-ext-authz label is an HTTP(S) URL.
+func validExtAuthzURL(v string) bool {
+	return strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://")
+}
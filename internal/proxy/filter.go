@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// listContains reports whether a comma-separated label value contains v,
+// ignoring case. "type/*" entries match every subtype.
+func listContains(list, v string) bool {
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if strings.EqualFold(item, v) {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(item, "/*"); ok && len(v) > len(prefix) && strings.EqualFold(v[:len(prefix)+1], prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// filterRequest rejects requests with a method outside exposed-methods (405).
+// When exposed-content-types or exposed-content-encodings is set, it also
+// rejects (415) bodies of another type, with several or unparsable
+// Content-Type headers, or encoded other than as listed (stacked encodings
+// never pass).
+func filterRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		info, _ := routeInfoFrom(req.Context())
+		route := info.Route
+		if route.Methods != "" && !listContains(route.Methods, req.Method) {
+			slog.Debug("Handler: Responding 405 Method Not Allowed", "fqdn", info.FQDN, "method", req.Method, "remote", req.RemoteAddr)
+			rw.Header().Set("Allow", strings.ToUpper(strings.ReplaceAll(route.Methods, " ", "")))
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintln(rw, "405 Method Not Allowed")
+			return
+		}
+		if req.ContentLength != 0 && (route.ContentTypes != "" || route.ContentEncodings != "") {
+			if reason := rejectBody(req, route); reason != "" {
+				slog.Debug("Handler: Responding 415 Unsupported Media Type", "fqdn", info.FQDN, "reason", reason, "remote", req.RemoteAddr)
+				rw.WriteHeader(http.StatusUnsupportedMediaType)
+				fmt.Fprintf(rw, "415 Unsupported Media Type: %s\n", reason)
+				return
+			}
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// rejectBody returns why a request body is not accepted by the route, or "".
+func rejectBody(req *http.Request, route Route) string {
+	if route.ContentTypes != "" {
+		types := req.Header.Values("Content-Type")
+		if len(types) != 1 {
+			return "exactly one Content-Type is required"
+		}
+		mediaType, _, err := mime.ParseMediaType(types[0])
+		if err != nil {
+			return "invalid Content-Type"
+		}
+		if !listContains(route.ContentTypes, mediaType) {
+			return fmt.Sprintf("content type %s is not accepted", mediaType)
+		}
+	}
+
+	encodings := req.Header.Values("Content-Encoding")
+	switch {
+	case len(encodings) == 0:
+		return ""
+	case len(encodings) > 1 || strings.Contains(encodings[0], ","):
+		return "stacked content encodings are not accepted"
+	}
+	encoding := strings.TrimSpace(encodings[0])
+	if !strings.EqualFold(encoding, "identity") && !listContains(route.ContentEncodings, encoding) {
+		return fmt.Sprintf("content encoding %s is not accepted", encoding)
+	}
+	return ""
+}
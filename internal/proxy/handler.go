@@ -1,16 +1,39 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"rproxy/internal/cache"
+	"rproxy/internal/config"
+	"rproxy/internal/spiffe"
+	"time"
 )
 
-// NewProxyHandler creates the main HTTP handler.
-func NewProxyHandler(router *Router) http.Handler {
+// NewProxyHandler creates the main HTTP handler. Routes with exposed-cache are
+// served from store. Scanners are sent to tarpit when it is not nil. Reencrypt
+// routes authenticate with the SVID from svids when it is not nil.
+func NewProxyHandler(cfg *config.Config, router *Router, dial DialFunc, tap *Tap, store *cache.Cache, tarpit *Tarpit, svids *spiffe.Source, spikes *errorSpikes) (http.Handler, error) {
+	transport, err := newRouteTransport(cfg.BackendCAFile, dial, svids)
+	if err != nil {
+		return nil, err
+	}
+	labelFilesDir = cfg.LabelFilesDir
+	respCache := &responseCache{
+		store:      store,
+		maxObject:  cfg.CacheMaxObjectBytes,
+		defaultTTL: cfg.CacheDefaultTTL,
+
+		staleWhileRevalidate: cfg.CacheStaleWhileRevalidate,
+		staleIfError:         cfg.CacheStaleIfError,
+	}
+	coalesced := newCoalescer(cfg.CoalesceMaxBytes)
+	starting := &startingPage{enabled: cfg.StartingPage, retryAfter: cfg.StartingRetryAfter}
+
 	director := func(req *http.Request) {
 		fqdn := req.Host // Use the Host header (which includes port if specified)
 		// If Host includes port, strip it for lookup
@@ -19,7 +42,7 @@ func NewProxyHandler(router *Router) http.Handler {
 			fqdn = host
 		}
 
-		route, exists := router.GetRoute(fqdn)
+		route, exists := lookupRoute(router, req, fqdn)
 		if !exists {
 			slog.Warn("Handler: No route found", "fqdn", fqdn)
 			// Set a special header or context value to indicate no route found
@@ -32,9 +55,21 @@ func NewProxyHandler(router *Router) http.Handler {
 		}
 
 		targetURL := &url.URL{
-			Scheme: "http", // Assuming backend is always HTTP for now
+			Scheme: "http",
 			Host:   net.JoinHostPort(route.TargetIP, fmt.Sprintf("%d", route.TargetPort)),
 		}
+		if route.TLSMode == TLSModeReencrypt {
+			targetURL.Scheme = "https"
+		}
+		if upstream, ok := req.Context().Value(scriptUpstreamKey{}).(string); ok {
+			targetURL.Host = upstream // Chosen by the route's request script
+		}
+		// Let the transport pick the backend TLS settings for this route
+		*req = *req.WithContext(withRouteInfo(req.Context(), routeInfo{FQDN: fqdn, Route: route}))
+		if info, ok := req.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+			info.fqdn = fqdn
+			info.upstream = targetURL.Host
+		}
 
 		req.URL.Scheme = targetURL.Scheme
 		req.URL.Host = targetURL.Host
@@ -54,16 +89,13 @@ func NewProxyHandler(router *Router) http.Handler {
 		}
 		
 		// Extract IP address from RemoteAddr (remove port if present)
-		clientIP := req.RemoteAddr
-		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-			clientIP = host
-		}
+		ip := clientIP(req.RemoteAddr)
 		
 		// Set all the X-Forwarded headers
 		req.Header.Set("X-Forwarded-Host", originalHost)
 		req.Header.Set("X-Forwarded-Proto", "https") // We are terminating TLS
-		req.Header.Set("X-Forwarded-For", clientIP)
-		req.Header.Set("X-Real-IP", clientIP)
+		req.Header.Set("X-Forwarded-For", ip)
+		req.Header.Set("X-Real-IP", ip)
 		
 		req.Host = targetURL.Host // Set Host header to the target's host
 
@@ -72,26 +104,240 @@ func NewProxyHandler(router *Router) http.Handler {
 		// log.Printf("[DEBUG] Handler: Proxying %s -> %s%s", fqdn, targetURL.Host, req.URL.Path)
 	}
 
+	// Error details (backend addresses, dial errors) only reach clients with
+	// ERROR_DETAILS; the logs always have them under the request ID.
 	errorHandler := func(rw http.ResponseWriter, req *http.Request, err error) {
+		info, _ := req.Context().Value(requestInfoKey{}).(*requestInfo)
+		if info == nil {
+			info = &requestInfo{}
+		}
 		if req.Header.Get("X-RProxy-Error") == "No route found" {
-			slog.Warn("Handler: Responding 502 Bad Gateway (No route found)", "host", req.Host)
+			slog.Warn("Handler: Responding 502 Bad Gateway (No route found)", "host", req.Host, "request_id", info.id)
 			rw.WriteHeader(http.StatusBadGateway)
 			fmt.Fprintln(rw, "502 Bad Gateway: No backend service available for this host.")
 			return
 		}
 
+		info.err = err.Error()
+		switch cancelReason(req.Context()) {
+		case cancelDeadline:
+			slog.Warn("Handler: Responding 504 Gateway Timeout (maximum request duration exceeded)", "fqdn", info.fqdn, "upstream", info.upstream, "request_id", info.id)
+			rw.WriteHeader(http.StatusGatewayTimeout)
+			fmt.Fprintf(rw, "504 Gateway Timeout: The backend did not answer in time.\nRequest ID: %s\n", info.id)
+			return
+		case cancelClient:
+			// Nobody is listening, only the access log sees the status
+			slog.Debug("Handler: Client went away, backend request cancelled", "fqdn", info.fqdn, "upstream", info.upstream, "request_id", info.id)
+			rw.WriteHeader(statusClientClosed)
+			return
+		}
+		if starting.serve(rw, req, err) {
+			return
+		}
+
 		// Default error handling for other proxy errors (e.g., connection refused)
-		slog.Error("Handler: Proxy error", "host", req.Host, "error", err)
+		slog.Error("Handler: Proxy error", "fqdn", info.fqdn, "upstream", info.upstream, "request_id", info.id, "error", err)
 		rw.WriteHeader(http.StatusBadGateway) // 502 usually appropriate for backend errors
-		fmt.Fprintf(rw, "502 Bad Gateway: %v", err)
+		if cfg.ErrorDetails {
+			fmt.Fprintf(rw, "502 Bad Gateway: %v\nRequest ID: %s\n", err, info.id)
+		} else {
+			fmt.Fprintf(rw, "502 Bad Gateway: The backend service is unavailable.\nRequest ID: %s\n", info.id)
+		}
 	}
 
-	proxy := &httputil.ReverseProxy{
-		Director:     director,
-		ErrorHandler: errorHandler,
-		// ModifyResponse can be added later if needed
-		// BufferPool can be added later for performance
+	pool := &proxyPool{base: httputil.ReverseProxy{
+		Director:       director,
+		Transport:      transport,
+		ErrorHandler:   errorHandler,
+		ModifyResponse: newResponsePipeline(cfg.StripResponseHeaders, ParseHeaderRules(cfg.ResponseHeaders), cfg.RewriteLocation, cfg.UpgradeIdleTimeout, cfg.AltSvc),
+		BufferPool:     copyBufferPool{},
+	}}
+
+	ingress := newBandwidthBudget("in", cfg.BandwidthLimitIn)
+	egress := newBandwidthBudget("out", cfg.BandwidthLimitOut)
+
+	if name := validMiddlewareOrder(cfg.MiddlewareOrder); name != "" {
+		return nil, fmt.Errorf("unknown middleware %q in MIDDLEWARE_ORDER", name)
+	}
+	// Serves a route after its middlewares (see middleware.go) passed
+	chains := &routeChains{defaultOrder: cfg.MiddlewareOrder}
+	chains.terminal = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		info, _ := routeInfoFrom(req.Context())
+		route := info.Route
+		flushInterval := cfg.FlushInterval
+		if route.Streaming {
+			flushInterval = route.FlushInterval
+		}
+		var backend http.Handler = pool.get(flushInterval)
+		if route.Coalesce {
+			backend = coalesced.wrap(info.FQDN, backend)
+		}
+		switch {
+		case route.StaticRoot != "":
+			if reqInfo, ok := req.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+				reqInfo.upstream = route.target()
+			}
+			serveStatic(rw, req, route)
+		case route.Cache:
+			respCache.serveHTTP(rw, req, info.FQDN, backend)
+		default:
+			backend.ServeHTTP(rw, req)
+		}
+	})
+
+	// Bodies are streamed in both directions; the read and write deadlines of
+	// each request are set from its route's maximum duration. Streaming routes
+	// (exposed-flush-interval) and SSE requests are flushed as they arrive and
+	// have no deadline unless the route sets exposed-max-duration.
+	proxy := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		maxDuration := cfg.MaxRequestDuration
+		fqdn := req.Host
+		if host, _, err := net.SplitHostPort(fqdn); err == nil {
+			fqdn = host
+		}
+		// Upgraded connections keep the deadlines set here after the hijack; they
+		// are bounded by the upgrade idle timeout instead
+		streaming := isEventStream(req) || isUpgrade(req)
+		route, ok := lookupRoute(router, req, fqdn)
+		if tarpit != nil {
+			switch {
+			case !ok:
+				tarpit.serve(rw, req, fqdn, "unrouted")
+				return
+			case tarpit.matchesPath(req.URL.Path):
+				if info, isSet := req.Context().Value(requestInfoKey{}).(*requestInfo); isSet {
+					info.fqdn = fqdn
+				}
+				tarpit.serve(rw, req, fqdn, "path")
+				return
+			}
+		}
+		if info, isSet := req.Context().Value(requestInfoKey{}).(*requestInfo); isSet && ok {
+			info.accessLog = route.AccessLog
+		}
+		if ok && route.Streaming {
+			streaming = true
+		}
+		if streaming {
+			maxDuration = 0
+		}
+		if ok && route.MaxDuration != 0 {
+			maxDuration = max(route.MaxDuration, 0) // Negative means unlimited
+		}
+		setRequestDeadline(rw, maxDuration)
+		req, cancel := withRequestDeadline(req, maxDuration)
+		defer cancel()
+
+		if eta, draining := router.DrainETA(fqdn); draining {
+			if info, ok := req.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+				info.fqdn = fqdn
+			}
+			serveDrained(rw, fqdn, route, ok, eta)
+			return
+		}
+
+		if !ok {
+			pool.get(cfg.FlushInterval).ServeHTTP(rw, req) // The director answers 502
+			return
+		}
+		if info, isSet := req.Context().Value(requestInfoKey{}).(*requestInfo); isSet {
+			info.fqdn = fqdn
+		}
+		if !isEventStream(req) && !isUpgrade(req) {
+			// Those two end by cancellation
+			defer recordCancelled(fqdn, req.Context())
+		}
+		setDeadlineHeader(req, cfg.DeadlineHeader)
+		setClientCertHeaders(req) // Before middlewares, so ext-authz and scripts see the verified values too
+		requestProtocols.Inc(fqdn, req.Proto)
+		if v := altSvcHeader(route, cfg.AltSvc); v != "" {
+			rw.Header().Set("Alt-Svc", v)
+		}
+		if route.RedirectHost != "" {
+			serveCanonicalRedirect(rw, req, route.RedirectHost)
+			return
+		}
+		applyConnLimits(rw, req, route)
+		req = req.WithContext(withRouteInfo(req.Context(), routeInfo{FQDN: fqdn, Route: route}))
+		if egress != nil {
+			rw = &throttledWriter{ResponseWriter: rw, budget: egress, ctx: req.Context(), route: fqdn}
+		}
+		if ingress != nil && req.Body != nil && req.Body != http.NoBody {
+			req.Body = &throttledBody{ReadCloser: req.Body, budget: ingress, ctx: req.Context(), route: fqdn}
+		}
+		chains.handler(route).ServeHTTP(rw, req)
+	})
+
+	var handler http.Handler = proxy
+	if cfg.ReadinessGate {
+		// Avoid a burst of 502s right after startup: answer 503 until the router is ready
+		handler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if !router.Ready() {
+				slog.Debug("Handler: Responding 503 Service Unavailable (not ready)", "host", req.Host)
+				rw.Header().Set("Retry-After", "5")
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintln(rw, "503 Service Unavailable: Proxy is starting up.")
+				return
+			}
+			proxy.ServeHTTP(rw, req)
+		})
 	}
 
-	return proxy
+	return instrumentHandler(handler, tap, cfg.EarlyHints, cfg.AccessLog, spikes), nil
+}
+
+// instrumentHandler records metrics for every request, writes the access log
+// and publishes completed requests to the tap while it has subscribers.
+// Informational (1xx) backend responses are forwarded only when earlyHints is
+// set. Routes may override the accessLog mode. Responses are counted for 5xx
+// spike detection unless spikes is nil.
+func instrumentHandler(next http.Handler, tap *Tap, earlyHints bool, accessLog string, spikes *errorSpikes) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		info := &requestInfo{id: requestID(req)}
+		req.Header.Set(requestIDHeader, info.id)
+		rec := &statusRecorder{ResponseWriter: rw}
+		out := &informationalWriter{ResponseWriter: rec, forward: earlyHints, info: info}
+		var body *countingBody
+		if req.Body != nil && req.Body != http.NoBody {
+			body = &countingBody{ReadCloser: req.Body}
+			req.Body = body
+		}
+		next.ServeHTTP(out, req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, info)))
+
+		var reqBytes int64
+		if body != nil {
+			reqBytes = body.n.Load()
+		}
+		recordRequest(info.fqdn, rec.status, reqBytes, rec.bytes, time.Since(start).Seconds())
+		spikes.record(info.fqdn, errorSample{Time: start, Method: req.Method, Path: req.URL.Path, Status: rec.status, Upstream: info.upstream, RequestID: info.id, Error: info.err})
+
+		mode := accessLog
+		if info.accessLog != "" {
+			mode = info.accessLog
+		}
+		if !tap.active() && mode == AccessLogOff {
+			return
+		}
+		fqdn := req.Host
+		if host, _, err := net.SplitHostPort(fqdn); err == nil {
+			fqdn = host
+		}
+		ev := TapEvent{
+			Time:     start,
+			FQDN:     fqdn,
+			Method:   req.Method,
+			Path:     req.URL.Path,
+			Status:   rec.status,
+			Duration: time.Since(start),
+			Upstream: info.upstream,
+			Remote:   req.RemoteAddr,
+
+			RequestID: info.id,
+		}
+		logAccess(mode, ev, rec.bytes)
+		if tap.active() {
+			tap.publish(ev)
+		}
+	})
 } 
\ No newline at end of file
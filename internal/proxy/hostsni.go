@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"rproxy/internal/metrics"
+	"strings"
+)
+
+var hostSNIMismatches = metrics.NewCounter("rproxy_host_sni_mismatches_total",
+	"Requests answered 421 because their Host did not match the TLS server name (ENFORCE_HOST_SNI).")
+
+// enforceHostSNI answers 421 Misdirected Request when the Host of a request
+// differs from the server name its TLS connection was established for. This
+// stops a connection opened for one route from being used for another, as in
+// domain fronting. Browsers coalescing HTTP/2 connections across names of one
+// certificate retry on a new connection. Connections without SNI are left to
+// NO_SNI_CERT.
+func enforceHostSNI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil || req.TLS.ServerName == "" {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(host, ".")
+		if !strings.EqualFold(host, req.TLS.ServerName) {
+			slog.Debug("Handler: Responding 421 Misdirected Request (Host does not match SNI)", "host", req.Host, "sni", req.TLS.ServerName, "remote", req.RemoteAddr)
+			hostSNIMismatches.Inc()
+			rw.WriteHeader(http.StatusMisdirectedRequest)
+			fmt.Fprintln(rw, "421 Misdirected Request: Host does not match the TLS server name.")
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// labelFilePrefix marks label values naming a file inside the rproxy
+// container, so secrets and larger content need not appear in labels.
+const labelFilePrefix = "file:"
+
+// labelFileRecheck is how often referenced files are checked for changes.
+const labelFileRecheck = 10 * time.Second
+
+// labelFilesDir is LABEL_FILES_DIR, the only directory "file:" references may
+// read from; empty refuses them. Labels come from containers, so without it a
+// maintenance page could be "file:" plus rproxy's own keys. Set once by
+// NewProxyHandler.
+var labelFilesDir string
+
+// errLabelFilesOff is returned for "file:" references without LABEL_FILES_DIR.
+var errLabelFilesOff = errors.New("file: labels need LABEL_FILES_DIR")
+
+// labelFile is the last read of a referenced file.
+type labelFile struct {
+	data    string
+	err     error
+	checked time.Time
+	modTime time.Time
+}
+
+var labelFiles sync.Map // path -> *labelFile
+
+// resolveLabel returns the value of a label, reading "file:" references
+// under LABEL_FILES_DIR. Files are re-read when their modification time
+// changes.
+func resolveLabel(spec string) (string, error) {
+	path, isFile := strings.CutPrefix(spec, labelFilePrefix)
+	if !isFile {
+		return spec, nil
+	}
+	now := time.Now()
+	v, ok := labelFiles.Load(path)
+	if ok && now.Sub(v.(*labelFile).checked) < labelFileRecheck {
+		return v.(*labelFile).data, v.(*labelFile).err
+	}
+
+	file := &labelFile{checked: now}
+	root, name, err := openLabelFilesRoot(path)
+	if err == nil {
+		defer root.Close()
+		var info os.FileInfo
+		info, err = root.Stat(name)
+		switch {
+		case err != nil:
+		case !info.Mode().IsRegular():
+			err = fmt.Errorf("%s is not a regular file", path)
+		case ok && v.(*labelFile).err == nil && info.ModTime().Equal(v.(*labelFile).modTime):
+			file.data, file.modTime = v.(*labelFile).data, info.ModTime()
+		default:
+			var data []byte
+			data, err = root.ReadFile(name)
+			file.data, file.modTime = string(data), info.ModTime()
+		}
+	}
+	if file.err = err; err != nil {
+		file.data = ""
+		slog.Error("Handler: Cannot read file referenced by label", "path", path, "error", err)
+	}
+	labelFiles.Store(path, file)
+	return file.data, file.err
+}
+
+// openLabelFilesRoot opens LABEL_FILES_DIR and returns path relative to it.
+// path may be relative or absolute below the directory; os.Root keeps ".."
+// and symlinks from escaping it.
+func openLabelFilesRoot(path string) (*os.Root, string, error) {
+	if labelFilesDir == "" {
+		return nil, "", errLabelFilesOff
+	}
+	name := path
+	if filepath.IsAbs(path) {
+		rel, err := filepath.Rel(labelFilesDir, path)
+		if err != nil || !filepath.IsLocal(rel) {
+			return nil, "", fmt.Errorf("%s is outside LABEL_FILES_DIR", path)
+		}
+		name = rel
+	}
+	root, err := os.OpenRoot(labelFilesDir)
+	if err != nil {
+		return nil, "", err
+	}
+	return root, name, nil
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"rproxy/internal/config"
+)
+
+// listenAddr is a socket to open for the public listener.
+type listenAddr struct {
+	network string // tcp (dual-stack), tcp4 or tcp6 (IPv6 only)
+	address string
+}
+
+// publicAddrs turns LISTEN_FAMILY and LISTEN_ADDRS into the sockets to open
+// on port 443. Explicit addresses pick their family from the address.
+func publicAddrs(cfg *config.Config) []listenAddr {
+	if len(cfg.ListenAddrs) > 0 {
+		addrs := make([]listenAddr, 0, len(cfg.ListenAddrs))
+		for _, a := range cfg.ListenAddrs {
+			network := "tcp6"
+			if netip.MustParseAddr(a).Is4() { // Validated by config
+				network = "tcp4"
+			}
+			addrs = append(addrs, listenAddr{network, net.JoinHostPort(a, "443")})
+		}
+		return addrs
+	}
+	switch cfg.ListenFamily {
+	case config.ListenIPv4:
+		return []listenAddr{{"tcp4", "0.0.0.0:443"}}
+	case config.ListenIPv6:
+		return []listenAddr{{"tcp6", "[::]:443"}} // tcp6 sets IPV6_V6ONLY
+	default:
+		return []listenAddr{{"tcp", ":443"}} // Dual-stack where the host supports it
+	}
+}
+
+// clientIP returns the client address as forwarded to backends: no port, no
+// zone, and IPv4-mapped IPv6 addresses (from dual-stack sockets) as plain IPv4.
+// IPv6 addresses are not bracketed, as X-Forwarded-For expects.
+func clientIP(remoteAddr string) string {
+	if ap, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		return ap.Addr().Unmap().WithZone("").String()
+	}
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// listenerKey carries the LISTENERS profile that accepted a request, empty for
+// the public listener.
+type listenerKey struct{}
+
+// lookupRoute finds the route for a request, hiding routes that belong to a
+// different listener profile than the one the request arrived on.
+func lookupRoute(router *Router, req *http.Request, fqdn string) (Route, bool) {
+	route, ok := router.GetRoute(fqdn, req.URL.Path)
+	if !ok {
+		return Route{}, false
+	}
+	listener, _ := req.Context().Value(listenerKey{}).(string)
+	return route, route.Listener == listener
+}
+
+// profileTLSConfig derives a listener profile's TLS policy from the base config.
+func profileTLSConfig(base *tls.Config, l config.Listener) (*tls.Config, error) {
+	tlsConfig := base.Clone()
+	tlsConfig.MinVersion = l.MinTLS
+	if l.ClientCAFile != "" {
+		pem, err := os.ReadFile(l.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA for listener %s: %w", l.Name, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA for listener %s", l.Name)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// CheckListen opens and closes the sockets the proxy listens on, public,
+// LISTENERS profiles and HTTP_ADDR alike, for `rproxy selftest`. It returns the addresses
+// bound, stopping at the first that fails.
+func CheckListen(cfg *config.Config) ([]string, error) {
+	var addrs []listenAddr
+	if cfg.PublicListener {
+		addrs = publicAddrs(cfg)
+	}
+	for _, l := range cfg.Listeners {
+		addrs = append(addrs, listenAddr{"tcp", l.Addr})
+	}
+	if cfg.HTTPAddr != "" {
+		addrs = append(addrs, listenAddr{"tcp", cfg.HTTPAddr})
+	}
+	var bound []string
+	for _, a := range addrs {
+		ln, err := net.Listen(a.network, a.address)
+		if err != nil {
+			return bound, err
+		}
+		ln.Close()
+		bound = append(bound, a.address)
+	}
+	return bound, nil
+}
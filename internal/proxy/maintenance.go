@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultRetryAfter is sent while draining without an expected end.
+const defaultRetryAfter = 30 * time.Second
+
+// maintenanceData is available to maintenance page templates.
+type maintenanceData struct {
+	Service    string // Container or service name
+	FQDN       string
+	ETA        time.Time // Expected end of the maintenance, zero if unknown
+	RetryAfter int       // Seconds, as sent in Retry-After
+}
+
+// maintenanceTemplates memoizes parsed pages by label value. A "file:" entry
+// is replaced when the file changes, so old pages are not kept.
+var maintenanceTemplates sync.Map // spec -> maintenancePage
+
+// maintenancePage is a template parsed from text, the resolved label value.
+type maintenancePage struct {
+	text string
+	tmpl *template.Template
+}
+
+// maintenanceTemplate parses a route's exposed-maintenance-page label, inline
+// or from a "file:" in LABEL_FILES_DIR.
+func maintenanceTemplate(spec string) (*template.Template, error) {
+	text, err := resolveLabel(spec)
+	if err != nil {
+		return nil, err
+	}
+	if cached, ok := maintenanceTemplates.Load(spec); ok && cached.(maintenancePage).text == text {
+		return cached.(maintenancePage).tmpl, nil
+	}
+	tmpl, err := template.New("maintenance").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	maintenanceTemplates.Store(spec, maintenancePage{text: text, tmpl: tmpl})
+	return tmpl, nil
+}
+
+// serveDrained answers a request for a drained FQDN with 503, using the
+// route's maintenance page when it has one.
+func serveDrained(rw http.ResponseWriter, fqdn string, route Route, hasRoute bool, eta time.Time) {
+	retryAfter := defaultRetryAfter
+	if until := time.Until(eta); until > 0 {
+		retryAfter = until
+	}
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	rw.Header().Set("Retry-After", fmt.Sprint(seconds))
+	rw.Header().Set("Cache-Control", "no-store")
+
+	if hasRoute && route.MaintenancePage != "" {
+		tmpl, err := maintenanceTemplate(route.MaintenancePage)
+		if err == nil {
+			var page bytes.Buffer
+			data := maintenanceData{Service: route.Service, FQDN: fqdn, ETA: eta, RetryAfter: seconds}
+			if err = tmpl.Execute(&page, data); err == nil {
+				rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				rw.Write(page.Bytes())
+				return
+			}
+		}
+		slog.Error("Handler: Failed to render maintenance page, using the default", "fqdn", fqdn, "error", err)
+	}
+
+	slog.Info("Handler: Responding 503 Service Unavailable (draining)", "host", fqdn)
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintln(rw, "503 Service Unavailable: This service is being drained.")
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import "strings"
+
+// routeMatcher finds the route for a host and path in time linear in their
+// length, however many routes there are. Hosts are walked label by label from
+// the TLD, so a wildcard route hangs off the node of its parent domain; paths
+// are walked segment by segment, so prefixes match on element boundaries like
+// Route.matches. Regex host routes are not part of it.
+type routeMatcher struct {
+	root hostNode
+}
+
+// hostNode is a domain in the host tree, e.g. the "example" child of "com".
+type hostNode struct {
+	children map[string]*hostNode // Keyed by the next label to the left
+	exact    *pathNode            // Routes of this host, nil if none
+	wildcard *pathNode            // Routes of "*." + this host, nil if none
+}
+
+// pathNode is a path prefix, e.g. the "api" child of "" for "/api".
+type pathNode struct {
+	children map[string]*pathNode // Keyed by the next path segment
+	route    *Route               // Route with this prefix, nil if none
+}
+
+// newRouteMatcher indexes routes (fqdn -> routes, longest path prefix first).
+// When several routes end on the same node ("/api" and "/api/"), the first wins.
+func newRouteMatcher(routes map[string][]Route) *routeMatcher {
+	m := &routeMatcher{}
+	for fqdn, list := range routes {
+		var paths **pathNode
+		if parent, ok := strings.CutPrefix(fqdn, "*."); ok {
+			paths = &m.root.insert(parent).wildcard
+		} else {
+			paths = &m.root.insert(fqdn).exact
+		}
+		if *paths == nil {
+			*paths = &pathNode{}
+		}
+		for _, route := range list {
+			(*paths).insert(route)
+		}
+	}
+	return m
+}
+
+// lookup returns the route for fqdn and path. Exact host routes take
+// precedence over the wildcard route of the parent domain.
+func (m *routeMatcher) lookup(fqdn, path string) (Route, bool) {
+	first, parentHost, found := strings.Cut(fqdn, ".")
+	var host, parent *hostNode
+	if found {
+		if parent = m.root.find(parentHost); parent != nil {
+			host = parent.children[first]
+		}
+	} else {
+		host = m.root.find(fqdn)
+	}
+	if host != nil && host.exact != nil {
+		if route, ok := host.exact.lookup(path); ok {
+			return route, true
+		}
+	}
+	// Wildcards are only indexed under domains with a dot (see validHostPattern),
+	// matching discovery.WildcardFor
+	if parent != nil && parent.wildcard != nil {
+		return parent.wildcard.lookup(path)
+	}
+	return Route{}, false
+}
+
+// insert returns the node of host, creating it and its parents as needed.
+func (n *hostNode) insert(host string) *hostNode {
+	for {
+		i := strings.LastIndexByte(host, '.')
+		label := host[i+1:]
+		child, ok := n.children[label]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*hostNode)
+			}
+			child = &hostNode{}
+			n.children[label] = child
+		}
+		n = child
+		if i < 0 {
+			return n
+		}
+		host = host[:i]
+	}
+}
+
+// find returns the node of host, nil if no route is under it.
+func (n *hostNode) find(host string) *hostNode {
+	for n != nil {
+		i := strings.LastIndexByte(host, '.')
+		n = n.children[host[i+1:]]
+		if i < 0 {
+			break
+		}
+		host = host[:i]
+	}
+	return n
+}
+
+// insert adds route under its path prefix, unless another route holds it.
+func (n *pathNode) insert(route Route) {
+	if prefix := strings.TrimSuffix(route.PathPrefix, "/"); prefix != "" {
+		for _, segment := range strings.Split(prefix, "/") {
+			child, ok := n.children[segment]
+			if !ok {
+				if n.children == nil {
+					n.children = make(map[string]*pathNode)
+				}
+				child = &pathNode{}
+				n.children[segment] = child
+			}
+			n = child
+		}
+	}
+	if n.route == nil {
+		n.route = &route
+	}
+}
+
+// lookup returns the route with the longest prefix of path.
+func (n *pathNode) lookup(path string) (Route, bool) {
+	var best *Route
+	for rest, done := path, false; n != nil; {
+		if n.route != nil {
+			best = n.route
+		}
+		if done {
+			break
+		}
+		var segment string
+		var more bool
+		segment, rest, more = strings.Cut(rest, "/")
+		n, done = n.children[segment], !more
+	}
+	if best == nil {
+		return Route{}, false
+	}
+	return *best, true
+}
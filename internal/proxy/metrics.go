@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"io"
+	"rproxy/internal/metrics"
+	"strconv"
+	"sync/atomic"
+)
+
+// Proxy metrics, served by the admin API at /metrics.
+var (
+	requestsTotal = metrics.NewCounter("rproxy_requests_total",
+		"Proxied requests by route FQDN and status code.", "fqdn", "code")
+	requestBytes = metrics.NewCounter("rproxy_request_bytes_total",
+		"Request body bytes received from clients.", "fqdn")
+	responseBytes = metrics.NewCounter("rproxy_response_bytes_total",
+		"Response body bytes sent to clients.", "fqdn")
+	requestProtocols = metrics.NewCounter("rproxy_request_protocols_total",
+		"Routed requests by FQDN and HTTP version (HTTP/1.1, HTTP/2.0).", "fqdn", "protocol")
+	informationalTotal = metrics.NewCounter("rproxy_informational_responses_total",
+		"1xx responses (e.g. 103 Early Hints) forwarded to clients.", "fqdn", "code")
+	requestSeconds = metrics.NewCounter("rproxy_request_duration_seconds_total",
+		"Cumulative time spent serving requests.", "fqdn")
+
+	upgradedOpen = metrics.NewGauge("rproxy_upgraded_connections",
+		"Currently open upgraded (e.g. WebSocket) connections.", "fqdn")
+	upgradedTotal = metrics.NewCounter("rproxy_upgraded_connections_total",
+		"Upgraded connections opened.", "fqdn")
+	upgradedReaped = metrics.NewCounter("rproxy_upgraded_idle_closed_total",
+		"Upgraded connections closed by the idle timeout.", "fqdn")
+
+	cacheRequests = metrics.NewCounter("rproxy_cache_requests_total",
+		"Requests on caching routes by result (hit, stale, revalidated, miss, bypass).", "fqdn", "result")
+
+	discoveryFailures = metrics.NewCounter("rproxy_discovery_failures_total",
+		"Failed discovery passes by provider.", "provider")
+	discoverySuccesses = metrics.NewCounter("rproxy_discovery_successes_total",
+		"Successful discovery passes by provider.", "provider")
+	discoverySeconds = metrics.NewGauge("rproxy_discovery_duration_seconds",
+		"Duration of the provider's latest discovery pass, failed or not.", "provider")
+	discoveryTargets = metrics.NewGauge("rproxy_discovery_targets",
+		"Targets (containers, services, routes) found by the provider's latest successful pass.", "provider")
+	discoveryProviderLastSuccess = metrics.NewGauge("rproxy_discovery_provider_last_success_timestamp_seconds",
+		"Unix time of the provider's last successful discovery pass.", "provider")
+	discoveryLastSuccess = metrics.NewGauge("rproxy_discovery_last_success_timestamp_seconds",
+		"Unix time of the last successful discovery pass.")
+	discoveryDegraded = metrics.NewGauge("rproxy_discovery_degraded",
+		"1 while discovery keeps failing and polls are backed off.")
+	routesStale = metrics.NewGauge("rproxy_routes_stale",
+		"1 while the served routes are not confirmed by discovery (snapshot restored or discovery failing).")
+	routeRemovalsDeferred = metrics.NewCounter("rproxy_route_removals_deferred_total",
+		"Discovery passes that kept a missing route instead of removing it.")
+	routesPendingRemoval = metrics.NewGauge("rproxy_routes_pending_removal",
+		"Hosts missing from discovery but kept until ROUTE_REMOVAL_MISSES is reached.")
+)
+
+// unroutedLabel is the fqdn label for requests that matched no route, so
+// arbitrary Host headers cannot create new series.
+const unroutedLabel = "unrouted"
+
+func recordRequest(fqdn string, status int, reqBytes, respBytes int64, seconds float64) {
+	if fqdn == "" {
+		fqdn = unroutedLabel
+	}
+	requestsTotal.Inc(fqdn, strconv.Itoa(status))
+	requestBytes.Add(float64(reqBytes), fqdn)
+	responseBytes.Add(float64(respBytes), fqdn)
+	requestSeconds.Add(seconds, fqdn)
+}
+
+// countingBody counts the request body bytes read by the reverse proxy.
+type countingBody struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
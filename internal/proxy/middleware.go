@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// middleware is a per-route request stage in front of the route's handler
+// (static files, cache or backend). It only runs on routes whose labels
+// configure it. Middlewares read the matched route with routeInfoFrom.
+type middleware struct {
+	name    string
+	enabled func(rt Route) bool
+	wrap    func(next http.Handler) http.Handler
+}
+
+// middlewares lists the built-in middlewares in their default order. Routes
+// reorder them with exposed-middlewares, the whole proxy with MIDDLEWARE_ORDER.
+var middlewares = []middleware{
+	{"client-cert", func(rt Route) bool { return rt.ClientCertAllow != "" }, requireClientCert},
+	{"filter", func(rt Route) bool { return rt.Methods != "" || rt.ContentTypes != "" || rt.ContentEncodings != "" }, filterRequest},
+	{"api-key", func(rt Route) bool { return rt.APIKeys != "" }, requireAPIKey},
+	{"hmac", func(rt Route) bool { return rt.HMACSecret != "" }, requireSignature},
+	{"ext-authz", func(rt Route) bool { return rt.ExtAuthz != "" }, checkExternalAuthz},
+	{"script", func(rt Route) bool { return rt.RequestScript != "" }, runRequestScript},
+}
+
+// validMiddlewareOrder reports the first unknown name in a comma-separated
+// middleware list, or "" when all are known.
+func validMiddlewareOrder(order string) (unknown string) {
+	for _, name := range strings.Split(order, ",") {
+		if name = strings.TrimSpace(name); name != "" && !slices.ContainsFunc(middlewares, func(m middleware) bool { return m.name == name }) {
+			return name
+		}
+	}
+	return ""
+}
+
+// orderMiddlewares returns the middlewares named in order first, followed by
+// the rest in fallback order, then in default order. Leaving a middleware out
+// never disables it: that is decided by the route's labels.
+func orderMiddlewares(order, fallback string) []middleware {
+	var ordered []middleware
+	for _, name := range slices.Concat(strings.Split(order, ","), strings.Split(fallback, ",")) {
+		name = strings.TrimSpace(name)
+		i := slices.IndexFunc(middlewares, func(m middleware) bool { return m.name == name })
+		if i >= 0 && !slices.ContainsFunc(ordered, func(m middleware) bool { return m.name == name }) {
+			ordered = append(ordered, middlewares[i])
+		}
+	}
+	for _, m := range middlewares {
+		if !slices.ContainsFunc(ordered, func(o middleware) bool { return o.name == m.name }) {
+			ordered = append(ordered, m)
+		}
+	}
+	return ordered
+}
+
+// routeChains builds and caches the middleware chain of each route.
+type routeChains struct {
+	defaultOrder string       // MIDDLEWARE_ORDER
+	terminal     http.Handler // Serves the route once every middleware passed
+	chains       sync.Map     // Route -> http.Handler
+}
+
+func (c *routeChains) handler(route Route) http.Handler {
+	if h, ok := c.chains.Load(route); ok {
+		return h.(http.Handler)
+	}
+	ordered := orderMiddlewares(route.Middlewares, c.defaultOrder)
+	h := c.terminal
+	for _, m := range slices.Backward(ordered) {
+		if m.enabled(route) {
+			h = m.wrap(h)
+		}
+	}
+	actual, _ := c.chains.LoadOrStore(route, h)
+	return actual.(http.Handler)
+}
+
+// requireAPIKey answers 401 unless the request carries one of the route's
+// API keys (see apikey.go).
+func requireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		info, _ := routeInfoFrom(req.Context())
+		if !checkAPIKey(req, info.Route.APIKeys) {
+			slog.Debug("Handler: Responding 401 Unauthorized (missing or invalid API key)", "fqdn", info.FQDN, "remote", req.RemoteAddr)
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="`+info.FQDN+`"`)
+			rw.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(rw, "401 Unauthorized: A valid API key is required.")
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// requireSignature rejects requests without a valid HMAC signature (see hmac.go).
+func requireSignature(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		info, _ := routeInfoFrom(req.Context())
+		if err := verifySignature(req, info.Route); err != nil {
+			status := http.StatusUnauthorized
+			if errors.Is(err, errBodyTooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			slog.Debug("Handler: Rejecting request with bad signature", "fqdn", info.FQDN, "remote", req.RemoteAddr, "error", err)
+			rw.WriteHeader(status)
+			fmt.Fprintf(rw, "%d %s: %v\n", status, http.StatusText(status), err)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// clientHelloTimeout bounds how long a client may take to send its ClientHello.
+const clientHelloTimeout = 10 * time.Second
+
+// errHelloRead aborts the fake handshake used to read the ClientHello.
+var errHelloRead = errors.New("client hello read")
+
+// sniListener accepts raw TCP connections, peeks the TLS ClientHello and splices
+// connections for passthrough routes directly to their backend. All other
+// connections are handed to the HTTPS server through Accept.
+type sniListener struct {
+	net.Listener
+	router *Router
+	dial   DialFunc
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+
+	// listener is the LISTENERS profile accepting the connections, empty for the public one
+	listener string
+
+	// hasCert, when set, makes connections for server names without a
+	// certificate close silently (UNKNOWN_SNI_POLICY=close)
+	hasCert func(serverName string) bool
+}
+
+func newSNIListener(inner net.Listener, router *Router, dial DialFunc) *sniListener {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	l := &sniListener{
+		Listener: inner,
+		router:   router,
+		dial:     dial,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// Accept returns the next connection that rproxy terminates itself.
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections.
+func (l *sniListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func (l *sniListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("Passthrough: Accept failed", "error", err)
+			}
+			l.Close()
+			return
+		}
+		go l.dispatch(conn)
+	}
+}
+
+// dispatch reads the ClientHello and either splices or hands over the connection.
+func (l *sniListener) dispatch(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName, peeked, err := peekServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		slog.Debug("Passthrough: Could not read ClientHello", "remote", conn.RemoteAddr(), "error", err)
+		conn.Close()
+		return
+	}
+
+	// Replay the peeked bytes to whoever handles the connection next
+	replay := &prefixConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(peeked), conn)}
+
+	if route, ok := l.router.GetRoute(serverName, "/"); ok && route.TLSMode == TLSModePassthrough && route.Listener == l.listener {
+		go l.splice(replay, serverName, route)
+		return
+	}
+	if l.hasCert != nil && !l.hasCert(serverName) {
+		slog.Debug("Passthrough: Closing connection for unknown server name", "sni", serverName, "remote", conn.RemoteAddr())
+		if serverName == "" {
+			tlsHandshakeErrors.Inc("no_sni")
+		} else {
+			tlsHandshakeErrors.Inc("unknown_sni")
+			recordSNIMiss(serverName)
+		}
+		conn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- replay:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// splice copies bytes both ways between the client and the backend without terminating TLS.
+func (l *sniListener) splice(client net.Conn, serverName string, route Route) {
+	defer client.Close()
+
+	target := net.JoinHostPort(route.TargetIP, strconv.Itoa(route.TargetPort))
+	ctx, cancel := context.WithTimeout(withRouteInfo(context.Background(), routeInfo{FQDN: serverName, Route: route}), 10*time.Second)
+	backend, err := l.dial(ctx, "tcp", target)
+	cancel()
+	if err != nil {
+		slog.Error("Passthrough: Failed to dial backend", "sni", serverName, "target", target, "error", err)
+		return
+	}
+	defer backend.Close()
+
+	slog.Debug("Passthrough: Splicing connection", "sni", serverName, "target", target, "remote", client.RemoteAddr())
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(backend, client)
+		closeWrite(backend)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(client, backend)
+		closeWrite(client)
+		errc <- err
+	}()
+	<-errc
+	<-errc
+}
+
+// closeWrite half-closes a connection so the peer sees EOF.
+func closeWrite(conn net.Conn) {
+	if pc, ok := conn.(*prefixConn); ok {
+		conn = pc.Conn
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+// peekServerName reads the ClientHello from conn and returns its SNI together
+// with the bytes consumed, so they can be replayed.
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	var buf bytes.Buffer
+	var serverName string
+	err := tls.Server(readOnlyConn{reader: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).HandshakeContext(context.Background())
+	if !errors.Is(err, errHelloRead) {
+		return "", nil, err
+	}
+	return serverName, buf.Bytes(), nil
+}
+
+// readOnlyConn lets crypto/tls parse a ClientHello without writing anything back.
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// prefixConn is a connection whose first reads come from already consumed bytes.
+type prefixConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) { return c.reader.Read(p) }
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"rproxy/internal/certs"
+	"rproxy/internal/metrics"
+	"strings"
+	"time"
+)
+
+var plainHTTPRequests = metrics.NewCounter("rproxy_plain_http_requests_total",
+	"Requests on HTTP_ADDR by result: challenge (an HTTP-01 token was served), redirect (sent to HTTPS) or not_found.", "result")
+
+// acmeChallengePath prefixes the HTTP-01 token requests of ACME servers.
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// plainHTTP serves HTTP_ADDR (port 80): it answers the HTTP-01 challenges of
+// certManager and redirects every other request for a published name to
+// HTTPS. Nothing is proxied in clear text.
+type plainHTTP struct {
+	router      *Router
+	certManager *certs.Manager
+}
+
+func (p *plainHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if token, ok := strings.CutPrefix(req.URL.Path, acmeChallengePath); ok && !strings.Contains(token, "/") {
+		if keyAuth, ok := p.certManager.HTTPChallenge(host, token); ok {
+			plainHTTPRequests.Inc("challenge")
+			slog.Debug("Handler: Answered HTTP-01 challenge", "fqdn", host, "remote", req.RemoteAddr)
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, keyAuth)
+			return
+		}
+	}
+
+	// Only names served on the public listener are redirected, so port 80
+	// does not reveal the names of other listeners
+	if route, ok := p.router.GetRoute(host, req.URL.Path); ok && route.Listener == "" {
+		plainHTTPRequests.Inc("redirect")
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusPermanentRedirect)
+		return
+	}
+	plainHTTPRequests.Inc("not_found")
+	http.NotFound(w, req)
+}
+
+// newPlainHTTPServer returns the server for HTTP_ADDR, nil when it is unset.
+func newPlainHTTPServer(addr string, router *Router, certMgr *certs.Manager) *http.Server {
+	if addr == "" {
+		return nil
+	}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           &plainHTTP{router: router, certManager: certMgr},
+		ErrorLog:          log.New(io.Discard, "", 0),
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       30 * time.Second,
+		MaxHeaderBytes:    16 << 10,
+	}
+}
@@ -0,0 +1,314 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"rproxy/internal/config"
+	"rproxy/internal/metrics"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// ProbeOff in exposed-probe-path leaves a host out of synthetic probes.
+const ProbeOff = "off"
+
+const (
+	// probeConcurrency is how many hosts are probed at a time.
+	probeConcurrency = 4
+	// probeMaxBody is how much of a probe response is read.
+	probeMaxBody = 1 << 20
+	// probeUserAgent identifies probes in access logs.
+	probeUserAgent = "rproxy-probe/1"
+)
+
+// probePhases are the parts of a probe timed in rproxy_probe_duration_seconds.
+var probePhases = []string{"dns", "connect", "tls", "processing", "transfer", "total"}
+
+var (
+	probeSuccess = metrics.NewGauge("rproxy_probe_success",
+		"Whether the latest synthetic probe of the FQDN got a response below 500 (1) or not (0).", "fqdn")
+	probeDuration = metrics.NewGauge("rproxy_probe_duration_seconds",
+		"Duration of the latest synthetic probe by phase (dns, connect, tls, processing, transfer, total).", "fqdn", "phase")
+	probeStatus = metrics.NewGauge("rproxy_probe_status_code",
+		"HTTP status of the latest synthetic probe, 0 without a response.", "fqdn")
+	probeCertExpiry = metrics.NewGauge("rproxy_probe_cert_expiry_timestamp_seconds",
+		"Expiry of the certificate the latest synthetic probe was served, as a Unix time.", "fqdn")
+	probeFailures = metrics.NewCounter("rproxy_probe_failures_total",
+		"Failed synthetic probes by the phase that failed (dns, connect, tls, http, status).", "fqdn", "phase")
+)
+
+// prober requests every published FQDN like a client would: resolving its
+// public name, connecting, verifying its certificate and going through the
+// proxy to the backend. Unlike the backend checks of spike reports, its
+// metrics show what users see, including DNS records, port forwarding and
+// certificates gone wrong.
+type prober struct {
+	router   *Router
+	interval time.Duration // PROBE_INTERVAL
+	timeout  time.Duration // PROBE_TIMEOUT
+	path     string        // PROBE_PATH
+	addr     string        // PROBE_ADDR, empty to resolve each FQDN
+
+	mu     sync.Mutex
+	probed map[string]bool // FQDNs with probe metrics
+}
+
+// newProber returns nil when PROBE_INTERVAL is 0.
+func newProber(cfg *config.Config, router *Router) *prober {
+	if cfg.ProbeInterval <= 0 {
+		return nil
+	}
+	return &prober{
+		router:   router,
+		interval: cfg.ProbeInterval,
+		timeout:  cfg.ProbeTimeout,
+		path:     cfg.ProbePath,
+		addr:     cfg.ProbeAddr,
+		probed:   make(map[string]bool),
+	}
+}
+
+// run probes every interval until ctx is done.
+func (p *prober) run(ctx context.Context) {
+	if p == nil {
+		return
+	}
+	slog.Info("Prober: Probing published hosts", "interval", p.interval, "path", p.path)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.probeAll(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probeAll probes each host once and drops the metrics of hosts that are gone.
+func (p *prober) probeAll(ctx context.Context) {
+	targets := p.router.probeTargets(p.path)
+	roots := p.roots()
+
+	var eg errgroup.Group
+	eg.SetLimit(probeConcurrency)
+	for fqdn, path := range targets {
+		eg.Go(func() error {
+			p.probe(ctx, roots, fqdn, path)
+			return nil
+		})
+	}
+	eg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for fqdn := range p.probed {
+		if _, ok := targets[fqdn]; ok {
+			continue
+		}
+		probeSuccess.Delete(fqdn)
+		probeStatus.Delete(fqdn)
+		probeCertExpiry.Delete(fqdn)
+		for _, phase := range probePhases {
+			probeDuration.Delete(fqdn, phase)
+		}
+		delete(p.probed, fqdn)
+	}
+	for fqdn := range targets {
+		p.probed[fqdn] = true
+	}
+}
+
+// roots trusts the system roots and, with INTERNAL_CA, the internal CA.
+func (p *prober) roots() *x509.CertPool {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if pem, ok := p.router.InternalCARoot(); ok {
+		roots.AppendCertsFromPEM(pem)
+	}
+	return roots
+}
+
+// probeTimes are the moments a probe reached, zero when it did not.
+type probeTimes struct {
+	mu                      sync.Mutex
+	dnsStart, dnsDone       time.Time
+	connectStart, connected time.Time
+	tlsStart, tlsDone       time.Time
+	firstByte               time.Time
+	dnsErr, connectErr      error
+	tlsErr                  error
+}
+
+func (t *probeTimes) trace() *httptrace.ClientTrace {
+	set := func(field *time.Time, errField *error, err error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if field.IsZero() {
+			*field = time.Now()
+		}
+		if errField != nil && err != nil {
+			*errField = err
+		}
+	}
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { set(&t.dnsStart, nil, nil) },
+		DNSDone:  func(i httptrace.DNSDoneInfo) { set(&t.dnsDone, &t.dnsErr, i.Err) },
+		// Happy eyeballs may connect more than once, the first attempt counts
+		ConnectStart:         func(string, string) { set(&t.connectStart, nil, nil) },
+		ConnectDone:          func(_, _ string, err error) { set(&t.connected, &t.connectErr, err) },
+		TLSHandshakeStart:    func() { set(&t.tlsStart, nil, nil) },
+		TLSHandshakeDone:     func(_ tls.ConnectionState, err error) { set(&t.tlsDone, &t.tlsErr, err) },
+		GotFirstResponseByte: func() { set(&t.firstByte, nil, nil) },
+	}
+}
+
+// failedPhase names where a probe that got no response failed.
+func (t *probeTimes) failedPhase() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.dnsErr != nil:
+		return "dns"
+	case t.connected.IsZero() || t.connectErr != nil:
+		return "connect"
+	case t.tlsDone.IsZero() || t.tlsErr != nil:
+		return "tls"
+	default:
+		return "http"
+	}
+}
+
+// probe requests https://fqdn/path on a new connection and records the result.
+func (p *prober) probe(ctx context.Context, roots *x509.CertPool, fqdn, path string) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	dialer := &net.Dialer{}
+	transport := &http.Transport{
+		DialContext:       dialer.DialContext,
+		TLSClientConfig:   &tls.Config{RootCAs: roots, ServerName: fqdn},
+		ForceAttemptHTTP2: true,
+		DisableKeepAlives: true, // Every probe times a full connection setup
+	}
+	defer transport.CloseIdleConnections()
+	if p.addr != "" {
+		transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, p.addr)
+		}
+	}
+
+	var times probeTimes
+	ctx = httptrace.WithClientTrace(ctx, times.trace())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+fqdn+path, nil)
+	if err != nil {
+		slog.Warn("Prober: Invalid probe URL", "fqdn", fqdn, "path", path, "error", err)
+		return
+	}
+	req.Header.Set("User-Agent", probeUserAgent)
+
+	start := time.Now()
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		phase := times.failedPhase()
+		probeSuccess.Set(0, fqdn)
+		probeStatus.Set(0, fqdn)
+		probeFailures.Inc(fqdn, phase)
+		for _, phase := range probePhases {
+			probeDuration.Delete(fqdn, phase) // Phases of an earlier probe
+		}
+		probeDuration.Set(time.Since(start).Seconds(), fqdn, "total")
+		slog.Debug("Prober: Probe failed", "fqdn", fqdn, "phase", phase, "error", err)
+		return
+	}
+	_, err = io.Copy(io.Discard, io.LimitReader(resp.Body, probeMaxBody))
+	resp.Body.Close()
+	end := time.Now()
+
+	times.mu.Lock()
+	phases := map[string]time.Duration{
+		"dns":        times.dnsDone.Sub(times.dnsStart),
+		"connect":    times.connected.Sub(times.connectStart),
+		"tls":        times.tlsDone.Sub(times.tlsStart),
+		"processing": times.firstByte.Sub(times.tlsDone),
+		"transfer":   end.Sub(times.firstByte),
+		"total":      end.Sub(start),
+	}
+	if times.dnsStart.IsZero() {
+		phases["dns"] = 0 // PROBE_ADDR, or an IP literal
+	}
+	times.mu.Unlock()
+	for phase, d := range phases {
+		probeDuration.Set(d.Seconds(), fqdn, phase)
+	}
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		probeCertExpiry.Set(float64(resp.TLS.PeerCertificates[0].NotAfter.Unix()), fqdn)
+	}
+	probeStatus.Set(float64(resp.StatusCode), fqdn)
+
+	switch {
+	case err != nil:
+		probeSuccess.Set(0, fqdn)
+		probeFailures.Inc(fqdn, "http")
+		slog.Debug("Prober: Probe response cut short", "fqdn", fqdn, "error", err)
+	case resp.StatusCode >= 500:
+		probeSuccess.Set(0, fqdn)
+		probeFailures.Inc(fqdn, "status")
+		slog.Debug("Prober: Probe got a server error", "fqdn", fqdn, "status", resp.StatusCode)
+	default:
+		probeSuccess.Set(1, fqdn)
+	}
+}
+
+// probeTargets returns the path to probe on each exact FQDN served on the
+// public listener: the exposed-probe-path of one of its routes, else
+// defaultPath when a route serves it, else the host's shortest path prefix.
+// Wildcard and regex hosts have no name to probe.
+func (r *Router) probeTargets(defaultPath string) map[string]string {
+	table := r.table.Load()
+	targets := make(map[string]string)
+	for fqdn, routes := range table.routes {
+		if strings.HasPrefix(fqdn, "*.") {
+			continue
+		}
+		var public []Route
+		for _, route := range routes {
+			if route.Listener == "" {
+				public = append(public, route)
+			}
+		}
+		if len(public) == 0 {
+			continue
+		}
+		path := ""
+		for _, route := range public {
+			if route.ProbePath != "" {
+				path = route.ProbePath
+				break
+			}
+		}
+		switch {
+		case path == ProbeOff:
+			continue
+		case path != "":
+		case public[len(public)-1].matches(defaultPath):
+			path = defaultPath
+		default:
+			path = public[len(public)-1].PathPrefix // Longest prefix first
+		}
+		targets[fqdn] = path
+	}
+	return targets
+}
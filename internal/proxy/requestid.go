@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"net/http"
+)
+
+// requestIDHeader carries the request ID to backends, so their logs can be
+// matched with rproxy's.
+const requestIDHeader = "X-Request-ID"
+
+// requestID returns the ID sent by the client (e.g. an outer load balancer)
+// when it looks sane, or a new random one.
+func requestID(req *http.Request) string {
+	if id := req.Header.Get(requestIDHeader); validRequestID(id) {
+		return id
+	}
+	return rand.Text()
+}
+
+// validRequestID accepts short IDs made of characters safe to log and echo.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
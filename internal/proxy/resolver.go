@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resolvedHost is a cached lookup of a backend hostname.
+type resolvedHost struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// resolver dials hostname targets (exposed-target-host, or a name in the route
+// file) through a small DNS cache, so every request does not cost a lookup.
+// IP targets are dialed as they are. When no cached address accepts the
+// connection, the name is resolved again at once: a recreated container
+// usually comes back under a new IP.
+type resolver struct {
+	ttl    time.Duration
+	dialer net.Dialer
+	lookup func(ctx context.Context, host string) ([]netip.Addr, error)
+
+	mu    sync.Mutex
+	cache map[string]resolvedHost
+}
+
+func newResolver(ttl time.Duration) *resolver {
+	return &resolver{
+		ttl: ttl,
+		lookup: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+		cache: make(map[string]resolvedHost),
+	}
+}
+
+// DialContext is a DialFunc.
+func (r *resolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	info, _ := routeInfoFrom(ctx)
+	guard := info.Route.TargetHostLabel
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if guard && localTarget(ip) {
+			return nil, errLocalTarget
+		}
+		return r.dialer.DialContext(ctx, network, addr)
+	}
+
+	addrs, err := r.resolve(ctx, host, false)
+	if err != nil {
+		return nil, err
+	}
+	if guard {
+		if addrs = slices.DeleteFunc(slices.Clone(addrs), localTarget); len(addrs) == 0 {
+			return nil, errLocalTarget
+		}
+	}
+	conn, err := r.dialAny(ctx, network, addrs, port)
+	if err == nil || ctx.Err() != nil {
+		return conn, err
+	}
+	fresh, lookupErr := r.resolve(ctx, host, true)
+	if guard && lookupErr == nil {
+		fresh = slices.DeleteFunc(slices.Clone(fresh), localTarget)
+	}
+	if lookupErr != nil || len(fresh) == 0 || slices.Equal(fresh, addrs) {
+		return nil, err
+	}
+	slog.Info("Handler: Backend hostname resolved to new addresses", "host", host, "addrs", fresh)
+	return r.dialAny(ctx, network, fresh, port)
+}
+
+// errLocalTarget refuses to dial an exposed-target-host at rproxy itself.
+var errLocalTarget = errors.New("exposed-target-host resolves to an address of rproxy itself")
+
+// localTarget reports whether a reaches rproxy itself rather than a backend:
+// loopback, link-local, unspecified or multicast, or an address of rproxy's
+// own interfaces, where the admin API may listen. Names from container labels
+// are never dialed there, even when their DNS record changes after the route
+// was built.
+func localTarget(a netip.Addr) bool {
+	a = a.Unmap()
+	if a.IsLoopback() || a.IsLinkLocalUnicast() || a.IsUnspecified() || a.IsMulticast() {
+		return true
+	}
+	ifAddrs, _ := net.InterfaceAddrs()
+	return slices.ContainsFunc(ifAddrs, func(ia net.Addr) bool {
+		p, err := netip.ParsePrefix(ia.String())
+		return err == nil && p.Addr().Unmap() == a
+	})
+}
+
+// localTargetName reports whether an exposed-target-host value names rproxy
+// itself without a lookup: "localhost" or an address localTarget refuses.
+func localTargetName(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	a, err := netip.ParseAddr(host)
+	return err == nil && localTarget(a)
+}
+
+// resolve returns the cached addresses of host, looking it up when the entry
+// expired or refresh is set.
+func (r *resolver) resolve(ctx context.Context, host string, refresh bool) ([]netip.Addr, error) {
+	r.mu.Lock()
+	entry, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && !refresh && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := r.lookup(ctx, host)
+	if err != nil {
+		if ok && !refresh {
+			// Keep serving the last answer while DNS is unavailable
+			slog.Warn("Handler: Cannot resolve backend hostname, using cached addresses", "host", host, "error", err)
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+	for i, a := range addrs {
+		addrs[i] = a.Unmap()
+	}
+	r.mu.Lock()
+	r.cache[host] = resolvedHost{addrs: addrs, expires: time.Now().Add(r.ttl)}
+	r.mu.Unlock()
+	return addrs, nil
+}
+
+// dialAny tries addrs in order and returns the first connection.
+func (r *resolver) dialAny(ctx context.Context, network string, addrs []netip.Addr, port string) (net.Conn, error) {
+	var errs []error
+	for _, a := range addrs {
+		conn, err := r.dialer.DialContext(ctx, network, net.JoinHostPort(a.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no addresses")
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// responseModifier is one step of the ModifyResponse pipeline.
+type responseModifier func(resp *http.Response, info routeInfo) error
+
+// headerRule sets a response header to a value.
+type headerRule struct {
+	name  string
+	value string
+}
+
+// ParseHeaderRules parses "Name=value|Other=value" into header rules.
+func ParseHeaderRules(spec string) []headerRule {
+	var rules []headerRule
+	for _, part := range strings.Split(spec, "|") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			if part != "" {
+				slog.Warn("Ignoring invalid header rule (expected Name=value)", "rule", part)
+			}
+			continue
+		}
+		rules = append(rules, headerRule{name: http.CanonicalHeaderKey(strings.TrimSpace(name)), value: strings.TrimSpace(value)})
+	}
+	return rules
+}
+
+// parseHeaderList parses "Server,X-Powered-By" into canonical header names.
+func parseHeaderList(spec string) []string {
+	var names []string
+	for _, name := range strings.Split(spec, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names
+}
+
+// labelRuleCache memoizes parsed per-route header labels, which are kept as raw
+// strings in Route so routes stay comparable.
+var labelRuleCache sync.Map // string -> []headerRule
+
+func cachedHeaderRules(spec string) []headerRule {
+	if v, ok := labelRuleCache.Load(spec); ok {
+		return v.([]headerRule)
+	}
+	rules := ParseHeaderRules(spec)
+	labelRuleCache.Store(spec, rules)
+	return rules
+}
+
+// newResponsePipeline builds the ModifyResponse steps from the global settings.
+// Per-route steps read their settings from the route attached to the request.
+func newResponsePipeline(stripHeaders []string, addHeaders []headerRule, rewriteLocation bool, upgradeIdle time.Duration, altSvc string) func(*http.Response) error {
+	var steps []responseModifier
+
+	// ReverseProxy runs ModifyResponse before taking over a 101 response's body
+	// as the backend connection, so upgraded connections are tracked here
+	steps = append(steps, func(resp *http.Response, info routeInfo) error {
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			return nil
+		}
+		rwc, ok := resp.Body.(io.ReadWriteCloser)
+		if !ok {
+			return nil
+		}
+		idle := upgradeIdle
+		if info.Route.UpgradeIdleTimeout != 0 {
+			idle = max(info.Route.UpgradeIdleTimeout, 0) // Negative means no timeout
+		}
+		resp.Body = newUpgradedConn(rwc, info.FQDN, idle, info.Route.MaxLifetime)
+		return nil
+	})
+
+	steps = append(steps, func(resp *http.Response, info routeInfo) error {
+		for _, name := range stripHeaders {
+			resp.Header.Del(name)
+		}
+		if altSvcHeader(info.Route, altSvc) != "" {
+			resp.Header.Del("Alt-Svc") // Set by the handler, it would be sent twice
+		}
+		for _, name := range parseHeaderList(info.Route.StripHeaders) {
+			resp.Header.Del(name)
+		}
+		return nil
+	})
+
+	steps = append(steps, func(resp *http.Response, info routeInfo) error {
+		if rewriteLocation || info.Route.RewriteBody {
+			return rewriteInternalLocation(resp, info)
+		}
+		return nil
+	})
+	steps = append(steps, rewriteBody)
+
+	steps = append(steps, func(resp *http.Response, info routeInfo) error {
+		for _, rule := range addHeaders {
+			resp.Header.Set(rule.name, rule.value)
+		}
+		for _, rule := range cachedHeaderRules(info.Route.ResponseHeaders) {
+			resp.Header.Set(rule.name, rule.value)
+		}
+		return nil
+	})
+
+	steps = append(steps, runResponseScript)
+
+	return func(resp *http.Response) error {
+		info, ok := routeInfoFrom(resp.Request.Context())
+		if !ok {
+			return nil
+		}
+		for _, step := range steps {
+			if err := step(resp, info); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// rewriteInternalLocation rewrites redirects pointing at the backend's internal
+// address (container IP:port) to the public https://FQDN.
+func rewriteInternalLocation(resp *http.Response, info routeInfo) error {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil
+	}
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return nil // Relative redirects are already correct
+	}
+
+	backend := net.JoinHostPort(info.Route.TargetIP, strconv.Itoa(info.Route.TargetPort))
+	host := u.Hostname()
+	if u.Host != backend && host != info.Route.TargetIP {
+		return nil
+	}
+
+	u.Scheme = "https"
+	u.Host = info.FQDN
+	slog.Debug("Handler: Rewrote internal Location header", "from", location, "to", u.String())
+	resp.Header.Set("Location", u.String())
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenReusePort is only implemented on Linux.
+func listenReusePort(network, address string) (net.Listener, error) {
+	return nil, fmt.Errorf("SO_REUSEPORT listeners are only supported on Linux")
+}
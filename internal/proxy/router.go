@@ -1,65 +1,746 @@
 package proxy
 
 import (
+	"cmp"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"rproxy/internal/certs"    // Assuming module path is rproxy
 	"rproxy/internal/config"
-	"rproxy/internal/podman"
+	"rproxy/internal/discovery"
+	"rproxy/internal/events"
+	"rproxy/internal/spiffe"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// TLS modes selectable per route with the exposed-tls label.
+const (
+	TLSModeTerminate   = "terminate"   // Terminate TLS and proxy plain HTTP to the backend (default)
+	TLSModePassthrough = "passthrough" // Splice the TLS stream to the backend untouched
+	TLSModeReencrypt   = "reencrypt"   // Terminate TLS and proxy HTTPS to the backend
+)
+
 // Route stores target backend info.
 type Route struct {
-	TargetIP   string
+	TargetIP   string // IP address, or a hostname resolved when dialing (see resolver.go)
 	TargetPort int
+	// TargetHostLabel is set when TargetIP comes from exposed-target-host, so
+	// it is never dialed at rproxy's own addresses (see localTarget).
+	TargetHostLabel bool
+	PathPrefix string // "/" matches every path
+	HostRegex  string // Set for regex host routes instead of an FQDN
+	CertFQDN   string // Certificate managed for a regex route
+	TLSMode    string
+	ManualCert bool // exposed-acme=false: serve the certificate files placed by hand, never issue
+
+	// Backend TLS verification for reencrypt routes
+	BackendCA         string // Base64 PEM bundle replacing the default roots
+	BackendServerName string // Defaults to the requested FQDN
+	BackendInsecure   bool
+	BackendClientCert string // Client certificate file presented to the backend (mTLS)
+	BackendClientKey  string
+	BackendSPIFFEID   string // Verify the backend's X.509 SVID instead of its host name
+
+	// Response modification, raw label values (see response.go)
+	ResponseHeaders string // "Name=value|Other=value" set on responses
+	StripHeaders    string // "Server,X-Powered-By" removed from responses
+	RewriteBody     bool   // Replace the backend address in text bodies and Location (see bodyrewrite.go)
+
+	// Streaming responses (SSE, chunked downloads)
+	Streaming     bool          // exposed-flush-interval is set: no write timeout
+	FlushInterval time.Duration // -1 flushes after every write
+	MaxDuration   time.Duration // Request deadline override, negative for unlimited
+
+	Cache    bool // Serve cacheable GET responses from the response cache
+	Coalesce bool // Concurrent identical GETs share one backend request (see coalesce.go)
+
+	AccessLog string // exposed-access-log mode, empty for ACCESS_LOG
+
+	Listener string // LISTENERS profile serving the route, empty for the public listener
+
+	Tenant string // exposed-tenant, empty for the operator's own routes (see tenant.go)
+
+	Service         string // Container or service name, for maintenance pages
+	MaintenancePage string // Raw exposed-maintenance-page label: inline HTML template or "file:" in LABEL_FILES_DIR
+	StartingPage    string // Raw exposed-starting-page label (see starting.go)
+
+	Middlewares string // Raw exposed-middlewares label: order of the route's middlewares (see middleware.go)
+
+	APIKeys string // Raw exposed-api-keys label, requests need one of the keys (see apikey.go)
+
+	ClientCertAllow string // Raw exposed-client-cert-allow label, client certificates let through (see clientcert.go)
+
+	// HMAC request signing (see hmac.go)
+	HMACSecret string // Raw exposed-hmac-secret label
+	HMACHeader string
+	HMACMaxAge time.Duration // Negative when timestamps are not signed
+
+	// Request filtering (see filter.go), raw comma-separated labels
+	Methods          string
+	ContentTypes     string
+	ContentEncodings string
+
+	// External authorization service (see extauthz.go)
+	ExtAuthz        string // URL asked about every request
+	ExtAuthzHeaders string // Raw exposed-ext-authz-headers label: verdict headers copied to the request
+
+	// WASI hooks run per request (see script.go), module paths
+	RequestScript  string
+	ResponseScript string
+
+	UpgradeIdleTimeout time.Duration // Overrides UPGRADE_IDLE_TIMEOUT, negative for none
+
+	// Client connection limits (see connlimits.go), 0 for the server defaults
+	IdleTimeout time.Duration // Keep-alive idle time before the connection is closed
+	MaxLifetime time.Duration // Total lifetime of keep-alive and upgraded connections
+
+	RedirectHost string // Canonical name requests are redirected to (see canonical.go)
+
+	ProbePath string // Raw exposed-probe-path label (see prober.go)
+
+	// Protocol advertisement (see alpn.go)
+	AltSvc string // Raw exposed-alt-svc label, overrides ALT_SVC
+	ALPN   string // Protocols offered in the TLS handshake, e.g. "http/1.1,h2"; empty for the server's
+
+	// Backend connection pool (see transport.go), 0 for the transport defaults
+	UpstreamMaxIdleConns int // Idle connections kept per backend, negative for none
+	UpstreamMaxConns     int
+	UpstreamIdleTimeout  time.Duration
+
+	// Static file serving instead of a backend (see static.go)
+	StaticRoot   string
+	StaticMaxAge time.Duration // Cache-Control max-age for non-HTML files
+}
+
+// needsIssuance reports whether rproxy obtains a certificate for the route.
+// Passthrough backends terminate TLS themselves.
+func (rt Route) needsIssuance() bool {
+	return rt.TLSMode != TLSModePassthrough && !rt.ManualCert
+}
+
+// matches reports whether the request path falls under the route's path prefix.
+// Prefixes match on path element boundaries: "/api" matches "/api" and "/api/x" but not "/apix".
+func (rt Route) matches(path string) bool {
+	prefix := strings.TrimSuffix(rt.PathPrefix, "/")
+	if prefix == "" {
+		return true
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
+// routeTable is one version of the routing table. It is never modified once
+// published: updates build a new table and swap it in, so lookups need no lock.
+type routeTable struct {
+	routes      map[string][]Route        // fqdn -> Routes, longest path prefix first
+	regexRoutes []Route                   // Host regex routes, checked in order after exact and wildcard routes
+	patterns    map[string]*regexp.Regexp // Compiled host regex cache, keyed by pattern
+	matcher     *routeMatcher             // Index of routes for GetRoute
+}
+
+// newRouteTable indexes routes for lookups.
+func newRouteTable(routes map[string][]Route, regexRoutes []Route, patterns map[string]*regexp.Regexp) *routeTable {
+	return &routeTable{routes: routes, regexRoutes: regexRoutes, patterns: patterns, matcher: newRouteMatcher(routes)}
 }
 
 // Router manages the dynamic routing table.
 type Router struct {
-	mu           sync.RWMutex
-	routes       map[string]Route // fqdn -> Route
-	podmanClient *podman.Client
+	table        atomic.Pointer[routeTable] // Current routes, swapped whole on change
+	mu           sync.RWMutex // Guards drained, stale, confirmedAt and discovered
+	providers    []discovery.Provider
 	certManager  *certs.Manager
 	config       *config.Config
 	certWorkCh   chan []string // FQDNs needing cert work, buffered to avoid blocking route updates
+	certRenewCh  chan string   // FQDNs whose renewal was requested explicitly (admin API)
+	refreshCh    chan struct{} // Discovery pass requested ahead of the poll interval
+	drained      map[string]time.Time // FQDNs answering 503 while their backend is drained, with the expected end if known
+	stale        bool            // Routes are not confirmed by the latest discovery pass: restored from a snapshot, or discovery is failing
+	confirmedAt  time.Time       // Last successful discovery pass, or when the snapshot was saved
+	discovered   map[string][]discovery.Target // Targets of the last successful pass by FQDN or host regex, for diagnostics
+	misses       map[string]int  // Consecutive passes a vanished host (or "regex:" pattern) was missing, see deferRemovals
+	ready        atomic.Bool     // Set once routes are known and their certificates preloaded
+	degraded     atomic.Bool     // Discovery failed discoveryDegradedAfter passes in a row
 }
 
 // NewRouter creates a new Router.
-func NewRouter(cfg *config.Config, pClient *podman.Client, cMgr *certs.Manager) *Router {
-	return &Router{
-		routes:       make(map[string]Route),
-		podmanClient: pClient,
+func NewRouter(cfg *config.Config, providers []discovery.Provider, cMgr *certs.Manager) *Router {
+	r := &Router{
+		providers:    providers,
 		certManager:  cMgr,
 		config:       cfg,
 		certWorkCh:   make(chan []string, 1),
+		certRenewCh:  make(chan string, 16),
+		refreshCh:    make(chan struct{}, 1),
+		drained:      make(map[string]time.Time),
+		misses:       make(map[string]int),
+		confirmedAt:  time.Now(),
+	}
+	r.table.Store(newRouteTable(make(map[string][]Route), nil, make(map[string]*regexp.Regexp)))
+	if cMgr != nil {
+		cMgr.SetWanted(r.wantsCert)
+	}
+	return r
+}
+
+// GetRoute finds the route for a given FQDN and request path.
+// Exact host routes take precedence over a wildcard route (*.example.com) for the parent domain,
+// which takes precedence over regex host routes.
+func (r *Router) GetRoute(fqdn, path string) (Route, bool) {
+	table := r.table.Load()
+	if route, ok := table.matcher.lookup(fqdn, path); ok {
+		return route, true
+	}
+	for _, route := range table.regexRoutes {
+		if table.patterns[route.HostRegex].MatchString(fqdn) && route.matches(path) {
+			if !r.config.DomainAllowed(fqdn) {
+				return Route{}, false
+			}
+			return route, true
+		}
+	}
+	return Route{}, false
+}
+
+// Ready reports whether the router has a route table (from discovery or a snapshot)
+// and the certificates for those routes were loaded.
+func (r *Router) Ready() bool {
+	return r.ready.Load()
+}
+
+// StaleFor reports whether the routes are stale, and how long ago discovery
+// last confirmed them.
+func (r *Router) StaleFor() (time.Duration, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if !r.stale {
+		return 0, false
+	}
+	return time.Since(r.confirmedAt), true
+}
+
+// StaleLimitExceeded reports whether the routes have been stale for longer
+// than ROUTES_STALE_LIMIT (never when it is 0), and for how long.
+func (r *Router) StaleLimitExceeded() (time.Duration, bool) {
+	age, stale := r.StaleFor()
+	return age, stale && r.config.RoutesStaleLimit > 0 && age > r.config.RoutesStaleLimit
+}
+
+// markStale flags the routes as unconfirmed after a failed discovery pass.
+// They keep being served.
+func (r *Router) markStale() {
+	r.mu.Lock()
+	wasStale := r.stale
+	r.stale = true
+	confirmedAt := r.confirmedAt
+	r.mu.Unlock()
+	routesStale.Set(1)
+	if !wasStale {
+		slog.Warn("Router: Discovery failed, serving the last known routes as stale", "confirmed_at", confirmedAt)
+	}
+}
+
+// markReady preloads existing certificates for all known FQDNs, then flags the router ready.
+func (r *Router) markReady() {
+	routes := r.table.Load().routes
+	fqdns := make([]string, 0, len(routes))
+	for fqdn := range routes {
+		fqdns = append(fqdns, fqdn)
+	}
+
+	for _, fqdn := range fqdns {
+		r.certManager.Preload(fqdn)
+	}
+	r.ready.Store(true)
+	slog.Info("Router: Ready to serve traffic", "routes", len(fqdns))
+}
+
+// RouteStatus describes a route for the admin API.
+type RouteStatus struct {
+	FQDN       string `json:"fqdn,omitempty"`
+	HostRegex  string `json:"host_regex,omitempty"`
+	PathPrefix string `json:"path_prefix"`
+	Target     string `json:"target"`
+	TLSMode    string `json:"tls_mode"`
+	Listener   string `json:"listener,omitempty"` // LISTENERS profile, empty for public
+	Tenant     string `json:"tenant,omitempty"`
+	Draining   bool   `json:"draining"`
+	Stale      bool   `json:"stale"` // Restored from snapshot or discovery failing, not confirmed by the latest pass
+
+	DrainETA time.Time `json:"drain_eta,omitzero"` // Expected end of a drain
+}
+
+// ListRoutes returns every active route, sorted by FQDN then path.
+func (r *Router) ListRoutes() []RouteStatus {
+	table := r.table.Load()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var list []RouteStatus
+	for fqdn, routes := range table.routes {
+		for _, route := range routes {
+			list = append(list, r.routeStatus(fqdn, route))
+		}
+	}
+	slices.SortFunc(list, func(a, b RouteStatus) int {
+		if c := strings.Compare(a.FQDN, b.FQDN); c != 0 {
+			return c
+		}
+		return strings.Compare(a.PathPrefix, b.PathPrefix)
+	})
+	for _, route := range table.regexRoutes {
+		list = append(list, r.routeStatus("", route))
+	}
+	return list
+}
+
+// target describes where a route sends requests.
+func (route Route) target() string {
+	if route.StaticRoot != "" {
+		return "static:" + route.StaticRoot
+	}
+	return net.JoinHostPort(route.TargetIP, strconv.Itoa(route.TargetPort))
+}
+
+// routeStatus must be called with r.mu held.
+func (r *Router) routeStatus(fqdn string, route Route) RouteStatus {
+	eta, draining := r.drained[fqdn]
+	return RouteStatus{
+		FQDN:       fqdn,
+		HostRegex:  route.HostRegex,
+		PathPrefix: route.PathPrefix,
+		Target:     route.target(),
+		TLSMode:    route.TLSMode,
+		Listener:   route.Listener,
+		Tenant:     route.Tenant,
+		Draining:   draining,
+		Stale:      r.stale,
+		DrainETA:   eta,
+	}
+}
+
+// SetDraining marks an FQDN as drained (new requests get 503) or restores it.
+// eta is the expected end of the drain, zero if unknown.
+func (r *Router) SetDraining(fqdn string, draining bool, eta time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if draining {
+		r.drained[fqdn] = eta
+	} else {
+		delete(r.drained, fqdn)
 	}
+	slog.Info("Router: Drain state changed", "fqdn", fqdn, "draining", draining, "eta", eta)
 }
 
-// GetRoute finds the route for a given FQDN.
-func (r *Router) GetRoute(fqdn string) (Route, bool) {
+// DrainETA reports whether an FQDN is drained and when the drain is expected to end.
+func (r *Router) DrainETA(fqdn string) (time.Time, bool) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	route, exists := r.routes[fqdn]
-	return route, exists
+	eta, draining := r.drained[fqdn]
+	return eta, draining
+}
+
+// RequestCertRenewal queues a forced certificate renewal for an FQDN.
+func (r *Router) RequestCertRenewal(fqdn string) error {
+	select {
+	case r.certRenewCh <- fqdn:
+		slog.Info("Router: Queued forced certificate renewal", "fqdn", fqdn)
+		return nil
+	default:
+		return fmt.Errorf("too many pending renewals, try again later")
+	}
+}
+
+// ExportCerts writes an encrypted backup of the certificate store to w.
+func (r *Router) ExportCerts(w io.Writer, passphrase string) (int, error) {
+	return r.certManager.Export(w, passphrase)
+}
+
+// InternalCARoot returns the root certificate of the internal CA (PEM), false
+// when INTERNAL_CA is off.
+func (r *Router) InternalCARoot() ([]byte, bool) {
+	return r.certManager.InternalCARoot()
+}
+
+// ImportCerts restores a backup written by ExportCerts.
+func (r *Router) ImportCerts(rd io.Reader, passphrase string) ([]string, error) {
+	return r.certManager.Import(rd, passphrase)
+}
+
+// newRoute builds a route from a discovered target and its per-route labels.
+func newRoute(t discovery.Target) Route {
+	route := Route{
+		TargetIP:   t.IP,
+		TargetPort: t.Port,
+		PathPrefix: t.PathPrefix,
+		TLSMode:    TLSModeTerminate,
+	}
+	if route.PathPrefix == "" {
+		route.PathPrefix = "/"
+	}
+	route.Tenant = t.Labels[discovery.LabelTenant]
+	route.ResponseHeaders = t.Labels[discovery.LabelResponseHeaders]
+	route.StripHeaders = t.Labels[discovery.LabelStripHeaders]
+	if v := t.Labels[discovery.LabelFlushInterval]; v != "" {
+		interval, err := discovery.ParseFlushInterval(v)
+		if err != nil {
+			slog.Warn("Router: Invalid exposed-flush-interval label, flushing immediately", "label", v, "container", t.Name)
+			interval = -1
+		}
+		route.Streaming = true
+		route.FlushInterval = interval
+	}
+	if t.StaticRoot != "" {
+		route.StaticRoot = t.StaticRoot
+		route.StaticMaxAge = time.Hour
+		if v := t.Labels[discovery.LabelStaticMaxAge]; v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				slog.Warn("Router: Invalid exposed-static-max-age label, using 1h", "label", v, "container", t.Name)
+			} else {
+				route.StaticMaxAge = d
+			}
+		}
+	}
+	if v := t.Labels[discovery.LabelUpgradeIdleTimeout]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			slog.Warn("Router: Invalid exposed-upgrade-idle-timeout label, using the default", "label", v, "container", t.Name)
+		} else if d == 0 {
+			route.UpgradeIdleTimeout = -1 // "0" disables the timeout
+		} else {
+			route.UpgradeIdleTimeout = d
+		}
+	}
+	if v := t.Labels[discovery.LabelTargetHost]; v != "" {
+		if !discovery.ValidHostname(v) {
+			slog.Warn("Router: Invalid exposed-target-host label, using the container IP", "label", v, "container", t.Name)
+		} else if localTargetName(v) {
+			slog.Warn("Router: exposed-target-host label names rproxy itself, using the container IP", "label", v, "container", t.Name)
+		} else {
+			route.TargetIP, route.TargetHostLabel = v, true
+		}
+	}
+	for label, target := range map[string]*time.Duration{
+		discovery.LabelIdleTimeout: &route.IdleTimeout,
+		discovery.LabelMaxLifetime: &route.MaxLifetime,
+	} {
+		if v := t.Labels[label]; v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				slog.Warn("Router: Invalid "+label+" label, using the default", "label", v, "container", t.Name)
+			} else {
+				*target = d
+			}
+		}
+	}
+	for label, target := range map[string]*int{
+		discovery.LabelUpstreamMaxIdleConns: &route.UpstreamMaxIdleConns,
+		discovery.LabelUpstreamMaxConns:     &route.UpstreamMaxConns,
+	} {
+		if v := t.Labels[label]; v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				slog.Warn("Router: Invalid "+label+" label, using the default", "label", v, "container", t.Name)
+			} else {
+				*target = n
+			}
+		}
+	}
+	if route.UpstreamMaxIdleConns == 0 && t.Labels[discovery.LabelUpstreamMaxIdleConns] == "0" {
+		route.UpstreamMaxIdleConns = -1 // "0" keeps no idle connections
+	}
+	if v := t.Labels[discovery.LabelUpstreamIdleTimeout]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			slog.Warn("Router: Invalid exposed-upstream-idle-timeout label, using the default", "label", v, "container", t.Name)
+		} else {
+			route.UpstreamIdleTimeout = d
+		}
+	}
+	if v := t.Labels[discovery.LabelAccessLog]; v != "" {
+		if validAccessLog(v) {
+			route.AccessLog = v
+		} else {
+			slog.Warn("Router: Invalid exposed-access-log label (expected on, off or errors-only), using ACCESS_LOG", "label", v, "container", t.Name)
+		}
+	}
+	if v := t.Labels[discovery.LabelListener]; v != "public" {
+		route.Listener = v
+	}
+	if v := t.Labels[discovery.LabelMiddlewares]; v != "" {
+		if name := validMiddlewareOrder(v); name != "" {
+			slog.Warn("Router: Invalid exposed-middlewares label, ignoring unknown middleware", "label", v, "middleware", name, "container", t.Name)
+		}
+		route.Middlewares = v
+	}
+	route.APIKeys = t.Labels[discovery.LabelAPIKeys]
+	if route.ClientCertAllow = t.Labels[discovery.LabelClientCertAllow]; route.ClientCertAllow != "" {
+		if _, err := parseClientCertRules(route.ClientCertAllow); err != nil {
+			slog.Warn("Router: Invalid exposed-client-cert-allow label, refusing every request", "label", route.ClientCertAllow, "container", t.Name, "error", err)
+		}
+	}
+	route.MaintenancePage = t.Labels[discovery.LabelMaintenancePage]
+	route.StartingPage = t.Labels[discovery.LabelStartingPage]
+	if route.MaintenancePage != "" || route.StartingPage != "" {
+		route.Service = t.Name
+	}
+	if route.HMACSecret = t.Labels[discovery.LabelHMACSecret]; route.HMACSecret != "" {
+		route.HMACHeader = t.Labels[discovery.LabelHMACHeader]
+		route.HMACMaxAge = defaultHMACMaxAge
+		if v := t.Labels[discovery.LabelHMACMaxAge]; v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				slog.Warn("Router: Invalid exposed-hmac-max-age label, using the default", "label", v, "container", t.Name)
+			} else if d == 0 {
+				route.HMACMaxAge = -1 // "0" signs the body only
+			} else {
+				route.HMACMaxAge = d
+			}
+		}
+	}
+	route.Methods = t.Labels[discovery.LabelMethods]
+	route.ContentTypes = t.Labels[discovery.LabelContentTypes]
+	route.ContentEncodings = t.Labels[discovery.LabelContentEncodings]
+	if route.ExtAuthz = t.Labels[discovery.LabelExtAuthz]; route.ExtAuthz != "" {
+		if !validExtAuthzURL(route.ExtAuthz) {
+			// Kept anyway: every request then fails closed with 503
+			slog.Warn("Router: Invalid exposed-ext-authz label (expected an http:// or https:// URL)", "label", route.ExtAuthz, "container", t.Name)
+		}
+		route.ExtAuthzHeaders = t.Labels[discovery.LabelExtAuthzHeaders]
+	}
+	route.RequestScript = t.Labels[discovery.LabelScriptRequest]
+	route.ResponseScript = t.Labels[discovery.LabelScriptResponse]
+	if v := t.Labels[discovery.LabelCache]; v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			slog.Warn("Router: Invalid exposed-cache label, not caching", "label", v, "container", t.Name)
+		}
+		route.Cache = enabled
+	}
+	if v := t.Labels[discovery.LabelRewriteBody]; v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			slog.Warn("Router: Invalid exposed-rewrite-body label, not rewriting", "label", v, "container", t.Name)
+		}
+		route.RewriteBody = enabled
+	}
+	if v := t.Labels[discovery.LabelCoalesce]; v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			slog.Warn("Router: Invalid exposed-coalesce label, not coalescing", "label", v, "container", t.Name)
+		}
+		route.Coalesce = enabled
+	}
+	if v := t.Labels[discovery.LabelMaxDuration]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			slog.Warn("Router: Invalid exposed-max-duration label, using the default", "label", v, "container", t.Name)
+		} else if d == 0 {
+			route.MaxDuration = -1 // "0" means no limit
+		} else {
+			route.MaxDuration = d
+		}
+	}
+
+	switch mode := t.Labels[discovery.LabelExposedTLS]; mode {
+	case "", TLSModeTerminate:
+	case TLSModePassthrough, TLSModeReencrypt:
+		route.TLSMode = mode
+	case "off":
+		route.TLSMode = TLSModePassthrough // No TLS handling by rproxy at all
+	default:
+		slog.Warn("Router: Invalid exposed-tls label, using terminate", "label", mode, "container", t.Name)
+	}
+	if v := t.Labels[discovery.LabelACME]; v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			slog.Warn("Router: Invalid exposed-acme label, issuing certificates", "label", v, "container", t.Name)
+			enabled = true
+		}
+		route.ManualCert = !enabled
+	}
+	if route.TLSMode == TLSModeReencrypt {
+		route.BackendCA = t.Labels[discovery.LabelBackendCA]
+		route.BackendServerName = t.Labels[discovery.LabelBackendServerName]
+		if v := t.Labels[discovery.LabelBackendInsecure]; v != "" {
+			insecure, err := strconv.ParseBool(v)
+			if err != nil {
+				slog.Warn("Router: Invalid exposed-backend-insecure label, verifying backend", "label", v, "container", t.Name)
+			}
+			route.BackendInsecure = insecure
+		}
+		route.BackendClientCert = t.Labels[discovery.LabelBackendClientCert]
+		route.BackendClientKey = t.Labels[discovery.LabelBackendClientKey]
+		if route.BackendClientKey == "" {
+			route.BackendClientKey = route.BackendClientCert // Combined PEM file
+		}
+		if id := t.Labels[discovery.LabelBackendSPIFFEID]; id != "" {
+			if _, err := spiffe.TrustDomain(id); err != nil {
+				slog.Warn("Router: Invalid exposed-backend-spiffe-id label, verifying backend by name", "label", id, "container", t.Name)
+			} else {
+				route.BackendSPIFFEID = id
+			}
+		}
+	}
+	if route.StaticRoot != "" && route.TLSMode != TLSModeTerminate {
+		slog.Warn("Router: Static routes are always terminated, ignoring exposed-tls", "label", route.TLSMode, "container", t.Name)
+		route.TLSMode = TLSModeTerminate
+	}
+	if route.TLSMode == TLSModePassthrough && (route.APIKeys != "" || route.HMACSecret != "" || route.ExtAuthz != "") {
+		slog.Warn("Router: Passthrough routes cannot check API keys, signatures or authorization, ignoring them", "container", t.Name)
+		route.APIKeys, route.HMACSecret, route.ExtAuthz = "", "", ""
+	}
+	if route.TLSMode == TLSModePassthrough && route.ClientCertAllow != "" {
+		// Ignoring the rule instead would open the backend to every client.
+		// The backend speaks TLS, so it is re-encrypted to.
+		slog.Warn("Router: Passthrough routes cannot check client certificates, re-encrypting instead", "container", t.Name)
+		route.TLSMode = TLSModeReencrypt
+	}
+	if route.TLSMode == TLSModePassthrough && (route.Methods != "" || route.ContentTypes != "" || route.ContentEncodings != "") {
+		slog.Warn("Router: Passthrough routes cannot filter requests, ignoring method and content type rules", "container", t.Name)
+		route.Methods, route.ContentTypes, route.ContentEncodings = "", "", ""
+	}
+	if route.TLSMode == TLSModePassthrough && (route.RequestScript != "" || route.ResponseScript != "") {
+		slog.Warn("Router: Passthrough routes cannot run scripts, ignoring them", "container", t.Name)
+		route.RequestScript, route.ResponseScript = "", ""
+	}
+	route.RedirectHost = canonicalRedirect(t)
+	if route.TLSMode == TLSModePassthrough && route.RedirectHost != "" {
+		slog.Warn("Router: Passthrough routes cannot redirect, serving the backend on both names", "container", t.Name)
+		route.RedirectHost = ""
+	}
+	route.AltSvc = t.Labels[discovery.LabelAltSvc]
+	route.ALPN = parseALPN(t)
+	if route.TLSMode == TLSModePassthrough && route.ALPN != "" {
+		slog.Warn("Router: Passthrough routes negotiate protocols with the backend, ignoring exposed-alpn", "container", t.Name)
+		route.ALPN = ""
+	}
+	if v := t.Labels[discovery.LabelProbePath]; v != "" {
+		if v == ProbeOff || strings.HasPrefix(v, "/") {
+			route.ProbePath = v
+		} else {
+			slog.Warn("Router: Invalid exposed-probe-path label (expected a path starting with / or off), using PROBE_PATH", "label", v, "container", t.Name)
+		}
+	}
+	if route.TLSMode == TLSModePassthrough && route.PathPrefix != "/" {
+		slog.Warn("Router: Passthrough routes cannot match paths, ignoring path prefix", "path", route.PathPrefix, "container", t.Name)
+		route.PathPrefix = "/"
+	}
+	return route
+}
+
+// validHostPattern rejects wildcard FQDNs other than a leading "*." label.
+func validHostPattern(fqdn string) bool {
+	if !strings.Contains(fqdn, "*") {
+		return true
+	}
+	rest, ok := strings.CutPrefix(fqdn, "*.")
+	return ok && !strings.Contains(rest, "*") && strings.Contains(rest, ".")
 }
 
 // RunUpdateLoop starts the periodic route update process.
 func (r *Router) RunUpdateLoop(ctx context.Context) {
-	slog.Info("Starting route update loop", "interval", r.config.UpdateInterval)
-	ticker := time.NewTicker(r.config.UpdateInterval)
-	defer ticker.Stop()
+	base := r.config.UpdateInterval
+	slog.Info("Starting route update loop", "interval", base, "max_interval", max(r.config.DiscoveryMaxInterval, base))
+	interval := base
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
 
+	failures := 0 // Consecutive failed passes
 	for {
 		select {
-		case <-ticker.C:
-			r.updateRoutes(ctx)
+		case <-timer.C:
+			changed, err := r.updateRoutes(ctx)
+			interval = r.afterPass(interval, changed, err, &failures)
+		case <-r.refreshCh:
+			slog.Debug("Router: Discovery pass requested")
+			timer.Stop()
+			_, err := r.updateRoutes(ctx)
+			interval = r.afterPass(interval, true, err, &failures) // A hint means things are moving, poll fast again
 		case <-ctx.Done():
 			slog.Info("Stopping route update loop.")
 			return
 		}
+		timer.Reset(interval)
+	}
+}
+
+// discoveryDegradedAfter is the number of consecutive failed discovery passes
+// after which discovery is reported degraded.
+const discoveryDegradedAfter = 3
+
+// afterPass returns the interval until the next discovery pass. Failed passes
+// back off exponentially up to DISCOVERY_FAILURE_MAX_BACKOFF, so an
+// unreachable SSH host is not dialed every few seconds. Failures are logged
+// at first, then only at every doubling of the count.
+func (r *Router) afterPass(interval time.Duration, changed bool, err error, failures *int) time.Duration {
+	base := r.config.UpdateInterval
+	if err != nil {
+		*failures++
+		ceiling := max(r.config.DiscoveryFailureMaxBackoff, base)
+		next := base
+		for i := 0; i < *failures && next < ceiling; i++ {
+			next *= 2
+		}
+		next = min(next, ceiling)
+		switch {
+		case *failures == discoveryDegradedAfter:
+			r.degraded.Store(true)
+			discoveryDegraded.Set(1)
+			slog.Error("Router: Discovery degraded, backing off", "failures", *failures, "retry_in", next, "error", err)
+		case *failures < discoveryDegradedAfter || *failures&(*failures-1) == 0:
+			slog.Error("Router: Discovery failed", "failures", *failures, "retry_in", next, "error", err)
+		default:
+			slog.Debug("Router: Discovery failed", "failures", *failures, "retry_in", next, "error", err)
+		}
+		return next
+	}
+	if *failures > 0 {
+		slog.Info("Router: Discovery recovered", "failures", *failures)
+		*failures = 0
+		r.degraded.Store(false)
+		discoveryDegraded.Set(0)
+		return base
+	}
+	return nextPollInterval(interval, base, r.config.DiscoveryMaxInterval, changed)
+}
+
+// DiscoveryDegraded reports whether discovery failed several passes in a row.
+func (r *Router) DiscoveryDegraded() bool {
+	return r.degraded.Load()
+}
+
+// nextPollInterval backs the discovery interval off while polls find no
+// changes, doubling it up to ceiling (DISCOVERY_MAX_INTERVAL), and snaps back
+// to base after a change.
+func nextPollInterval(interval, base, ceiling time.Duration, changed bool) time.Duration {
+	next := base
+	if !changed && ceiling > base {
+		next = min(interval*2, ceiling)
+	}
+	if next != interval {
+		slog.Debug("Router: Discovery interval changed", "interval", next, "routes_changed", changed)
+	}
+	return next
+}
+
+// RequestRefresh runs a discovery pass now instead of at the next poll, e.g.
+// when a deploy hook knows containers changed.
+func (r *Router) RequestRefresh() {
+	select {
+	case r.refreshCh <- struct{}{}:
+	default: // A pass is already pending
 	}
 }
 
@@ -70,24 +751,67 @@ func (r *Router) RunUpdateLoop(ctx context.Context) {
 func (r *Router) RunCertManager(ctx context.Context) {
 	const dnsChallengeTTLWait = 310 * time.Second
 	slog.Info("Starting cert manager")
+
+	// Failed obtains are retried with backoff by the certificate manager; poll for due retries
+	retryTicker := time.NewTicker(time.Minute)
+	defer retryTicker.Stop()
+
+	// processBatch checks each name, waiting out the DNS TTL between them. It
+	// returns false when ctx is cancelled.
+	processBatch := func(fqdns []string) bool {
+		for i, fqdn := range fqdns {
+			slog.Info("CertManager: Checking certificate", "fqdn", fqdn)
+			r.certManager.CheckAndManageCert(fqdn)
+			if i < len(fqdns)-1 {
+				slog.Info("CertManager: Waiting for DNS TTL to expire before next renewal", "wait", dnsChallengeTTLWait)
+				select {
+				case <-time.After(dnsChallengeTTLWait):
+				case <-ctx.Done():
+					slog.Info("CertManager: Stopping during TTL wait.")
+					return false
+				}
+			}
+		}
+		return true
+	}
+
 	for {
 		select {
+		case fqdn := <-r.certRenewCh:
+			slog.Info("CertManager: Forcing certificate renewal", "fqdn", fqdn)
+			r.certManager.Unquarantine(fqdn)
+			if err := r.certManager.ForceRenew(fqdn); err != nil {
+				slog.Error("CertManager: Forced renewal failed", "fqdn", fqdn, "error", err)
+			}
+			// Same DNS TTL constraint as between batch entries
+			select {
+			case <-time.After(dnsChallengeTTLWait):
+			case <-ctx.Done():
+				slog.Info("CertManager: Stopping during TTL wait.")
+				return
+			}
 		case fqdns := <-r.certWorkCh:
 			slog.Info("CertManager: Processing certificate renewals", "count", len(fqdns), "fqdns", fqdns)
-			for i, fqdn := range fqdns {
-				slog.Info("CertManager: Checking certificate", "fqdn", fqdn)
-				r.certManager.CheckAndManageCert(fqdn)
-				if i < len(fqdns)-1 {
-					slog.Info("CertManager: Waiting for DNS TTL to expire before next renewal", "wait", dnsChallengeTTLWait)
-					select {
-					case <-time.After(dnsChallengeTTLWait):
-					case <-ctx.Done():
-						slog.Info("CertManager: Stopping during TTL wait.")
-						return
-					}
-				}
+			if !processBatch(fqdns) {
+				return
 			}
 			slog.Info("CertManager: Batch complete")
+		case <-retryTicker.C:
+			var due []string
+			for _, fqdn := range r.certManager.DueRetries(time.Now()) {
+				if r.wantsCert(fqdn) {
+					due = append(due, fqdn)
+				} else {
+					r.certManager.ResetFailures(fqdn) // Route gone, stop retrying
+				}
+			}
+			if len(due) == 0 {
+				continue
+			}
+			slog.Info("CertManager: Retrying certificates", "count", len(due), "fqdns", due)
+			if !processBatch(due) {
+				return
+			}
 		case <-ctx.Done():
 			slog.Info("Stopping cert manager.")
 			return
@@ -95,102 +819,332 @@ func (r *Router) RunCertManager(ctx context.Context) {
 	}
 }
 
-// updateRoutes discovers containers and updates the routing map.
-func (r *Router) updateRoutes(ctx context.Context) {
-	// Get copy of current map to check for changes
-	r.mu.RLock()
-	oldRoutes := make(map[string]Route, len(r.routes))
-	for k, v := range r.routes {
-		oldRoutes[k] = v
+// CertStatus reports the managed certificates and their failure state.
+func (r *Router) CertStatus() []certs.CertStatus {
+	return r.certManager.Status()
+}
+
+// wantsCert reports whether a current route still needs a certificate for fqdn.
+func (r *Router) wantsCert(fqdn string) bool {
+	table := r.table.Load()
+	if slices.ContainsFunc(table.routes[fqdn], Route.needsIssuance) {
+		return true
+	}
+	return slices.ContainsFunc(table.regexRoutes, func(rt Route) bool { return rt.CertFQDN == fqdn && !rt.ManualCert })
+}
+
+// diffRouteHosts lists the hosts (FQDNs and host regexes) that gained or lost
+// all their routes between two tables.
+func diffRouteHosts(oldRoutes, newRoutes map[string][]Route, oldRegex, newRegex []Route) (added, removed []string) {
+	hosts := func(routes map[string][]Route, regex []Route) map[string]bool {
+		set := make(map[string]bool, len(routes)+len(regex))
+		for fqdn := range routes {
+			set[fqdn] = true
+		}
+		for _, rt := range regex {
+			set[rt.HostRegex] = true
+		}
+		return set
+	}
+	before, after := hosts(oldRoutes, oldRegex), hosts(newRoutes, newRegex)
+	for host := range after {
+		if !before[host] {
+			added = append(added, host)
+		}
+	}
+	for host := range before {
+		if !after[host] {
+			removed = append(removed, host)
+		}
 	}
-	r.mu.RUnlock()
+	slices.Sort(added)
+	slices.Sort(removed)
+	return added, removed
+}
+
+// updateRoutes discovers containers and updates the routing map. It reports
+// whether the routes changed, or why discovery failed.
+func (r *Router) updateRoutes(ctx context.Context) (bool, error) {
+	// The current table is never modified, compare against it directly
+	old := r.table.Load()
+	oldRoutes, oldRegexRoutes, oldPatterns := old.routes, old.regexRoutes, old.patterns
 
-	newRoutes := make(map[string]Route)
+	newRoutes := make(map[string][]Route)
+	var newRegexRoutes []Route
+	newPatterns := make(map[string]*regexp.Regexp)
 	routesChanged := false
 	var fqdnsNeedingCerts []string // Collect FQDNs that need certificate management
+	var manualCerts []string       // FQDNs serving hand-placed certificates, reloaded on change
 
-	// 1. List containers
-	containers, err := r.podmanClient.ListContainers()
-	if err != nil {
-		slog.Error("Router: Error listing containers", "error", err)
-		return // Keep old map on error
+	// 1. Discover targets from every provider. All are polled even when one
+	// fails, so the per-provider metrics show which one misbehaves.
+	var targets []discovery.Target
+	var errs []error
+	for _, provider := range r.providers {
+		start := time.Now()
+		found, err := provider.Discover(ctx)
+		name := provider.Name()
+		discoverySeconds.Set(time.Since(start).Seconds(), name)
+		if err != nil {
+			discoveryFailures.Inc(name)
+			errs = append(errs, fmt.Errorf("%s provider: %w", name, err))
+			continue
+		}
+		discoverySuccesses.Inc(name)
+		discoveryTargets.Set(float64(len(found)), name)
+		discoveryProviderLastSuccess.Set(float64(time.Now().Unix()), name)
+		targets = append(targets, found...)
+	}
+	if len(errs) > 0 {
+		r.markStale()
+		return false, errors.Join(errs...) // Keep old map on error
 	}
 
-	// 2. Inspect each container found to get IP
-	var wg sync.WaitGroup
-	var inspectMutex sync.Mutex // Mutex to protect access to newRoutes map and fqdnsNeedingCerts slice from goroutines
-
-	for _, container := range containers {
-		wg.Add(1)
-		go func(c podman.ContainerInfo) {
-			defer wg.Done()
-
-			inspectData, err := r.podmanClient.InspectContainer(c.ID)
-			if err != nil {
-				slog.Error("Router: Error inspecting container", "name", c.Name, "id", c.ID, "error", err)
-				return
+	// 2. Build the new routing map
+	targets = withAliases(targets)
+	discovered := make(map[string][]discovery.Target)
+	for _, t := range targets {
+		host := cmp.Or(t.HostRegex, t.FQDN)
+		discovered[host] = append(discovered[host], t)
+	}
+	for _, t := range targets {
+		if t.HostRegex != "" {
+			if tenant := t.Labels[discovery.LabelTenant]; tenant != "" {
+				slog.Warn("Router: Tenants cannot use host regex routes, ignoring route", "tenant", tenant, "regex", t.HostRegex, "container", t.Name)
+				tenantRejected.Inc(tenant, "regex")
+				continue
 			}
-
-			var ipAddress string
-			if inspectData.NetworkSettings.Networks != nil {
-				for _, netDetails := range inspectData.NetworkSettings.Networks {
-					if netDetails.IPAddress != "" {
-						ipAddress = netDetails.IPAddress
-						break
-					}
-				}
+			if !r.admitDomain(t) {
+				continue
 			}
-			if ipAddress == "" {
-				slog.Warn("Router: Could not find IP address for container", "name", c.Name, "id", c.ID)
-				return
+			// Reuse the compiled pattern from the previous pass when possible
+			pattern, ok := oldPatterns[t.HostRegex]
+			if !ok {
+				var err error
+				if pattern, err = regexp.Compile(t.HostRegex); err != nil {
+					slog.Warn("Router: Invalid host regex", "regex", t.HostRegex, "container", t.Name, "error", err)
+					continue
+				}
 			}
+			newPatterns[t.HostRegex] = pattern
+			route := newRoute(t)
+			route.HostRegex = t.HostRegex
+			route.CertFQDN = t.CertFQDN
+			newRegexRoutes = append(newRegexRoutes, route)
+			continue
+		}
 
-			exposedPort, err := strconv.Atoi(c.ExposedPort)
-			if err != nil {
-				slog.Error("Router: Invalid exposed-port label", "label", c.ExposedPort, "name", c.Name, "id", c.ID, "error", err)
-				return
-			}
+		if !validHostPattern(t.FQDN) {
+			slog.Warn("Router: Invalid wildcard FQDN, only a leading '*.' label is supported", "fqdn", t.FQDN, "container", t.Name)
+			continue
+		}
+		if !r.admitTenant(t) || !r.admitDomain(t) {
+			continue
+		}
 
-			newRoute := Route{
-				TargetIP:   ipAddress,
-				TargetPort: exposedPort,
-			}
+		newRoute := newRoute(t)
 
-			// Check if route is new or changed before logging/managing cert
-			inspectMutex.Lock()
-			oldRoute, exists := oldRoutes[c.FQDN]
-			if !exists || oldRoute != newRoute {
-				routesChanged = true
-				slog.Info("Router: Updating route", "fqdn", c.FQDN, "targetIP", ipAddress, "targetPort", exposedPort, "container", c.Name)
-				newRoutes[c.FQDN] = newRoute
-				// Collect FQDN for certificate management (will be processed sequentially later)
-				fqdnsNeedingCerts = append(fqdnsNeedingCerts, c.FQDN)
-			} else {
-				// Route exists and is unchanged, just copy it
-				newRoutes[c.FQDN] = newRoute
+		if slices.ContainsFunc(newRoutes[t.FQDN], func(rt Route) bool { return rt.PathPrefix == newRoute.PathPrefix }) {
+			slog.Warn("Router: Duplicate FQDN and path, keeping first target", "fqdn", t.FQDN, "path", newRoute.PathPrefix, "ignored", t.Name)
+			continue
+		}
+		newRoutes[t.FQDN] = append(newRoutes[t.FQDN], newRoute)
+	}
+
+	r.enforceTenantQuotas(oldRoutes, newRoutes)
+
+	pendingRemovals := r.deferRemovals(oldRoutes, newRoutes, oldRegexRoutes, &newRegexRoutes, oldPatterns, newPatterns)
+
+	for fqdn, routes := range newRoutes {
+		// Longest prefix first so the most specific route wins in GetRoute.
+		// Ties are broken by prefix and target, so equal-length prefixes keep
+		// their order across rebuilds.
+		slices.SortStableFunc(routes, func(a, b Route) int {
+			return cmp.Or(
+				len(b.PathPrefix)-len(a.PathPrefix),
+				strings.Compare(a.PathPrefix, b.PathPrefix),
+				strings.Compare(a.TargetIP, b.TargetIP),
+				a.TargetPort-b.TargetPort,
+			)
+		})
+
+		// Check if routes are new or changed before logging/managing cert
+		oldHostRoutes, exists := oldRoutes[fqdn]
+		if !exists || !slices.Equal(oldHostRoutes, routes) {
+			routesChanged = true
+			slog.Info("Router: Updating route", "fqdn", fqdn, "routes", routes)
+			// Collect FQDN for certificate management (will be processed sequentially later).
+			if slices.ContainsFunc(routes, Route.needsIssuance) {
+				fqdnsNeedingCerts = append(fqdnsNeedingCerts, fqdn)
+			} else if slices.ContainsFunc(routes, func(rt Route) bool { return rt.ManualCert }) {
+				manualCerts = append(manualCerts, fqdn)
 			}
-			inspectMutex.Unlock()
+		}
+	}
 
-		}(container)
+	// Routes that disappeared also count as a change
+	if len(newRoutes) != len(oldRoutes) {
+		routesChanged = true
+	}
+	// Regex routes only need certificates when they name one explicitly
+	if !slices.Equal(newRegexRoutes, oldRegexRoutes) {
+		routesChanged = true
+		slog.Info("Router: Updating regex routes", "routes", newRegexRoutes)
+		for _, rt := range newRegexRoutes {
+			switch {
+			case rt.CertFQDN == "":
+			case rt.ManualCert:
+				manualCerts = append(manualCerts, rt.CertFQDN)
+			case !slices.Contains(fqdnsNeedingCerts, rt.CertFQDN):
+				fqdnsNeedingCerts = append(fqdnsNeedingCerts, rt.CertFQDN)
+			}
+		}
 	}
-	wg.Wait()
 
-	// Update the global routing map only if changes were detected
+	// Swap in the new table only if changes were detected
 	if routesChanged {
-		r.mu.Lock()
-		r.routes = newRoutes
-		slog.Info("Router: Route map updated", "active_routes", len(r.routes))
-		r.mu.Unlock()
+		r.table.Store(newRouteTable(newRoutes, newRegexRoutes, newPatterns))
+		slog.Info("Router: Route map updated", "active_routes", len(newRoutes))
+	}
+	r.mu.Lock()
+	wasStale := r.stale
+	r.stale = false
+	r.confirmedAt = time.Now()
+	r.discovered = discovered
+	r.mu.Unlock()
+	routesStale.Set(0)
+	discoveryLastSuccess.Set(float64(time.Now().Unix()))
+	if wasStale {
+		slog.Info("Router: Discovery pass succeeded, routes are no longer stale")
+	}
+	if routesChanged {
+		// Persist the table so a restart during a discovery outage keeps routing
+		r.saveSnapshot()
+		// The first table (neither restored nor discovered before) is not news
+		if r.ready.Load() {
+			added, removed := diffRouteHosts(oldRoutes, newRoutes, oldRegexRoutes, newRegexRoutes)
+			for _, host := range added {
+				events.Publish(events.RouteAdded, host, "")
+			}
+			for _, host := range removed {
+				events.Publish(events.RouteRemoved, host, "")
+			}
+		}
+	}
+	if !r.ready.Load() {
+		r.markReady()
+	}
+	// Pick up certificates replaced by hand along with their route
+	for _, fqdn := range manualCerts {
+		r.certManager.Preload(fqdn)
 	}
 
 	// 3. Hand off certificate management to the dedicated cert manager goroutine.
 	// This avoids blocking the route update loop during long cert renewals.
 	if len(fqdnsNeedingCerts) > 0 {
+		// A changed route gets a fresh set of attempts
+		for _, fqdn := range fqdnsNeedingCerts {
+			r.certManager.ResetFailures(fqdn)
+		}
 		select {
 		case r.certWorkCh <- fqdnsNeedingCerts:
 			slog.Info("Router: Queued certificate management", "count", len(fqdnsNeedingCerts), "fqdns", fqdnsNeedingCerts)
 		default:
-			slog.Warn("Router: Cert manager busy, cert renewal will retry on next route change", "fqdns", fqdnsNeedingCerts)
+			slog.Warn("Router: Cert manager busy, deferring certificate checks", "fqdns", fqdnsNeedingCerts)
+			for _, fqdn := range fqdnsNeedingCerts {
+				r.certManager.Defer(fqdn, time.Minute)
+			}
+		}
+	}
+
+	// Keep polling fast until the pending removals are settled
+	return routesChanged || pendingRemovals > 0, nil
+}
+
+// withAliases adds a copy of each target for every FQDN of its
+// exposed-fqdn-aliases label, and for the www or apex counterpart of its
+// FQDN with exposed-canonical-host. The copies are routed, admitted and
+// certified like separate targets.
+func withAliases(targets []discovery.Target) []discovery.Target {
+	var aliased []discovery.Target
+	for _, t := range targets {
+		v := t.Labels[discovery.LabelFQDNAliases]
+		if t.Labels[discovery.LabelCanonicalHost] != "" && t.HostRegex == "" && !strings.HasPrefix(t.FQDN, "*.") {
+			v += "," + wwwCounterpart(t.FQDN)
+		}
+		if v == "" {
+			continue
+		}
+		if t.HostRegex != "" {
+			slog.Warn("Router: exposed-fqdn-aliases does not apply to host regex routes, ignoring it", "regex", t.HostRegex, "container", t.Name)
+			continue
+		}
+		seen := map[string]bool{t.FQDN: true}
+		for alias := range strings.SplitSeq(v, ",") {
+			alias = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(alias), "."))
+			if alias == "" || seen[alias] {
+				continue
+			}
+			seen[alias] = true
+			at := t
+			at.FQDN = alias
+			aliased = append(aliased, at)
+		}
+	}
+	if len(aliased) == 0 {
+		return targets
+	}
+	return append(slices.Clone(targets), aliased...)
+}
+
+// deferRemovals keeps hosts and regex patterns that vanished from discovery
+// until they were missing ROUTE_REMOVAL_MISSES passes in a row, so a single
+// empty or partial answer from a provider does not take routes down. The kept
+// routes are added back to newRoutes and newRegex. It returns how many are
+// pending removal.
+func (r *Router) deferRemovals(oldRoutes, newRoutes map[string][]Route, oldRegex []Route, newRegex *[]Route, oldPatterns, newPatterns map[string]*regexp.Regexp) int {
+	present := make(map[string]bool, len(newRoutes)+len(*newRegex))
+	for fqdn := range newRoutes {
+		present[fqdn] = true
+	}
+	for _, rt := range *newRegex {
+		present["regex:"+rt.HostRegex] = true
+	}
+	for key := range r.misses {
+		if present[key] {
+			delete(r.misses, key)
+		}
+	}
+
+	pending := make(map[string]bool)
+	keep := func(key string) bool {
+		if present[key] {
+			return false
+		}
+		if pending[key] {
+			return true // Another path route of the same regex
+		}
+		r.misses[key]++
+		if r.misses[key] >= int(r.config.RouteRemovalMisses) {
+			delete(r.misses, key)
+			return false
+		}
+		slog.Warn("Router: Route missing from discovery, keeping it for now", "host", key, "misses", r.misses[key], "threshold", r.config.RouteRemovalMisses)
+		routeRemovalsDeferred.Inc()
+		pending[key] = true
+		return true
+	}
+	for fqdn, routes := range oldRoutes {
+		if keep(fqdn) {
+			newRoutes[fqdn] = slices.Clone(routes) // Sorted again below, the old table must stay untouched
+		}
+	}
+	for _, rt := range oldRegex {
+		if keep("regex:" + rt.HostRegex) {
+			*newRegex = append(*newRegex, rt)
+			newPatterns[rt.HostRegex] = oldPatterns[rt.HostRegex]
 		}
 	}
+	routesPendingRemoval.Set(float64(len(pending)))
+	return len(pending)
 } 
\ No newline at end of file
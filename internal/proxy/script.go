@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// Script hooks are WASI modules (e.g. built with GOOS=wasip1 or TinyGo) named
+// by the exposed-script-request and exposed-script-response labels. Each call
+// runs a fresh instance: the module reads a scriptInput as JSON on stdin and
+// writes a scriptVerdict as JSON on stdout. Empty output changes nothing.
+const (
+	scriptTimeout     = 100 * time.Millisecond // Per call, including instantiation
+	scriptMemoryPages = 256                    // 16 MiB of linear memory
+	scriptMaxOutput   = 64 << 10
+)
+
+// scriptInput describes the request (and in the response phase, the
+// response) to the hook.
+type scriptInput struct {
+	Phase    string      `json:"phase"` // "request" or "response"
+	FQDN     string      `json:"fqdn"`
+	Method   string      `json:"method"`
+	Path     string      `json:"path"`
+	Query    string      `json:"query,omitempty"`
+	Remote   string      `json:"remote"`
+	Headers  http.Header `json:"headers"`
+	Upstream string      `json:"upstream"`
+
+	Status          int         `json:"status,omitempty"`
+	ResponseHeaders http.Header `json:"response_headers,omitempty"`
+}
+
+// scriptVerdict is what a hook asks for. In the request phase, a non-zero
+// Status answers the request without reaching the backend, with Body and
+// ResponseHeaders; SetHeaders and RemoveHeaders change the request and
+// Upstream ("host:port") replaces the route's backend. In the response phase,
+// SetHeaders and RemoveHeaders change the response and Status replaces its
+// status code.
+type scriptVerdict struct {
+	Status          int               `json:"status"`
+	Body            string            `json:"body"`
+	ResponseHeaders map[string]string `json:"response_headers"`
+	SetHeaders      map[string]string `json:"set_headers"`
+	RemoveHeaders   []string          `json:"remove_headers"`
+	Upstream        string            `json:"upstream"`
+}
+
+// scriptRuntime compiles and runs all hooks. Calls are cancelled when their
+// context is done, so a looping module cannot hold a request.
+var scriptRuntime = sync.OnceValue(func() wazero.Runtime {
+	ctx := context.Background()
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(scriptMemoryPages))
+	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
+	return rt
+})
+
+// scriptModule is the last compile of a hook file.
+type scriptModule struct {
+	compiled wazero.CompiledModule
+	err      error
+	checked  time.Time
+	modTime  time.Time
+}
+
+var scriptModules sync.Map // path -> *scriptModule
+
+// loadScript returns the compiled module at path, recompiling it when the
+// file's modification time changes (checked like label files, see labelfile.go).
+// Replaced modules are left to the garbage collector rather than closed, since
+// requests may still be instantiating them.
+func loadScript(path string) (wazero.CompiledModule, error) {
+	now := time.Now()
+	v, ok := scriptModules.Load(path)
+	if ok && now.Sub(v.(*scriptModule).checked) < labelFileRecheck {
+		return v.(*scriptModule).compiled, v.(*scriptModule).err
+	}
+
+	module := &scriptModule{checked: now}
+	info, err := os.Stat(path)
+	switch {
+	case err != nil:
+		module.err = err
+	case ok && v.(*scriptModule).err == nil && info.ModTime().Equal(v.(*scriptModule).modTime):
+		module.compiled, module.modTime = v.(*scriptModule).compiled, info.ModTime()
+	default:
+		module.modTime = info.ModTime()
+		var code []byte
+		if code, module.err = os.ReadFile(path); module.err == nil {
+			module.compiled, module.err = scriptRuntime().CompileModule(context.Background(), code)
+		}
+	}
+	if module.err != nil {
+		slog.Error("Handler: Cannot load script", "path", path, "error", module.err)
+	}
+	scriptModules.Store(path, module)
+	return module.compiled, module.err
+}
+
+// limitedBuffer keeps the first max bytes written and reports overflow.
+type limitedBuffer struct {
+	bytes.Buffer
+	max      int
+	overflow bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.max {
+		b.overflow = true
+		b.Buffer.Write(p[:max(b.max-b.Len(), 0)])
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// runScript runs the hook at path with input and decodes its verdict.
+func runScript(ctx context.Context, path string, input scriptInput) (scriptVerdict, error) {
+	var verdict scriptVerdict
+	compiled, err := loadScript(path)
+	if err != nil {
+		return verdict, err
+	}
+	in, err := json.Marshal(input)
+	if err != nil {
+		return verdict, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, scriptTimeout)
+	defer cancel()
+	stdout := &limitedBuffer{max: scriptMaxOutput}
+	stderr := &limitedBuffer{max: 4 << 10}
+	config := wazero.NewModuleConfig().
+		WithName(""). // Instances of the same module run concurrently
+		WithArgs(path).
+		WithStdin(bytes.NewReader(in)).
+		WithStdout(stdout).
+		WithStderr(stderr)
+	mod, err := scriptRuntime().InstantiateModule(ctx, compiled, config)
+	if mod != nil {
+		mod.Close(context.Background())
+	}
+	if exitErr := (*sys.ExitError)(nil); errors.As(err, &exitErr) && exitErr.ExitCode() == 0 {
+		err = nil
+	}
+	if err != nil {
+		return verdict, fmt.Errorf("script failed: %w (stderr: %q)", err, stderr.String())
+	}
+	if stdout.overflow {
+		return verdict, fmt.Errorf("script output exceeds %d bytes", scriptMaxOutput)
+	}
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return verdict, nil
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &verdict); err != nil {
+		return verdict, fmt.Errorf("invalid script output: %w", err)
+	}
+	return verdict, nil
+}
+
+// scriptUpstreamKey carries a request hook's backend override to the director.
+type scriptUpstreamKey struct{}
+
+// runRequestScript runs the route's request hook before the backend. Requests
+// are answered with 500 when the hook fails, so a broken hook cannot let
+// requests through that it was meant to reject.
+func runRequestScript(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		info, _ := routeInfoFrom(req.Context())
+		verdict, err := runScript(req.Context(), info.Route.RequestScript, scriptInput{
+			Phase:    "request",
+			FQDN:     info.FQDN,
+			Method:   req.Method,
+			Path:     req.URL.Path,
+			Query:    req.URL.RawQuery,
+			Remote:   clientIP(req.RemoteAddr),
+			Headers:  req.Header,
+			Upstream: info.Route.target(),
+		})
+		if err != nil {
+			slog.Error("Handler: Request script failed, responding 500", "fqdn", info.FQDN, "script", info.Route.RequestScript, "error", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(rw, "500 Internal Server Error: The request could not be checked.")
+			return
+		}
+		if verdict.Status != 0 {
+			if verdict.Status < 200 || verdict.Status > 599 {
+				slog.Error("Handler: Request script returned an invalid status, responding 500", "fqdn", info.FQDN, "script", info.Route.RequestScript, "status", verdict.Status)
+				verdict.Status, verdict.Body = http.StatusInternalServerError, "500 Internal Server Error: The request could not be checked.\n"
+			}
+			slog.Debug("Handler: Request answered by script", "fqdn", info.FQDN, "status", verdict.Status, "remote", req.RemoteAddr)
+			for name, value := range verdict.ResponseHeaders {
+				rw.Header().Set(name, value)
+			}
+			rw.WriteHeader(verdict.Status)
+			fmt.Fprint(rw, verdict.Body)
+			return
+		}
+		for _, name := range verdict.RemoveHeaders {
+			req.Header.Del(name)
+		}
+		for name, value := range verdict.SetHeaders {
+			req.Header.Set(name, value)
+		}
+		if verdict.Upstream != "" {
+			req = req.WithContext(context.WithValue(req.Context(), scriptUpstreamKey{}, verdict.Upstream))
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// runResponseScript is the response pipeline step running the route's
+// response hook. A failing hook turns the response into a 502.
+func runResponseScript(resp *http.Response, info routeInfo) error {
+	if info.Route.ResponseScript == "" {
+		return nil
+	}
+	req := resp.Request
+	verdict, err := runScript(req.Context(), info.Route.ResponseScript, scriptInput{
+		Phase:           "response",
+		FQDN:            info.FQDN,
+		Method:          req.Method,
+		Path:            req.URL.Path,
+		Query:           req.URL.RawQuery,
+		Remote:          clientIP(req.RemoteAddr),
+		Headers:         req.Header,
+		Upstream:        req.URL.Host,
+		Status:          resp.StatusCode,
+		ResponseHeaders: resp.Header,
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range verdict.RemoveHeaders {
+		resp.Header.Del(name)
+	}
+	for name, value := range verdict.SetHeaders {
+		resp.Header.Set(name, value)
+	}
+	if verdict.Status >= 200 && verdict.Status <= 599 && resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.StatusCode = verdict.Status
+		resp.Status = fmt.Sprintf("%d %s", verdict.Status, http.StatusText(verdict.Status))
+	}
+	return nil
+}
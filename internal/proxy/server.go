@@ -1,12 +1,21 @@
 package proxy
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"fmt"
+	"log"
 	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"rproxy/internal/cache"
 	"rproxy/internal/certs"
+	"rproxy/internal/config"
+	"rproxy/internal/ddns"
+	"rproxy/internal/spiffe"
+	"rproxy/internal/tunnel"
 	"time"
 )
 
@@ -15,56 +24,275 @@ type Server struct {
 	router      *Router
 	certManager *certs.Manager
 	httpServer  *http.Server
+	dial        DialFunc
+	public      []listenAddr   // Public sockets, empty with PUBLIC_LISTENER=false
+	listeners   []net.Listener // Additional listeners, e.g. on a tailnet
+	profiles    []profileServer
+	reusePort   int    // SO_REUSEPORT sockets per address, 0 for one plain socket
+	keyLogFile  string // TLS_KEYLOG_FILE, warned about while set
+	unknownSNI  *unknownSNI
+	strict      strictChecks // HTTP_STRICT
+	spikes      *errorSpikes // nil without 5xx spike detection
+	prober      *prober      // nil with PROBE_INTERVAL=0
+	dnsCheck    *dnsCheck    // nil without PUBLIC_IPS or DDNS
+	plainHTTP   *http.Server // HTTP_ADDR: HTTP-01 challenges and redirects to HTTPS, nil when unset
 }
 
-// NewServer creates a new proxy server instance.
-func NewServer(router *Router, certMgr *certs.Manager) *Server {
-	proxyHandler := NewProxyHandler(router)
+// profileServer serves a LISTENERS profile on its own address and TLS policy.
+type profileServer struct {
+	name       string
+	addr       string
+	httpServer *http.Server
+}
 
+// NewServer creates a new proxy server instance. Backends are dialed with dial,
+// or directly when dial is nil, resolving hostname targets through a cache.
+// Tunnel targets are dialed through their agent when tunnels is not nil. DNS
+// records are checked against the addresses publicIPs detects when
+// PUBLIC_IPS is unset.
+func NewServer(cfg *config.Config, router *Router, certMgr *certs.Manager, dial DialFunc, tap *Tap, store *cache.Cache, tarpit *Tarpit, svids *spiffe.Source, tunnels *tunnel.Hub, publicIPs *ddns.Updater) (*Server, error) {
+	if dial == nil {
+		dial = newResolver(cfg.BackendDNSTTL).DialContext
+	}
+	if tunnels != nil {
+		dial = tunnels.Dial(dial)
+	}
+	spikes := newErrorSpikes(cfg, router, dial)
+	proxyHandler, err := NewProxyHandler(cfg, router, dial, tap, store, tarpit, svids, spikes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create proxy handler: %w", err)
+	}
+
+	unknown, err := newUnknownSNI(cfg.UnknownSNIPolicy, cfg.NoSNICert, certMgr)
+	if err != nil {
+		return nil, err
+	}
 	tlsConfig := &tls.Config{
-		GetCertificate: certMgr.GetCertificateForSNI,
-		MinVersion:     tls.VersionTLS12,
+		GetCertificate:   unknown.getCertificate,
+		VerifyConnection: recordHandshake,
+		MinVersion:       tls.VersionTLS12,
+	}
+	if cfg.TLSKeyLogFile != "" {
+		keyLog, err := os.OpenFile(cfg.TLSKeyLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open TLS_KEYLOG_FILE: %w", err)
+		}
+		tlsConfig.KeyLogWriter = keyLog
+		slog.Warn("!!! TLS_KEYLOG_FILE is set: session secrets of every TLS connection are written to disk. "+
+			"Anyone with this file can decrypt captured traffic. Use for debugging only and unset it afterwards !!!", "file", cfg.TLSKeyLogFile)
 	}
 
-	server := &http.Server{
-		Addr:         ":443", // Revert to default dual-stack address
-		Handler:      proxyHandler,
-		TLSConfig:    tlsConfig,
-		ReadTimeout:  60 * time.Second,  // 1 minute - time to read the client request
-		WriteTimeout: 600 * time.Second, // 10 minutes - time for backend to respond and write back
-		IdleTimeout:  120 * time.Second, // 2 minutes - keep idle connections alive
+	limits := &connLimits{}
+	strict := newStrictChecks(cfg.HTTPStrict)
+	var handler http.Handler = unknown.handler(proxyHandler)
+	handler = pinALPN(handler, router)
+	if cfg.EnforceHostSNI {
+		handler = enforceHostSNI(handler)
+	}
+	if tunnels != nil {
+		handler = tunnels.Intercept(handler)
+	}
+	newHTTPServer := func(listener string, tlsConfig *tls.Config) *http.Server {
+		if strict.inspectsHeads() {
+			// Offered by ServeTLS otherwise, see strictListener
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+		tlsConfig = withRouteALPN(tlsConfig, router)
+		return &http.Server{
+			Handler:   strict.handler(handler),
+			TLSConfig: tlsConfig,
+			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+				if sc, ok := c.(*strictConn); ok {
+					ctx = context.WithValue(ctx, strictConnKey{}, sc)
+				}
+				c = unwrapStrict(c)
+				ctx = context.WithValue(ctx, listenerKey{}, listener)
+				return limits.connContext(context.WithValue(ctx, connKey{}, c), c)
+			},
+			ConnState: func(c net.Conn, state http.ConnState) {
+				c = unwrapStrict(c)
+				unknown.connState(c, state)
+				limits.connState(c, state)
+			},
+			ErrorLog:          log.New(handshakeErrorLog{}, "", 0),
+			ReadHeaderTimeout: 60 * time.Second,  // 1 minute - time to read the request headers; body deadlines are per route
+			WriteTimeout:      600 * time.Second, // 10 minutes - replaced per request by the route's max duration
+			IdleTimeout:       120 * time.Second, // 2 minutes - keep idle connections alive
+		}
+	}
+	server := newHTTPServer("", tlsConfig)
+
+	var profiles []profileServer
+	for _, l := range cfg.Listeners {
+		profileTLS, err := profileTLSConfig(tlsConfig, l)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profileServer{name: l.Name, addr: l.Addr, httpServer: newHTTPServer(l.Name, profileTLS)})
+	}
+
+	var public []listenAddr
+	if cfg.PublicListener {
+		public = publicAddrs(cfg)
 	}
 
 	return &Server{
 		router:      router,
 		certManager: certMgr,
 		httpServer:  server,
-	}
+		dial:        dial,
+		public:      public,
+		profiles:    profiles,
+		reusePort:   int(cfg.ListenReusePort),
+		keyLogFile:  cfg.TLSKeyLogFile,
+		unknownSNI:  unknown,
+		strict:      strict,
+		spikes:      spikes,
+		prober:      newProber(cfg, router),
+		dnsCheck:    newDNSCheck(cfg, router, publicIPs),
+		plainHTTP:   newPlainHTTPServer(cfg.HTTPAddr, router, certMgr),
+	}, nil
+}
+
+// AddListener serves the proxy on an additional listener. Must be called before Start.
+func (s *Server) AddListener(ln net.Listener) {
+	s.listeners = append(s.listeners, ln)
 }
 
-// Start runs the HTTPS server.
+// boundListener is an open socket and the server (and profile) handling it.
+type boundListener struct {
+	net.Listener
+	server  *http.Server
+	profile string
+}
+
+// Start runs the HTTPS servers: the public one on its listeners and one per
+// listener profile.
 func (s *Server) Start(ctx context.Context) error {
-	slog.Info("Starting HTTPS proxy server", "address", s.httpServer.Addr)
-
-	// Channel to listen for errors from ListenAndServeTLS
-	errChan := make(chan error, 1)
-
-	go func() {
-		// Use ListenAndServeTLS for default dual-stack behavior.
-		// Certs are provided by http.Server.TLSConfig.GetCertificate
-		if err := s.httpServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
-			errChan <- fmt.Errorf("HTTPS server error: %w", err)
-		} else {
-			errChan <- nil // Signal graceful shutdown
+	var listeners []boundListener
+	for _, ln := range s.listeners {
+		listeners = append(listeners, boundListener{ln, s.httpServer, ""})
+	}
+	// With LISTEN_REUSEPORT, each address gets that many sockets, each with
+	// its own accept loop
+	listen := func(network, address string, server *http.Server, profile string) error {
+		for range max(s.reusePort, 1) {
+			var ln net.Listener
+			var err error
+			if s.reusePort > 0 {
+				ln, err = listenReusePort(network, address)
+			} else {
+				ln, err = net.Listen(network, address)
+			}
+			if err != nil {
+				for _, opened := range listeners[len(s.listeners):] {
+					opened.Close()
+				}
+				return fmt.Errorf("HTTPS server error: %w", err)
+			}
+			listeners = append(listeners, boundListener{ln, server, profile})
 		}
-	}()
+		return nil
+	}
+	for _, a := range s.public {
+		if err := listen(a.network, a.address, s.httpServer, ""); err != nil {
+			return err
+		}
+	}
+	for _, p := range s.profiles {
+		if err := listen("tcp", p.addr, p.httpServer, p.name); err != nil {
+			return err
+		}
+	}
+	if len(listeners) == 0 {
+		return fmt.Errorf("HTTPS server error: no listeners configured")
+	}
+	var plainLn net.Listener
+	if s.plainHTTP != nil {
+		var err error
+		if plainLn, err = net.Listen("tcp", s.plainHTTP.Addr); err != nil {
+			for _, opened := range listeners[len(s.listeners):] {
+				opened.Close()
+			}
+			return fmt.Errorf("HTTP server error: %w", err)
+		}
+	}
+
+	// Channel to listen for errors from ServeTLS, one per listener, and from
+	// the plain HTTP server
+	errChan := make(chan error, len(listeners)+1)
+
+	for _, ln := range listeners {
+		slog.Info("Starting HTTPS proxy server", "address", ln.Addr(), "listener", cmp.Or(ln.profile, "public"))
+		// Passthrough routes are spliced before TLS termination; everything else reaches the HTTPS server
+		sniLn := newSNIListener(ln.Listener, s.router, s.dial)
+		sniLn.listener = ln.profile
+		if s.unknownSNI.policy == UnknownSNIClose {
+			sniLn.hasCert = s.unknownSNI.hasCert
+		}
+
+		go func() {
+			// Certs are provided by http.Server.TLSConfig.GetCertificate
+			var err error
+			if s.strict.inspectsHeads() {
+				err = ln.server.Serve(newStrictListener(sniLn, ln.server.TLSConfig, s.strict))
+			} else {
+				err = ln.server.ServeTLS(sniLn, "", "")
+			}
+			if err != nil && err != http.ErrServerClosed {
+				errChan <- fmt.Errorf("HTTPS server error on %s: %w", ln.Addr(), err)
+			} else {
+				errChan <- nil // Signal graceful shutdown
+			}
+		}()
+	}
+
+	servers := []*http.Server{s.httpServer}
+	for _, p := range s.profiles {
+		servers = append(servers, p.httpServer)
+	}
+	if plainLn != nil {
+		slog.Info("Starting HTTP server for ACME challenges and redirects to HTTPS", "address", plainLn.Addr())
+		go func() {
+			if err := s.plainHTTP.Serve(plainLn); err != nil && err != http.ErrServerClosed {
+				errChan <- fmt.Errorf("HTTP server error on %s: %w", plainLn.Addr(), err)
+			} else {
+				errChan <- nil
+			}
+		}()
+		servers = append(servers, s.plainHTTP)
+	}
+
+	go s.spikes.run(ctx)
+	go s.prober.run(ctx)
+	go s.dnsCheck.run(ctx)
+
+	// Keep reminding while TLS secrets are being logged
+	if s.keyLogFile != "" {
+		go func() {
+			ticker := time.NewTicker(time.Hour)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					slog.Warn("TLS_KEYLOG_FILE is still set: TLS session secrets are being written to disk", "file", s.keyLogFile)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
 
 	// Wait for context cancellation or server error
 	select {
 	case err := <-errChan:
 		if err != nil {
 			slog.Error("Server error", "error", err)
-			// Listener is closed by ListenAndServeTLS on error or Shutdown
+			// Stop the remaining listeners too
+			for _, server := range servers {
+				server.Close()
+			}
 			return err
 		}
 		slog.Info("Server shutdown initiated gracefully (via server stop).")
@@ -73,13 +301,19 @@ func (s *Server) Start(ctx context.Context) error {
 		// Attempt graceful shutdown
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		// Shutdown stops the server AND closes the listener(s)
-		if err := s.httpServer.Shutdown(shutdownCtx); err != nil {
-			slog.Warn("Server graceful shutdown failed", "error", err)
-			return err
+		// Shutdown stops the servers AND closes their listener(s)
+		var shutdownErr error
+		for _, server := range servers {
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				slog.Warn("Server graceful shutdown failed", "error", err)
+				shutdownErr = err
+			}
+		}
+		if shutdownErr != nil {
+			return shutdownErr
 		}
 		slog.Info("Server gracefully stopped.")
 	}
 
 	return nil
-} 
\ No newline at end of file
+}
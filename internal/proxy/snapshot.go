@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// routeSnapshot is the on-disk form of the route table.
+type routeSnapshot struct {
+	SavedAt     time.Time          `json:"saved_at"`
+	Routes      map[string][]Route `json:"routes"`
+	RegexRoutes []Route            `json:"regex_routes"`
+}
+
+// RestoreSnapshot loads the route table saved by a previous run. Restored routes
+// are served but marked stale until the first successful discovery pass.
+// A missing snapshot file is not an error.
+func (r *Router) RestoreSnapshot() error {
+	path := r.config.RoutesStateFile
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		slog.Info("Router: No route snapshot to restore", "path", path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read route snapshot %s: %w", path, err)
+	}
+
+	var snap routeSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("failed to parse route snapshot %s: %w", path, err)
+	}
+
+	patterns := make(map[string]*regexp.Regexp)
+	var regexRoutes []Route
+	for _, route := range snap.RegexRoutes {
+		pattern, err := regexp.Compile(route.HostRegex)
+		if err != nil {
+			slog.Warn("Router: Skipping invalid regex route in snapshot", "regex", route.HostRegex, "error", err)
+			continue
+		}
+		if route.CertFQDN != "" && !r.config.DomainAllowed(route.CertFQDN) {
+			continue
+		}
+		patterns[route.HostRegex] = pattern
+		regexRoutes = append(regexRoutes, route)
+	}
+	if snap.Routes == nil {
+		snap.Routes = make(map[string][]Route)
+	}
+	// The domain policy may have changed since the snapshot was saved
+	for fqdn := range snap.Routes {
+		if !r.config.DomainAllowed(fqdn) {
+			slog.Warn("Router: Skipping snapshot routes not allowed by DOMAIN_ALLOWLIST/DOMAIN_DENYLIST", "fqdn", fqdn)
+			delete(snap.Routes, fqdn)
+		}
+	}
+
+	r.table.Store(newRouteTable(snap.Routes, regexRoutes, patterns))
+	r.mu.Lock()
+	r.stale = true
+	r.confirmedAt = snap.SavedAt
+	r.mu.Unlock()
+	routesStale.Set(1)
+
+	slog.Info("Router: Restored stale routes from snapshot", "path", path, "saved_at", snap.SavedAt, "routes", len(snap.Routes), "regex_routes", len(regexRoutes))
+	// Serve the restored routes right away rather than waiting for discovery
+	r.markReady()
+	return nil
+}
+
+// saveSnapshot writes the current route table to disk atomically.
+func (r *Router) saveSnapshot() {
+	path := r.config.RoutesStateFile
+	if path == "" {
+		return
+	}
+
+	table := r.table.Load()
+	snap := routeSnapshot{
+		SavedAt:     time.Now(),
+		Routes:      table.routes,
+		RegexRoutes: table.regexRoutes,
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		slog.Error("Router: Failed to encode route snapshot", "error", err)
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".routes-*.json")
+	if err != nil {
+		slog.Error("Router: Failed to save route snapshot", "path", path, "error", err)
+		return
+	}
+	defer os.Remove(tmp.Name()) // No-op after a successful rename
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		slog.Error("Router: Failed to save route snapshot", "path", path, "error", err)
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		slog.Error("Router: Failed to save route snapshot", "path", path, "error", err)
+		return
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		slog.Error("Router: Failed to save route snapshot", "path", path, "error", err)
+		return
+	}
+	slog.Debug("Router: Saved route snapshot", "path", path)
+}
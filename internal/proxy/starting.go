@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"rproxy/internal/metrics"
+	"strings"
+	"time"
+)
+
+// Special values of the exposed-starting-page label; anything else is a
+// template, inline or a "file:" in LABEL_FILES_DIR.
+const (
+	StartingPageOn  = "on"  // The built-in page, also without STARTING_PAGE
+	StartingPageOff = "off" // Plain 502s, also with STARTING_PAGE
+)
+
+var startingResponses = metrics.NewCounter("rproxy_starting_page_responses_total",
+	"Requests answered with the service starting page because the backend refused connections.", "fqdn")
+
+// defaultStartingPage reloads itself after Retry-After until the backend answers.
+var defaultStartingPage = template.Must(template.New("starting").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.RetryAfter}}">
+<title>Starting {{.FQDN}}</title>
+<style>body{font-family:system-ui,sans-serif;margin:20vh auto;max-width:30em;text-align:center;color:#333}</style>
+</head>
+<body>
+<h1>Starting up</h1>
+<p>{{.FQDN}} is starting. This page reloads in {{.RetryAfter}} seconds.</p>
+</body>
+</html>
+`))
+
+// startingData is available to starting page templates.
+type startingData struct {
+	Service    string // Container or service name
+	FQDN       string
+	RetryAfter int // Seconds, as sent in Retry-After
+}
+
+// startingPage answers requests whose backend is routed but refuses
+// connections, typically a container still starting, with 503 and
+// Retry-After instead of a 502. Browsers get a page that reloads itself.
+type startingPage struct {
+	enabled    bool          // STARTING_PAGE
+	retryAfter time.Duration // STARTING_RETRY_AFTER
+}
+
+// serve answers req if the route wants a starting page and err is a failure
+// to connect to the backend. It reports whether it did.
+func (s *startingPage) serve(rw http.ResponseWriter, req *http.Request, err error) bool {
+	info, ok := routeInfoFrom(req.Context())
+	if !ok || !isDialError(err) {
+		return false
+	}
+	label := info.Route.StartingPage
+	if label == StartingPageOff || (label == "" && !s.enabled) {
+		return false
+	}
+
+	seconds := int(math.Ceil(s.retryAfter.Seconds()))
+	rw.Header().Set("Retry-After", fmt.Sprint(seconds))
+	rw.Header().Set("Cache-Control", "no-store")
+	startingResponses.Inc(info.FQDN)
+	slog.Info("Handler: Responding 503 Service Unavailable (backend starting)", "fqdn", info.FQDN, "error", err)
+
+	if req.Method == http.MethodGet && strings.Contains(req.Header.Get("Accept"), "text/html") {
+		tmpl := defaultStartingPage
+		if label != "" && label != StartingPageOn {
+			if tmpl, err = maintenanceTemplate(label); err != nil {
+				slog.Error("Handler: Failed to parse starting page, using the default", "fqdn", info.FQDN, "error", err)
+				tmpl = defaultStartingPage
+			}
+		}
+		var page bytes.Buffer
+		data := startingData{Service: info.Route.Service, FQDN: info.FQDN, RetryAfter: seconds}
+		if err = tmpl.Execute(&page, data); err == nil {
+			rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			rw.Write(page.Bytes())
+			return true
+		}
+		slog.Error("Handler: Failed to render starting page", "fqdn", info.FQDN, "error", err)
+	}
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintln(rw, "503 Service Unavailable: The service is starting, retry shortly.")
+	return true
+}
+
+// isDialError reports whether err is a failure to connect to the backend,
+// as opposed to one on an established connection.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// staticIndexFiles are tried, in order, for requests to a directory.
+var staticIndexFiles = []string{"index.html", "index.htm"}
+
+// serveStatic answers a request for a route that maps to a local directory.
+// Files are resolved through os.Root so neither ".." nor symlinks can escape
+// the directory; dotfiles and directory listings are never served.
+func serveStatic(rw http.ResponseWriter, req *http.Request, route Route) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	root, err := os.OpenRoot(route.StaticRoot)
+	if err != nil {
+		slog.Error("Handler: Failed to open static root", "root", route.StaticRoot, "error", err)
+		http.Error(rw, "502 Bad Gateway: Static root unavailable.", http.StatusBadGateway)
+		return
+	}
+	defer root.Close()
+
+	// Paths are relative to the route's prefix: /blog/post.html -> post.html under a /blog route
+	rel := strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(route.PathPrefix, "/"))
+	name := strings.TrimPrefix(path.Clean("/"+rel), "/")
+	if name == "" {
+		name = "."
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if strings.HasPrefix(elem, ".") && elem != "." {
+			http.NotFound(rw, req)
+			return
+		}
+	}
+
+	f, info, isIndex, err := openStatic(root, name)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Handler: Failed to open static file", "root", route.StaticRoot, "path", name, "error", err)
+		}
+		http.NotFound(rw, req)
+		return
+	}
+	defer f.Close()
+
+	// Directories need a trailing slash so relative links in index files resolve
+	if isIndex && !strings.HasSuffix(req.URL.Path, "/") {
+		target := req.URL.Path + "/"
+		if req.URL.RawQuery != "" {
+			target += "?" + req.URL.RawQuery
+		}
+		http.Redirect(rw, req, target, http.StatusMovedPermanently)
+		return
+	}
+
+	h := rw.Header()
+	h.Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	if ext := path.Ext(f.Name()); ext == ".html" || ext == ".htm" {
+		h.Set("Cache-Control", "no-cache") // Pages revalidate so deploys show up at once
+	} else {
+		h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(route.StaticMaxAge.Seconds())))
+	}
+	for _, rule := range cachedHeaderRules(route.ResponseHeaders) {
+		h.Set(rule.name, rule.value)
+	}
+	http.ServeContent(rw, req, f.Name(), info.ModTime(), f)
+}
+
+// openStatic opens a file, or the index file of a directory.
+func openStatic(root *os.Root, name string) (f *os.File, info fs.FileInfo, isIndex bool, err error) {
+	f, info, err = openRegular(root, name)
+	if err == nil || !errors.Is(err, errIsDir) {
+		return f, info, false, err
+	}
+	for _, index := range staticIndexFiles {
+		if f, info, err = openRegular(root, path.Join(name, index)); err == nil {
+			return f, info, true, nil
+		}
+	}
+	return nil, nil, false, fs.ErrNotExist
+}
+
+var errIsDir = errors.New("is a directory")
+
+// openRegular opens name if it is not a directory.
+func openRegular(root *os.Root, name string) (*os.File, fs.FileInfo, error) {
+	f, err := root.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && info.IsDir() {
+		err = errIsDir
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyPool hands out reverse proxies that only differ in FlushInterval, since
+// httputil.ReverseProxy has no per-request flush setting.
+type proxyPool struct {
+	base    httputil.ReverseProxy
+	proxies sync.Map // time.Duration -> *httputil.ReverseProxy
+}
+
+func (p *proxyPool) get(flushInterval time.Duration) *httputil.ReverseProxy {
+	if rp, ok := p.proxies.Load(flushInterval); ok {
+		return rp.(*httputil.ReverseProxy)
+	}
+	rp := p.base
+	rp.FlushInterval = flushInterval
+	actual, _ := p.proxies.LoadOrStore(flushInterval, &rp)
+	return actual.(*httputil.ReverseProxy)
+}
+
+// isEventStream reports whether the client asked for Server-Sent Events.
+func isEventStream(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+}
+
+// setRequestDeadline replaces the server-wide timeouts for one request so large
+// uploads and downloads are bounded by the route's duration instead. Zero
+// removes the deadline. They run deadlineGrace past the request's context
+// (see withRequestDeadline), so a 504 for a backend that is too slow still
+// reaches the client.
+func setRequestDeadline(rw http.ResponseWriter, d time.Duration) {
+	var deadline time.Time
+	if d > 0 {
+		deadline = time.Now().Add(d + deadlineGrace)
+	}
+	rc := http.NewResponseController(rw)
+	rc.SetReadDeadline(deadline)
+	rc.SetWriteDeadline(deadline)
+}
+
+// copyBufferSize is the chunk size used to stream bodies between client and backend.
+const copyBufferSize = 64 << 10
+
+// copyBufferPool reuses body copy buffers across requests.
+type copyBufferPool struct{}
+
+var copyBuffers = sync.Pool{New: func() any { return make([]byte, copyBufferSize) }}
+
+func (copyBufferPool) Get() []byte  { return copyBuffers.Get().([]byte) }
+func (copyBufferPool) Put(b []byte) { copyBuffers.Put(b) }
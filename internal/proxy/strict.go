@@ -0,0 +1,375 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"rproxy/internal/metrics"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// strictHandshakeTimeout matches the ReadHeaderTimeout that bounds
+	// handshakes done by the HTTP server.
+	strictHandshakeTimeout = 60 * time.Second
+
+	// strictMaxLine stops inspecting a connection whose request head has a
+	// longer line. The HTTP server refuses such heads anyway.
+	strictMaxLine = 64 << 10
+)
+
+var httpAnomalies = metrics.NewCounter("rproxy_http_anomalies_total",
+	"Requests refused by HTTP_STRICT, by reason (te_cl, header_whitespace, absolute_form).", "reason")
+
+// strictChecks are the HTTP_STRICT checks. te-cl and header-whitespace look at
+// HTTP/1 request heads as sent, before the HTTP server normalizes them:
+// it silently drops Content-Length next to Transfer-Encoding and unfolds
+// continuation lines. HTTP/2 frames requests itself and needs neither.
+type strictChecks struct {
+	teCL             bool // Transfer-Encoding and Content-Length in one request
+	headerWhitespace bool // Folded header lines or whitespace in header names
+	absoluteForm     bool // Request targets like "http://host/path"
+}
+
+func newStrictChecks(names []string) strictChecks {
+	return strictChecks{
+		teCL:             slices.Contains(names, "te-cl"),
+		headerWhitespace: slices.Contains(names, "header-whitespace"),
+		absoluteForm:     slices.Contains(names, "absolute-form"),
+	}
+}
+
+// inspectsHeads reports whether connections need a strictListener.
+func (c strictChecks) inspectsHeads() bool {
+	return c.teCL || c.headerWhitespace
+}
+
+// strictConnKey carries the client's strictConn in request contexts.
+type strictConnKey struct{}
+
+// strictListener terminates TLS itself, so the request heads of HTTP/1
+// connections can be inspected on their way to the HTTP server. HTTP/2
+// connections are handed over as the *tls.Conn the server expects, HTTP/1
+// ones wrapped in a strictConn.
+type strictListener struct {
+	net.Listener
+	tlsConfig *tls.Config
+	checks    strictChecks
+	conns     chan net.Conn
+	done      chan struct{}
+	once      sync.Once
+}
+
+func newStrictListener(inner net.Listener, tlsConfig *tls.Config, checks strictChecks) *strictListener {
+	l := &strictListener{
+		Listener:  inner,
+		tlsConfig: tlsConfig,
+		checks:    checks,
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// Accept returns the next connection past its TLS handshake.
+func (l *strictListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections.
+func (l *strictListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func (l *strictListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.Close()
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake runs the TLS handshake off the accept loop, reporting failures
+// like the HTTP server does.
+func (l *strictListener) handshake(conn net.Conn) {
+	tlsConn := tls.Server(conn, l.tlsConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), strictHandshakeTimeout)
+	err := tlsConn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		fmt.Fprintf(handshakeErrorLog{}, "http: TLS handshake error from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	var next net.Conn = tlsConn
+	if tlsConn.ConnectionState().NegotiatedProtocol != "h2" {
+		next = &strictConn{Conn: tlsConn, checks: l.checks, requestLn: true}
+	}
+	select {
+	case l.conns <- next:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// strictConn is an HTTP/1 connection whose request heads are checked as the
+// HTTP server reads them. Request bodies are skipped by following their
+// framing, and inspection ends at the first anomaly, at a protocol upgrade
+// or at anything it cannot follow, which the server then refuses itself.
+type strictConn struct {
+	*tls.Conn
+	checks strictChecks
+
+	anomaly atomic.Pointer[string] // First anomaly, nil if none
+
+	// Parse state, only touched by Read
+	state     strictState
+	line      []byte
+	requestLn bool  // The next head line is the request line
+	remaining int64 // Body or chunk bytes left to skip
+	head      strictHead
+}
+
+type strictState int
+
+const (
+	stateHead strictState = iota
+	stateBody
+	stateChunkSize
+	stateChunkData
+	stateChunkEnd
+	stateTrailer
+	stateDone
+)
+
+// strictHead collects what one request head says about framing.
+type strictHead struct {
+	connect          bool
+	upgrade          bool
+	transferEncoding []string
+	contentLength    []string
+}
+
+// NetConn returns the underlying *tls.Conn.
+func (c *strictConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *strictConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.state != stateDone {
+		c.scan(p[:n])
+	}
+	return n, err
+}
+
+// reason returns the anomaly found on the connection, "" if none.
+func (c *strictConn) reason() string {
+	if r := c.anomaly.Load(); r != nil {
+		return *r
+	}
+	return ""
+}
+
+func (c *strictConn) flag(reason string) {
+	c.anomaly.CompareAndSwap(nil, &reason)
+	c.state = stateDone
+}
+
+// scan advances the parse state over p.
+func (c *strictConn) scan(p []byte) {
+	for len(p) > 0 && c.state != stateDone {
+		switch c.state {
+		case stateBody, stateChunkData:
+			skip := min(int64(len(p)), c.remaining)
+			p = p[skip:]
+			if c.remaining -= skip; c.remaining == 0 {
+				if c.state == stateBody {
+					c.state = stateHead
+					c.requestLn = true
+				} else {
+					c.state = stateChunkEnd
+				}
+			}
+		default:
+			i := bytes.IndexByte(p, '\n')
+			if i < 0 {
+				c.line = append(c.line, p...)
+				if len(c.line) > strictMaxLine {
+					c.state = stateDone
+				}
+				return
+			}
+			c.line = append(c.line, p[:i]...)
+			p = p[i+1:]
+			line := bytes.TrimSuffix(c.line, []byte("\r"))
+			c.line = c.line[:0]
+			c.scanLine(line)
+		}
+	}
+}
+
+// scanLine handles one line of a head, chunk size or trailer.
+func (c *strictConn) scanLine(line []byte) {
+	switch c.state {
+	case stateHead:
+		if c.requestLn {
+			if len(line) == 0 {
+				return // Empty lines before a request are tolerated
+			}
+			c.requestLn = false
+			c.head = strictHead{connect: bytes.HasPrefix(line, []byte("CONNECT "))}
+			return
+		}
+		if len(line) == 0 {
+			c.endHead()
+			return
+		}
+		c.scanHeader(line)
+	case stateChunkSize:
+		size, _, _ := bytes.Cut(line, []byte(";"))
+		n, err := strconv.ParseInt(string(bytes.TrimSpace(size)), 16, 64)
+		switch {
+		case err != nil || n < 0:
+			c.state = stateDone
+		case n == 0:
+			c.state = stateTrailer
+		default:
+			c.state, c.remaining = stateChunkData, n
+		}
+	case stateChunkEnd:
+		if len(line) != 0 {
+			c.state = stateDone
+			return
+		}
+		c.state = stateChunkSize
+	case stateTrailer:
+		if len(line) == 0 {
+			c.state = stateHead
+			c.requestLn = true
+		}
+	}
+}
+
+func (c *strictConn) scanHeader(line []byte) {
+	if line[0] == ' ' || line[0] == '\t' {
+		if c.checks.headerWhitespace {
+			c.flag("header_whitespace")
+		}
+		return
+	}
+	name, value, ok := bytes.Cut(line, []byte(":"))
+	if !ok {
+		return
+	}
+	if bytes.ContainsAny(name, " \t") {
+		if c.checks.headerWhitespace {
+			c.flag("header_whitespace")
+		}
+		return
+	}
+	value = bytes.TrimSpace(value)
+	switch strings.ToLower(string(name)) {
+	case "transfer-encoding":
+		c.head.transferEncoding = append(c.head.transferEncoding, strings.ToLower(string(value)))
+	case "content-length":
+		c.head.contentLength = append(c.head.contentLength, string(value))
+	case "upgrade":
+		c.head.upgrade = true
+	}
+}
+
+// endHead checks the completed head and follows its body.
+func (c *strictConn) endHead() {
+	head := c.head
+	c.head = strictHead{}
+	if c.checks.teCL && len(head.transferEncoding) > 0 && len(head.contentLength) > 0 {
+		c.flag("te_cl")
+		return
+	}
+	switch {
+	case head.connect || head.upgrade:
+		// The connection may stop speaking HTTP/1 after this request
+		c.state = stateDone
+	case len(head.transferEncoding) > 0:
+		codings := strings.Split(head.transferEncoding[len(head.transferEncoding)-1], ",")
+		if strings.TrimSpace(codings[len(codings)-1]) != "chunked" {
+			c.state = stateDone
+			return
+		}
+		c.state = stateChunkSize
+	case len(head.contentLength) > 0:
+		n, err := strconv.ParseInt(head.contentLength[0], 10, 64)
+		if err != nil || n < 0 {
+			c.state = stateDone
+			return
+		}
+		if n > 0 {
+			c.state, c.remaining = stateBody, n
+			return
+		}
+		c.requestLn = true
+	default:
+		c.requestLn = true
+	}
+}
+
+// unwrapStrict returns the *tls.Conn of a strictConn, other connections as
+// they are, so per-connection state is keyed the same for HTTP/1 and HTTP/2.
+func unwrapStrict(c net.Conn) net.Conn {
+	if sc, ok := c.(*strictConn); ok {
+		return sc.Conn
+	}
+	return c
+}
+
+// handler refuses requests with the anomalies checked for. A connection
+// that sent an anomalous head is answered 400 and closed, since what follows
+// on it cannot be trusted. It also restores req.TLS, which the HTTP server
+// only sets for connections it terminated itself.
+func (c strictChecks) handler(next http.Handler) http.Handler {
+	if !c.inspectsHeads() && !c.absoluteForm {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		reason := ""
+		if sc, ok := req.Context().Value(strictConnKey{}).(*strictConn); ok {
+			if req.TLS == nil {
+				state := sc.ConnectionState()
+				req.TLS = &state
+			}
+			reason = sc.reason()
+		}
+		if reason == "" && c.absoluteForm && req.ProtoMajor == 1 && req.RequestURI != "*" && !strings.HasPrefix(req.RequestURI, "/") {
+			reason = "absolute_form"
+		}
+		if reason != "" {
+			slog.Warn("Handler: Refusing anomalous request (HTTP_STRICT)", "reason", reason, "host", req.Host, "remote", req.RemoteAddr)
+			httpAnomalies.Inc(reason)
+			rw.Header().Set("Connection", "close")
+			http.Error(rw, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
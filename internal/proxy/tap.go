@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TapEvent describes a completed request, streamed to tap subscribers.
+type TapEvent struct {
+	Time     time.Time     `json:"time"`
+	FQDN     string        `json:"fqdn"`
+	Method   string        `json:"method"`
+	Path     string        `json:"path"`
+	Status   int           `json:"status"`
+	Duration time.Duration `json:"duration_ns"`
+	Upstream string        `json:"upstream,omitempty"`
+	Remote   string        `json:"remote"`
+
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// TapFilter selects the requests a subscriber receives.
+type TapFilter struct {
+	FQDN       string
+	PathPrefix string
+	MinStatus  int
+}
+
+func (f TapFilter) match(ev TapEvent) bool {
+	return ev.FQDN == f.FQDN && strings.HasPrefix(ev.Path, f.PathPrefix) && ev.Status >= f.MinStatus
+}
+
+type tapSubscriber struct {
+	filter TapFilter
+	ch     chan TapEvent
+}
+
+// Tap fans out completed requests to live subscribers (the admin API tap stream).
+// Publishing never blocks: events are dropped for subscribers that fall behind.
+type Tap struct {
+	mu    sync.RWMutex
+	subs  map[*tapSubscriber]struct{}
+	count atomic.Int32 // Lets the request path skip all work when nobody listens
+}
+
+// NewTap creates an empty tap.
+func NewTap() *Tap {
+	return &Tap{subs: make(map[*tapSubscriber]struct{})}
+}
+
+// Subscribe registers a subscriber. The returned function unsubscribes it.
+func (t *Tap) Subscribe(filter TapFilter) (<-chan TapEvent, func()) {
+	sub := &tapSubscriber{filter: filter, ch: make(chan TapEvent, 64)}
+	t.mu.Lock()
+	t.subs[sub] = struct{}{}
+	t.count.Add(1)
+	t.mu.Unlock()
+
+	return sub.ch, func() {
+		t.mu.Lock()
+		if _, ok := t.subs[sub]; ok {
+			delete(t.subs, sub)
+			t.count.Add(-1)
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (t *Tap) active() bool {
+	return t != nil && t.count.Load() > 0
+}
+
+func (t *Tap) publish(ev TapEvent) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for sub := range t.subs {
+		if !sub.filter.match(ev) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default: // Subscriber too slow, drop the event
+		}
+	}
+}
+
+// requestInfoKey carries a *requestInfo through the proxied request's context
+// so the director can report the route and upstream it picked.
+type requestInfoKey struct{}
+
+type requestInfo struct {
+	id        string // Request ID, logged with errors and sent to the backend
+	fqdn      string // Set once a route matched
+	upstream  string
+	accessLog string // Route's exposed-access-log mode, empty for the global one
+	err       string // Why the backend could not answer, for 5xx spike reports
+}
+
+// statusRecorder captures the status code and body size written by the reverse proxy.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack on the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+	"rproxy/internal/metrics"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var tarpitRequests = metrics.NewCounter("rproxy_tarpit_requests_total",
+	"Requests answered slowly by the tarpit, by reason (unrouted or path).", "reason")
+
+// DefaultTarpitPaths are path prefixes probed by exploit scanners that no
+// legitimate client requests.
+var DefaultTarpitPaths = []string{
+	"/.env", "/.git/", "/.aws/", "/.ssh/", "/.DS_Store",
+	"/phpmyadmin", "/phpMyAdmin", "/pma/",
+	"/vendor/phpunit/", "/cgi-bin/", "/boaform/", "/HNAP1",
+}
+
+// maxTarpitOffenders bounds the offender table; the least recently seen
+// address is dropped when it is full.
+const maxTarpitOffenders = 10000
+
+// TarpitOffender is a client address that hit the tarpit.
+type TarpitOffender struct {
+	IP        string    `json:"ip"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	LastHost  string    `json:"last_host"`
+	LastPath  string    `json:"last_path"`
+}
+
+// Tarpit answers requests for unrouted hosts and known exploit paths slowly
+// and minimally instead of with a fast 502, and records their sources. A nil
+// Tarpit is disabled.
+type Tarpit struct {
+	delay time.Duration
+	paths []string
+	slots chan struct{} // Bounds the requests held at once
+
+	mu        sync.Mutex
+	offenders map[string]*TarpitOffender
+}
+
+// NewTarpit creates a tarpit holding up to maxConcurrent requests for delay
+// each. Requests beyond that are answered at once.
+func NewTarpit(delay time.Duration, paths []string, maxConcurrent int) *Tarpit {
+	return &Tarpit{
+		delay:     delay,
+		paths:     paths,
+		slots:     make(chan struct{}, maxConcurrent),
+		offenders: make(map[string]*TarpitOffender),
+	}
+}
+
+// matchesPath reports whether path is a known exploit probe.
+func (t *Tarpit) matchesPath(path string) bool {
+	return slices.ContainsFunc(t.paths, func(prefix string) bool { return strings.HasPrefix(path, prefix) })
+}
+
+// serve records the client and answers after the delay with a bare 404, so
+// the scanner learns nothing and waits.
+func (t *Tarpit) serve(rw http.ResponseWriter, req *http.Request, host, reason string) {
+	tarpitRequests.Inc(reason)
+	ip := clientIP(req.RemoteAddr)
+	t.record(ip, host, req.URL.Path)
+	slog.Debug("Handler: Tarpitting request", "reason", reason, "host", host, "path", req.URL.Path, "remote", ip)
+
+	select {
+	case t.slots <- struct{}{}:
+		timer := time.NewTimer(t.delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+		}
+		<-t.slots
+	default: // Full: don't let scanners pin down more resources
+	}
+	rw.Header().Set("Connection", "close")
+	rw.WriteHeader(http.StatusNotFound)
+}
+
+func (t *Tarpit) record(ip, host, path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	o, ok := t.offenders[ip]
+	if !ok {
+		if len(t.offenders) >= maxTarpitOffenders {
+			var oldest *TarpitOffender
+			for _, candidate := range t.offenders {
+				if oldest == nil || candidate.LastSeen.Before(oldest.LastSeen) {
+					oldest = candidate
+				}
+			}
+			delete(t.offenders, oldest.IP)
+		}
+		o = &TarpitOffender{IP: ip, FirstSeen: now}
+		t.offenders[ip] = o
+	}
+	o.Count++
+	o.LastSeen = now
+	o.LastHost = host
+	o.LastPath = path
+}
+
+// Offenders returns the recorded addresses, most active first.
+func (t *Tarpit) Offenders() []TarpitOffender {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	list := make([]TarpitOffender, 0, len(t.offenders))
+	for _, o := range t.offenders {
+		list = append(list, *o)
+	}
+	t.mu.Unlock()
+	slices.SortFunc(list, func(a, b TarpitOffender) int { return b.Count - a.Count })
+	return list
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"log/slog"
+	"rproxy/internal/discovery"
+	"rproxy/internal/metrics"
+	"slices"
+	"strings"
+)
+
+var (
+	tenantRoutes = metrics.NewGauge("rproxy_tenant_routes",
+		"Routes per tenant.", "tenant")
+	tenantRejected = metrics.NewCounter("rproxy_tenant_routes_rejected_total",
+		"Tenant routes refused, by tenant and reason (unknown, zone, regex, route_quota, cert_quota).", "tenant", "reason")
+)
+
+// admitTenant reports whether the target's exposed-tenant label matches the
+// owner of its host: the tenant whose zones contain it, or nobody. Hosts in a
+// tenant's zones are thus only routed for that tenant, and tenants cannot
+// route hosts outside their zones.
+func (r *Router) admitTenant(t discovery.Target) bool {
+	label := t.Labels[discovery.LabelTenant]
+	if len(r.config.Tenants) == 0 {
+		if label != "" {
+			slog.Warn("Router: exposed-tenant label set but no TENANTS are configured, ignoring route", "tenant", label, "container", t.Name)
+			return false
+		}
+		return true
+	}
+	if label != "" && r.config.Tenant(label) == nil {
+		slog.Warn("Router: Unknown tenant in exposed-tenant label, ignoring route", "tenant", label, "container", t.Name)
+		tenantRejected.Inc(label, "unknown")
+		return false
+	}
+	owner := ""
+	if tenant := r.config.TenantFor(t.FQDN); tenant != nil {
+		owner = tenant.Name
+	}
+	if label != owner {
+		slog.Warn("Router: Route outside its tenant's zones, ignoring route", "fqdn", t.FQDN, "tenant", label, "zone_owner", owner, "container", t.Name)
+		tenantRejected.Inc(label, "zone")
+		return false
+	}
+	return true
+}
+
+// enforceTenantQuotas removes the hosts that take a tenant past its route or
+// certificate quota. Hosts routed in the previous table are counted first, so
+// a new deploy cannot push out a running one.
+func (r *Router) enforceTenantQuotas(oldRoutes, newRoutes map[string][]Route) {
+	for _, tenant := range r.config.Tenants {
+		var hosts []string
+		for fqdn, routes := range newRoutes {
+			if routes[0].Tenant == tenant.Name {
+				hosts = append(hosts, fqdn)
+			}
+		}
+		slices.SortFunc(hosts, func(a, b string) int {
+			_, aOld := oldRoutes[a]
+			_, bOld := oldRoutes[b]
+			switch {
+			case aOld && !bOld:
+				return -1
+			case bOld && !aOld:
+				return 1
+			}
+			return strings.Compare(a, b)
+		})
+
+		var routeCount, certCount int64
+		for _, fqdn := range hosts {
+			routes := newRoutes[fqdn]
+			needsCert := slices.ContainsFunc(routes, Route.needsIssuance)
+			reason := ""
+			switch {
+			case tenant.MaxRoutes > 0 && routeCount+int64(len(routes)) > tenant.MaxRoutes:
+				reason = "route_quota"
+			case tenant.MaxCerts > 0 && needsCert && certCount >= tenant.MaxCerts:
+				reason = "cert_quota"
+			}
+			if reason != "" {
+				slog.Warn("Router: Tenant quota exceeded, ignoring host", "tenant", tenant.Name, "fqdn", fqdn, "quota", reason, "max_routes", tenant.MaxRoutes, "max_certs", tenant.MaxCerts)
+				tenantRejected.Inc(tenant.Name, reason)
+				delete(newRoutes, fqdn)
+				continue
+			}
+			routeCount += int64(len(routes))
+			if needsCert {
+				certCount++
+			}
+		}
+		tenantRoutes.Set(float64(routeCount), tenant.Name)
+	}
+}
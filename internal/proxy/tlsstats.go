@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"cmp"
+	"crypto/tls"
+	"log"
+	"log/slog"
+	"rproxy/internal/metrics"
+	"strings"
+	"sync"
+)
+
+// TLS handshake metrics, to make certificate coverage gaps and client
+// compatibility visible.
+var (
+	tlsHandshakes = metrics.NewCounter("rproxy_tls_handshakes_total",
+		"Completed TLS handshakes by negotiated version and cipher suite.", "version", "cipher")
+	tlsALPN = metrics.NewCounter("rproxy_tls_alpn_total",
+		"Completed TLS handshakes by negotiated application protocol (h2, http/1.1, none).", "protocol")
+	tlsHandshakeErrors = metrics.NewCounter("rproxy_tls_handshake_errors_total",
+		"Failed TLS handshakes by reason (unknown_sni, no_sni, protocol, not_tls, client_cert, client_rejected_cert, client_abort, timeout, other).", "reason")
+	tlsSNIMisses = metrics.NewCounter("rproxy_tls_sni_misses_total",
+		"Handshakes for server names without a certificate, by name (the first 100 names, then \"other\").", "sni")
+)
+
+// maxSNIMissNames bounds the series of rproxy_tls_sni_misses_total, since
+// scanners can send any server name.
+const maxSNIMissNames = 100
+
+var sniMisses = struct {
+	sync.Mutex
+	seen map[string]bool
+}{seen: map[string]bool{}}
+
+// recordHandshake is the tls.Config VerifyConnection hook. It only counts.
+func recordHandshake(cs tls.ConnectionState) error {
+	tlsHandshakes.Inc(tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite))
+	tlsALPN.Inc(cmp.Or(cs.NegotiatedProtocol, "none"))
+	return nil
+}
+
+// recordSNIMiss counts a handshake for a name without a certificate and logs
+// each new name once.
+func recordSNIMiss(serverName string) {
+	sniMisses.Lock()
+	label := serverName
+	if !sniMisses.seen[serverName] {
+		if len(sniMisses.seen) < maxSNIMissNames {
+			sniMisses.seen[serverName] = true
+			slog.Info("TLS: No certificate for requested server name", "sni", serverName)
+		} else {
+			label = "other"
+		}
+	}
+	sniMisses.Unlock()
+	tlsSNIMisses.Inc(label)
+}
+
+// handshakeErrorLog receives the http.Server error log. Handshake errors are
+// counted by reason and logged at debug level; everything else is passed on to
+// the standard logger.
+type handshakeErrorLog struct{}
+
+func (handshakeErrorLog) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	rest, ok := strings.CutPrefix(msg, "http: TLS handshake error from ")
+	if !ok {
+		log.Print(msg)
+		return len(p), nil
+	}
+	remote, errText, _ := strings.Cut(rest, ": ")
+	reason := handshakeFailureReason(errText)
+	tlsHandshakeErrors.Inc(reason)
+	slog.Debug("TLS: Handshake failed", "reason", reason, "remote", remote, "error", errText)
+	return len(p), nil
+}
+
+// handshakeFailureReason classifies a handshake error message.
+func handshakeFailureReason(errText string) string {
+	contains := func(subs ...string) bool {
+		for _, s := range subs {
+			if strings.Contains(errText, s) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case contains("missing server name"):
+		return "no_sni"
+	case contains("not available"): // certs.Manager: no certificate for the name
+		return "unknown_sni"
+	case strings.HasPrefix(errText, "remote error: tls: ") && contains("certificate"):
+		return "client_rejected_cert" // The client does not trust our certificate
+	case contains("protocol version", "unsupported versions", "no cipher suite", "no supported versions", "no mutually supported", "unsupported SSLv2"):
+		return "protocol"
+	case contains("HTTP request to an HTTPS server", "does not look like a TLS handshake", "oversized record", "unexpected message"):
+		return "not_tls"
+	case contains("client didn't provide a certificate", "failed to verify certificate", "bad certificate"):
+		return "client_cert"
+	case contains("timeout"):
+		return "timeout"
+	case contains("EOF", "connection reset", "broken pipe", "use of closed"):
+		return "client_abort"
+	}
+	return "other"
+}
@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"rproxy/internal/spiffe"
+	"sync"
+	"time"
+)
+
+// DialFunc opens connections to backends. Nil means dialing directly.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// errNoRoute is returned for requests the director could not route.
+var errNoRoute = errors.New("no route")
+
+// routeContextKey carries the matched route from the director to the transport.
+type routeContextKey struct{}
+
+// routeInfo is the routing decision attached to an outgoing request.
+type routeInfo struct {
+	FQDN  string
+	Route Route
+}
+
+func withRouteInfo(ctx context.Context, info routeInfo) context.Context {
+	return context.WithValue(ctx, routeContextKey{}, info)
+}
+
+func routeInfoFrom(ctx context.Context) (routeInfo, bool) {
+	info, ok := ctx.Value(routeContextKey{}).(routeInfo)
+	return info, ok
+}
+
+// transportKey identifies a distinct backend transport configuration.
+type transportKey struct {
+	reencrypt bool
+	tls       backendTLSKey // Zero unless reencrypt
+	pool      upstreamPool
+}
+
+// backendTLSKey identifies a distinct backend TLS client configuration.
+type backendTLSKey struct {
+	serverName string
+	ca         string // Base64 PEM from the exposed-backend-ca label
+	insecure   bool
+	clientCert string // Client certificate file for backend mTLS
+	clientKey  string
+	spiffeID   string // Expected backend SPIFFE ID, replacing name verification
+}
+
+// routeTransport selects an HTTP transport per route so reencrypt routes can
+// verify their backend, and routes can size their connection pool, with
+// route-specific settings. Transports are cached so connection pools are
+// reused across requests.
+type routeTransport struct {
+	plain  *http.Transport
+	rootCA *x509.CertPool // System roots plus BACKEND_CA_FILE, nil for system roots only
+	svids  *spiffe.Source // Workload identity from SPIFFE_ENDPOINT_SOCKET, nil if unset
+
+	mu         sync.Mutex
+	transports map[transportKey]*http.Transport
+}
+
+func newRouteTransport(caFile string, dial DialFunc, svids *spiffe.Source) (*routeTransport, error) {
+	t := &routeTransport{
+		plain:      http.DefaultTransport.(*http.Transport).Clone(),
+		svids:      svids,
+		transports: make(map[transportKey]*http.Transport),
+	}
+	// Larger buffers for multi-GB transfers; bodies are never buffered whole
+	t.plain.ReadBufferSize = copyBufferSize
+	t.plain.WriteBufferSize = copyBufferSize
+	// Pass Accept-Encoding through untouched so Range, ETag and Content-Length stay the backend's
+	t.plain.DisableCompression = true
+	if dial != nil {
+		t.plain.DialContext = dial // Inherited by the per-route transports
+	}
+	t.plain.DialContext = countConns(t.plain.DialContext)
+	if caFile != "" {
+		pemData, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read backend CA file %s: %w", caFile, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in backend CA file %s", caFile)
+		}
+		t.rootCA = pool
+		slog.Info("Loaded backend CA bundle", "path", caFile)
+	}
+	return t, nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *routeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	info, ok := routeInfoFrom(req.Context())
+	if !ok {
+		// The director found no usable route; fail without dialing the dummy host
+		return nil, errNoRoute
+	}
+	req = withConnTrace(req, info.FQDN)
+
+	key := transportKey{pool: poolOf(info.Route)}
+	if info.Route.TLSMode == TLSModeReencrypt {
+		key.reencrypt = true
+		key.tls = backendTLSKey{
+			serverName: info.Route.BackendServerName,
+			ca:         info.Route.BackendCA,
+			insecure:   info.Route.BackendInsecure,
+			clientCert: info.Route.BackendClientCert,
+			clientKey:  info.Route.BackendClientKey,
+			spiffeID:   info.Route.BackendSPIFFEID,
+		}
+		if key.tls.serverName == "" {
+			key.tls.serverName = info.FQDN
+		}
+	}
+	if key == (transportKey{}) {
+		return t.plain.RoundTrip(req)
+	}
+	transport, err := t.transport(key)
+	if err != nil {
+		return nil, err
+	}
+	return transport.RoundTrip(req)
+}
+
+// transport returns the cached transport for a backend configuration.
+func (t *routeTransport) transport(key transportKey) (*http.Transport, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if transport, ok := t.transports[key]; ok {
+		return transport, nil
+	}
+
+	transport := t.plain.Clone()
+	key.pool.apply(transport)
+	if key.reencrypt {
+		tlsConfig, err := t.tlsConfig(key.tls)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	t.transports[key] = transport
+	return transport, nil
+}
+
+// tlsConfig builds the TLS client configuration for a reencrypt backend.
+func (t *routeTransport) tlsConfig(key backendTLSKey) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         key.serverName,
+		RootCAs:            t.rootCA,
+		InsecureSkipVerify: key.insecure,
+	}
+	if key.ca != "" {
+		pemData, err := base64.StdEncoding.DecodeString(key.ca)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 in exposed-backend-ca label: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in exposed-backend-ca label")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if key.spiffeID != "" {
+		if t.svids == nil {
+			return nil, fmt.Errorf("exposed-backend-spiffe-id requires SPIFFE_ENDPOINT_SOCKET")
+		}
+		// Verified against the current SPIFFE bundle by VerifyPeer, not by name
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = t.svids.VerifyPeer(key.spiffeID)
+	}
+	switch {
+	case key.clientCert != "":
+		loader := &clientCertLoader{certFile: key.clientCert, keyFile: key.clientKey}
+		// Fail early on a bad reference rather than on the first handshake
+		if _, err := loader.GetClientCertificate(nil); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = loader.GetClientCertificate
+	case t.svids != nil:
+		// Backends asking for a client certificate get the current SVID
+		tlsConfig.GetClientCertificate = t.svids.GetClientCertificate
+	}
+	return tlsConfig, nil
+}
+
+// clientCertLoader serves a client certificate from disk, reloading it when the
+// certificate file changes so rotated certificates are picked up without a restart.
+type clientCertLoader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (l *clientCertLoader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	info, err := os.Stat(l.certFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat backend client certificate %s: %w", l.certFile, err)
+	}
+	if l.cert != nil && info.ModTime().Equal(l.modTime) {
+		return l.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load backend client certificate %s: %w", l.certFile, err)
+	}
+	l.cert = &cert
+	l.modTime = info.ModTime()
+	slog.Info("Loaded backend client certificate", "cert", l.certFile)
+	return l.cert, nil
+}
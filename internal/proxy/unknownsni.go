@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"rproxy/internal/certs"
+	"sync"
+	"time"
+)
+
+// Policies for TLS connections whose SNI has no certificate, set with UNKNOWN_SNI_POLICY.
+const (
+	UnknownSNIReject      = "reject"       // Fail the handshake with an alert
+	UnknownSNIDefaultCert = "default-cert" // Complete it with a self-signed certificate, then answer 421
+	UnknownSNIClose       = "close"        // Close the connection without a response
+)
+
+// connKey carries the accepted connection in request contexts.
+type connKey struct{}
+
+// Special NO_SNI_CERT values; anything else names the FQDN whose certificate is served.
+const (
+	NoSNICertFirst      = "first"       // The first managed certificate by name
+	NoSNICertSelfSigned = "self-signed" // The same self-signed certificate as default-cert
+)
+
+// unknownSNI applies the policy for handshakes without a certificate, and
+// picks the certificate for clients sending no SNI at all.
+type unknownSNI struct {
+	policy      string
+	noSNI       string // NO_SNI_CERT, empty to treat missing SNI like an unknown name
+	certMgr     *certs.Manager
+	defaultCert *tls.Certificate
+	misdirected sync.Map // net.Conn -> struct{}, connections served the default certificate
+}
+
+func newUnknownSNI(policy, noSNI string, certMgr *certs.Manager) (*unknownSNI, error) {
+	u := &unknownSNI{policy: policy, noSNI: noSNI, certMgr: certMgr}
+	if policy == UnknownSNIDefaultCert || noSNI == NoSNICertSelfSigned {
+		cert, err := selfSignedCert()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create default certificate: %w", err)
+		}
+		u.defaultCert = cert
+	}
+	return u, nil
+}
+
+// hasCert reports whether a certificate is available for serverName.
+func (u *unknownSNI) hasCert(serverName string) bool {
+	if serverName == "" {
+		return u.noSNI != ""
+	}
+	_, err := u.certMgr.GetCertificateForSNI(&tls.ClientHelloInfo{ServerName: serverName})
+	return err == nil
+}
+
+// noSNICert returns the certificate for clients sending no SNI (health
+// checkers, old clients). Requests on such connections are routed by Host.
+func (u *unknownSNI) noSNICert() (*tls.Certificate, error) {
+	switch u.noSNI {
+	case NoSNICertSelfSigned:
+		return u.defaultCert, nil
+	case NoSNICertFirst:
+		if cert, ok := u.certMgr.FirstCertificate(); ok {
+			return cert, nil
+		}
+		return nil, fmt.Errorf("no certificate loaded yet for clients without SNI")
+	default:
+		return u.certMgr.GetCertificateForSNI(&tls.ClientHelloInfo{ServerName: u.noSNI})
+	}
+}
+
+// getCertificate wraps the certificate manager for tls.Config.
+func (u *unknownSNI) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName == "" && u.noSNI != "" {
+		return u.noSNICert()
+	}
+	cert, err := u.certMgr.GetCertificateForSNI(hello)
+	if err != nil && hello.ServerName != "" {
+		recordSNIMiss(hello.ServerName)
+	}
+	if err == nil || u.policy != UnknownSNIDefaultCert {
+		return cert, err
+	}
+	u.misdirected.Store(hello.Conn, struct{}{})
+	return u.defaultCert, nil
+}
+
+// connState forgets closed connections.
+func (u *unknownSNI) connState(conn net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			u.misdirected.Delete(tlsConn.NetConn())
+		}
+	}
+}
+
+// handler answers 421 Misdirected Request on connections that got the default
+// certificate, so clients never talk to a route under the wrong name.
+func (u *unknownSNI) handler(next http.Handler) http.Handler {
+	if u.defaultCert == nil {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if tlsConn, ok := req.Context().Value(connKey{}).(*tls.Conn); ok {
+			if _, bad := u.misdirected.Load(tlsConn.NetConn()); bad {
+				slog.Debug("Handler: Responding 421 Misdirected Request (no certificate for SNI)", "sni", req.TLS.ServerName, "remote", req.RemoteAddr)
+				rw.Header().Set("Connection", "close")
+				rw.WriteHeader(http.StatusMisdirectedRequest)
+				fmt.Fprintln(rw, "421 Misdirected Request: No certificate for this server name.")
+				return
+			}
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// selfSignedCert creates a certificate naming no host, served when the SNI is unknown.
+func selfSignedCert() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "rproxy default certificate"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// isUpgrade reports whether a request asks to switch protocols (e.g. WebSocket).
+func isUpgrade(req *http.Request) bool {
+	return req.Header.Get("Upgrade") != "" && strings.Contains(strings.ToLower(req.Header.Get("Connection")), "upgrade")
+}
+
+// upgradedConn wraps the backend side of a switched-protocols connection.
+// httputil.ReverseProxy copies between it and the hijacked client connection
+// and closes it when either side is done, so closing it on idle (or at the
+// route's maximum lifetime) tears down both halves.
+type upgradedConn struct {
+	io.ReadWriteCloser
+	fqdn     string
+	idle     time.Duration
+	timer    *time.Timer
+	lifetime *time.Timer
+	once     sync.Once
+}
+
+func newUpgradedConn(rwc io.ReadWriteCloser, fqdn string, idle, lifetime time.Duration) *upgradedConn {
+	c := &upgradedConn{ReadWriteCloser: rwc, fqdn: fqdn, idle: idle}
+	upgradedOpen.Inc(fqdn)
+	upgradedTotal.Inc(fqdn)
+	if idle > 0 {
+		c.timer = time.AfterFunc(idle, func() {
+			slog.Info("Handler: Closing idle upgraded connection", "fqdn", fqdn, "idleTimeout", idle)
+			upgradedReaped.Inc(fqdn)
+			c.Close()
+		})
+	}
+	if lifetime > 0 {
+		c.lifetime = time.AfterFunc(lifetime, func() {
+			slog.Info("Handler: Closing upgraded connection at its maximum lifetime", "fqdn", fqdn, "maxLifetime", lifetime)
+			c.Close()
+		})
+	}
+	return c
+}
+
+func (c *upgradedConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.touch()
+	return n, err
+}
+
+func (c *upgradedConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.touch()
+	return n, err
+}
+
+func (c *upgradedConn) touch() {
+	if c.timer != nil {
+		c.timer.Reset(c.idle)
+	}
+}
+
+func (c *upgradedConn) Close() error {
+	c.once.Do(func() {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		if c.lifetime != nil {
+			c.lifetime.Stop()
+		}
+		upgradedOpen.Dec(c.fqdn)
+	})
+	return c.ReadWriteCloser.Close()
+}
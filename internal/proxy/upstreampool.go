@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"rproxy/internal/metrics"
+	"sync"
+	"time"
+)
+
+// Backend connection pool metrics. Connections are counted by backend
+// address since pools are shared by the routes to the same backend.
+var (
+	upstreamConnsOpen = metrics.NewGauge("rproxy_upstream_connections_open",
+		"Open connections to backends, idle or in use, by backend address.", "backend")
+	upstreamConnsOpened = metrics.NewCounter("rproxy_upstream_connections_opened_total",
+		"Connections dialed to backends, by backend address.", "backend")
+	upstreamRequests = metrics.NewCounter("rproxy_upstream_requests_total",
+		"Requests sent to backends by domain and whether they reused a pooled connection (reused, new).", "fqdn", "connection")
+)
+
+// upstreamPool is the connection pool configuration of a route, from the
+// exposed-upstream-* labels. The zero value keeps the transport defaults.
+type upstreamPool struct {
+	maxIdle     int // Per backend, negative for no keep-alive
+	maxConns    int // Per backend, 0 for no limit
+	idleTimeout time.Duration
+}
+
+func poolOf(r Route) upstreamPool {
+	return upstreamPool{
+		maxIdle:     r.UpstreamMaxIdleConns,
+		maxConns:    r.UpstreamMaxConns,
+		idleTimeout: r.UpstreamIdleTimeout,
+	}
+}
+
+// apply sets the pool limits on a transport cloned from the default one.
+func (p upstreamPool) apply(t *http.Transport) {
+	switch {
+	case p.maxIdle < 0:
+		t.DisableKeepAlives = true
+	case p.maxIdle > 0:
+		t.MaxIdleConnsPerHost = p.maxIdle
+		t.MaxIdleConns = max(t.MaxIdleConns, p.maxIdle)
+	}
+	if p.maxConns > 0 {
+		t.MaxConnsPerHost = p.maxConns
+	}
+	if p.idleTimeout > 0 {
+		t.IdleConnTimeout = p.idleTimeout
+	}
+}
+
+// countConns wraps dial to keep rproxy_upstream_connections_open and
+// rproxy_upstream_connections_opened_total.
+func countConns(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		upstreamConnsOpened.Inc(addr)
+		upstreamConnsOpen.Inc(addr)
+		return &countedConn{Conn: conn, addr: addr}, nil
+	}
+}
+
+// countedConn decrements the open connection gauge once when closed.
+type countedConn struct {
+	net.Conn
+	addr string
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { upstreamConnsOpen.Dec(c.addr) })
+	return c.Conn.Close()
+}
+
+// withConnTrace counts whether the request to the backend got a pooled
+// connection.
+func withConnTrace(req *http.Request, fqdn string) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				upstreamRequests.Inc(fqdn, "reused")
+			} else {
+				upstreamRequests.Inc(fqdn, "new")
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
@@ -0,0 +1,159 @@
+package routefile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"rproxy/internal/discovery"
+	"strings"
+)
+
+// varPattern matches ${VAR} references in label values. Bare $VAR is left
+// alone, host regexes and templates use '$' themselves.
+var varPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// File is the static route file format.
+//
+//	{
+//	  "routes": [
+//	    {"fqdn": "nas.example.com", "target": "192.168.1.10", "port": 5000},
+//	    {"fqdn": "wiki.example.com", "target": "wiki.lan", "port": 8080},
+//	    {"host_regex": "^pr-[0-9]+\\.ci\\.example\\.com$", "cert_fqdn": "*.ci.example.com", "target": "10.88.0.5", "port": 3000},
+//	    {"fqdn": "blog.example.com", "static_root": "/srv/www/blog"},
+//	    {"fqdn": "api.example.com", "target": "10.88.0.7", "port": 8000, "labels": {"exposed-api-keys": "${API_KEYS}"}}
+//	  ]
+//	}
+//
+// Label values may reference ${VAR}, replaced by the environment variable VAR
+// or the content of the secret file named by VAR_FILE, so secrets need not be
+// written into the file.
+type File struct {
+	Routes []Entry `json:"routes"`
+}
+
+// Entry is a single static route. Exactly one of FQDN or HostRegex must be set,
+// and either Target and Port or StaticRoot.
+type Entry struct {
+	FQDN       string            `json:"fqdn"`
+	HostRegex  string            `json:"host_regex"`
+	CertFQDN   string            `json:"cert_fqdn"` // Certificate covering the regex matches
+	PathPrefix string            `json:"path_prefix"`
+	Target     string            `json:"target"` // Backend IP address or hostname
+	Port       int               `json:"port"`
+	StaticRoot string            `json:"static_root"` // Serve files from this directory instead
+	Labels     map[string]string `json:"labels"`      // Same per-route options as container labels
+}
+
+// Provider serves routes declared in a JSON file. The file is re-read on every
+// discovery pass so edits are picked up without a restart.
+type Provider struct {
+	path string
+}
+
+// New creates a new static route file provider.
+func New(path string) *Provider {
+	return &Provider{path: path}
+}
+
+// Name identifies this provider in logs.
+func (p *Provider) Name() string {
+	return "file"
+}
+
+// Discover reads the route file and returns its valid entries.
+func (p *Provider) Discover(ctx context.Context) ([]discovery.Target, error) {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read route file %s: %w", p.path, err)
+	}
+
+	var file File
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse route file %s: %w", p.path, err)
+	}
+
+	var targets []discovery.Target
+	for i, e := range file.Routes {
+		name := fmt.Sprintf("%s#%d", p.path, i)
+		if (e.FQDN == "") == (e.HostRegex == "") {
+			slog.Warn("RouteFile: Route must set exactly one of fqdn or host_regex", "route", name)
+			continue
+		}
+		if e.StaticRoot != "" {
+			if e.Target != "" || e.Port != 0 {
+				slog.Warn("RouteFile: Route must set either static_root or target and port", "route", name)
+				continue
+			}
+			if !filepath.IsAbs(e.StaticRoot) {
+				slog.Warn("RouteFile: Route static_root must be an absolute path", "route", name, "static_root", e.StaticRoot)
+				continue
+			}
+		} else if net.ParseIP(e.Target) == nil && !discovery.ValidHostname(e.Target) {
+			slog.Warn("RouteFile: Route target must be an IP address or hostname", "route", name, "target", e.Target)
+			continue
+		} else if e.Port < 1 || e.Port > 65535 {
+			slog.Warn("RouteFile: Route port out of range", "route", name, "port", e.Port)
+			continue
+		}
+		labels, err := expandLabels(e.Labels)
+		if err != nil {
+			slog.Warn("RouteFile: Cannot expand route labels", "route", name, "error", err)
+			continue
+		}
+		targets = append(targets, discovery.Target{
+			ID:         name,
+			Name:       name,
+			FQDN:       e.FQDN,
+			HostRegex:  e.HostRegex,
+			CertFQDN:   e.CertFQDN,
+			PathPrefix: e.PathPrefix,
+			IP:         e.Target,
+			Port:       e.Port,
+			StaticRoot: e.StaticRoot,
+			Labels:     labels,
+		})
+	}
+	return targets, nil
+}
+
+// expandLabels replaces ${VAR} references in label values. A route referencing
+// an unset variable is skipped rather than served with an empty secret.
+func expandLabels(labels map[string]string) (map[string]string, error) {
+	expanded := make(map[string]string, len(labels))
+	for key, value := range labels {
+		var err error
+		expanded[key] = varPattern.ReplaceAllStringFunc(value, func(ref string) string {
+			name := ref[2 : len(ref)-1]
+			v, lookupErr := lookupVar(name)
+			if lookupErr != nil && err == nil {
+				err = fmt.Errorf("label %s: %w", key, lookupErr)
+			}
+			return v
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
+}
+
+// lookupVar returns the environment variable name, or the trimmed content of
+// the file named by name_FILE.
+func lookupVar(name string) (string, error) {
+	if v, ok := os.LookupEnv(name); ok {
+		return v, nil
+	}
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s_FILE: %w", name, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", fmt.Errorf("variable %s is not set", name)
+}
@@ -0,0 +1,62 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+)
+
+// Backend names, set with SECRETS_BACKEND.
+const (
+	BackendVault = "vault" // HashiCorp Vault KV secret
+	BackendSOPS  = "sops"  // SOPS-encrypted JSON, YAML or dotenv file
+)
+
+// Backend fetches configuration secrets (GANDI_PAT, TS_AUTHKEY, ...) from
+// outside the environment. Keys are the environment variable names.
+type Backend interface {
+	// Name identifies the backend in logs.
+	Name() string
+	// Fetch returns the current secrets.
+	Fetch(ctx context.Context) (map[string]string, error)
+}
+
+// Options configures the backend selected by New.
+type Options struct {
+	VaultAddr  string // Vault server URL
+	VaultToken string
+	VaultPath  string // KV secret path, e.g. secret/data/rproxy
+	SOPSFile   string // Encrypted file
+	SOPSBinary string // sops command, "sops" by default
+}
+
+// New returns the backend called name.
+func New(name string, opts Options) (Backend, error) {
+	switch name {
+	case BackendVault:
+		if opts.VaultAddr == "" || opts.VaultToken == "" || opts.VaultPath == "" {
+			return nil, fmt.Errorf("the vault secrets backend needs VAULT_ADDR, VAULT_TOKEN and SECRETS_VAULT_PATH")
+		}
+		return newVault(opts.VaultAddr, opts.VaultToken, opts.VaultPath), nil
+	case BackendSOPS:
+		if opts.SOPSFile == "" {
+			return nil, fmt.Errorf("the sops secrets backend needs SECRETS_SOPS_FILE")
+		}
+		return newSOPS(opts.SOPSBinary, opts.SOPSFile), nil
+	default:
+		return nil, fmt.Errorf("unknown secrets backend %q (expected vault or sops)", name)
+	}
+}
+
+// stringValues keeps the string values of a decoded secret, rejecting others
+// so a nested or numeric value is not silently dropped.
+func stringValues(data map[string]any) (map[string]string, error) {
+	values := make(map[string]string, len(data))
+	for key, v := range data {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("secret %s is not a string", key)
+		}
+		values[key] = s
+	}
+	return values, nil
+}
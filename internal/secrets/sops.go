@@ -0,0 +1,45 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// SOPS decrypts a SOPS-encrypted file with the sops command, which finds its
+// keys (age, PGP, cloud KMS) the usual way, e.g. from SOPS_AGE_KEY_FILE.
+type SOPS struct {
+	binary string
+	path   string
+}
+
+func newSOPS(binary, path string) *SOPS {
+	if binary == "" {
+		binary = "sops"
+	}
+	return &SOPS{binary: binary, path: path}
+}
+
+// Name identifies this backend in logs.
+func (s *SOPS) Name() string {
+	return BackendSOPS
+}
+
+// Fetch decrypts the file. Its top-level values must be strings.
+func (s *SOPS) Fetch(ctx context.Context) (map[string]string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.binary, "--decrypt", "--output-type", "json", s.path)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w: %s", s.path, err, strings.TrimSpace(stderr.String()))
+	}
+	var data map[string]any
+	if err := json.Unmarshal(out, &data); err != nil {
+		return nil, fmt.Errorf("failed to parse decrypted %s: %w", s.path, err)
+	}
+	return stringValues(data)
+}
@@ -0,0 +1,63 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Vault reads one secret from a Vault KV engine, version 1 or 2.
+type Vault struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newVault(addr, token, path string) *Vault {
+	return &Vault{
+		url:    strings.TrimSuffix(addr, "/") + "/v1/" + strings.TrimPrefix(path, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name identifies this backend in logs.
+func (v *Vault) Name() string {
+	return BackendVault
+}
+
+// Fetch reads the secret's key/value pairs.
+func (v *Vault) Fetch(ctx context.Context) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("vault request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("vault returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var secret struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("failed to decode vault response: %w", err)
+	}
+	// KV version 2 nests the values under data.data, next to data.metadata
+	if nested, ok := secret.Data["data"].(map[string]any); ok {
+		if _, versioned := secret.Data["metadata"]; versioned {
+			return stringValues(nested)
+		}
+	}
+	return stringValues(secret.Data)
+}
@@ -0,0 +1,119 @@
+package spiffe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The few Workload API messages needed are decoded by hand rather than
+// pulling in gRPC and protobuf. Field numbers are from workload.proto.
+
+// x509SVIDResponse is the X509SVIDResponse message.
+type x509SVIDResponse struct {
+	svids     []x509SVID        // Field 1
+	federated map[string][]byte // Field 3, DER bundles by trust domain
+}
+
+// x509SVID is the X509SVID message.
+type x509SVID struct {
+	id     string // Field 1
+	certs  []byte // Field 2, DER chain, leaf first
+	key    []byte // Field 3, PKCS#8 DER
+	bundle []byte // Field 4, DER certificates of its trust domain
+}
+
+func parseX509SVIDResponse(b []byte) (x509SVIDResponse, error) {
+	resp := x509SVIDResponse{federated: make(map[string][]byte)}
+	err := protoFields(b, func(num int, val []byte) error {
+		switch num {
+		case 1:
+			svid, err := parseX509SVID(val)
+			if err != nil {
+				return err
+			}
+			resp.svids = append(resp.svids, svid)
+		case 3:
+			// A map entry: key in field 1, value in field 2
+			var domain string
+			var bundle []byte
+			err := protoFields(val, func(num int, val []byte) error {
+				switch num {
+				case 1:
+					domain = string(val)
+				case 2:
+					bundle = val
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			resp.federated[domain] = bundle
+		}
+		return nil
+	})
+	return resp, err
+}
+
+func parseX509SVID(b []byte) (x509SVID, error) {
+	var svid x509SVID
+	err := protoFields(b, func(num int, val []byte) error {
+		switch num {
+		case 1:
+			svid.id = string(val)
+		case 2:
+			svid.certs = val
+		case 3:
+			svid.key = val
+		case 4:
+			svid.bundle = val
+		}
+		return nil
+	})
+	return svid, err
+}
+
+// protoFields calls fn with the number and contents of each length-delimited
+// field of message b. Fields of other wire types are skipped; none of the
+// fields used has one.
+func protoFields(b []byte, fn func(num int, val []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("invalid protobuf tag")
+		}
+		b = b[n:]
+		num, wire := int(tag>>3), tag&7
+		switch wire {
+		case 0: // varint
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return errors.New("invalid protobuf varint")
+			}
+			b = b[n:]
+		case 1: // 64-bit
+			if len(b) < 8 {
+				return errors.New("truncated protobuf field")
+			}
+			b = b[8:]
+		case 5: // 32-bit
+			if len(b) < 4 {
+				return errors.New("truncated protobuf field")
+			}
+			b = b[4:]
+		case 2: // length-delimited
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return errors.New("truncated protobuf field")
+			}
+			val := b[n : n+int(size)]
+			b = b[n+int(size):]
+			if err := fn(num, val); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", wire)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+// Package spiffe fetches X.509 SVIDs from a SPIFFE Workload API endpoint,
+// such as a SPIRE agent, so rproxy can authenticate to backends with its
+// workload identity and verify theirs.
+package spiffe
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"rproxy/internal/metrics"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// startTimeout bounds the wait for the first SVID, giving an agent
+	// started alongside rproxy time to attest it.
+	startTimeout = 30 * time.Second
+
+	// Reconnect backoff after the stream from the agent breaks
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+
+	// maxMessage bounds a Workload API message, like gRPC's default limit.
+	maxMessage = 4 << 20
+)
+
+var svidExpiry = metrics.NewGauge("rproxy_spiffe_svid_expiry_timestamp_seconds",
+	"Expiry of the X.509 SVID presented to backends.")
+
+// Source holds the current X.509 SVID and trust bundles, kept up to date by a
+// stream from the Workload API.
+type Source struct {
+	client *http.Client
+	url    string
+
+	mu      sync.RWMutex
+	id      string
+	cert    *tls.Certificate
+	bundles map[string]*x509.CertPool // By trust domain, federated ones included
+}
+
+// New connects to the Workload API at addr (SPIFFE_ENDPOINT_SOCKET syntax:
+// "unix:///path/to/agent.sock" or "tcp://host:port") and waits for the first
+// SVID. Updates are then received in the background until ctx is done.
+func New(ctx context.Context, addr string) (*Source, error) {
+	network, address, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+		Protocols: new(http.Protocols),
+	}
+	// gRPC without TLS, as the Workload API is served
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	s := &Source{
+		client: &http.Client{Transport: transport},
+		url:    "http://localhost/SpiffeWorkloadAPI/FetchX509SVID",
+	}
+
+	slog.Info("SPIFFE: Fetching X.509 SVID from the Workload API", "endpoint", addr)
+	ready := make(chan struct{})
+	go s.run(ctx, ready)
+	timer := time.NewTimer(startTimeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return s, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("no X.509 SVID from the Workload API at %s after %s", addr, startTimeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// parseAddr splits a SPIFFE_ENDPOINT_SOCKET value into a network and address.
+func parseAddr(addr string) (network, address string, err error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid Workload API address %q: %w", addr, err)
+	}
+	switch {
+	case u.Scheme == "unix" && u.Path != "":
+		return "unix", u.Path, nil
+	case u.Scheme == "unix" && u.Opaque != "":
+		return "unix", u.Opaque, nil
+	case u.Scheme == "tcp" && u.Host != "":
+		return "tcp", u.Host, nil
+	}
+	return "", "", fmt.Errorf("invalid Workload API address %q, expected unix:///path or tcp://host:port", addr)
+}
+
+// run keeps a stream open to the Workload API, reconnecting with backoff.
+// ready is closed once the first SVID is in.
+func (s *Source) run(ctx context.Context, ready chan struct{}) {
+	var once sync.Once
+	backoff := minBackoff
+	for ctx.Err() == nil {
+		received := false
+		err := s.watch(ctx, func() {
+			received = true
+			once.Do(func() { close(ready) })
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if received {
+			backoff = minBackoff
+		}
+		slog.Warn("SPIFFE: Workload API stream ended, reconnecting", "error", err, "retry_in", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// watch calls FetchX509SVID and applies each response until the stream ends.
+func (s *Source) watch(ctx context.Context, updated func()) error {
+	// The request is an empty X509SVIDRequest in one uncompressed gRPC frame
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(make([]byte, 5)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("workload.spiffe.io", "true") // Required by the Workload API
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("workload API answered HTTP %d", resp.StatusCode)
+	}
+	if err := grpcStatus(resp.Header); err != nil {
+		return err // Trailers-only response, e.g. no identity for this workload
+	}
+
+	for {
+		msg, err := readFrame(resp.Body)
+		if errors.Is(err, io.EOF) {
+			if err := grpcStatus(resp.Trailer); err != nil {
+				return err
+			}
+			return errors.New("stream closed by the agent")
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.update(msg); err != nil {
+			// Keep the current SVID; the agent sends the next one before it expires
+			slog.Error("SPIFFE: Ignoring invalid Workload API response", "error", err)
+			continue
+		}
+		updated()
+	}
+}
+
+// grpcStatus returns the error carried in grpc-status, nil for OK or none.
+func grpcStatus(h http.Header) error {
+	code := h.Get("Grpc-Status")
+	if code == "" || code == "0" {
+		return nil
+	}
+	return fmt.Errorf("workload API error (gRPC status %s): %s", code, h.Get("Grpc-Message"))
+}
+
+// readFrame reads one length-prefixed gRPC message.
+func readFrame(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errors.New("truncated gRPC frame")
+		}
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed gRPC frame")
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > maxMessage {
+		return nil, fmt.Errorf("gRPC message of %d bytes exceeds %d", n, maxMessage)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("truncated gRPC message: %w", err)
+	}
+	return msg, nil
+}
+
+// update applies an X509SVIDResponse. The first SVID is the default one
+// and is used; the others are for workloads with several identities.
+func (s *Source) update(msg []byte) error {
+	resp, err := parseX509SVIDResponse(msg)
+	if err != nil {
+		return err
+	}
+	if len(resp.svids) == 0 {
+		return errors.New("no SVID in response")
+	}
+	svid := resp.svids[0]
+	trustDomain, err := TrustDomain(svid.id)
+	if err != nil {
+		return err
+	}
+
+	certs, err := x509.ParseCertificates(svid.certs)
+	if err != nil || len(certs) == 0 {
+		return fmt.Errorf("invalid X.509 SVID for %s: %v", svid.id, err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(svid.key)
+	if err != nil {
+		return fmt.Errorf("invalid X.509 SVID key for %s: %w", svid.id, err)
+	}
+	cert := &tls.Certificate{PrivateKey: key, Leaf: certs[0]}
+	for _, c := range certs {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+
+	bundles := make(map[string]*x509.CertPool)
+	for domain, der := range resp.federated {
+		if pool, err := certPool(der); err == nil {
+			bundles[strings.TrimPrefix(domain, "spiffe://")] = pool
+		} else {
+			slog.Warn("SPIFFE: Ignoring invalid federated bundle", "trust_domain", domain, "error", err)
+		}
+	}
+	if bundles[trustDomain], err = certPool(svid.bundle); err != nil {
+		return fmt.Errorf("invalid trust bundle for %s: %w", trustDomain, err)
+	}
+
+	s.mu.Lock()
+	changed := s.id != svid.id
+	s.id, s.cert, s.bundles = svid.id, cert, bundles
+	s.mu.Unlock()
+	svidExpiry.Set(float64(certs[0].NotAfter.Unix()))
+	if changed {
+		slog.Info("SPIFFE: Received X.509 SVID", "spiffe_id", svid.id, "expiry", certs[0].NotAfter)
+	} else {
+		slog.Debug("SPIFFE: Rotated X.509 SVID", "spiffe_id", svid.id, "expiry", certs[0].NotAfter)
+	}
+	return nil
+}
+
+func certPool(der []byte) (*x509.CertPool, error) {
+	certs, err := x509.ParseCertificates(der)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("empty bundle")
+	}
+	pool := x509.NewCertPool()
+	for _, c := range certs {
+		pool.AddCert(c)
+	}
+	return pool, nil
+}
+
+// ID returns the SPIFFE ID of the current SVID.
+func (s *Source) ID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.id
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate with the
+// current SVID.
+func (s *Source) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, nil
+}
+
+// VerifyPeer returns a tls.Config.VerifyConnection function accepting peers
+// whose X.509 SVID chains to the bundle of its trust domain and whose ID is
+// want. A want without path, like "spiffe://example.org", accepts any
+// workload of that trust domain. Host names are not checked, so the
+// config must set InsecureSkipVerify to leave verification to it.
+func (s *Source) VerifyPeer(want string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("spiffe: backend presented no certificate")
+		}
+		leaf := cs.PeerCertificates[0]
+		if len(leaf.URIs) != 1 {
+			return fmt.Errorf("spiffe: backend certificate has %d URI SANs, an X.509 SVID has one", len(leaf.URIs))
+		}
+		id := leaf.URIs[0].String()
+		if !matchID(want, id) {
+			return fmt.Errorf("spiffe: backend identity %s, want %s", id, want)
+		}
+		trustDomain, err := TrustDomain(id)
+		if err != nil {
+			return err
+		}
+		s.mu.RLock()
+		roots := s.bundles[trustDomain]
+		s.mu.RUnlock()
+		if roots == nil {
+			return fmt.Errorf("spiffe: no trust bundle for %s", trustDomain)
+		}
+		intermediates := x509.NewCertPool()
+		for _, c := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(c)
+		}
+		_, err = leaf.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return fmt.Errorf("spiffe: backend certificate for %s: %w", id, err)
+		}
+		return nil
+	}
+}
+
+// matchID reports whether id is want, or in trust domain want.
+func matchID(want, id string) bool {
+	if id == want {
+		return true
+	}
+	td, err := TrustDomain(want)
+	return err == nil && want == "spiffe://"+td && strings.HasPrefix(id, want+"/")
+}
+
+// TrustDomain returns the trust domain of a SPIFFE ID, "example.org" for
+// "spiffe://example.org/backend".
+func TrustDomain(id string) (string, error) {
+	rest, ok := strings.CutPrefix(id, "spiffe://")
+	if !ok {
+		return "", fmt.Errorf("invalid SPIFFE ID %q", id)
+	}
+	td, _, _ := strings.Cut(rest, "/")
+	if td == "" {
+		return "", fmt.Errorf("invalid SPIFFE ID %q", id)
+	}
+	return strings.ToLower(td), nil
+}
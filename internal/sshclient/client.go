@@ -1,10 +1,14 @@
 package sshclient
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -14,14 +18,22 @@ import (
 type Client struct {
 	config *ssh.ClientConfig
 	addr   string
-}
 
-const sshKeyPathInsideContainer = "/ssh/id_rsa" // Define constant for the path
+	tunnelMu sync.Mutex
+	tunnel   *ssh.Client // Persistent connection used to dial backends, see DialContext
+}
 
-// New creates a new SSH client.
-// func New(user, host, port, identityFile string) (*Client, error) { // Removed identityFile parameter
-func New(user, host, port string) (*Client, error) {
-	authMethod, err := getPrivateKeyAuthMethod(sshKeyPathInsideContainer) // Use the constant path
+// New creates a new SSH client authenticating with the private key at keyPath,
+// or with keyData (PEM) when it is set.
+func New(user, host, port, keyPath string, keyData []byte) (*Client, error) {
+	var authMethod ssh.AuthMethod
+	var err error
+	if keyData != nil {
+		keyPath = "PODMAN_SSH_KEY_DATA"
+		authMethod, err = parsePrivateKey(keyData, keyPath)
+	} else {
+		authMethod, err = getPrivateKeyAuthMethod(keyPath)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare SSH auth method: %w", err)
 	}
@@ -37,7 +49,7 @@ func New(user, host, port string) (*Client, error) {
 
 	addr := net.JoinHostPort(host, port)
 
-	slog.Info("SSH Client configured", "user", user, "address", addr, "keyPath", sshKeyPathInsideContainer)
+	slog.Info("SSH Client configured", "user", user, "address", addr, "keyPath", keyPath)
 	return &Client{
 		config: sshConfig,
 		addr:   addr,
@@ -46,10 +58,24 @@ func New(user, host, port string) (*Client, error) {
 
 // RunCommand executes a command over SSH and returns its output.
 func (c *Client) RunCommand(command string) ([]byte, error) {
-	client, err := ssh.Dial("tcp", c.addr, c.config)
+	return c.RunCommandContext(context.Background(), command)
+}
+
+// RunCommandContext is RunCommand with a context: the SSH connection is closed
+// when ctx is done, which aborts the command.
+func (c *Client) RunCommandContext(ctx context.Context, command string) ([]byte, error) {
+	conn, err := (&net.Dialer{Timeout: c.config.Timeout}).DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial SSH server %s: %w", c.addr, err)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, c.addr, c.config)
 	if err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("failed to dial SSH server %s: %w", c.addr, err)
 	}
+	client := ssh.NewClient(sshConn, chans, reqs)
 	defer client.Close()
 
 	session, err := client.NewSession()
@@ -64,11 +90,20 @@ func (c *Client) RunCommand(command string) ([]byte, error) {
 		if len(output) > 0 {
 			outputStr = fmt.Sprintf(". Output/Stderr: %s", string(output))
 		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
 		return nil, fmt.Errorf("failed to run command via SSH '%s': %w%s", command, err, outputStr)
 	}
 	return output, nil
 }
 
+// Quote returns s as a single POSIX shell word, for commands built from
+// configuration values.
+func Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 // getPrivateKeyAuthMethod loads an SSH key.
 func getPrivateKeyAuthMethod(keyPath string) (ssh.AuthMethod, error) {
 	keyBytes, err := os.ReadFile(keyPath)
@@ -76,10 +111,95 @@ func getPrivateKeyAuthMethod(keyPath string) (ssh.AuthMethod, error) {
 		// Add more context to the error message
 		return nil, fmt.Errorf("failed to read private key file %q (ensure it's mounted correctly): %w", keyPath, err)
 	}
+	return parsePrivateKey(keyBytes, keyPath)
+}
+
+// parsePrivateKey turns a PEM private key into an auth method. source names
+// the key in errors.
+func parsePrivateKey(keyBytes []byte, source string) (ssh.AuthMethod, error) {
 	signer, err := ssh.ParsePrivateKey(keyBytes)
 	if err != nil {
 		// TODO: Add support for passphrase-protected keys if needed
-		return nil, fmt.Errorf("failed to parse private key %s: %w", keyPath, err)
+		return nil, fmt.Errorf("failed to parse private key %s: %w", source, err)
 	}
 	return ssh.PublicKeys(signer), nil
-} 
\ No newline at end of file
+} 
+
+// DialContext opens a TCP connection to addr from the SSH host, through a
+// persistent SSH connection that is re-established when it breaks.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := c.dialTunnel(network, addr)
+		done <- result{conn, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.conn, res.err
+	case <-ctx.Done():
+		// Close the connection if the dial completes after we gave up
+		go func() {
+			if res := <-done; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// dialTunnel dials through the persistent connection, reconnecting once on failure.
+func (c *Client) dialTunnel(network, addr string) (net.Conn, error) {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		tunnel, tErr := c.tunnelClient()
+		if tErr != nil {
+			return nil, tErr
+		}
+
+		var conn net.Conn
+		conn, err = tunnel.Dial(network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			// The SSH host could not reach the target; the tunnel itself is fine
+			return nil, fmt.Errorf("failed to dial %s through SSH: %w", addr, err)
+		}
+		// The connection may be dead (host restarted, network blip): drop it and retry
+		slog.Warn("SSH tunnel dial failed, reconnecting", "target", addr, "error", err)
+		c.resetTunnel(tunnel)
+	}
+	return nil, fmt.Errorf("failed to dial %s through SSH: %w", addr, err)
+}
+
+// tunnelClient returns the persistent SSH connection, establishing it if needed.
+func (c *Client) tunnelClient() (*ssh.Client, error) {
+	c.tunnelMu.Lock()
+	defer c.tunnelMu.Unlock()
+	if c.tunnel != nil {
+		return c.tunnel, nil
+	}
+	client, err := ssh.Dial("tcp", c.addr, c.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial SSH server %s: %w", c.addr, err)
+	}
+	slog.Info("SSH tunnel connection established", "address", c.addr)
+	c.tunnel = client
+	return client, nil
+}
+
+// resetTunnel closes a broken tunnel unless another caller already replaced it.
+func (c *Client) resetTunnel(broken *ssh.Client) {
+	c.tunnelMu.Lock()
+	defer c.tunnelMu.Unlock()
+	if c.tunnel == broken {
+		c.tunnel.Close()
+		c.tunnel = nil
+	}
+}
@@ -0,0 +1,255 @@
+package swarm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"rproxy/internal/discovery"
+	"rproxy/internal/sshclient"
+	"strings"
+)
+
+// --- Structs for Docker Swarm Data ---
+
+// ServiceInspect matches the relevant fields from `docker service inspect`.
+type ServiceInspect struct {
+	ID   string `json:"ID"`
+	Spec struct {
+		Name   string            `json:"Name"`
+		Labels map[string]string `json:"Labels"`
+	} `json:"Spec"`
+	Endpoint struct {
+		VirtualIPs []struct {
+			NetworkID string `json:"NetworkID"`
+			Addr      string `json:"Addr"` // CIDR notation, e.g. 10.0.1.5/24
+		} `json:"VirtualIPs"`
+	} `json:"Endpoint"`
+}
+
+// TaskInspect matches the relevant fields from `docker inspect <task>`.
+type TaskInspect struct {
+	ID     string `json:"ID"`
+	Status struct {
+		State string `json:"State"`
+	} `json:"Status"`
+	NetworksAttachments []struct {
+		Network struct {
+			ID string `json:"ID"`
+		} `json:"Network"`
+		Addresses []string `json:"Addresses"` // CIDR notation
+	} `json:"NetworksAttachments"`
+}
+
+// --- Swarm Client ---
+
+// Client discovers Swarm services via the docker CLI of a manager node over SSH.
+type Client struct {
+	ssh     *sshclient.Client
+	network string // SWARM_NETWORK, empty for any network but ingress
+}
+
+// New creates a new Swarm client using the addresses of services on network,
+// or on any network but ingress when it is empty.
+func New(sshClient *sshclient.Client, network string) *Client {
+	return &Client{ssh: sshClient, network: network}
+}
+
+// Name identifies this provider in logs.
+func (c *Client) Name() string {
+	return "swarm"
+}
+
+// ListServices lists services carrying the exposed-port and exposed-fqdn labels.
+func (c *Client) ListServices() ([]ServiceInspect, error) {
+	cmd := `docker service ls --filter label=exposed-port --filter label=exposed-fqdn --format '{{.ID}}'`
+	output, err := c.ssh.RunCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list swarm services via ssh: %w", err)
+	}
+
+	ids := scanLines(output)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// Inspect all services in a single round-trip
+	cmd = fmt.Sprintf("docker service inspect %s --format json", strings.Join(ids, " "))
+	output, err = c.ssh.RunCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect swarm services via ssh: %w", err)
+	}
+
+	var services []ServiceInspect
+	if err := json.Unmarshal(output, &services); err != nil {
+		return nil, fmt.Errorf("failed to parse swarm service inspect json: %w", err)
+	}
+	return services, nil
+}
+
+// overlayNetworks returns the names of the overlay networks by ID.
+func (c *Client) overlayNetworks() (map[string]string, error) {
+	output, err := c.ssh.RunCommand(`docker network ls --filter driver=overlay --no-trunc --format '{{.ID}} {{.Name}}'`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list swarm networks via ssh: %w", err)
+	}
+	networks := make(map[string]string)
+	for _, line := range scanLines(output) {
+		if id, name, ok := strings.Cut(line, " "); ok {
+			networks[id] = name
+		}
+	}
+	return networks, nil
+}
+
+// usable reports whether addresses on the network with this name can be
+// dialed by rproxy.
+func (c *Client) usable(name string) bool {
+	if c.network != "" {
+		return name == c.network
+	}
+	return name != "ingress" && name != ""
+}
+
+// TaskAddresses returns the addresses of the running tasks of a service on
+// the networks of usable, with networks mapping their IDs to names. Used
+// for services without a VIP (endpoint mode dnsrr).
+func (c *Client) TaskAddresses(serviceID string, networks map[string]string) ([]string, error) {
+	cmd := fmt.Sprintf("docker service ps %s --filter desired-state=running --no-trunc --quiet", serviceID)
+	output, err := c.ssh.RunCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tasks of service %s via ssh: %w", serviceID, err)
+	}
+
+	ids := scanLines(output)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	cmd = fmt.Sprintf("docker inspect --type task %s --format json", strings.Join(ids, " "))
+	output, err = c.ssh.RunCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect tasks of service %s via ssh: %w", serviceID, err)
+	}
+
+	var tasks []TaskInspect
+	if err := json.Unmarshal(output, &tasks); err != nil {
+		return nil, fmt.Errorf("failed to parse task inspect json for %s: %w", serviceID, err)
+	}
+
+	var addrs []string
+	for _, task := range tasks {
+		if task.Status.State != "running" {
+			continue
+		}
+		for _, attachment := range task.NetworksAttachments {
+			if !c.usable(networks[attachment.Network.ID]) {
+				continue
+			}
+			for _, cidr := range attachment.Addresses {
+				if ip := stripCIDR(cidr); ip != "" {
+					addrs = append(addrs, ip)
+				}
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// Discover returns a target per labelled service, addressed by its VIP on
+// SWARM_NETWORK, or by the first running task address there when the service
+// has no VIP.
+func (c *Client) Discover(ctx context.Context) ([]discovery.Target, error) {
+	services, err := c.ListServices()
+	if err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, nil
+	}
+	networks, err := c.overlayNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []discovery.Target
+	for _, svc := range services {
+		name := svc.Spec.Name
+		fqdn := strings.TrimSpace(svc.Spec.Labels[discovery.LabelExposedFQDN])
+		portLabel := svc.Spec.Labels[discovery.LabelExposedPort]
+		if fqdn == "" || portLabel == "" {
+			slog.Warn("Swarm: Missing required labels on service", "name", name, "id", svc.ID)
+			continue
+		}
+
+		port, err := discovery.ParsePort(portLabel)
+		if err != nil {
+			slog.Error("Swarm: Invalid exposed-port label", "label", portLabel, "name", name, "id", svc.ID, "error", err)
+			continue
+		}
+
+		var ipAddress string
+		for _, vip := range svc.Endpoint.VirtualIPs {
+			if ip := stripCIDR(vip.Addr); ip != "" && c.usable(networks[vip.NetworkID]) {
+				ipAddress = ip
+				slog.Debug("Swarm: Using service VIP", "name", name, "network", networks[vip.NetworkID], "ip", ip)
+				break
+			}
+		}
+		if ipAddress == "" && len(svc.Endpoint.VirtualIPs) > 0 {
+			slog.Warn("Swarm: Service has no VIP on a network shared with rproxy, set SWARM_NETWORK or attach it", "name", name, "id", svc.ID, "network", c.network)
+			continue
+		}
+		if ipAddress == "" {
+			addrs, err := c.TaskAddresses(svc.ID, networks)
+			if err != nil {
+				slog.Error("Swarm: Error resolving task addresses", "name", name, "id", svc.ID, "error", err)
+				continue
+			}
+			if len(addrs) > 0 {
+				ipAddress = addrs[0]
+			}
+		}
+		if ipAddress == "" {
+			slog.Warn("Swarm: Could not find VIP or running task address for service", "name", name, "id", svc.ID)
+			continue
+		}
+
+		targets = append(targets, discovery.Target{
+			ID:     svc.ID,
+			Name:   name,
+			FQDN:   fqdn,
+			IP:     ipAddress,
+			Port:   port,
+			Labels: svc.Spec.Labels,
+		})
+	}
+	return targets, nil
+}
+
+// scanLines returns the non-empty trimmed lines of a command output.
+func scanLines(output []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// stripCIDR turns "10.0.1.5/24" into "10.0.1.5".
+func stripCIDR(addr string) string {
+	ip, _, err := net.ParseCIDR(addr)
+	if err != nil {
+		if parsed := net.ParseIP(addr); parsed != nil {
+			return parsed.String()
+		}
+		return ""
+	}
+	return ip.String()
+}
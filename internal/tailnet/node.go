@@ -0,0 +1,55 @@
+package tailnet
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"tailscale.com/tsnet"
+)
+
+// Node is an embedded Tailscale node used to listen on and dial into a tailnet.
+type Node struct {
+	srv *tsnet.Server
+}
+
+// New starts a tailnet node and waits until it is connected.
+func New(ctx context.Context, hostname, stateDir, authKey string) (*Node, error) {
+	srv := &tsnet.Server{
+		Hostname: hostname,
+		Dir:      stateDir,
+		AuthKey:  authKey,
+		UserLogf: func(format string, args ...any) {
+			slog.Info("Tailscale: " + fmt.Sprintf(format, args...))
+		},
+	}
+
+	slog.Info("Tailscale: Starting tailnet node", "hostname", hostname, "stateDir", stateDir)
+	status, err := srv.Up(ctx)
+	if err != nil {
+		srv.Close()
+		return nil, fmt.Errorf("failed to bring up tailnet node: %w", err)
+	}
+	slog.Info("Tailscale: Tailnet node running", "hostname", hostname, "ips", status.TailscaleIPs)
+	return &Node{srv: srv}, nil
+}
+
+// Listen listens for TCP connections on the tailnet, e.g. ":443".
+func (n *Node) Listen(addr string) (net.Listener, error) {
+	ln, err := n.srv.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on tailnet %s: %w", addr, err)
+	}
+	return ln, nil
+}
+
+// DialContext dials an address (typically a Tailscale IP) through the tailnet.
+func (n *Node) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return n.srv.Dial(ctx, network, addr)
+}
+
+// Close shuts the node down.
+func (n *Node) Close() error {
+	return n.srv.Close()
+}
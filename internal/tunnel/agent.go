@@ -0,0 +1,182 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Reconnect backoff after rproxy could not be reached or refused the agent
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+
+	// idleTimeout closes an idle connection that went without a ping, so a
+	// silently dropped one is replaced.
+	idleTimeout = 3 * pingInterval
+)
+
+// Agent keeps idle tunnel connections open to rproxy for one FQDN and relays
+// the backend connections rproxy opens through them to Target.
+type Agent struct {
+	Server  string         // rproxy address, host or host:port (default port 443)
+	FQDN    string         // Tunnel FQDN, also the TLS server name
+	Token   string         // Token of FQDN in TUNNEL_TOKENS
+	Target  string         // Local service, host:port
+	Idle    int            // Idle connections kept open, which bounds connection bursts
+	RootCAs *x509.CertPool // nil for the system roots
+}
+
+// Run keeps a.Idle connections open until ctx is done.
+func (a *Agent) Run(ctx context.Context) {
+	slog.Info("Agent: Publishing service through rproxy", "fqdn", a.FQDN, "server", a.Server, "target", a.Target)
+	var wg sync.WaitGroup
+	for range max(a.Idle, 1) {
+		wg.Go(func() { a.worker(ctx) })
+	}
+	wg.Wait()
+}
+
+// worker keeps one idle connection open, reopening it once it is used.
+func (a *Agent) worker(ctx context.Context) {
+	backoff := minBackoff
+	for ctx.Err() == nil {
+		conn, err := a.connect(ctx)
+		if err == nil {
+			backoff = minBackoff
+			err = a.serve(ctx, conn)
+			if err == nil {
+				continue // Relaying in the background, open the next one
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("Agent: Tunnel connection failed, reconnecting", "error", err, "retry_in", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// connect opens a tunnel connection.
+func (a *Agent) connect(ctx context.Context) (net.Conn, error) {
+	addr := a.Server
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+	dialer := &tls.Dialer{Config: &tls.Config{
+		ServerName: a.FQDN,
+		RootCAs:    a.RootCAs,
+		NextProtos: []string{"http/1.1"},
+		MinVersion: tls.VersionTLS12,
+	}}
+	dialCtx, cancel := context.WithTimeout(ctx, claimTimeout)
+	defer cancel()
+	conn, err := dialer.DialContext(dialCtx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(claimTimeout))
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: %s\r\nAuthorization: Bearer %s\r\n\r\n",
+		Path, a.FQDN, upgradeProtocol, a.Token)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("rproxy refused the tunnel: %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// serve waits on an idle connection until rproxy asks for a backend
+// connection, then relays it in the background.
+func (a *Agent) serve(ctx context.Context, conn net.Conn) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	var msg [1]byte
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if _, err := io.ReadFull(conn, msg[:]); err != nil {
+			stop()
+			conn.Close()
+			return err
+		}
+		if msg[0] == msgStart {
+			break
+		}
+		if msg[0] != msgPing {
+			stop()
+			conn.Close()
+			return fmt.Errorf("unexpected tunnel message %d", msg[0])
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var d net.Dialer
+	dialCtx, cancel := context.WithTimeout(ctx, claimTimeout)
+	backend, err := d.DialContext(dialCtx, "tcp", a.Target)
+	cancel()
+	if err != nil {
+		slog.Error("Agent: Cannot reach the service", "target", a.Target, "error", err)
+		conn.Write([]byte{ackFail})
+		stop()
+		conn.Close()
+		return nil // rproxy reports it, the tunnel itself is fine
+	}
+	if _, err := conn.Write([]byte{ackOK}); err != nil {
+		stop()
+		backend.Close()
+		conn.Close()
+		return err
+	}
+	go func() {
+		defer stop()
+		relay(conn, backend)
+	}()
+	return nil
+}
+
+// relay copies between the tunnel connection and the service until both
+// directions are done.
+func relay(tunnel, backend net.Conn) {
+	var wg sync.WaitGroup
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Debug("Agent: Relay ended", "error", err)
+		}
+		// Pass the end of stream on, or close when the peer cannot half-close
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+			return
+		}
+		dst.Close()
+	}
+	wg.Add(2)
+	go copyHalf(tunnel, backend)
+	go copyHalf(backend, tunnel)
+	wg.Wait()
+	tunnel.Close()
+	backend.Close()
+}
@@ -0,0 +1,356 @@
+// Package tunnel publishes services from machines rproxy cannot dial, such as
+// hosts behind NAT. An agent on such a machine dials out to rproxy over TLS,
+// authenticates for its FQDN and keeps a few idle connections open. rproxy
+// terminates TLS for the FQDN as for any route and forwards each backend
+// connection over one of them; the agent relays it to its local service.
+//
+// The tunnel is opened on the HTTPS listener with an HTTP/1.1 upgrade:
+//
+//	GET /.well-known/rproxy-tunnel HTTP/1.1
+//	Host: app.example.com
+//	Connection: Upgrade
+//	Upgrade: rproxy-tunnel
+//	Authorization: Bearer <token>
+//
+// After "101 Switching Protocols" the connection idles. rproxy writes
+// msgPing now and then, and msgStart when it needs a backend connection; the
+// agent dials its service and answers ackOK or ackFail, after which the
+// connection carries the bytes of the backend connection until closed.
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"rproxy/internal/discovery"
+	"rproxy/internal/metrics"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Path is where agents open tunnels, on any tunnel FQDN.
+	Path = "/.well-known/rproxy-tunnel"
+
+	upgradeProtocol = "rproxy-tunnel"
+
+	// hostSuffix marks tunnel targets: the route of app.example.com dials
+	// app.example.com.tunnel.invalid:80, which Dial hands to its agent.
+	hostSuffix = ".tunnel.invalid"
+	targetPort = 80
+
+	pingInterval = 30 * time.Second
+	pingTimeout  = 5 * time.Second
+
+	// claimTimeout bounds the wait for an idle connection of the agent and
+	// for its answer to msgStart.
+	claimTimeout = 10 * time.Second
+
+	// maxIdle bounds the idle connections kept per FQDN.
+	maxIdle = 64
+)
+
+// Messages on an idle tunnel connection.
+const (
+	msgPing  byte = 0 // rproxy to agent, keeps NATs from dropping the connection
+	msgStart byte = 1 // rproxy to agent, dial the service
+	ackOK    byte = 1 // agent to rproxy, relaying from now on
+	ackFail  byte = 2 // agent to rproxy, the service could not be dialed
+)
+
+var (
+	tunnelIdle = metrics.NewGauge("rproxy_tunnel_idle_connections",
+		"Idle connections opened by tunnel agents, by FQDN.", "fqdn")
+	tunnelStreams = metrics.NewCounter("rproxy_tunnel_streams_total",
+		"Backend connections requested through tunnels by FQDN and result (ok, no_agent, agent_error).", "fqdn", "result")
+)
+
+// Hub accepts agent connections and hands them out as backend connections.
+// It is also the discovery provider of the tunnel routes: every FQDN with a
+// token is routed, so its certificate is ready before the agent first
+// connects; requests fail with 502 while no agent is connected.
+type Hub struct {
+	tokens map[string]string // By FQDN
+
+	mu      sync.Mutex
+	idle    map[string][]net.Conn
+	arrived map[string]chan struct{} // Closed when a connection is added
+	online  map[string]bool          // Until its idle connections stop answering pings
+}
+
+// NewHub creates a hub for the FQDNs of tokens (TUNNEL_TOKENS), pinging idle
+// connections until ctx is done.
+func NewHub(ctx context.Context, tokens map[string]string) *Hub {
+	h := &Hub{
+		tokens:  tokens,
+		idle:    make(map[string][]net.Conn),
+		arrived: make(map[string]chan struct{}),
+		online:  make(map[string]bool),
+	}
+	go h.pingLoop(ctx)
+	return h
+}
+
+// Name identifies this provider in logs.
+func (h *Hub) Name() string {
+	return "tunnel"
+}
+
+// Discover returns a target for every tunnel FQDN.
+func (h *Hub) Discover(ctx context.Context) ([]discovery.Target, error) {
+	var targets []discovery.Target
+	for fqdn := range h.tokens {
+		targets = append(targets, discovery.Target{
+			ID:     "tunnel/" + fqdn,
+			Name:   "tunnel/" + fqdn,
+			FQDN:   fqdn,
+			IP:     fqdn + hostSuffix,
+			Port:   targetPort,
+			Labels: map[string]string{},
+		})
+	}
+	slices.SortFunc(targets, func(a, b discovery.Target) int { return strings.Compare(a.FQDN, b.FQDN) })
+	return targets, nil
+}
+
+// Intercept serves tunnel requests from agents and passes everything else
+// to next.
+func (h *Hub) Intercept(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != Path || !strings.EqualFold(r.Header.Get("Upgrade"), upgradeProtocol) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.accept(w, r)
+	})
+}
+
+// accept authenticates an agent and keeps its connection as an idle one.
+func (h *Hub) accept(w http.ResponseWriter, r *http.Request) {
+	fqdn := r.Host
+	if host, _, err := net.SplitHostPort(fqdn); err == nil {
+		fqdn = host
+	}
+	fqdn = strings.ToLower(fqdn)
+	token, ok := h.tokens[fqdn]
+	given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		slog.Warn("Tunnel: Rejected agent with an invalid token", "fqdn", fqdn, "remote", r.RemoteAddr)
+		http.Error(w, "invalid tunnel token", http.StatusUnauthorized)
+		return
+	}
+	if r.ProtoMajor != 1 {
+		http.Error(w, "tunnels need HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	h.mu.Lock()
+	full := len(h.idle[fqdn]) >= maxIdle
+	h.mu.Unlock()
+	if full {
+		http.Error(w, "too many idle tunnel connections", http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		slog.Error("Tunnel: Cannot take over the agent connection", "fqdn", fqdn, "error", err)
+		return
+	}
+	conn.SetDeadline(time.Time{}) // Lift the request timeouts of the HTTPS server
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", upgradeProtocol)
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	if rw.Reader.Buffered() > 0 {
+		conn = &bufferedConn{Conn: conn, r: rw.Reader}
+	}
+	slog.Debug("Tunnel: Agent connection ready", "fqdn", fqdn, "remote", r.RemoteAddr)
+	h.add(fqdn, conn)
+}
+
+// bufferedConn reads what the HTTP server buffered before the connection
+// was hijacked.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (h *Hub) add(fqdn string, conn net.Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.online[fqdn] {
+		h.online[fqdn] = true
+		slog.Info("Tunnel: Agent connected", "fqdn", fqdn)
+	}
+	h.idle[fqdn] = append(h.idle[fqdn], conn)
+	tunnelIdle.Set(float64(len(h.idle[fqdn])), fqdn)
+	if ch, ok := h.arrived[fqdn]; ok {
+		close(ch)
+		delete(h.arrived, fqdn)
+	}
+}
+
+// take removes an idle connection of fqdn, or returns a channel closed when
+// one arrives.
+func (h *Hub) take(fqdn string) (net.Conn, <-chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if conns := h.idle[fqdn]; len(conns) > 0 {
+		conn := conns[len(conns)-1] // Newest, the least likely to have gone stale
+		h.idle[fqdn] = conns[:len(conns)-1]
+		tunnelIdle.Set(float64(len(h.idle[fqdn])), fqdn)
+		return conn, nil
+	}
+	ch, ok := h.arrived[fqdn]
+	if !ok {
+		ch = make(chan struct{})
+		h.arrived[fqdn] = ch
+	}
+	return nil, ch
+}
+
+// pingLoop writes msgPing on every idle connection, dropping those that fail.
+// The connections are taken out of h.idle while they are pinged, so take
+// cannot hand one out in the middle of a ping; it waits for them to return
+// like for a new connection.
+func (h *Hub) pingLoop(ctx context.Context) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		h.mu.Lock()
+		idle := h.idle
+		h.idle = make(map[string][]net.Conn, len(idle))
+		h.mu.Unlock()
+
+		var wg sync.WaitGroup
+		for fqdn, conns := range idle {
+			wg.Go(func() {
+				alive := conns[:0]
+				for _, conn := range conns {
+					conn.SetWriteDeadline(time.Now().Add(pingTimeout))
+					_, err := conn.Write([]byte{msgPing})
+					conn.SetWriteDeadline(time.Time{})
+					if err != nil {
+						conn.Close()
+						continue
+					}
+					alive = append(alive, conn)
+				}
+				h.putBack(fqdn, alive)
+			})
+		}
+		wg.Wait()
+	}
+}
+
+// putBack returns the connections of fqdn that answered a ping to the idle
+// ones, before those that arrived meanwhile so take still prefers the newest.
+func (h *Hub) putBack(fqdn string, conns []net.Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.idle[fqdn] = append(conns, h.idle[fqdn]...)
+	tunnelIdle.Set(float64(len(h.idle[fqdn])), fqdn)
+	if len(h.idle[fqdn]) == 0 {
+		delete(h.idle, fqdn)
+		if h.online[fqdn] {
+			h.online[fqdn] = false
+			slog.Info("Tunnel: Agent disconnected", "fqdn", fqdn)
+		}
+		return
+	}
+	if ch, ok := h.arrived[fqdn]; ok {
+		close(ch)
+		delete(h.arrived, fqdn)
+	}
+}
+
+// errAgent is returned when the agent could not dial its service.
+var errAgent = errors.New("tunnel agent could not reach its service")
+
+// Dial wraps next so addresses of tunnel targets are dialed through their
+// agent.
+func (h *Hub) Dial(next func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil {
+			if fqdn, ok := strings.CutSuffix(host, hostSuffix); ok {
+				return h.dialAgent(ctx, fqdn)
+			}
+		}
+		return next(ctx, network, addr)
+	}
+}
+
+// dialAgent claims an idle connection of fqdn's agent and has it dial the
+// service, skipping connections that went stale.
+func (h *Hub) dialAgent(ctx context.Context, fqdn string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, claimTimeout)
+	defer cancel()
+	for {
+		conn, arrived := h.take(fqdn)
+		if conn == nil {
+			select {
+			case <-arrived:
+				continue
+			case <-ctx.Done():
+				tunnelStreams.Inc(fqdn, "no_agent")
+				return nil, dialError(fmt.Errorf("no tunnel agent connected for %s", fqdn))
+			}
+		}
+		err := start(ctx, conn)
+		if err == nil {
+			tunnelStreams.Inc(fqdn, "ok")
+			return conn, nil
+		}
+		conn.Close()
+		if errors.Is(err, errAgent) {
+			tunnelStreams.Inc(fqdn, "agent_error")
+			return nil, dialError(fmt.Errorf("%s: %w", fqdn, err))
+		}
+		slog.Debug("Tunnel: Skipping stale agent connection", "fqdn", fqdn, "error", err)
+	}
+}
+
+// dialError reports err like a failed dial of the service, which it stands
+// for.
+func dialError(err error) error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: err}
+}
+
+// start asks the agent to dial its service and waits for the answer.
+func start(ctx context.Context, conn net.Conn) error {
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte{msgStart}); err != nil {
+		return err
+	}
+	var ack [1]byte
+	if _, err := conn.Read(ack[:]); err != nil {
+		return err
+	}
+	switch ack[0] {
+	case ackOK:
+		return nil
+	case ackFail:
+		return errAgent
+	}
+	return fmt.Errorf("unexpected tunnel message %d", ack[0])
+}